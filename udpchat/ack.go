@@ -0,0 +1,124 @@
+package udpchat
+
+import (
+	"sort"
+	"strconv"
+
+	"github.com/neverchanje/unplayground/udpchat/codec"
+)
+
+// Maximum number of ranges carried by a single kRespRecvSegAck.
+const kMaxSackRanges = 16
+
+// A half-open range [start, end) of SEG_IDs accepted by the receiver.
+type segRange struct {
+	start uint32
+	end   uint32
+}
+
+// Selective acknowledgement of a file transfer. Every SEG_ID lower than
+// cum_ack has been accepted, as well as the SEG_IDs covered by ranges, which
+// are sorted and never overlap with each other or with [0, cum_ack).
+//
+//	kRespRecvSegAck PACKET_ID CUM_ACK N_RANGES [START END]...
+//
+// Downloads are acked by kReqFileSegAck in the same format.
+type segAck struct {
+	packet_id uint64
+	cum_ack   uint32
+	ranges    []segRange
+}
+
+func (a *segAck) acks(seg_id uint32) bool {
+	if seg_id < a.cum_ack {
+		return true
+	}
+	for _, r := range a.ranges {
+		if seg_id >= r.start && seg_id < r.end {
+			return true
+		}
+	}
+	return false
+}
+
+// Returns the highest SEG_ID acknowledged by a, or false if a acks nothing.
+func (a *segAck) highest() (uint32, bool) {
+	if len(a.ranges) != 0 {
+		return a.ranges[len(a.ranges)-1].end - 1, true
+	}
+	if a.cum_ack != 0 {
+		return a.cum_ack - 1, true
+	}
+	return 0, false
+}
+
+// Encodes the ack as a packet of type t, that's kRespRecvSegAck for uploads
+// and kReqFileSegAck for downloads.
+func (a *segAck) encode(t byte) []byte {
+	ack := codec.SegAck{PacketID: a.packet_id, CumAck: a.cum_ack}
+	for _, r := range a.ranges {
+		ack.Ranges = append(ack.Ranges, codec.Range{Start: r.start, End: r.end})
+	}
+	if t == byte(kReqFileSegAck) {
+		return codec.Marshal(&codec.FileSegAck{SegAck: ack})
+	}
+	return codec.Marshal(&codec.RecvSegAck{SegAck: ack})
+}
+
+func decodeSegAck(packet []byte, t byte) (*segAck, bool) {
+	var ack codec.SegAck
+	if t == byte(kReqFileSegAck) {
+		m := new(codec.FileSegAck)
+		if codec.Unmarshal(packet, m) != nil {
+			return nil, false
+		}
+		ack = m.SegAck
+	} else {
+		m := new(codec.RecvSegAck)
+		if codec.Unmarshal(packet, m) != nil {
+			return nil, false
+		}
+		ack = m.SegAck
+	}
+
+	a := new(segAck)
+	a.packet_id = ack.PacketID
+	a.cum_ack = ack.CumAck
+	a.ranges = make([]segRange, len(ack.Ranges))
+	for i, r := range ack.Ranges {
+		a.ranges[i] = segRange{r.Start, r.End}
+	}
+	return a, true
+}
+
+// Builds the sorted ranges covering ids, which must all be larger than
+// the cumulative ack. At most kMaxSackRanges ranges are returned, the ones
+// closest to the cumulative ack are preferred since they describe the gaps
+// that block the transfer.
+func makeSegRanges(ids []uint32) []segRange {
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+
+	var ranges []segRange
+	for _, id := range ids {
+		if n := len(ranges); n != 0 && ranges[n-1].end == id {
+			ranges[n-1].end++
+			continue
+		}
+		if len(ranges) == kMaxSackRanges {
+			break
+		}
+		ranges = append(ranges, segRange{id, id + 1})
+	}
+	return ranges
+}
+
+func (a *segAck) toString() string {
+	str := "<PACKET_ID: " + strconv.FormatUint(a.packet_id, 10)
+	str += " , CUM_ACK: " + strconv.FormatUint(uint64(a.cum_ack), 10)
+	for _, r := range a.ranges {
+		str += " , [" + strconv.FormatUint(uint64(r.start), 10) +
+			", " + strconv.FormatUint(uint64(r.end), 10) + ")"
+	}
+	str += ">"
+	return str
+}
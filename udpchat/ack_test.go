@@ -0,0 +1,167 @@
+package udpchat
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/neverchanje/unplayground/udpchat/codec"
+)
+
+func TestSegAckEncodeDecode(t *testing.T) {
+	ack := &segAck{
+		packet_id: 42,
+		cum_ack:   3,
+		ranges:    makeSegRanges([]uint32{9, 5, 6, 12, 10}),
+	}
+
+	want := []segRange{{5, 7}, {9, 11}, {12, 13}}
+	if !reflect.DeepEqual(ack.ranges, want) {
+		t.Fatalf("ranges = %v, want %v", ack.ranges, want)
+	}
+
+	got, ok := decodeSegAck(ack.encode(byte(kRespRecvSegAck)), byte(kRespRecvSegAck))
+	if !ok {
+		t.Fatal("failed to decode ack")
+	}
+	if !reflect.DeepEqual(got, ack) {
+		t.Fatalf("decoded %s, want %s", got.toString(), ack.toString())
+	}
+
+	for id, acked := range map[uint32]bool{0: true, 2: true, 3: false, 5: true, 7: false, 10: true, 12: true, 13: false} {
+		if got.acks(id) != acked {
+			t.Errorf("acks(%d) = %v, want %v", id, !acked, acked)
+		}
+	}
+	if h, _ := got.highest(); h != 12 {
+		t.Errorf("highest() = %d, want 12", h)
+	}
+
+	if _, ok := decodeSegAck(ack.encode(byte(kRespRecvSegAck))[:20], byte(kRespRecvSegAck)); ok {
+		t.Error("decoded a truncated ack")
+	}
+}
+
+// A packetLink from a fileSender straight to a fileReceiver, losing the
+// segments and the acks drop picks. The times each segment is sent at are
+// recorded.
+type lossyTestLink struct {
+	fr      *fileReceiver
+	dropSeg func(seg_id uint32, nth int) bool
+	dropAck func(nth int) bool
+
+	acks  chan []byte
+	nAcks int
+	sent  map[uint32][]time.Time
+}
+
+func (l *lossyTestLink) write(packet []byte) error {
+	var seg codec.SendSeg
+	if err := codec.Unmarshal(packet, &seg); err != nil {
+		return err
+	}
+	nth := len(l.sent[seg.SegID])
+	l.sent[seg.SegID] = append(l.sent[seg.SegID], time.Now())
+	if l.dropSeg(seg.SegID, nth) {
+		return nil
+	}
+	ack := l.fr.handleSendSegment(newFileSegment(&seg.Segment))
+	l.nAcks++
+	if !l.dropAck(l.nAcks) {
+		l.acks <- ack.encode(byte(kRespRecvSegAck))
+	}
+	return nil
+}
+
+func (l *lossyTestLink) read(deadline time.Time) ([]byte, error) {
+	timer := time.NewTimer(time.Until(deadline))
+	defer timer.Stop()
+	select {
+	case packet := <-l.acks:
+		return packet, nil
+	case <-timer.C:
+		return nil, errTimeout
+	}
+}
+
+// Sends content from a fileSender to a fileReceiver over link, and checks
+// that the receiver commits it intact.
+func sendTestFile(t *testing.T, content []byte, link *lossyTestLink) {
+	t.Helper()
+	dir := t.TempDir()
+	file := filepath.Join(dir, "a.txt")
+	if err := os.WriteFile(file, content, 0644); err != nil {
+		t.Fatal(err)
+	}
+	fr := newTestReceiver(filepath.Join(dir, "b.txt"), content)
+	if err := fr.open(); err != nil {
+		t.Fatal(err)
+	}
+	link.fr = fr
+	link.acks = make(chan []byte, 1024)
+	link.sent = make(map[uint32][]time.Time)
+
+	fs := newFileSender(link, fr.packet_id, int(fr.session.window))
+	fs.seg_size = int(fr.session.seg_size)
+	fs.seg_count = fr.session.seg_count
+	if err := fs.sendFileImpl(file); err != nil {
+		t.Fatal(err)
+	}
+
+	fr.mu.Lock()
+	complete := fr.isComplete()
+	fr.mu.Unlock()
+	if !complete {
+		t.Fatal("transfer is not complete")
+	}
+	fr.expected = fs.digest.Sum(nil)
+	if sum := sha256.Sum256(content); !bytes.Equal(fr.expected, sum[:]) {
+		t.Fatal("digest of the sender differs")
+	}
+	if err := fr.commit(); err != nil {
+		t.Fatal(err)
+	}
+	if got, _ := os.ReadFile(fr.fname); !bytes.Equal(got, content) {
+		t.Fatal("received file differs from the original")
+	}
+}
+
+// The lost segments are retransmitted until the file is complete, whether
+// they or their acks were lost.
+func TestRetransmitLostSegments(t *testing.T) {
+	link := &lossyTestLink{
+		dropSeg: func(seg_id uint32, nth int) bool {
+			return (seg_id == 0 && nth < 3) || (seg_id%7 == 3 && nth == 0)
+		},
+		dropAck: func(nth int) bool { return nth%5 == 0 },
+	}
+	sendTestFile(t, bytes.Repeat([]byte("0123456789"), 40), link)
+	if len(link.sent[0]) < 4 || len(link.sent[3]) < 2 {
+		t.Fatalf("segments 0 and 3 sent %d and %d times", len(link.sent[0]), len(link.sent[3]))
+	}
+}
+
+// Every timeout without an ack doubles the wait before the next
+// retransmission.
+func TestRetransmitBackoff(t *testing.T) {
+	link := &lossyTestLink{
+		dropSeg: func(seg_id uint32, nth int) bool { return nth < 3 },
+		dropAck: func(nth int) bool { return false },
+	}
+	sendTestFile(t, []byte("0123"), link)
+
+	sent := link.sent[0]
+	if len(sent) != 4 {
+		t.Fatalf("segment sent %d times", len(sent))
+	}
+	for i := 2; i < len(sent); i++ {
+		before, after := sent[i-1].Sub(sent[i-2]), sent[i].Sub(sent[i-1])
+		if after < before*3/2 {
+			t.Fatalf("retransmitted after %v then %v, without backoff", before, after)
+		}
+	}
+}
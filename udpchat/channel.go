@@ -0,0 +1,477 @@
+package udpchat
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"log"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode"
+
+	"github.com/neverchanje/unplayground/udpchat/codec"
+)
+
+// Chat messages are published to channels, identified by an id the hub
+// assigns when the channel is created, and never reuses:
+//
+//	kReqSendChatMsg CHANNEL_ID MESSAGE
+//	kReqListChannels [FROM]			   ---->
+//	kReqListSubscribed [FROM]		   ---->
+//				<----  kRespChannelList COUNT [LEN <CHANNEL_ID/NAME>]... [NEXT]
+//	kReqSubscribe CHANNEL_ID		   ---->
+//	kReqUnsubscribe CHANNEL_ID		   ---->
+//	kReqMakeChannel REQ_ID NAME		   ---->
+//	kReqRemoveChannel REQ_ID CHANNEL_ID ---->
+//				<----  kRespChannelOK CHANNEL_ID NAME
+//				<----  kRespChannelFailed REASON
+//
+// A client receives the messages pushed to the channels it subscribed to, and
+// "history" returns the messages of these channels, which kReqListSubscribed
+// lists. Clients are subscribed to kDefaultChannel when they join. The
+// subscriptions belong to the session of the client rather than to its
+// address, so that they survive a NAT rebinding the address. Only the user
+// that created a channel can remove it, and kDefaultChannel can't be removed.
+// REQ_ID is chosen by the client so that a retransmitted request gets the
+// reply to the channel made or removed in the first place, rather than making
+// another channel or failing, as the hub remembers the latest one of each
+// session.
+//
+// The hub stores the channels next to the history log (see histlog.go), in a
+// file whose first line is the id of the latest channel created, followed by
+// a "<channel-id> <name> <creator>" line for each channel but
+// kDefaultChannel, so that a restarted hub still has them, and doesn't reuse
+// the ids of the ones removed.
+const (
+	kDefaultChannel     uint32 = 1
+	kDefaultChannelName        = "general"
+	kMaxChannelNameLen         = 64
+
+	kChannelsFile = "channels"
+)
+
+type channel struct {
+	id      uint32
+	name    string
+	creator string // username of the user that created the channel
+
+	// pushed to at the address they last sent a request from.
+	subscribers map[[kTokenSize]byte]*session
+}
+
+func newChannel(id uint32, name string, creator string) *channel {
+	ch := &channel{id: id, name: name, creator: creator}
+	ch.subscribers = make(map[[kTokenSize]byte]*session)
+	return ch
+}
+
+func (ch *channel) toString() string {
+	return strconv.FormatUint(uint64(ch.id), 10) + "/" + ch.name
+}
+
+func validChannelName(name string) bool {
+	if len(name) == 0 || len(name) > kMaxChannelNameLen {
+		return false
+	}
+	for _, r := range name {
+		if r == '/' || r == ';' || unicode.IsSpace(r) || !unicode.IsPrint(r) {
+			return false
+		}
+	}
+	return true
+}
+
+// Parses "<channel-id>" or "<channel-id>/<channel-name>", the name being
+// only informative.
+func parseChannelRef(ref string) (uint32, bool) {
+	if i := strings.IndexByte(ref, '/'); i >= 0 {
+		ref = ref[:i]
+	}
+	id, err := strconv.ParseUint(ref, 10, 32)
+	return uint32(id), err == nil && id != 0
+}
+
+var errMalformedChannel = errors.New("Malformed channel request")
+
+// Restores the channels stored at path if any, and stores the channels
+// created or removed there from now on.
+func (h *Hub) openChannels(path string) error {
+	h.channelsPath = path
+	content, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	lines := strings.Split(string(content), "\n")
+	last, err := strconv.ParseUint(strings.TrimSpace(lines[0]), 10, 32)
+	if err != nil {
+		return errors.New("Malformed channels file " + path)
+	}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if uint32(last) > h.lastChannel {
+		h.lastChannel = uint32(last)
+	}
+	for _, line := range lines[1:] {
+		fields := strings.Fields(line)
+		if len(fields) == 0 {
+			continue
+		}
+		id, ok := parseChannelRef(fields[0])
+		if len(fields) != 3 || !ok || id == kDefaultChannel || !validChannelName(fields[1]) {
+			log.Println("[Error] Malformed channel in " + path)
+			continue
+		}
+		h.channels[id] = newChannel(id, fields[1], fields[2])
+		if id > h.lastChannel {
+			h.lastChannel = id
+		}
+	}
+	return nil
+}
+
+// Stores the channels, if they are not only kept in memory. The file is
+// replaced as a whole so that it's never half written.
+func (h *Hub) storeChannels() error {
+	if len(h.channelsPath) == 0 {
+		return nil
+	}
+	h.channelsMu.Lock()
+	defer h.channelsMu.Unlock()
+
+	h.mu.Lock()
+	var channels []*channel
+	for id, ch := range h.channels {
+		if id != kDefaultChannel {
+			channels = append(channels, ch)
+		}
+	}
+	content := strconv.FormatUint(uint64(h.lastChannel), 10) + "\n"
+	h.mu.Unlock()
+
+	sort.Slice(channels, func(i, j int) bool { return channels[i].id < channels[j].id })
+	for _, ch := range channels {
+		content += strconv.FormatUint(uint64(ch.id), 10) + " " + ch.name + " " + ch.creator + "\n"
+	}
+	tmp := h.channelsPath + ".tmp"
+	if err := os.WriteFile(tmp, []byte(content), 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, h.channelsPath)
+}
+
+func (h *RequestHandler) replyChannel(ch *channel) error {
+	return h.replyChannelOK(&codec.ChannelOK{Channel: ch.id, Name: ch.name})
+}
+
+func (h *RequestHandler) replyChannelOK(ok *codec.ChannelOK) error {
+	_, err := h.hub.writeTo(codec.Marshal(ok), h.ra)
+	return err
+}
+
+// Whether req_id is the channel request the session made or removed a channel
+// with last, the reply to which is returned. A REQ_ID of 0 is never one.
+// REQUIRE: hub mutex lock held
+func (h *RequestHandler) channelReplied(req_id uint64) (codec.ChannelOK, bool) {
+	s := h.session
+	return s.channel_reply, req_id != 0 && s.channel_req == req_id
+}
+
+// REQUIRE: hub mutex lock held
+func (h *RequestHandler) rememberChannelReply(req_id uint64, ch *channel) {
+	h.session.channel_req = req_id
+	h.session.channel_reply = codec.ChannelOK{Channel: ch.id, Name: ch.name}
+}
+
+// Replies the reason of the failure, which is also returned.
+func (h *RequestHandler) rejectChannel(reason string) error {
+	resp := codec.Marshal(&codec.ChannelFailed{Reason: reason})
+	if _, err := h.hub.writeTo(resp, h.ra); err != nil {
+		return err
+	}
+	return errors.New(reason + " from " + h.ra.String())
+}
+
+// Answers a page of the channels, see lists.go.
+func (h *RequestHandler) handleListChannels(recv []byte) error {
+	var req codec.ListChannels
+	if err := codec.Unmarshal(recv, &req); err != nil {
+		return err
+	}
+	h.hub.mu.Lock()
+	var channels []*channel
+	for _, ch := range h.hub.channels {
+		channels = append(channels, ch)
+	}
+	h.hub.mu.Unlock()
+	return h.replyChannelList(channels, req.From)
+}
+
+// Answers a page of the channels subscribed by the client.
+func (h *RequestHandler) handleListSubscribed(recv []byte) error {
+	var req codec.ListSubscribed
+	if err := codec.Unmarshal(recv, &req); err != nil {
+		return err
+	}
+	h.hub.mu.Lock()
+	var channels []*channel
+	for id := range h.subscribedChannels() {
+		if ch, has := h.hub.channels[id]; has {
+			channels = append(channels, ch)
+		}
+	}
+	h.hub.mu.Unlock()
+	return h.replyChannelList(channels, req.From)
+}
+
+func (h *RequestHandler) replyChannelList(channels []*channel, from uint32) error {
+	sort.Slice(channels, func(i, j int) bool { return channels[i].id < channels[j].id })
+
+	names := make([]string, len(channels))
+	for i, ch := range channels {
+		names[i] = ch.toString()
+	}
+	page, next := pageList(names, from)
+	_, err := h.hub.writeTo(codec.Marshal(&codec.ChannelList{Channels: page, Next: next}), h.ra)
+	return err
+}
+
+func (h *RequestHandler) handleSubscribe(recv []byte) error {
+	var req codec.Subscribe
+	if codec.Unmarshal(recv, &req) != nil {
+		return errMalformedChannel
+	}
+	id := req.Channel
+
+	h.hub.mu.Lock()
+	ch, has := h.hub.channels[id]
+	if has {
+		ch.subscribers[h.session.token] = h.session
+	}
+	h.hub.mu.Unlock()
+
+	if !has {
+		return h.rejectChannel("No such channel")
+	}
+	return h.replyChannel(ch)
+}
+
+func (h *RequestHandler) handleUnsubscribe(recv []byte) error {
+	var req codec.Unsubscribe
+	if codec.Unmarshal(recv, &req) != nil {
+		return errMalformedChannel
+	}
+	id := req.Channel
+
+	h.hub.mu.Lock()
+	ch, has := h.hub.channels[id]
+	if has {
+		delete(ch.subscribers, h.session.token)
+	}
+	h.hub.mu.Unlock()
+
+	if !has {
+		return h.rejectChannel("No such channel")
+	}
+	return h.replyChannel(ch)
+}
+
+// The creator is subscribed to the new channel.
+func (h *RequestHandler) handleMakeChannel(recv []byte) error {
+	var req codec.MakeChannel
+	if codec.Unmarshal(recv, &req) != nil {
+		return errMalformedChannel
+	}
+	name := req.Name
+	if !validChannelName(name) {
+		return h.rejectChannel("Invalid channel name")
+	}
+
+	h.hub.mu.Lock()
+	if ok, replied := h.channelReplied(req.ReqID); replied {
+		h.hub.mu.Unlock()
+		return h.replyChannelOK(&ok)
+	}
+	h.hub.lastChannel++
+	ch := newChannel(h.hub.lastChannel, name, h.username())
+	ch.subscribers[h.session.token] = h.session
+	h.hub.channels[ch.id] = ch
+	h.rememberChannelReply(req.ReqID, ch)
+	h.hub.mu.Unlock()
+
+	log.Println("Channel " + ch.toString() + " created by " + h.username())
+	if err := h.hub.storeChannels(); err != nil {
+		log.Println("Server " + err.Error())
+	}
+	return h.replyChannel(ch)
+}
+
+func (h *RequestHandler) handleRemoveChannel(recv []byte) error {
+	var req codec.RemoveChannel
+	if codec.Unmarshal(recv, &req) != nil {
+		return errMalformedChannel
+	}
+	id := req.Channel
+
+	h.hub.mu.Lock()
+	if ok, replied := h.channelReplied(req.ReqID); replied {
+		h.hub.mu.Unlock()
+		return h.replyChannelOK(&ok)
+	}
+	ch, has := h.hub.channels[id]
+	allowed := has && id != kDefaultChannel && ch.creator == h.username()
+	if allowed {
+		delete(h.hub.channels, id)
+		h.rememberChannelReply(req.ReqID, ch)
+	}
+	h.hub.mu.Unlock()
+
+	switch {
+	case !has:
+		return h.rejectChannel("No such channel")
+	case !allowed:
+		return h.rejectChannel("Only the creator can remove the channel")
+	}
+	log.Println("Channel " + ch.toString() + " removed by " + h.username())
+	if err := h.hub.storeChannels(); err != nil {
+		log.Println("Server " + err.Error())
+	}
+	return h.replyChannel(ch)
+}
+
+// Channels subscribed by the client, or kDefaultChannel if none.
+// REQUIRE: hub mutex lock held
+func (h *RequestHandler) subscribedChannels() map[uint32]bool {
+	subscribed := make(map[uint32]bool)
+	for id, ch := range h.hub.channels {
+		if _, has := ch.subscribers[h.session.token]; has {
+			subscribed[id] = true
+		}
+	}
+	if len(subscribed) == 0 {
+		subscribed[kDefaultChannel] = true
+	}
+	return subscribed
+}
+
+func (c *Client) listChannels() ([]string, error) {
+	return fetchList(c, func(from uint32) codec.Message {
+		req := new(codec.ListChannels)
+		req.From = from
+		return req
+	}, func(packet []byte) ([]string, uint32, bool) {
+		var list codec.ChannelList
+		err := codec.Unmarshal(packet, &list)
+		return list.Channels, list.Next, err == nil
+	})
+}
+
+// The channels the hub has the client subscribed to.
+func (c *Client) subscribedChannels() (map[uint32]bool, error) {
+	list, err := fetchList(c, func(from uint32) codec.Message {
+		req := new(codec.ListSubscribed)
+		req.From = from
+		return req
+	}, func(packet []byte) ([]string, uint32, bool) {
+		var list codec.ChannelList
+		err := codec.Unmarshal(packet, &list)
+		return list.Channels, list.Next, err == nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	channels := make(map[uint32]bool)
+	for _, ref := range list {
+		if id, ok := parseChannelRef(ref); ok {
+			channels[id] = true
+		}
+	}
+	return channels, nil
+}
+
+func (c *Client) ListChannels() {
+	channels, err := c.listChannels()
+	if err != nil {
+		log.Println("[Error] Listing channels: " + err.Error())
+		return
+	}
+	for _, ch := range channels {
+		println(ch)
+	}
+}
+
+// Sends a channel request, and prints the channel the hub replies with.
+func (c *Client) channelRequest(req codec.Message, done string) {
+	var ok codec.ChannelOK
+	var failed codec.ChannelFailed
+	resp, err := exchange(c, codec.Marshal(req), func(packet []byte) bool {
+		return codec.Unmarshal(packet, &ok) == nil || codec.Unmarshal(packet, &failed) == nil
+	})
+	if err != nil {
+		log.Println("[Error] Channel request: " + err.Error())
+		return
+	}
+	if ResponseType(resp[0]) == kRespChannelFailed {
+		log.Println("[Error] " + failed.Reason)
+		return
+	}
+
+	println(done + " channel " + strconv.FormatUint(uint64(ok.Channel), 10) + "/" + ok.Name)
+}
+
+func (c *Client) Subscribe(ref string) {
+	if id, ok := parseChannelRef(ref); !ok {
+		println("Invalid channel id: " + ref)
+	} else {
+		c.channelRequest(&codec.Subscribe{Channel: id}, "Subscribed to")
+	}
+}
+
+func (c *Client) Unsubscribe(ref string) {
+	if id, ok := parseChannelRef(ref); !ok {
+		println("Invalid channel id: " + ref)
+	} else {
+		c.channelRequest(&codec.Unsubscribe{Channel: id}, "Unsubscribed from")
+	}
+}
+
+// A REQ_ID for a channel request.
+func newChannelReqID() (uint64, error) {
+	var id [8]byte
+	if _, err := rand.Read(id[:]); err != nil {
+		return 0, err
+	}
+	return binary.LittleEndian.Uint64(id[:]), nil
+}
+
+func (c *Client) MakeChannel(name string) {
+	if !validChannelName(name) {
+		println("Channel name should be 1 to " + strconv.Itoa(kMaxChannelNameLen) +
+			" characters, without spaces, '/' or ';'.")
+		return
+	}
+	req_id, err := newChannelReqID()
+	if err != nil {
+		log.Println("[Error] " + err.Error())
+		return
+	}
+	c.channelRequest(&codec.MakeChannel{ReqID: req_id, Name: name}, "Created")
+}
+
+func (c *Client) RemoveChannel(ref string) {
+	id, ok := parseChannelRef(ref)
+	if !ok {
+		println("Invalid channel id: " + ref)
+		return
+	}
+	req_id, err := newChannelReqID()
+	if err != nil {
+		log.Println("[Error] " + err.Error())
+		return
+	}
+	c.channelRequest(&codec.RemoveChannel{ReqID: req_id, Channel: id}, "Removed")
+}
@@ -0,0 +1,248 @@
+package udpchat
+
+import (
+	"encoding/binary"
+	"net"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/neverchanje/unplayground/udpchat/codec"
+)
+
+func TestChannels(t *testing.T) {
+	hub := newTestHub(t)
+	alice, bob := dialTestHub(t, hub), dialTestHub(t, hub)
+	joinTestHub(t, alice, "alice")
+	loginTestHub(t, bob, "bob")
+
+	alice.Write(codec.Marshal(&codec.MakeChannel{Name: "ops"}))
+	resp := readTestPacket(t, alice)
+	if ResponseType(resp[0]) != kRespChannelOK || string(resp[5:]) != "ops" {
+		t.Fatalf("created channel with response %q", resp)
+	}
+	ops := binary.LittleEndian.Uint32(resp[1:5])
+	if ops == kDefaultChannel {
+		t.Fatal("channel id is reused")
+	}
+
+	bob.Write(codec.Marshal(&codec.Subscribe{Channel: ops}))
+	if resp = readTestPacket(t, bob); ResponseType(resp[0]) != kRespChannelOK {
+		t.Fatalf("subscribed with response %q", resp)
+	}
+	bob.Write(codec.Marshal(&codec.Subscribe{Channel: ops + 1}))
+	if resp = readTestPacket(t, bob); ResponseType(resp[0]) != kRespChannelFailed {
+		t.Fatalf("subscribed to unknown channel with response %q", resp)
+	}
+
+	// only the subscribers of the channel are pushed the message, and only
+	// they find it in their history.
+	alice.Write(codec.Marshal(&codec.SendChatMsg{Channel: ops, Message: "deploying"}))
+	if push := readTestPacket(t, bob); !strings.Contains(string(push), "/ops] deploying") {
+		t.Fatalf("pushed %q", push)
+	}
+	alice.Write(codec.Marshal(&codec.SendChatMsg{Channel: kDefaultChannel, Message: "lunch?"}))
+	time.Sleep(100 * time.Millisecond)
+
+	bob.Write([]byte{byte(kReqGetHistory)})
+	history, err := decodeHistoryPart(readTestPacket(t, bob))
+	if err != nil || len(history) != 1 || history[0].msg != "deploying" {
+		t.Fatalf("history of bob: %v, %v", history, err)
+	}
+
+	bob.Write(codec.Marshal(&codec.RemoveChannel{Channel: ops}))
+	if resp = readTestPacket(t, bob); ResponseType(resp[0]) != kRespChannelFailed {
+		t.Fatalf("channel removed by another client with response %q", resp)
+	}
+	alice.Write(codec.Marshal(&codec.RemoveChannel{Channel: kDefaultChannel}))
+	if resp = readTestPacket(t, alice); ResponseType(resp[0]) != kRespChannelFailed {
+		t.Fatalf("default channel removed with response %q", resp)
+	}
+	alice.Write(codec.Marshal(&codec.RemoveChannel{Channel: ops}))
+	if resp = readTestPacket(t, alice); ResponseType(resp[0]) != kRespChannelOK {
+		t.Fatalf("channel not removed by its creator, response %q", resp)
+	}
+
+	alice.Write([]byte{byte(kReqListChannels)})
+	var list codec.ChannelList
+	if err := codec.Unmarshal(readTestPacket(t, alice), &list); err != nil ||
+		len(list.Channels) != 1 || list.Channels[0] != "1/general" {
+		t.Fatalf("channels: %q, %v", list.Channels, err)
+	}
+}
+
+// The subscriptions and the channels created follow the session of a client
+// whose address a NAT rebinds.
+func TestChannelsAfterRebinding(t *testing.T) {
+	hub := newTestHub(t)
+	alice, bob := dialTestHub(t, hub), dialTestHub(t, hub)
+	joinTestHub(t, alice, "alice")
+	loginTestHub(t, bob, "bob")
+
+	alice.Write(codec.Marshal(&codec.MakeChannel{Name: "ops"}))
+	var ok codec.ChannelOK
+	if err := codec.Unmarshal(readTestPacket(t, alice), &ok); err != nil {
+		t.Fatal(err)
+	}
+
+	conn, err := hub.transport.Dial(hub.conn.LocalAddr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	rebound := &testConn{Conn: conn, secure: alice.secure, token: alice.token}
+	rebound.Write([]byte{byte(kReqPing)})
+	if resp := readTestPacket(t, rebound); ResponseType(resp[0]) != kRespPong {
+		t.Fatalf("pinged with response %q", resp)
+	}
+
+	bob.Write(codec.Marshal(&codec.SendChatMsg{Channel: ok.Channel, Message: "deploying"}))
+	if push := readTestPacket(t, rebound); !strings.Contains(string(push), "/ops] deploying from bob") {
+		t.Fatalf("pushed %q", push)
+	}
+	rebound.Write(codec.Marshal(&codec.ListSubscribed{}))
+	var list codec.ChannelList
+	if err := codec.Unmarshal(readTestPacket(t, rebound), &list); err != nil ||
+		len(list.Channels) != 2 || list.Channels[0] != "1/general" || list.Channels[1] != "2/ops" {
+		t.Fatalf("subscribed to %q, %v", list.Channels, err)
+	}
+	rebound.Write(codec.Marshal(&codec.RemoveChannel{Channel: ok.Channel}))
+	if resp := readTestPacket(t, rebound); ResponseType(resp[0]) != kRespChannelOK {
+		t.Fatalf("channel not removed by its creator, response %q", resp)
+	}
+}
+
+func TestStoreChannels(t *testing.T) {
+	hub := newTestHub(t)
+	path := filepath.Join(t.TempDir(), kChannelsFile)
+	if err := hub.openChannels(path); err != nil {
+		t.Fatal(err)
+	}
+	alice := dialTestHub(t, hub)
+	joinTestHub(t, alice, "alice")
+	for _, name := range []string{"ops", "dev"} {
+		alice.Write(codec.Marshal(&codec.MakeChannel{Name: name}))
+		if resp := readTestPacket(t, alice); ResponseType(resp[0]) != kRespChannelOK {
+			t.Fatalf("created channel with response %q", resp)
+		}
+	}
+	alice.Write(codec.Marshal(&codec.RemoveChannel{Channel: 3}))
+	if resp := readTestPacket(t, alice); ResponseType(resp[0]) != kRespChannelOK {
+		t.Fatalf("removed channel with response %q", resp)
+	}
+
+	// the removed channel is gone, but its id isn't reused.
+	restarted := newHub()
+	if err := restarted.openChannels(path); err != nil {
+		t.Fatal(err)
+	}
+	ops, has := restarted.channels[2]
+	if len(restarted.channels) != 2 || !has || ops.name != "ops" || ops.creator != "alice" {
+		t.Fatalf("restored channels %v", restarted.channels)
+	}
+	if restarted.lastChannel != 3 {
+		t.Fatalf("latest channel restored as %d", restarted.lastChannel)
+	}
+}
+
+// A MemoryTransport on which the hub loses the replies it's told to.
+type replyLosingTransport struct {
+	*MemoryTransport
+
+	mu    sync.Mutex
+	drops int // of the next replies
+}
+
+func (t *replyLosingTransport) Listen(address string) (net.PacketConn, error) {
+	conn, err := t.MemoryTransport.Listen(address)
+	return &replyLosingConn{conn, t}, err
+}
+
+// Loses the next n replies, and returns how many of the previous ones were
+// left to lose.
+func (t *replyLosingTransport) loseReplies(n int) int {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	left := t.drops
+	t.drops = n
+	return left
+}
+
+type replyLosingConn struct {
+	net.PacketConn
+	transport *replyLosingTransport
+}
+
+func (conn *replyLosingConn) WriteTo(p []byte, addr net.Addr) (int, error) {
+	t := conn.transport
+	t.mu.Lock()
+	lost := t.drops > 0
+	if lost {
+		t.drops--
+	}
+	t.mu.Unlock()
+	if lost {
+		return len(p), nil
+	}
+	return conn.PacketConn.WriteTo(p, addr)
+}
+
+// A channel request retransmitted as its reply was lost gets the reply to the
+// channel made or removed in the first place.
+func TestRetransmitChannelRequests(t *testing.T) {
+	transport := &replyLosingTransport{MemoryTransport: NewMemoryTransport()}
+	hub := newTestHubOn(t, transport)
+	alice := newTestClient(t, hub, "alice")
+
+	request := func(req codec.Message) codec.ChannelOK {
+		t.Helper()
+		transport.loseReplies(1)
+		var ok codec.ChannelOK
+		if _, err := exchange(alice, codec.Marshal(req), func(packet []byte) bool {
+			return codec.Unmarshal(packet, &ok) == nil
+		}); err != nil {
+			t.Fatal(err)
+		}
+		if transport.loseReplies(0) != 0 {
+			t.Fatal("no reply lost")
+		}
+		return ok
+	}
+
+	ok := request(&codec.MakeChannel{ReqID: 1, Name: "ops"})
+	hub.mu.Lock()
+	channels, last := len(hub.channels), hub.lastChannel
+	hub.mu.Unlock()
+	if ok.Name != "ops" || channels != 2 || last != ok.Channel {
+		t.Fatalf("made channel %d/%s, %d channels and the latest %d", ok.Channel, ok.Name, channels, last)
+	}
+
+	if removed := request(&codec.RemoveChannel{ReqID: 2, Channel: ok.Channel}); removed != ok {
+		t.Fatalf("removed channel %d/%s", removed.Channel, removed.Name)
+	}
+
+	// a request with another REQ_ID makes another channel.
+	if again := request(&codec.MakeChannel{ReqID: 3, Name: "ops"}); again.Channel != ok.Channel+1 {
+		t.Fatalf("made channel %d again", again.Channel)
+	}
+}
+
+// A message goes to a channel other than the default one only when sent to
+// it explicitly.
+func TestSendToChannel(t *testing.T) {
+	hub := newTestHub(t)
+	alice := newTestClient(t, hub, "alice")
+	alice.MakeChannel("ops")
+
+	alice.SendChatMsg("2 apples")
+	alice.SendChannelMsg("2/ops deploying")
+	alice.SendChannelMsg("deploying")
+	if page := waitHistory(t, alice, 2, "alice", 1); len(page) != 1 || page[0].msg != "deploying" {
+		t.Fatalf("sent to the channel %v", page)
+	}
+	if page := waitHistory(t, alice, kDefaultChannel, "alice", 1); len(page) != 1 || page[0].msg != "2 apples" {
+		t.Fatalf("sent to the default channel %v", page)
+	}
+}
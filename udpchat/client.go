@@ -2,24 +2,30 @@ package udpchat
 
 import (
 	"bufio"
-	"bytes"
+	"crypto/sha256"
 	"encoding/binary"
+	"encoding/hex"
 	"errors"
 	"fmt"
-	"hash/fnv"
-	"io"
 	"log"
+	"math"
 	"net"
 	"os"
+	"path/filepath"
 	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/neverchanje/unplayground/udpchat/codec"
 )
 
 // The client serves as a application that executes commands in
 // sequential order.
 type Client struct {
-	remote   *net.UDPAddr
-	conn     *net.UDPConn
+	remote   net.Addr
+	conn     net.Conn // over a Transport, see transport.go
 	username string
 
 	// stdin
@@ -28,20 +34,73 @@ type Client struct {
 	// indicates iff the user types "quit".
 	quitListener chan bool
 
-	recv []byte
+	// closed by Close, which stops the pings, see presence.go.
+	closed chan struct{}
+
+	// responses to the requests of the user, other than the packets of
+	// file transfers, which are dispatched to their transfers by receive.
+	replies *queuedLink
+
+	// responses to the requests the client makes on its own, like joining
+	// the chat.
+	background *queuedLink
+
+	// out serializes the messages pushed by the server with the prompt,
+	// which is shown while prompting.
+	out       sync.Mutex
+	prompting bool
+
+	// maximum number of segments in flight during a file transfer.
+	sendWindow int
+
+	// QUERY_ID of the last history query.
+	lastQuery uint32
+
+	// nil if the history is not cached, see histcache.go.
+	history *historyCache
+
+	// of the session, following the type of every request once logged in,
+	// see users.go.
+	token []byte
 
-	fsender *fileSender
+	// the keys of the handshake with the hub, and its static key, see
+	// secure.go.
+	secure *secureChannel
+	hubKey []byte
+
+	// nil until opened, see keys.go and dm.go.
+	identity *identity
+
+	mu           sync.Mutex
+	transfers    map[uint64]*transfer // running, by PACKET_ID
+	allTransfers []*transfer
+	shownDMs     map[string]bool // by sender and DM_ID
+	lastSent     time.Time       // when a request was last written, see presence.go
 }
 
-// Establishes an udp connection to server.
-func (c *Client) connect(host string, port int) (err error) {
-	c.remote = &net.UDPAddr{IP: net.ParseIP(host), Port: port}
-	c.conn, err = net.DialUDP("udp", nil, c.remote)
+// Establishes a connection to the hub at address, which is encrypted once
+// the handshake completes.
+func (c *Client) connect(transport Transport, address string) (err error) {
+	if c.conn, err = transport.Dial(address); err != nil {
+		return err
+	}
+	c.remote = c.conn.RemoteAddr()
+	c.secure, c.hubKey, err = dialSecure(c.conn, codec.Supported)
 	return err
 }
 
 func (c *Client) Close() {
+	c.mu.Lock()
+	loggedIn := len(c.token) != 0
+	c.mu.Unlock()
+	if loggedIn {
+		c.Send(nil, kReqLeave)
+	}
+	close(c.closed)
 	c.conn.Close()
+	if c.history != nil {
+		c.history.close()
+	}
 }
 
 func (c *Client) Send(msg []byte, t RequestType) error {
@@ -56,175 +115,272 @@ func (c *Client) Send(msg []byte, t RequestType) error {
 
 	msg = append(header, msg...)
 
-	_, err := c.conn.Write(msg)
-	return err
+	return c.write(msg)
 }
 
-func (c *Client) handleHisResponse() error {
-	n, err := c.conn.Read(c.recv)
-	if err != nil {
-		return err
-	}
-	if n != 0 {
-		histories := strings.Split(string(c.recv), "; ")
-		for i := range histories {
-			println(histories[i])
-		}
-	}
-	return nil
+// Sends the message to kDefaultChannel, whatever it starts with.
+func (c *Client) SendChatMsg(msg string) {
+	c.sendChatMsg(kDefaultChannel, msg)
 }
 
-func (c *Client) SendHisReq() {
-	err := c.Send(nil, kReqGetHistory)
-	if err == nil {
-		err = c.handleHisResponse()
-	}
-	if err != nil {
-		log.Println("[Error] Sending history request: " + err.Error())
+// Sends a message given as "<channel-id>[/<channel-name>] <message>" to the
+// channel.
+func (c *Client) SendChannelMsg(args string) {
+	fields := strings.SplitN(strings.TrimSpace(args), " ", 2)
+	channel, ok := parseChannelRef(fields[0])
+	if !ok || len(fields) != 2 {
+		println("Usage: sendto: <channel-id> <message>")
+		return
 	}
+	c.sendChatMsg(channel, strings.TrimSpace(fields[1]))
 }
 
-func (c *Client) SendChatMsg(msg string) {
+func (c *Client) sendChatMsg(channel uint32, msg string) {
 	if len(msg) == 0 {
 		println("Input message should not be empty.")
-	} else if len(msg) > 250 {
-		println("Length of message should not be larger than 250")
+	} else if len(msg) > kMaxChatMsgLen {
+		println("Length of message should not be larger than " + strconv.Itoa(kMaxChatMsgLen))
 	} else {
-		err := c.Send([]byte(msg), kReqSendChatMsg)
+		err := c.write(codec.Marshal(&codec.SendChatMsg{Channel: channel, Message: msg}))
 		if err != nil {
 			log.Println("[Error] Sending chat message: " + err.Error())
 		}
 	}
 }
 
-type fileSender struct {
-	fname  string
-	client *Client
-
-	// segments that's not accepted
-	// TODO use offset as value
-	unaccepted map[uint32]([]byte)
+// The PACKET_ID of a transfer stays the same across client restarts as long
+// as the file is unchanged, so that the server recognizes an interrupted
+// transfer to resume. The host is included for users of the same name on
+// different machines.
+func transferID(username string, fname string, info os.FileInfo) []byte {
+	if abs, err := filepath.Abs(fname); err == nil {
+		fname = abs
+	}
+	host, _ := os.Hostname()
 
-	packet_id []byte
+	hs := sha256.New()
+	hs.Write([]byte(username + "\x00" + host + "\x00" + fname + "\x00"))
+	binary.Write(hs, binary.LittleEndian, info.Size())
+	binary.Write(hs, binary.LittleEndian, info.ModTime().UnixNano())
+	return hs.Sum(nil)[:8]
 }
 
-func (c *Client) newFileSender(fname string) *fileSender {
-	f := new(fileSender)
-	f.unaccepted = make(map[uint32]([]byte))
-	f.client = c
-	f.fname = fname
-
-	// TODO use better packet_id, like hash64(ra.String() + fname)
-	f.packet_id = make([]byte, 8)
-	hs := fnv.New64()
-	hs.Write([]byte(f.fname))
-	binary.LittleEndian.PutUint64(f.packet_id, hs.Sum64())
-
-	log.Println("Generating packet_id: ", hs.Sum64())
+// Sets the maximum number of segments in flight for the following file
+// transfers.
+func (c *Client) SetSendWindow(window int) error {
+	if window <= 0 || window > math.MaxUint16 {
+		return errors.New("Send window should be within [1, 65535].")
+	}
+	c.sendWindow = window
+	return nil
+}
 
-	return f
+// Sends a sealed packet with the token of the session after its type,
+// implementing packetLink for file transfers.
+func (c *Client) write(packet []byte) error {
+	c.mu.Lock()
+	token := c.token
+	c.lastSent = time.Now()
+	c.mu.Unlock()
+
+	if len(token) != 0 && len(packet) != 0 && !isLoginRequest(RequestType(packet[0])) {
+		buf := make([]byte, 1, 1+len(token)+len(packet)-1)
+		buf[0] = packet[0]
+		buf = append(buf, token...)
+		packet = append(buf, packet[1:]...)
+	}
+	if c.secure == nil {
+		return errors.New("Not connected to the hub")
+	}
+	datagram, err := c.secure.seal(packet)
+	if err != nil {
+		return err
+	}
+	_, err = c.conn.Write(datagram)
+	return err
 }
 
-func (c *Client) SendFile(file string) {
-	if len(file) == 0 {
-		println("Input file name should not be empty.")
-	} else {
-		c.fsender = c.newFileSender(file)
+func (c *Client) nextQueryID() uint32 {
+	return atomic.AddUint32(&c.lastQuery, 1)
+}
 
-		send_file_packet := make([]byte, len(file)+8)
-		copy(send_file_packet, c.fsender.packet_id)
-		copy(send_file_packet[8:], []byte(file))
-		err := c.Send(send_file_packet, kReqSendFile)
+// Returns the next reply from the server received before deadline.
+func (c *Client) read(deadline time.Time) ([]byte, error) {
+	return c.replies.read(deadline)
+}
 
-		if err != nil {
-			log.Println("[Error] Sending file: " + err.Error())
+// Reads every packet from the server, the ones of file transfers are
+// dispatched to their transfers and the others are replies.
+func (c *Client) receive() {
+	for {
+		datagram := make([]byte, kMaxDatagramSize)
+		n, err := c.conn.Read(datagram)
+		if errors.Is(err, net.ErrClosed) {
 			return
+		} else if err != nil {
+			continue
 		}
-
-		_, err = c.conn.Read(c.recv)
-		if err != nil {
-			log.Println("[Error] Sending file: " + err.Error())
-			return
+		// forged and replayed datagrams are dropped.
+		packet, err := c.secure.open(datagram[:n])
+		if err != nil || len(packet) == 0 {
+			continue
 		}
+		n = len(packet)
 
-		switch ResponseType(c.recv[0]) {
-		case kRespSendFileOK:
-			println("Start file transferring")
-			c.fsender.sendFileImpl(file)
-			c.fsender = nil
-		case kRespSendFileFailed:
-			log.Println("[Error] Sending file is not permitted")
-			return
+		if c.dispatch(packet[:n]) {
+			continue
+		}
+		switch ResponseType(packet[0]) {
+		case kRespChatMsg:
+			var msg codec.ChatMsg
+			if codec.Unmarshal(packet, &msg) == nil {
+				c.printAsync(msg.Text)
+			}
+		case kRespDM:
+			c.receiveDM(packet[:n])
+		case kRespPong:
+		case kRespJoinOK, kRespLoginOK, kRespLoginFailed:
+			c.background.deliver(packet[:n])
+		case kRespUnauthenticated:
+			var resp codec.Unauthenticated
+			if codec.Unmarshal(packet, &resp) == nil {
+				c.printAsync("[Error] " + resp.Reason + ", please log in again.")
+			}
+		case kRespRequestFailed:
+			// chat messages are sent without waiting for a response.
+			var failed codec.RequestFailed
+			if codec.Unmarshal(packet, &failed) == nil && RequestType(failed.Request) == kReqSendChatMsg {
+				c.printAsync("[Error] The message is refused: " + failed.Reason)
+			} else {
+				c.replies.deliver(packet[:n])
+			}
+		default:
+			c.replies.deliver(packet[:n])
 		}
 	}
 }
 
-func (fs *fileSender) sendFileImpl(fname string) {
-	file, err := os.Open(fname)
-	if err != nil {
-		log.Println("[Error] " + err.Error())
+// Sends packet as a request of type t, and waits for the response accepted
+// by isResponse. The request is retransmitted with backoff when no such
+// response arrives in time.
+func (c *Client) request(packet []byte, t RequestType, isResponse func([]byte) bool) ([]byte, error) {
+	return exchange(c, append([]byte{byte(t)}, packet...), isResponse)
+}
+
+// Starts sending a file in background, see "transfers" for its progress.
+// The transfer is set up with a three-way handshake negotiating the
+// segment size and the window, and terminated with a FIN that either
+// commits or cancels the file on the server.
+func (c *Client) SendFile(file string) {
+	if len(file) == 0 {
+		println("Input file name should not be empty.")
 		return
 	}
 
-	reader := bufio.NewReader(file)
-	var sid uint32 = 0
-	hitsEOF := false
-	content := make([]byte, 512)
-
-	for {
-		if hitsEOF {
-			//TODO resend segment
-			break
-		} else {
-			n, err := reader.Read(content)
-			if err == io.EOF {
-				hitsEOF = true
-			} else if err != nil {
-				log.Println("[Error] File reading " + err.Error())
-				return
-			}
-			content = content[:n]
-		}
-
-		err = fs.sendSegment(content, sid)
-		if err != nil {
-			log.Println("[Error] Segment sending " + err.Error())
-		}
+	info, err := os.Stat(file)
+	if err != nil {
+		log.Println("[Error] Sending file: " + err.Error())
+		return
+	}
 
-		sid += 1
+	packet_id := binary.LittleEndian.Uint64(transferID(c.username, file, info))
+	t, err := c.startTransfer(packet_id, true, file)
+	if err != nil {
+		log.Println("[Error] Sending file: " + err.Error())
+		return
 	}
+	go func() {
+		c.finishTransfer(t, c.sendFile(t, info))
+	}()
 }
 
-func (fs *fileSender) sendSegment(content []byte, seg_id uint32) error {
-	packet := new(bytes.Buffer)
+func (c *Client) sendFile(t *transfer, info os.FileInfo) error {
+	fs := newFileSender(t.link, t.packet_id, c.sendWindow)
 
-	packet.WriteByte(byte(kReqSendSeg))
-
-	// PACKET_ID
-	packet.Write(fs.packet_id)
+	session := &fileSession{
+		packet_id:  t.packet_id,
+		seg_size:   kSegmentSize,
+		window:     uint16(c.sendWindow),
+		total_size: uint64(info.Size()),
+		user:       c.username,
+		fname:      t.fname,
+	}
+	syn := codec.Marshal(&codec.SendFile{FileSyn: session.syn()})
+	resp, err := exchange(t.link, syn, func(packet []byte) bool {
+		failed := decodeTransfer(packet, new(codec.SendFileFailed), session.packet_id)
+		return failed || session.decodeSynAck(packet)
+	})
+	if err != nil {
+		return err
+	}
+	if ResponseType(resp[0]) == kRespSendFileFailed {
+		return errors.New("Sending file is not permitted")
+	}
 
-	// SEG_ID
-	seg_id_buf := make([]byte, 4)
-	binary.LittleEndian.PutUint32(seg_id_buf, seg_id)
-	packet.Write(seg_id_buf)
+	if err = t.link.write(codec.Marshal(&codec.SendFileAck{PacketID: t.packet_id})); err != nil {
+		return err
+	}
+	fs.seg_size = int(session.seg_size)
+	fs.seg_count = session.seg_count
+	fs.next_sid = session.resume_from
+	fs.window = int(session.window)
+	t.establish(session.total_size, func() uint64 {
+		return atomic.LoadUint64(&fs.acked)
+	})
+
+	if fs.next_sid != 0 {
+		println("Resume file transferring " + t.fname + " from segment " +
+			strconv.FormatUint(uint64(fs.next_sid), 10))
+	} else {
+		println("Start file transferring " + t.fname)
+	}
+	err = fs.sendFileImpl(t.fname)
+	if err != nil {
+		fs.finish(kFinCancel)
+		return err
+	}
 
-	// SEG_CONTENT
-	packet.Write(content)
-	fs.unaccepted[seg_id] = content
+	status, err := fs.finish(kFinCommit)
+	switch {
+	case err != nil:
+		return err
+	case status == kFinStatusCorrupt:
+		return errors.New("File is corrupted, SHA-256 mismatch on the server")
+	case status != kFinStatusOK:
+		return errors.New("File is rejected by the server")
+	}
+	println("File transferring finished " + t.fname + ", SHA-256 verified: " +
+		hex.EncodeToString(fs.digest.Sum(nil)))
+	return nil
+}
 
-	_, err := fs.client.conn.Write(packet.Bytes())
+// Terminates an upload with a FIN carrying flag, and returns the status
+// of the FIN-ACK. A commit carries the SHA-256 of the whole file.
+func (fs *fileSender) finish(flag byte) (byte, error) {
+	fin := &codec.SendFileFin{PacketID: binary.LittleEndian.Uint64(fs.packet_id), Flag: flag}
+	if flag == kFinCommit {
+		fin.Digest = fs.digest.Sum(nil)
+	}
 
-	log.Println("Writing segment "+strconv.FormatUint(uint64(seg_id), 10)+" in length ", packet.Len()-13)
-	return err
+	var status byte
+	_, err := exchange(fs.link, codec.Marshal(fin), func(packet []byte) bool {
+		var ack codec.SendFileFinAck
+		if !decodeTransfer(packet, &ack, fin.PacketID) {
+			return false
+		}
+		status = ack.Status
+		return true
+	})
+	return status, err
 }
 
 // Asynchronously checks the user input.
 func (c *Client) checkInput() {
 	for {
 
-		fmt.Print(">>> ")
-
+		c.prompt(true)
 		line, _, err := c.input.ReadLine()
+		c.prompt(false)
 
 		// TODO input error?
 		if err != nil {
@@ -242,18 +398,68 @@ func (c *Client) checkInput() {
 			PrintHelpInfo()
 			continue
 		} else if strings.EqualFold(msg, "history") {
-			c.SendHisReq()
+			c.SendHisReq("")
+			continue
+		} else if strings.HasPrefix(msg, "history:") {
+			c.SendHisReq(strings.TrimPrefix(msg, "history:"))
+			continue
+		} else if strings.HasPrefix(msg, "search:") {
+			c.Search(strings.TrimPrefix(msg, "search:"))
+			continue
+		} else if strings.HasPrefix(msg, "sendto:") {
+			c.SendChannelMsg(strings.TrimPrefix(msg, "sendto:"))
 			continue
 		} else if strings.HasPrefix(msg, "send:") {
 			msg = strings.TrimLeft(msg, "send:")
 			msg = strings.TrimSpace(msg)
 			c.SendChatMsg(msg)
 			continue
+		} else if strings.HasPrefix(msg, "dm:") {
+			c.SendDM(strings.TrimPrefix(msg, "dm:"))
+			continue
+		} else if strings.EqualFold(msg, "fingerprint") {
+			c.Fingerprint("")
+			continue
+		} else if strings.HasPrefix(msg, "fingerprint:") {
+			c.Fingerprint(strings.TrimSpace(strings.TrimPrefix(msg, "fingerprint:")))
+			continue
+		} else if strings.HasPrefix(msg, "verify:") {
+			c.Verify(strings.TrimPrefix(msg, "verify:"))
+			continue
 		} else if strings.HasPrefix(msg, "sendfile:") {
 			file := strings.TrimLeft(msg, "sendfile:")
 			file = strings.TrimSpace(file)
 			c.SendFile(file)
 			continue
+		} else if strings.EqualFold(msg, "transfers") {
+			c.ListTransfers()
+			continue
+		} else if strings.EqualFold(msg, "who") {
+			c.Who()
+			continue
+		} else if strings.EqualFold(msg, "channels") {
+			c.ListChannels()
+			continue
+		} else if strings.HasPrefix(msg, "subscribe:") {
+			c.Subscribe(strings.TrimSpace(strings.TrimPrefix(msg, "subscribe:")))
+			continue
+		} else if strings.HasPrefix(msg, "unsubscribe:") {
+			c.Unsubscribe(strings.TrimSpace(strings.TrimPrefix(msg, "unsubscribe:")))
+			continue
+		} else if strings.HasPrefix(msg, "mkchannel:") {
+			c.MakeChannel(strings.TrimSpace(strings.TrimPrefix(msg, "mkchannel:")))
+			continue
+		} else if strings.HasPrefix(msg, "rmchannel:") {
+			c.RemoveChannel(strings.TrimSpace(strings.TrimPrefix(msg, "rmchannel:")))
+			continue
+		} else if strings.EqualFold(msg, "files") {
+			c.ListFiles()
+			continue
+		} else if strings.HasPrefix(msg, "getfile:") {
+			file := strings.TrimPrefix(msg, "getfile:")
+			file = strings.TrimSpace(file)
+			c.GetFile(file)
+			continue
 		}
 
 		fmt.Println("Unsupported command, type \"help\" for more information.")
@@ -261,7 +467,8 @@ func (c *Client) checkInput() {
 }
 
 // The main loop takes charge for receiving messages from the server,
-// and sending messages to the server.
+// and sending messages to the server. The client should have joined the
+// chat before.
 func (c *Client) RunLoop() {
 	go c.checkInput()
 
@@ -278,14 +485,24 @@ loop:
 // Create a new client with connection to server.
 // NOTE Close the opened client when no longer used.
 func NewClient(username string) (client *Client, err error) {
+	return NewClientOn(UDP, ServiceAddress(), username)
+}
+
+// Creates a client connected to the hub at address over transport.
+func NewClientOn(transport Transport, address string, username string) (client *Client, err error) {
 	client = new(Client)
-	err = client.connect(ServiceHost, ServicePort)
+	client.input = bufio.NewReader(os.Stdin)
+	client.quitListener = make(chan bool)
+	client.closed = make(chan struct{})
+	client.username = username
+	client.replies = newQueuedLink(client.write, 16)
+	client.background = newQueuedLink(client.write, 16)
+	client.sendWindow = kDefaultSendWindow
+	client.transfers = make(map[uint64]*transfer)
+	client.shownDMs = make(map[string]bool)
+	err = client.connect(transport, address)
 	if err == nil {
-		client.input = bufio.NewReader(os.Stdin)
-		client.quitListener = make(chan bool)
-		client.username = username
-		client.recv = make([]byte, 4096)
-		client.fsender = nil
+		go client.receive()
 	}
 	return client, err
 }
@@ -2,29 +2,127 @@ package main
 
 import (
 	"bufio"
+	"flag"
 	"fmt"
 	"os"
+	"path/filepath"
 	"runtime"
 	"time"
 
 	"github.com/neverchanje/unplayground/udpchat"
+	"golang.org/x/term"
 )
 
+var (
+	window    = flag.Int("window", 32, "maximum number of file segments in flight")
+	cacheDir  = flag.String("cache-dir", "", "directory of the history cache and the identity key, under the user config directory by default")
+	noCache   = flag.Bool("no-cache", false, "do not cache the history")
+	register  = flag.Bool("register", false, "register an account with the username, instead of logging in")
+	knownHubs = flag.String("known-hubs", "", "file the keys of the hubs are pinned in, under the user config directory by default")
+	impair    = flag.String("impair", "", "impair the datagrams sent as a bad network, e.g. lossy or loss=0.05,delay=20ms, for testing")
+)
+
+// Reads the password without echoing it if stdin is a terminal.
+func readPassword(input *bufio.Reader) (string, error) {
+	if fd := int(os.Stdin.Fd()); term.IsTerminal(fd) {
+		password, err := term.ReadPassword(fd)
+		fmt.Println()
+		return string(password), err
+	}
+	password, _, err := input.ReadLine()
+	return string(password), err
+}
+
 func main() {
+	flag.Parse()
+	if len(*knownHubs) == 0 {
+		dir, err := udpchat.DefaultCacheDir()
+		if err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+		*knownHubs = filepath.Join(dir, "known_hubs")
+	}
+	transport := udpchat.UDP
+	if len(*impair) != 0 {
+		imp, err := udpchat.ParseImpairment(*impair)
+		if err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+		transport = udpchat.NewImpairedTransport(transport, imp)
+	}
 
 	fmt.Println("udpchat (" + time.Now().Format(time.UnixDate) + ")")
 	fmt.Println("[" + runtime.GOOS + " " + runtime.GOARCH + "]")
 	fmt.Println("Type \"help\" for more information.")
 
-	fmt.Print("\nPlease enter your username: ")
-	username, _, _ := bufio.NewReader(os.Stdin).ReadLine()
+	// asks again until the hub accepts the username and the password.
+	var client *udpchat.Client
+	var err error
+	input := bufio.NewReader(os.Stdin)
+	for client == nil {
+		fmt.Print("\nPlease enter your username: ")
+		username, _, rerr := input.ReadLine()
+		if rerr != nil {
+			fmt.Println(rerr)
+			os.Exit(1)
+		}
+		fmt.Print("Password: ")
+		password, rerr := readPassword(input)
+		if rerr != nil {
+			fmt.Println(rerr)
+			os.Exit(1)
+		}
 
-	client, err := udpchat.NewClient(string(username))
-	if err != nil {
+		if client, err = udpchat.NewClientOn(transport, udpchat.ServiceAddress(), string(username)); err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+		// the password is only sent to the hub whose key is pinned.
+		trusted, err := client.CheckHubKey(*knownHubs)
+		if err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+		if trusted {
+			fmt.Println("Trusting the key of the hub on first use, fingerprint " + client.HubFingerprint())
+		}
+		if *register {
+			err = client.Register(password)
+		} else {
+			err = client.Login(password)
+		}
+		if err == nil {
+			err = client.Join()
+		}
+		if err != nil {
+			fmt.Println(err)
+			client.Close()
+			client = nil
+		}
+	}
+	defer client.Close()
+
+	if err = client.SetSendWindow(*window); err != nil {
 		fmt.Println(err)
 		os.Exit(1)
 	}
-	defer client.Close()
+
+	if len(*cacheDir) == 0 {
+		if *cacheDir, err = udpchat.DefaultCacheDir(); err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+	}
+	if !*noCache {
+		if err = client.OpenHistoryCache(*cacheDir); err != nil {
+			fmt.Println("History is not cached: " + err.Error())
+		}
+	}
+	if err = client.OpenIdentity(*cacheDir); err != nil {
+		fmt.Println("Direct messages are disabled: " + err.Error())
+	}
 
 	fmt.Println("Successful launch!")
 	client.RunLoop()
@@ -1,10 +1,79 @@
 package udpchat
 
 import (
+	"bytes"
+	"os"
+	"path/filepath"
 	"testing"
+	"time"
 )
 
-func TestSend(t *testing.T) {
-	c, _ := NewClient("wutao")
-	c.SendFile("testfile.txt")
+// A client of the test hub, registered as name and in the chat.
+func newTestClient(t *testing.T, hub *Hub, name string) *Client {
+	t.Helper()
+	c, err := NewClientOn(hub.transport, hub.conn.LocalAddr().String(), name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(c.Close)
+	if err = c.Register(kTestPassword); err != nil {
+		t.Fatal(err)
+	}
+	if err = c.Join(); err != nil {
+		t.Fatal(err)
+	}
+	return c
+}
+
+// Waits for the last transfer started by c to finish, and returns its error.
+func waitTransfer(t *testing.T, c *Client, timeout time.Duration) error {
+	t.Helper()
+	c.mu.Lock()
+	tr := c.allTransfers[len(c.allTransfers)-1]
+	c.mu.Unlock()
+	deadline := time.Now().Add(timeout)
+	for {
+		tr.mu.Lock()
+		finished, err := !tr.finished.IsZero(), tr.err
+		tr.mu.Unlock()
+		if finished {
+			return err
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("transfer of %s not finished after %v", tr.fname, timeout)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestSendFile(t *testing.T) {
+	testFileTransfer(t, newTestHub(t))
+}
+
+// alice uploads a file, that bob downloads.
+func testFileTransfer(t *testing.T, hub *Hub) {
+	alice := newTestClient(t, hub, "alice")
+	bob := newTestClient(t, hub, "bob")
+
+	content := bytes.Repeat([]byte("0123456789abcdef"), 10000)
+	file := filepath.Join(t.TempDir(), "notes.txt")
+	if err := os.WriteFile(file, content, 0644); err != nil {
+		t.Fatal(err)
+	}
+	alice.SendFile(file)
+	if err := waitTransfer(t, alice, 20*time.Second); err != nil {
+		t.Fatal(err)
+	}
+	if stored, err := os.ReadFile(filepath.Join(hub.uploadDir, "alice", "notes.txt")); err != nil || !bytes.Equal(stored, content) {
+		t.Fatalf("stored %d bytes, %v", len(stored), err)
+	}
+
+	t.Chdir(t.TempDir())
+	bob.GetFile("alice/notes.txt")
+	if err := waitTransfer(t, bob, 20*time.Second); err != nil {
+		t.Fatal(err)
+	}
+	if got, err := os.ReadFile("notes.txt"); err != nil || !bytes.Equal(got, content) {
+		t.Fatalf("downloaded %d bytes, %v", len(got), err)
+	}
 }
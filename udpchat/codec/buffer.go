@@ -0,0 +1,163 @@
+package codec
+
+import (
+	"encoding/binary"
+	"math"
+)
+
+// Appends the fields of a body.
+type writer struct {
+	buf []byte
+}
+
+func (w *writer) uint8(v uint8) {
+	w.buf = append(w.buf, v)
+}
+
+func (w *writer) uint16(v uint16) {
+	w.buf = binary.LittleEndian.AppendUint16(w.buf, v)
+}
+
+func (w *writer) uint32(v uint32) {
+	w.buf = binary.LittleEndian.AppendUint32(w.buf, v)
+}
+
+func (w *writer) uint64(v uint64) {
+	w.buf = binary.LittleEndian.AppendUint64(w.buf, v)
+}
+
+func (w *writer) bool(v bool) {
+	if v {
+		w.uint8(1)
+	} else {
+		w.uint8(0)
+	}
+}
+
+// Appends b as is, for the fields of a fixed size and the last field.
+func (w *writer) bytes(b []byte) {
+	w.buf = append(w.buf, b...)
+}
+
+// Appends s preceded by its length in a byte, s is truncated to 255 bytes.
+func (w *writer) string8(s string) {
+	if len(s) > math.MaxUint8 {
+		s = s[:math.MaxUint8]
+	}
+	w.uint8(uint8(len(s)))
+	w.buf = append(w.buf, s...)
+}
+
+// Appends the strings preceded by their count, each preceded by its length
+// in two bytes.
+func (w *writer) strings16(list []string) {
+	w.uint16(uint16(len(list)))
+	for _, s := range list {
+		if len(s) > math.MaxUint16 {
+			s = s[:math.MaxUint16]
+		}
+		w.uint16(uint16(len(s)))
+		w.buf = append(w.buf, s...)
+	}
+}
+
+// Consumes the fields of a body. The first field missing sets err, after
+// which every field reads as zero.
+type reader struct {
+	buf []byte
+	err error
+}
+
+// Consumes the next n bytes, nil if there are less.
+func (r *reader) next(n int) []byte {
+	if r.err != nil {
+		return nil
+	}
+	if len(r.buf) < n {
+		r.err = ErrTruncated
+		r.buf = nil
+		return nil
+	}
+	b := r.buf[:n]
+	r.buf = r.buf[n:]
+	return b
+}
+
+func (r *reader) uint8() uint8 {
+	if b := r.next(1); b != nil {
+		return b[0]
+	}
+	return 0
+}
+
+func (r *reader) uint16() uint16 {
+	if b := r.next(2); b != nil {
+		return binary.LittleEndian.Uint16(b)
+	}
+	return 0
+}
+
+func (r *reader) uint32() uint32 {
+	if b := r.next(4); b != nil {
+		return binary.LittleEndian.Uint32(b)
+	}
+	return 0
+}
+
+func (r *reader) uint64() uint64 {
+	if b := r.next(8); b != nil {
+		return binary.LittleEndian.Uint64(b)
+	}
+	return 0
+}
+
+func (r *reader) bool() bool {
+	return r.uint8() != 0
+}
+
+// Copies the next len(b) bytes into b.
+func (r *reader) fixed(b []byte) {
+	copy(b, r.next(len(b)))
+}
+
+// Copies the rest of the body.
+func (r *reader) rest() []byte {
+	b := r.next(len(r.buf))
+	if len(b) == 0 {
+		return nil
+	}
+	return append([]byte(nil), b...)
+}
+
+func (r *reader) restString() string {
+	return string(r.next(len(r.buf)))
+}
+
+func (r *reader) string8() string {
+	return string(r.next(int(r.uint8())))
+}
+
+func (r *reader) strings16() []string {
+	n := int(r.uint16())
+	var list []string
+	for i := 0; i < n && r.err == nil; i++ {
+		s := r.next(int(r.uint16()))
+		if r.err == nil {
+			list = append(list, string(s))
+		}
+	}
+	return list
+}
+
+func (r *reader) empty() bool {
+	return len(r.buf) == 0
+}
+
+// The error of the body, which is fully consumed unless it has trailing
+// bytes.
+func (r *reader) finish() error {
+	if r.err == nil && len(r.buf) != 0 {
+		r.err = ErrTrailing
+	}
+	return r.err
+}
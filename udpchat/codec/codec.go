@@ -0,0 +1,232 @@
+// Package codec encodes the messages exchanged by the clients and the hub
+// of udpchat, and frames them with a versioned header.
+//
+// A packet is the type of a message followed by its body, whose fields are
+// little-endian and laid out as documented on each message:
+//
+//	MSG_ID BODY
+//
+// On the wire, a packet is framed with a header telling the version of the
+// protocol it follows:
+//
+//	MAGIC VERSION FLAGS MSG_ID LENGTH BODY
+//
+// MAGIC is "uc", VERSION is the version the client and the hub negotiated in
+// their handshake (see Negotiate), FLAGS has FlagResponse set for the
+// responses of the hub, MSG_ID is the RequestType or the ResponseType of the
+// message, and LENGTH the length of BODY in two bytes. The session token of a
+// request, if any, is the first field of BODY.
+//
+// Version1 is the protocol of the releases before the header: a frame is the
+// bare packet, the lists of kRespFileList, kRespChannelList and kRespWho are
+// joined by "; ", without NEXT as they weren't paged, and kReqMakeChannel and
+// kReqRemoveChannel come without REQ_ID. Framer translates the packets of the
+// peers that only speak Version1, so that the rest of udpchat only deals with
+// the packets of the current version.
+package codec
+
+import (
+	"encoding/binary"
+	"errors"
+	"strconv"
+)
+
+const (
+	Version1 uint8 = 1
+	Version2 uint8 = 2
+
+	// The header of Version2 and later.
+	HeaderSize = 7
+
+	// Maximum length of BODY.
+	MaxBodySize = 1<<16 - 1
+)
+
+// The versions this release speaks.
+var Supported = Versions{Min: Version1, Max: Version2}
+
+var magic = [2]byte{'u', 'c'}
+
+type Flags uint8
+
+const (
+	// Set on the responses of the hub, the other flags are reserved.
+	FlagResponse Flags = 1 << 0
+)
+
+var (
+	ErrEmpty       = errors.New("Empty packet")
+	ErrTruncated   = errors.New("Truncated packet")
+	ErrTrailing    = errors.New("Trailing bytes in packet")
+	ErrUnknownType = errors.New("Unknown message type")
+	ErrType        = errors.New("Unexpected message type")
+	ErrMagic       = errors.New("Bad magic")
+	ErrVersion     = errors.New("Unexpected protocol version")
+	ErrFlags       = errors.New("Unexpected flags")
+	ErrLength      = errors.New("Length mismatch")
+	ErrTooLong     = errors.New("Body too long")
+)
+
+// Frames the packets sent by one side of a connection, and unframes the
+// packets it receives.
+type Framer struct {
+	Version uint8
+
+	// whether this side sends the responses, that's the hub.
+	Response bool
+}
+
+// Frames packet, which follows the current version.
+func (f Framer) Encode(packet []byte) ([]byte, error) {
+	if len(packet) == 0 {
+		return nil, ErrEmpty
+	}
+	if len(packet)-1 > MaxBodySize {
+		return nil, ErrTooLong
+	}
+	if f.Version == Version1 {
+		return downgrade(packet, f.Response)
+	}
+
+	var flags Flags
+	if f.Response {
+		flags |= FlagResponse
+	}
+	frame := make([]byte, HeaderSize, HeaderSize+len(packet)-1)
+	copy(frame, magic[:])
+	frame[2] = f.Version
+	frame[3] = byte(flags)
+	frame[4] = packet[0]
+	binary.LittleEndian.PutUint16(frame[5:7], uint16(len(packet)-1))
+	return append(frame, packet[1:]...), nil
+}
+
+// Returns the packet of frame, following the current version. Frames of
+// another version than the negotiated one, or sent the same way as this side
+// sends, are rejected.
+func (f Framer) Decode(frame []byte) ([]byte, error) {
+	if f.Version == Version1 {
+		if len(frame) == 0 {
+			return nil, ErrEmpty
+		}
+		return upgrade(frame, !f.Response)
+	}
+
+	if len(frame) < HeaderSize {
+		return nil, ErrTruncated
+	}
+	if frame[0] != magic[0] || frame[1] != magic[1] {
+		return nil, ErrMagic
+	}
+	if frame[2] != f.Version {
+		return nil, ErrVersion
+	}
+	want := FlagResponse
+	if f.Response {
+		want = 0
+	}
+	if Flags(frame[3]) != want {
+		return nil, ErrFlags
+	}
+	if int(binary.LittleEndian.Uint16(frame[5:7])) != len(frame)-HeaderSize {
+		return nil, ErrLength
+	}
+	packet := make([]byte, 1, len(frame)-HeaderSize+1)
+	packet[0] = frame[4]
+	return append(packet, frame[HeaderSize:]...), nil
+}
+
+// A range of versions a peer speaks, sent in the handshake:
+//
+//	MIN MAX
+//
+// A peer of Version1 sends nothing.
+type Versions struct {
+	Min uint8
+	Max uint8
+}
+
+func (v Versions) Encode() []byte {
+	return []byte{v.Min, v.Max}
+}
+
+func (v Versions) toString() string {
+	return strconv.Itoa(int(v.Min)) + " to " + strconv.Itoa(int(v.Max))
+}
+
+func DecodeVersions(payload []byte) (Versions, error) {
+	switch {
+	case len(payload) == 0:
+		return Versions{Version1, Version1}, nil
+	case len(payload) != 2:
+		return Versions{}, ErrLength
+	case payload[0] == 0 || payload[0] > payload[1]:
+		return Versions{}, ErrVersion
+	}
+	return Versions{payload[0], payload[1]}, nil
+}
+
+// The error of peers without a version in common.
+type VersionError struct {
+	Local  Versions
+	Remote Versions
+}
+
+func (e *VersionError) Error() string {
+	return "No protocol version in common, versions " + e.Local.toString() +
+		" are spoken here and versions " + e.Remote.toString() + " by the peer"
+}
+
+func (e *VersionError) Is(target error) bool {
+	return target == ErrVersion
+}
+
+// Returns the highest version spoken by both peers.
+func Negotiate(local Versions, remote Versions) (uint8, error) {
+	low, high := local.Min, local.Max
+	if remote.Min > low {
+		low = remote.Min
+	}
+	if remote.Max < high {
+		high = remote.Max
+	}
+	if low > high {
+		return 0, &VersionError{local, remote}
+	}
+	return high, nil
+}
+
+// The answer of the hub to the versions of the client, either the version
+// chosen, or 0 followed by the versions of the hub if none is in common:
+//
+//	VERSION
+//	0 MIN MAX
+//
+// A hub of Version1 answers nothing.
+func EncodeChoice(version uint8, local Versions) []byte {
+	if version == 0 {
+		return append([]byte{0}, local.Encode()...)
+	}
+	return []byte{version}
+}
+
+// Returns the version the hub chose among the local ones.
+func DecodeChoice(payload []byte, local Versions) (uint8, error) {
+	if len(payload) == 0 {
+		payload = []byte{Version1}
+	}
+	if payload[0] == 0 {
+		remote, err := DecodeVersions(payload[1:])
+		if err != nil {
+			return 0, err
+		}
+		return 0, &VersionError{local, remote}
+	}
+	if len(payload) != 1 {
+		return 0, ErrLength
+	}
+	if payload[0] < local.Min || payload[0] > local.Max {
+		return 0, &VersionError{local, Versions{payload[0], payload[0]}}
+	}
+	return payload[0], nil
+}
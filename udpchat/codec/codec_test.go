@@ -0,0 +1,316 @@
+package codec
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+)
+
+func TestRoundTrip(t *testing.T) {
+	syn := FileSyn{PacketID: 7, SegSize: 1024, Window: 64, TotalSize: 123456, User: "alice", Filename: "a b.txt"}
+	seg := Segment{PacketID: 7, SegID: 3, Checksum: 0xdeadbeef, Content: []byte("content")}
+	ack := SegAck{PacketID: 7, CumAck: 3, Ranges: []Range{{5, 6}, {8, 10}}}
+	var key [KeySize]byte
+	key[0], key[KeySize-1] = 1, 2
+	var nonce [NonceSize]byte
+	nonce[3] = 4
+	var token [TokenSize]byte
+	token[5] = 6
+	var digest [DigestSize]byte
+	digest[7] = 8
+
+	requests := []Message{
+		&SendChatMsg{Channel: 2, Message: "hello"},
+		&GetHistory{QueryID: 1, Limit: 20, Before: 3, After: 4, Channel: 5, Sender: "bob"},
+		&SendFile{FileSyn: syn},
+		&SendSeg{Segment: seg},
+		&SendFileAck{PacketID: 7},
+		&SendFileFin{PacketID: 7, Flag: 1, Digest: digest[:]},
+		&GetFile{FileSyn: syn},
+		&GetFileAck{PacketID: 7, ResumeFrom: 2},
+		&FileSegAck{SegAck: ack},
+		&FileFinAck{PacketID: 7, Status: 1},
+		&ListFiles{},
+		&ListFiles{listPage: listPage{From: 3}},
+		&Join{},
+		&Leave{},
+		&ListChannels{},
+		&Subscribe{Channel: 2},
+		&Unsubscribe{Channel: 2},
+		&MakeChannel{ReqID: 7, Name: "ops"},
+		&RemoveChannel{ReqID: 8, Channel: 2},
+		&Search{QueryID: 1, Limit: 20, Since: 3, Until: 4, Channel: 5, Terms: "msg 7"},
+		&Login{Register: true, LoginID: 1, Username: "alice", Password: "secret"},
+		&Login{LoginID: 1, Username: "alice", Password: "secret"},
+		&PublishKey{Key: key},
+		&GetKey{Username: "bob"},
+		&SendDM{DMID: 1, To: "bob", Key: key, Nonce: nonce, Box: []byte("box")},
+		&GetDMs{},
+		&DMAck{MsgID: 9},
+		&Ping{},
+		&Who{},
+		&Who{listPage: listPage{From: 3}},
+		&ListSubscribed{listPage: listPage{From: 3}},
+	}
+	responses := []Message{
+		&SendFileOK{PacketID: 7, SegSize: 1024, Window: 64, SegCount: 121, ResumeFrom: 2},
+		&SendFileFailed{PacketID: 7},
+		&RecvSegAck{SegAck: ack},
+		&SendFileFinAck{PacketID: 7, Status: 1},
+		&GetFileOK{FileSyn: syn},
+		&GetFileFailed{PacketID: 7},
+		&FileSeg{Segment: seg},
+		&FileFin{PacketID: 7, Digest: digest},
+		&FileList{Files: []string{"a.txt (3 bytes)", "b.txt (4 bytes)"}},
+		&FileList{Files: []string{"c.txt (5 bytes)"}, Next: 3},
+		&JoinOK{},
+		&ChatMsg{Text: "alice: hello"},
+		&ChannelList{Channels: []string{"1/general", "2/ops"}},
+		&ChannelOK{Channel: 2, Name: "ops"},
+		&ChannelFailed{Reason: "No such channel"},
+		&History{QueryID: 1, Part: 1, Parts: 2, More: true, Records: []byte("records")},
+		&LoginOK{Token: token},
+		&LoginFailed{Reason: "Wrong username or password"},
+		&Unauthenticated{Reason: "Session expired"},
+		&KeyPublished{Key: key},
+		&UserKey{Username: "bob", Key: key[:]},
+		&UserKey{Username: "bob"},
+		&DMSent{DMID: 1},
+		&DMFailed{DMID: 1, Reason: "No such user"},
+		&DMCount{Count: 3},
+		&DM{MsgID: 9, Time: 10, From: "alice", DMID: 1, Key: key, Nonce: nonce, Box: []byte("box")},
+		&Pong{},
+		&WhoList{Users: []string{"alice", "bob"}},
+		&RequestFailed{Request: uint8(ReqSubscribe), Code: CodeMalformed, Reason: "Truncated packet"},
+	}
+
+	for _, m := range requests {
+		got, err := DecodeRequest(Marshal(m))
+		if err != nil || !reflect.DeepEqual(got, m) {
+			t.Errorf("request %T decoded as %+v, %v", m, got, err)
+		}
+	}
+	for _, m := range responses {
+		got, err := DecodeResponse(Marshal(m))
+		if err != nil || !reflect.DeepEqual(got, m) {
+			t.Errorf("response %T decoded as %+v, %v", m, got, err)
+		}
+	}
+
+	for typ := 1; typ <= int(ReqListSubscribed); typ++ {
+		if m := NewRequest(RequestType(typ)); m == nil || int(m.ID()) != typ || m.IsResponse() {
+			t.Errorf("request type %d makes %T", typ, m)
+		}
+	}
+	for typ := int(RespSendFileOK); typ <= int(RespRequestFailed); typ++ {
+		if m := NewResponse(ResponseType(typ)); m == nil || int(m.ID()) != typ || !m.IsResponse() {
+			t.Errorf("response type %d makes %T", typ, m)
+		}
+	}
+}
+
+func TestMalformedMessages(t *testing.T) {
+	cases := []struct {
+		packet []byte
+		err    error
+	}{
+		{nil, ErrEmpty},
+		{[]byte{0}, ErrUnknownType},
+		{[]byte{99}, ErrUnknownType},
+		{Marshal(&SendFileAck{PacketID: 7})[:5], ErrTruncated},
+		{append(Marshal(&SendFileAck{PacketID: 7}), 0), ErrTrailing},
+		{append(Marshal(&Ping{}), 0), ErrTrailing},
+		{Marshal(&SendDM{DMID: 1, To: "bob"})[:20], ErrTruncated},
+		{append(Marshal(&SendFileFin{PacketID: 7}), 1, 2), ErrTruncated},
+		{[]byte{byte(ReqSendChatMsg), 1, 2}, ErrTruncated},
+	}
+	for _, c := range cases {
+		if _, err := DecodeRequest(c.packet); err != c.err {
+			t.Errorf("request %v failed with %v, want %v", c.packet, err, c.err)
+		}
+	}
+
+	list := Marshal(&WhoList{Users: []string{"alice", "bob"}})
+	if _, err := DecodeResponse(list[:len(list)-1]); err != ErrTruncated {
+		t.Errorf("truncated list failed with %v", err)
+	}
+	if err := Unmarshal(Marshal(&Ping{}), &Who{}); err != ErrType {
+		t.Errorf("ping decoded as who with %v", err)
+	}
+	if err := Unmarshal(Marshal(&Login{Register: true}), &Login{}); err != ErrType {
+		t.Errorf("register decoded as login with %v", err)
+	}
+
+	// A bare query is the zero query.
+	var query GetHistory
+	if err := Unmarshal([]byte{byte(ReqGetHistory)}, &query); err != nil || query != (GetHistory{}) {
+		t.Errorf("bare query decoded as %+v, %v", query, err)
+	}
+}
+
+func TestFramer(t *testing.T) {
+	client := Framer{Version: Version2}
+	hub := Framer{Version: Version2, Response: true}
+
+	req := Marshal(&SendChatMsg{Channel: 2, Message: "hello"})
+	frame, err := client.Encode(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(frame[:2]) != "uc" || frame[2] != Version2 || Flags(frame[3]) != 0 ||
+		frame[4] != byte(ReqSendChatMsg) || len(frame) != HeaderSize+len(req)-1 {
+		t.Fatalf("framed as %v", frame)
+	}
+	if packet, err := hub.Decode(frame); err != nil || string(packet) != string(req) {
+		t.Fatalf("unframed as %v, %v", packet, err)
+	}
+
+	resp := Marshal(&Pong{})
+	frame, _ = hub.Encode(resp)
+	if Flags(frame[3]) != FlagResponse {
+		t.Fatalf("response flags %d", frame[3])
+	}
+	if packet, err := client.Decode(frame); err != nil || string(packet) != string(resp) {
+		t.Fatalf("unframed as %v, %v", packet, err)
+	}
+	// Neither side takes back what it sends.
+	if _, err := hub.Decode(frame); err != ErrFlags {
+		t.Fatalf("hub took a response with %v", err)
+	}
+
+	good, _ := client.Encode(req)
+	corrupt := func(f func(frame []byte) []byte) []byte {
+		return f(append([]byte(nil), good...))
+	}
+	cases := []struct {
+		name  string
+		frame []byte
+		err   error
+	}{
+		{"magic", corrupt(func(f []byte) []byte { f[0] = 'x'; return f }), ErrMagic},
+		{"version", corrupt(func(f []byte) []byte { f[2] = 3; return f }), ErrVersion},
+		{"flags", corrupt(func(f []byte) []byte { f[3] = 2; return f }), ErrFlags},
+		{"length", corrupt(func(f []byte) []byte { f[5]++; return f }), ErrLength},
+		{"trailing", corrupt(func(f []byte) []byte { return append(f, 0) }), ErrLength},
+		{"truncated", good[:HeaderSize-1], ErrTruncated},
+		{"empty", nil, ErrTruncated},
+	}
+	for _, c := range cases {
+		if _, err := hub.Decode(c.frame); err != c.err {
+			t.Errorf("%s: failed with %v, want %v", c.name, err, c.err)
+		}
+	}
+
+	if _, err := client.Encode(nil); err != ErrEmpty {
+		t.Errorf("empty packet framed with %v", err)
+	}
+	if _, err := client.Encode(make([]byte, MaxBodySize+2)); err != ErrTooLong {
+		t.Errorf("long packet framed with %v", err)
+	}
+}
+
+func TestLegacyFramer(t *testing.T) {
+	client := Framer{Version: Version1}
+	hub := Framer{Version: Version1, Response: true}
+
+	// Everything but the lists goes as is.
+	req := Marshal(&SendChatMsg{Channel: 2, Message: "hello"})
+	if frame, err := client.Encode(req); err != nil || string(frame) != string(req) {
+		t.Fatalf("framed as %v, %v", frame, err)
+	}
+	if packet, err := hub.Decode(req); err != nil || string(packet) != string(req) {
+		t.Fatalf("unframed as %v, %v", packet, err)
+	}
+
+	who := Marshal(&WhoList{Users: []string{"alice", "bob"}})
+	frame, err := hub.Encode(who)
+	if err != nil || string(frame) != string(byte(RespWho))+"alice; bob" {
+		t.Fatalf("who framed as %q, %v", frame, err)
+	}
+	if packet, err := client.Decode(frame); err != nil || string(packet) != string(who) {
+		t.Fatalf("who unframed as %v, %v", packet, err)
+	}
+
+	// An empty list is an empty body.
+	files := Marshal(&FileList{})
+	frame, _ = hub.Encode(files)
+	if len(frame) != 1 {
+		t.Fatalf("empty list framed as %q", frame)
+	}
+	if packet, err := client.Decode(frame); err != nil || string(packet) != string(files) {
+		t.Fatalf("empty list unframed as %v, %v", packet, err)
+	}
+
+	// The channel requests of Version1 have no REQ_ID after the token.
+	token := string(make([]byte, TokenSize))
+	legacy := string(byte(ReqRemoveChannel)) + token + "\x02\x00\x00\x00"
+	rm := Marshal(&RemoveChannel{Channel: 2})
+	rm = append(rm[:1:1], append([]byte(token), rm[1:]...)...)
+	if packet, err := hub.Decode([]byte(legacy)); err != nil || string(packet) != string(rm) {
+		t.Fatalf("remove channel unframed as %v, %v", packet, err)
+	}
+	if frame, err := client.Encode(rm); err != nil || string(frame) != legacy {
+		t.Fatalf("remove channel framed as %v, %v", frame, err)
+	}
+	if _, err := hub.Decode([]byte{byte(ReqMakeChannel), 1}); err != ErrTruncated {
+		t.Fatalf("truncated channel request unframed with %v", err)
+	}
+
+	// The requests of the same type are not lists.
+	if packet, err := hub.Decode([]byte{byte(ReqWho)}); err != nil || len(packet) != 1 {
+		t.Fatalf("who request unframed as %v, %v", packet, err)
+	}
+	if _, err := client.Decode(nil); err != ErrEmpty {
+		t.Fatalf("empty frame unframed with %v", err)
+	}
+}
+
+func TestNegotiate(t *testing.T) {
+	v12 := Versions{Version1, Version2}
+	cases := []struct {
+		local, remote Versions
+		version       uint8
+	}{
+		{v12, v12, Version2},
+		{v12, Versions{Version1, Version1}, Version1},
+		{Versions{Version1, Version1}, v12, Version1},
+		{v12, Versions{Version2, 5}, Version2},
+		{Versions{Version2, Version2}, Versions{Version1, Version1}, 0},
+		{v12, Versions{3, 4}, 0},
+	}
+	for _, c := range cases {
+		version, err := Negotiate(c.local, c.remote)
+		if version != c.version || (version == 0) != errors.Is(err, ErrVersion) {
+			t.Errorf("%v and %v negotiated %d, %v", c.local, c.remote, version, err)
+		}
+
+		// As the hub answers in the handshake.
+		choice, err := DecodeChoice(EncodeChoice(version, c.local), c.remote)
+		if choice != c.version || (choice == 0) != errors.Is(err, ErrVersion) {
+			t.Errorf("%v and %v chose %d, %v", c.local, c.remote, choice, err)
+		}
+	}
+
+	if v, err := DecodeVersions(v12.Encode()); v != v12 || err != nil {
+		t.Errorf("versions decoded as %v, %v", v, err)
+	}
+	if v, err := DecodeVersions(nil); v != (Versions{Version1, Version1}) || err != nil {
+		t.Errorf("legacy versions decoded as %v, %v", v, err)
+	}
+	for _, payload := range [][]byte{{1}, {1, 2, 3}, {0, 2}, {2, 1}} {
+		if _, err := DecodeVersions(payload); err == nil {
+			t.Errorf("versions %v decoded", payload)
+		}
+	}
+
+	// A hub of Version1 answers nothing.
+	if v, err := DecodeChoice(nil, v12); v != Version1 || err != nil {
+		t.Errorf("legacy hub chose %d, %v", v, err)
+	}
+	if _, err := DecodeChoice(nil, Versions{Version2, Version2}); !errors.Is(err, ErrVersion) {
+		t.Errorf("legacy hub chosen with %v", err)
+	}
+	if _, err := DecodeChoice([]byte{Version2, 0}, v12); err != ErrLength {
+		t.Errorf("long choice decoded with %v", err)
+	}
+}
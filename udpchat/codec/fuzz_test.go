@@ -0,0 +1,112 @@
+package codec
+
+import (
+	"bytes"
+	"reflect"
+	"testing"
+)
+
+// The seeds run with the other tests, run "go test -fuzz <target>" to fuzz
+// one of them.
+
+func FuzzDecodeRequest(f *testing.F) {
+	f.Add(Marshal(&SendChatMsg{Channel: 2, Message: "hello"}))
+	f.Add(Marshal(&SendFile{FileSyn: FileSyn{PacketID: 7, SegSize: 1024, Window: 64, User: "alice", Filename: "a.txt"}}))
+	f.Add(Marshal(&FileSegAck{SegAck: SegAck{PacketID: 7, Ranges: []Range{{5, 6}}}}))
+	f.Add(Marshal(&SendFileFin{PacketID: 7, Flag: 1, Digest: make([]byte, DigestSize)}))
+	f.Add(Marshal(&SendDM{DMID: 1, To: "bob", Box: []byte("box")}))
+	f.Add(Marshal(&Login{Register: true, Username: "alice", Password: "secret"}))
+	f.Add([]byte{byte(ReqGetHistory)})
+	f.Add([]byte{})
+
+	f.Fuzz(func(t *testing.T, packet []byte) {
+		m, err := DecodeRequest(packet)
+		if err != nil {
+			return
+		}
+		again, err := DecodeRequest(Marshal(m))
+		if err != nil || !reflect.DeepEqual(again, m) {
+			t.Fatalf("request %+v decoded again as %+v, %v", m, again, err)
+		}
+	})
+}
+
+func FuzzDecodeResponse(f *testing.F) {
+	f.Add(Marshal(&GetFileOK{FileSyn: FileSyn{PacketID: 7, SegSize: 1024, Window: 64, User: "alice", Filename: "a.txt"}}))
+	f.Add(Marshal(&RecvSegAck{SegAck: SegAck{PacketID: 7, Ranges: []Range{{5, 6}}}}))
+	f.Add(Marshal(&History{Parts: 1, Records: []byte("records")}))
+	f.Add(Marshal(&WhoList{Users: []string{"alice", "bob"}}))
+	f.Add(Marshal(&UserKey{Username: "bob", Key: make([]byte, KeySize)}))
+	f.Add(Marshal(&DM{From: "alice", Box: []byte("box")}))
+	f.Add(Marshal(&RequestFailed{Request: uint8(ReqPing), Code: CodeMalformed, Reason: "Truncated packet"}))
+	f.Add([]byte{})
+
+	f.Fuzz(func(t *testing.T, packet []byte) {
+		m, err := DecodeResponse(packet)
+		if err != nil {
+			return
+		}
+		again, err := DecodeResponse(Marshal(m))
+		if err != nil || !reflect.DeepEqual(again, m) {
+			t.Fatalf("response %+v decoded again as %+v, %v", m, again, err)
+		}
+	})
+}
+
+func FuzzFramerDecode(f *testing.F) {
+	req := Marshal(&SendChatMsg{Channel: 2, Message: "hello"})
+	frame, _ := Framer{Version: Version2}.Encode(req)
+	f.Add(frame, Version2, true)
+	resp := Marshal(&ChannelList{Channels: []string{"1/general"}})
+	frame, _ = Framer{Version: Version2, Response: true}.Encode(resp)
+	f.Add(frame, Version2, false)
+	f.Add([]byte{byte(RespWho), 'a', ';', ' ', 'b'}, Version1, false)
+	f.Add([]byte{}, Version1, true)
+
+	f.Fuzz(func(t *testing.T, frame []byte, version uint8, response bool) {
+		if version != Version1 {
+			version = Version2
+		}
+		framer := Framer{Version: version, Response: response}
+		packet, err := framer.Decode(frame)
+		if err != nil {
+			return
+		}
+		// what is taken in is what the peer sends.
+		peer := Framer{Version: version, Response: !response}
+		if version == Version2 {
+			if again, err := peer.Encode(packet); err != nil || !bytes.Equal(again, frame) {
+				t.Fatalf("frame %v encoded again as %v, %v", frame, again, err)
+			}
+		} else if legacyReqID(packet, !response) {
+			if again, err := peer.Encode(packet); err != nil || !bytes.Equal(again, frame) {
+				t.Fatalf("frame %v encoded again as %v, %v", frame, again, err)
+			}
+		} else if _, m := legacyList(packet, !response); m != nil {
+			// the lists of Version1 are upgraded to well-formed ones.
+			if err := Unmarshal(packet, m); err != nil {
+				t.Fatalf("upgraded %q to a malformed list, %v", frame, err)
+			}
+		}
+	})
+}
+
+func FuzzNegotiation(f *testing.F) {
+	f.Add([]byte{Version1, Version2})
+	f.Add(EncodeChoice(0, Supported))
+	f.Add([]byte{Version2})
+	f.Add([]byte{})
+
+	f.Fuzz(func(t *testing.T, payload []byte) {
+		if remote, err := DecodeVersions(payload); err == nil {
+			if version, err := Negotiate(Supported, remote); err == nil &&
+				(version < remote.Min || version > remote.Max || version < Supported.Min || version > Supported.Max) {
+				t.Fatalf("negotiated %d with %v", version, remote)
+			}
+		}
+		if version, err := DecodeChoice(payload, Supported); err == nil &&
+			(version < Supported.Min || version > Supported.Max) {
+			t.Fatalf("chose %d of %v", version, payload)
+		}
+	})
+}
@@ -0,0 +1,346 @@
+package codec
+
+import (
+	"strings"
+)
+
+type RequestType uint8
+
+const (
+	ReqSendChatMsg    RequestType = 1
+	ReqGetHistory     RequestType = 2
+	ReqSendFile       RequestType = 3
+	ReqSendSeg        RequestType = 4
+	ReqSendFileAck    RequestType = 5
+	ReqSendFileFin    RequestType = 6
+	ReqGetFile        RequestType = 7
+	ReqGetFileAck     RequestType = 8
+	ReqFileSegAck     RequestType = 9
+	ReqFileFinAck     RequestType = 10
+	ReqListFiles      RequestType = 11
+	ReqJoin           RequestType = 12
+	ReqLeave          RequestType = 13
+	ReqListChannels   RequestType = 14
+	ReqSubscribe      RequestType = 15
+	ReqUnsubscribe    RequestType = 16
+	ReqMakeChannel    RequestType = 17
+	ReqRemoveChannel  RequestType = 18
+	ReqSearch         RequestType = 19
+	ReqRegister       RequestType = 20
+	ReqLogin          RequestType = 21
+	ReqPublishKey     RequestType = 22
+	ReqGetKey         RequestType = 23
+	ReqSendDM         RequestType = 24
+	ReqGetDMs         RequestType = 25
+	ReqDMAck          RequestType = 26
+	ReqPing           RequestType = 27
+	ReqWho            RequestType = 28
+	ReqListSubscribed RequestType = 29
+)
+
+type ResponseType uint8
+
+const (
+	RespSendFileOK      ResponseType = 3
+	RespSendFileFailed  ResponseType = 4
+	RespRecvSegAck      ResponseType = 5
+	RespSendFileFinAck  ResponseType = 6
+	RespGetFileOK       ResponseType = 7
+	RespGetFileFailed   ResponseType = 8
+	RespFileSeg         ResponseType = 9
+	RespFileFin         ResponseType = 10
+	RespFileList        ResponseType = 11
+	RespJoinOK          ResponseType = 12
+	RespChatMsg         ResponseType = 13
+	RespChannelList     ResponseType = 14
+	RespChannelOK       ResponseType = 15
+	RespChannelFailed   ResponseType = 16
+	RespHistory         ResponseType = 17
+	RespLoginOK         ResponseType = 18
+	RespLoginFailed     ResponseType = 19
+	RespUnauthenticated ResponseType = 20
+	RespKeyPublished    ResponseType = 21
+	RespUserKey         ResponseType = 22
+	RespDMSent          ResponseType = 23
+	RespDMFailed        ResponseType = 24
+	RespDMCount         ResponseType = 25
+	RespDM              ResponseType = 26
+	RespPong            ResponseType = 27
+	RespWho             ResponseType = 28
+	RespRequestFailed   ResponseType = 29
+)
+
+// Sizes of the fixed-size fields.
+const (
+	TokenSize  = 16 // of a session
+	KeySize    = 32 // of an X25519 key
+	NonceSize  = 24 // of NaCl box
+	DigestSize = 32 // SHA-256
+)
+
+// A request or a response.
+type Message interface {
+	// The RequestType or the ResponseType.
+	ID() uint8
+	IsResponse() bool
+
+	encode(w *writer)
+	decode(r *reader)
+}
+
+// The messages of a file transfer, which carry its PACKET_ID.
+type TransferMessage interface {
+	Message
+	Transfer() uint64
+}
+
+// Requests are embedded in the messages of every RequestType.
+type request struct{}
+
+func (request) IsResponse() bool { return false }
+
+type response struct{}
+
+func (response) IsResponse() bool { return true }
+
+// Encodes m as a packet.
+func Marshal(m Message) []byte {
+	w := &writer{buf: []byte{m.ID()}}
+	m.encode(w)
+	return w.buf
+}
+
+// Decodes packet into m, which must be a packet of the type of m without
+// anything left over.
+func Unmarshal(packet []byte, m Message) error {
+	if len(packet) == 0 {
+		return ErrEmpty
+	}
+	if packet[0] != m.ID() {
+		return ErrType
+	}
+	r := &reader{buf: packet[1:]}
+	m.decode(r)
+	return r.finish()
+}
+
+// A zero message of type t, nil if t is unknown.
+func NewRequest(t RequestType) Message {
+	switch t {
+	case ReqSendChatMsg:
+		return new(SendChatMsg)
+	case ReqGetHistory:
+		return new(GetHistory)
+	case ReqSendFile:
+		return new(SendFile)
+	case ReqSendSeg:
+		return new(SendSeg)
+	case ReqSendFileAck:
+		return new(SendFileAck)
+	case ReqSendFileFin:
+		return new(SendFileFin)
+	case ReqGetFile:
+		return new(GetFile)
+	case ReqGetFileAck:
+		return new(GetFileAck)
+	case ReqFileSegAck:
+		return new(FileSegAck)
+	case ReqFileFinAck:
+		return new(FileFinAck)
+	case ReqListFiles:
+		return new(ListFiles)
+	case ReqJoin:
+		return new(Join)
+	case ReqLeave:
+		return new(Leave)
+	case ReqListChannels:
+		return new(ListChannels)
+	case ReqSubscribe:
+		return new(Subscribe)
+	case ReqUnsubscribe:
+		return new(Unsubscribe)
+	case ReqMakeChannel:
+		return new(MakeChannel)
+	case ReqRemoveChannel:
+		return new(RemoveChannel)
+	case ReqSearch:
+		return new(Search)
+	case ReqRegister:
+		return &Login{Register: true}
+	case ReqLogin:
+		return new(Login)
+	case ReqPublishKey:
+		return new(PublishKey)
+	case ReqGetKey:
+		return new(GetKey)
+	case ReqSendDM:
+		return new(SendDM)
+	case ReqGetDMs:
+		return new(GetDMs)
+	case ReqDMAck:
+		return new(DMAck)
+	case ReqPing:
+		return new(Ping)
+	case ReqWho:
+		return new(Who)
+	case ReqListSubscribed:
+		return new(ListSubscribed)
+	}
+	return nil
+}
+
+// A zero message of type t, nil if t is unknown.
+func NewResponse(t ResponseType) Message {
+	switch t {
+	case RespSendFileOK:
+		return new(SendFileOK)
+	case RespSendFileFailed:
+		return new(SendFileFailed)
+	case RespRecvSegAck:
+		return new(RecvSegAck)
+	case RespSendFileFinAck:
+		return new(SendFileFinAck)
+	case RespGetFileOK:
+		return new(GetFileOK)
+	case RespGetFileFailed:
+		return new(GetFileFailed)
+	case RespFileSeg:
+		return new(FileSeg)
+	case RespFileFin:
+		return new(FileFin)
+	case RespFileList:
+		return new(FileList)
+	case RespJoinOK:
+		return new(JoinOK)
+	case RespChatMsg:
+		return new(ChatMsg)
+	case RespChannelList:
+		return new(ChannelList)
+	case RespChannelOK:
+		return new(ChannelOK)
+	case RespChannelFailed:
+		return new(ChannelFailed)
+	case RespHistory:
+		return new(History)
+	case RespLoginOK:
+		return new(LoginOK)
+	case RespLoginFailed:
+		return new(LoginFailed)
+	case RespUnauthenticated:
+		return new(Unauthenticated)
+	case RespKeyPublished:
+		return new(KeyPublished)
+	case RespUserKey:
+		return new(UserKey)
+	case RespDMSent:
+		return new(DMSent)
+	case RespDMFailed:
+		return new(DMFailed)
+	case RespDMCount:
+		return new(DMCount)
+	case RespDM:
+		return new(DM)
+	case RespPong:
+		return new(Pong)
+	case RespWho:
+		return new(WhoList)
+	case RespRequestFailed:
+		return new(RequestFailed)
+	}
+	return nil
+}
+
+// Decodes a request of any type.
+func DecodeRequest(packet []byte) (Message, error) {
+	if len(packet) == 0 {
+		return nil, ErrEmpty
+	}
+	m := NewRequest(RequestType(packet[0]))
+	if m == nil {
+		return nil, ErrUnknownType
+	}
+	return m, Unmarshal(packet, m)
+}
+
+// Decodes a response of any type.
+func DecodeResponse(packet []byte) (Message, error) {
+	if len(packet) == 0 {
+		return nil, ErrEmpty
+	}
+	m := NewResponse(ResponseType(packet[0]))
+	if m == nil {
+		return nil, ErrUnknownType
+	}
+	return m, Unmarshal(packet, m)
+}
+
+// The lists of Version1 are joined by "; ".
+const kLegacySeparator = "; "
+
+// The responses whose body differs in Version1, all of them lists.
+func legacyList(packet []byte, isResponse bool) (*[]string, Message) {
+	if !isResponse {
+		return nil, nil
+	}
+	switch ResponseType(packet[0]) {
+	case RespFileList:
+		m := new(FileList)
+		return &m.Files, m
+	case RespChannelList:
+		m := new(ChannelList)
+		return &m.Channels, m
+	case RespWho:
+		m := new(WhoList)
+		return &m.Users, m
+	}
+	return nil, nil
+}
+
+// Whether the packet is one of the requests that Version1 sends without the
+// REQ_ID following the token, which is 0 for them.
+func legacyReqID(packet []byte, isResponse bool) bool {
+	if isResponse {
+		return false
+	}
+	t := RequestType(packet[0])
+	return t == ReqMakeChannel || t == ReqRemoveChannel
+}
+
+// Translates a packet of the current version to Version1.
+func downgrade(packet []byte, isResponse bool) ([]byte, error) {
+	if legacyReqID(packet, isResponse) {
+		if len(packet) < 1+TokenSize+8 {
+			return nil, ErrTruncated
+		}
+		legacy := append([]byte{}, packet[:1+TokenSize]...)
+		return append(legacy, packet[1+TokenSize+8:]...), nil
+	}
+	list, m := legacyList(packet, isResponse)
+	if m == nil {
+		return packet, nil
+	}
+	if err := Unmarshal(packet, m); err != nil {
+		return nil, err
+	}
+	return append([]byte{packet[0]}, strings.Join(*list, kLegacySeparator)...), nil
+}
+
+// Translates a packet of Version1 to the current version.
+func upgrade(packet []byte, isResponse bool) ([]byte, error) {
+	if legacyReqID(packet, isResponse) {
+		if len(packet) < 1+TokenSize {
+			return nil, ErrTruncated
+		}
+		current := append([]byte{}, packet[:1+TokenSize]...)
+		current = append(current, make([]byte, 8)...)
+		return append(current, packet[1+TokenSize:]...), nil
+	}
+	list, m := legacyList(packet, isResponse)
+	if m == nil {
+		return packet, nil
+	}
+	if len(packet) > 1 {
+		*list = strings.Split(string(packet[1:]), kLegacySeparator)
+	}
+	return Marshal(m), nil
+}
@@ -0,0 +1,535 @@
+package codec
+
+// kReqSendChatMsg CHANNEL_ID MESSAGE
+type SendChatMsg struct {
+	request
+	Channel uint32
+	Message string
+}
+
+func (*SendChatMsg) ID() uint8 { return uint8(ReqSendChatMsg) }
+
+func (m *SendChatMsg) encode(w *writer) {
+	w.uint32(m.Channel)
+	w.bytes([]byte(m.Message))
+}
+
+func (m *SendChatMsg) decode(r *reader) {
+	m.Channel = r.uint32()
+	m.Message = r.restString()
+}
+
+// kReqGetHistory [QUERY_ID LIMIT BEFORE AFTER CHANNEL SENDER_LEN SENDER]
+//
+// A bare request decodes as the zero query.
+type GetHistory struct {
+	request
+	QueryID uint32
+	Limit   uint16
+	Before  uint64
+	After   uint64
+	Channel uint32
+	Sender  string
+}
+
+func (*GetHistory) ID() uint8 { return uint8(ReqGetHistory) }
+
+func (m *GetHistory) encode(w *writer) {
+	w.uint32(m.QueryID)
+	w.uint16(m.Limit)
+	w.uint64(m.Before)
+	w.uint64(m.After)
+	w.uint32(m.Channel)
+	w.string8(m.Sender)
+}
+
+func (m *GetHistory) decode(r *reader) {
+	if r.empty() {
+		return
+	}
+	m.QueryID = r.uint32()
+	m.Limit = r.uint16()
+	m.Before = r.uint64()
+	m.After = r.uint64()
+	m.Channel = r.uint32()
+	m.Sender = r.string8()
+}
+
+// The parameters of a file transfer, proposed by kReqSendFile and kReqGetFile
+// and offered by kRespGetFileOK:
+//
+//	PACKET_ID SEG_SIZE WINDOW TOTAL_SIZE USER_LEN USERNAME FILENAME
+type FileSyn struct {
+	PacketID  uint64
+	SegSize   uint16
+	Window    uint16
+	TotalSize uint64
+	User      string
+	Filename  string
+}
+
+func (s *FileSyn) Transfer() uint64 { return s.PacketID }
+
+func (s *FileSyn) encode(w *writer) {
+	w.uint64(s.PacketID)
+	w.uint16(s.SegSize)
+	w.uint16(s.Window)
+	w.uint64(s.TotalSize)
+	w.string8(s.User)
+	w.bytes([]byte(s.Filename))
+}
+
+func (s *FileSyn) decode(r *reader) {
+	s.PacketID = r.uint64()
+	s.SegSize = r.uint16()
+	s.Window = r.uint16()
+	s.TotalSize = r.uint64()
+	s.User = r.string8()
+	s.Filename = r.restString()
+}
+
+// kReqSendFile FileSyn
+type SendFile struct {
+	request
+	FileSyn
+}
+
+func (*SendFile) ID() uint8 { return uint8(ReqSendFile) }
+
+// kReqGetFile FileSyn, TOTAL_SIZE being ignored.
+type GetFile struct {
+	request
+	FileSyn
+}
+
+func (*GetFile) ID() uint8 { return uint8(ReqGetFile) }
+
+// A segment of a file, sent by kReqSendSeg and kRespFileSeg:
+//
+//	PACKET_ID SEG_ID CRC32C SEG_CONTENT
+type Segment struct {
+	PacketID uint64
+	SegID    uint32
+	Checksum uint32 // CRC32C of Content
+	Content  []byte
+}
+
+// Size of the fields before the content.
+const SegmentHeaderSize = 16
+
+func (s *Segment) Transfer() uint64 { return s.PacketID }
+
+func (s *Segment) encode(w *writer) {
+	w.uint64(s.PacketID)
+	w.uint32(s.SegID)
+	w.uint32(s.Checksum)
+	w.bytes(s.Content)
+}
+
+func (s *Segment) decode(r *reader) {
+	s.PacketID = r.uint64()
+	s.SegID = r.uint32()
+	s.Checksum = r.uint32()
+	s.Content = r.rest()
+}
+
+// kReqSendSeg Segment
+type SendSeg struct {
+	request
+	Segment
+}
+
+func (*SendSeg) ID() uint8 { return uint8(ReqSendSeg) }
+
+// kReqSendFileAck PACKET_ID
+type SendFileAck struct {
+	request
+	PacketID uint64
+}
+
+func (*SendFileAck) ID() uint8          { return uint8(ReqSendFileAck) }
+func (m *SendFileAck) Transfer() uint64 { return m.PacketID }
+func (m *SendFileAck) encode(w *writer) { w.uint64(m.PacketID) }
+func (m *SendFileAck) decode(r *reader) { m.PacketID = r.uint64() }
+
+// kReqSendFileFin PACKET_ID FLAG [SHA256]
+type SendFileFin struct {
+	request
+	PacketID uint64
+	Flag     uint8
+	Digest   []byte // empty, or the SHA-256 of the file
+}
+
+func (*SendFileFin) ID() uint8          { return uint8(ReqSendFileFin) }
+func (m *SendFileFin) Transfer() uint64 { return m.PacketID }
+
+func (m *SendFileFin) encode(w *writer) {
+	w.uint64(m.PacketID)
+	w.uint8(m.Flag)
+	w.bytes(m.Digest)
+}
+
+func (m *SendFileFin) decode(r *reader) {
+	m.PacketID = r.uint64()
+	m.Flag = r.uint8()
+	if !r.empty() {
+		m.Digest = make([]byte, DigestSize)
+		r.fixed(m.Digest)
+	}
+}
+
+// kReqGetFileAck PACKET_ID RESUME_FROM
+type GetFileAck struct {
+	request
+	PacketID   uint64
+	ResumeFrom uint32
+}
+
+func (*GetFileAck) ID() uint8          { return uint8(ReqGetFileAck) }
+func (m *GetFileAck) Transfer() uint64 { return m.PacketID }
+
+func (m *GetFileAck) encode(w *writer) {
+	w.uint64(m.PacketID)
+	w.uint32(m.ResumeFrom)
+}
+
+func (m *GetFileAck) decode(r *reader) {
+	m.PacketID = r.uint64()
+	m.ResumeFrom = r.uint32()
+}
+
+// A half-open range [Start, End) of accepted SEG_IDs.
+type Range struct {
+	Start uint32
+	End   uint32
+}
+
+// A selective ack, sent by kRespRecvSegAck and kReqFileSegAck:
+//
+//	PACKET_ID CUM_ACK N_RANGES [START END]...
+type SegAck struct {
+	PacketID uint64
+	CumAck   uint32
+	Ranges   []Range // at most 255
+}
+
+func (a *SegAck) Transfer() uint64 { return a.PacketID }
+
+func (a *SegAck) encode(w *writer) {
+	ranges := a.Ranges
+	if len(ranges) > 255 {
+		ranges = ranges[:255]
+	}
+	w.uint64(a.PacketID)
+	w.uint32(a.CumAck)
+	w.uint8(uint8(len(ranges)))
+	for _, rg := range ranges {
+		w.uint32(rg.Start)
+		w.uint32(rg.End)
+	}
+}
+
+func (a *SegAck) decode(r *reader) {
+	a.PacketID = r.uint64()
+	a.CumAck = r.uint32()
+	n := int(r.uint8())
+	for i := 0; i < n && r.err == nil; i++ {
+		rg := Range{Start: r.uint32(), End: r.uint32()}
+		if r.err == nil {
+			a.Ranges = append(a.Ranges, rg)
+		}
+	}
+}
+
+// kReqFileSegAck SegAck
+type FileSegAck struct {
+	request
+	SegAck
+}
+
+func (*FileSegAck) ID() uint8 { return uint8(ReqFileSegAck) }
+
+// kReqFileFinAck PACKET_ID STATUS
+type FileFinAck struct {
+	request
+	PacketID uint64
+	Status   uint8
+}
+
+func (*FileFinAck) ID() uint8          { return uint8(ReqFileFinAck) }
+func (m *FileFinAck) Transfer() uint64 { return m.PacketID }
+
+func (m *FileFinAck) encode(w *writer) {
+	w.uint64(m.PacketID)
+	w.uint8(m.Status)
+}
+
+func (m *FileFinAck) decode(r *reader) {
+	m.PacketID = r.uint64()
+	m.Status = r.uint8()
+}
+
+// Requests without a body.
+type empty struct{}
+
+func (empty) encode(w *writer) {}
+func (empty) decode(r *reader) {}
+
+// The requests of a page of a list, FROM being the index of the first entry
+// of the page. The first page is asked for without FROM, as in the releases
+// before the lists were paged.
+type listPage struct {
+	From uint32
+}
+
+func (m *listPage) encode(w *writer) {
+	if m.From != 0 {
+		w.uint32(m.From)
+	}
+}
+
+func (m *listPage) decode(r *reader) {
+	if !r.empty() {
+		m.From = r.uint32()
+	}
+}
+
+// kReqListFiles [FROM]
+type ListFiles struct {
+	request
+	listPage
+}
+
+func (*ListFiles) ID() uint8 { return uint8(ReqListFiles) }
+
+// kReqJoin
+type Join struct {
+	request
+	empty
+}
+
+func (*Join) ID() uint8 { return uint8(ReqJoin) }
+
+// kReqLeave
+type Leave struct {
+	request
+	empty
+}
+
+func (*Leave) ID() uint8 { return uint8(ReqLeave) }
+
+// kReqListChannels [FROM]
+type ListChannels struct {
+	request
+	listPage
+}
+
+func (*ListChannels) ID() uint8 { return uint8(ReqListChannels) }
+
+// kReqSubscribe CHANNEL_ID
+type Subscribe struct {
+	request
+	Channel uint32
+}
+
+func (*Subscribe) ID() uint8          { return uint8(ReqSubscribe) }
+func (m *Subscribe) encode(w *writer) { w.uint32(m.Channel) }
+func (m *Subscribe) decode(r *reader) { m.Channel = r.uint32() }
+
+// kReqUnsubscribe CHANNEL_ID
+type Unsubscribe struct {
+	request
+	Channel uint32
+}
+
+func (*Unsubscribe) ID() uint8          { return uint8(ReqUnsubscribe) }
+func (m *Unsubscribe) encode(w *writer) { w.uint32(m.Channel) }
+func (m *Unsubscribe) decode(r *reader) { m.Channel = r.uint32() }
+
+// kReqMakeChannel REQ_ID NAME
+type MakeChannel struct {
+	request
+	ReqID uint64
+	Name  string
+}
+
+func (*MakeChannel) ID() uint8 { return uint8(ReqMakeChannel) }
+
+func (m *MakeChannel) encode(w *writer) {
+	w.uint64(m.ReqID)
+	w.bytes([]byte(m.Name))
+}
+
+func (m *MakeChannel) decode(r *reader) {
+	m.ReqID = r.uint64()
+	m.Name = r.restString()
+}
+
+// kReqRemoveChannel REQ_ID CHANNEL_ID
+type RemoveChannel struct {
+	request
+	ReqID   uint64
+	Channel uint32
+}
+
+func (*RemoveChannel) ID() uint8 { return uint8(ReqRemoveChannel) }
+
+func (m *RemoveChannel) encode(w *writer) {
+	w.uint64(m.ReqID)
+	w.uint32(m.Channel)
+}
+
+func (m *RemoveChannel) decode(r *reader) {
+	m.ReqID = r.uint64()
+	m.Channel = r.uint32()
+}
+
+// kReqSearch QUERY_ID LIMIT SINCE UNTIL CHANNEL TERMS
+type Search struct {
+	request
+	QueryID uint32
+	Limit   uint16
+	Since   uint64 // nanoseconds since the epoch, 0 for no bound
+	Until   uint64
+	Channel uint32
+	Terms   string
+}
+
+func (*Search) ID() uint8 { return uint8(ReqSearch) }
+
+func (m *Search) encode(w *writer) {
+	w.uint32(m.QueryID)
+	w.uint16(m.Limit)
+	w.uint64(m.Since)
+	w.uint64(m.Until)
+	w.uint32(m.Channel)
+	w.bytes([]byte(m.Terms))
+}
+
+func (m *Search) decode(r *reader) {
+	m.QueryID = r.uint32()
+	m.Limit = r.uint16()
+	m.Since = r.uint64()
+	m.Until = r.uint64()
+	m.Channel = r.uint32()
+	m.Terms = r.restString()
+}
+
+// kReqRegister LOGIN_ID USER_LEN USERNAME PASSWORD
+// kReqLogin LOGIN_ID USER_LEN USERNAME PASSWORD
+type Login struct {
+	request
+	Register bool // kReqRegister rather than kReqLogin
+	LoginID  uint64
+	Username string
+	Password string
+}
+
+func (m *Login) ID() uint8 {
+	if m.Register {
+		return uint8(ReqRegister)
+	}
+	return uint8(ReqLogin)
+}
+
+func (m *Login) encode(w *writer) {
+	w.uint64(m.LoginID)
+	w.string8(m.Username)
+	w.bytes([]byte(m.Password))
+}
+
+func (m *Login) decode(r *reader) {
+	m.LoginID = r.uint64()
+	m.Username = r.string8()
+	m.Password = r.restString()
+}
+
+// kReqPublishKey KEY
+type PublishKey struct {
+	request
+	Key [KeySize]byte
+}
+
+func (*PublishKey) ID() uint8          { return uint8(ReqPublishKey) }
+func (m *PublishKey) encode(w *writer) { w.bytes(m.Key[:]) }
+func (m *PublishKey) decode(r *reader) { r.fixed(m.Key[:]) }
+
+// kReqGetKey USERNAME
+type GetKey struct {
+	request
+	Username string
+}
+
+func (*GetKey) ID() uint8          { return uint8(ReqGetKey) }
+func (m *GetKey) encode(w *writer) { w.bytes([]byte(m.Username)) }
+func (m *GetKey) decode(r *reader) { m.Username = r.restString() }
+
+// kReqSendDM DM_ID TO_LEN TO KEY NONCE BOX
+type SendDM struct {
+	request
+	DMID  uint64
+	To    string
+	Key   [KeySize]byte
+	Nonce [NonceSize]byte
+	Box   []byte
+}
+
+func (*SendDM) ID() uint8 { return uint8(ReqSendDM) }
+
+func (m *SendDM) encode(w *writer) {
+	w.uint64(m.DMID)
+	w.string8(m.To)
+	w.bytes(m.Key[:])
+	w.bytes(m.Nonce[:])
+	w.bytes(m.Box)
+}
+
+func (m *SendDM) decode(r *reader) {
+	m.DMID = r.uint64()
+	m.To = r.string8()
+	r.fixed(m.Key[:])
+	r.fixed(m.Nonce[:])
+	m.Box = r.rest()
+}
+
+// kReqGetDMs
+type GetDMs struct {
+	request
+	empty
+}
+
+func (*GetDMs) ID() uint8 { return uint8(ReqGetDMs) }
+
+// kReqDMAck MSG_ID
+type DMAck struct {
+	request
+	MsgID uint64
+}
+
+func (*DMAck) ID() uint8          { return uint8(ReqDMAck) }
+func (m *DMAck) encode(w *writer) { w.uint64(m.MsgID) }
+func (m *DMAck) decode(r *reader) { m.MsgID = r.uint64() }
+
+// kReqPing
+type Ping struct {
+	request
+	empty
+}
+
+func (*Ping) ID() uint8 { return uint8(ReqPing) }
+
+// kReqWho [FROM]
+type Who struct {
+	request
+	listPage
+}
+
+func (*Who) ID() uint8 { return uint8(ReqWho) }
+
+// kReqListSubscribed [FROM]
+type ListSubscribed struct {
+	request
+	listPage
+}
+
+func (*ListSubscribed) ID() uint8 { return uint8(ReqListSubscribed) }
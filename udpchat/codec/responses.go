@@ -0,0 +1,430 @@
+package codec
+
+// kRespSendFileOK PACKET_ID SEG_SIZE WINDOW SEG_COUNT RESUME_FROM
+type SendFileOK struct {
+	response
+	PacketID   uint64
+	SegSize    uint16
+	Window     uint16
+	SegCount   uint32
+	ResumeFrom uint32
+}
+
+func (*SendFileOK) ID() uint8          { return uint8(RespSendFileOK) }
+func (m *SendFileOK) Transfer() uint64 { return m.PacketID }
+
+func (m *SendFileOK) encode(w *writer) {
+	w.uint64(m.PacketID)
+	w.uint16(m.SegSize)
+	w.uint16(m.Window)
+	w.uint32(m.SegCount)
+	w.uint32(m.ResumeFrom)
+}
+
+func (m *SendFileOK) decode(r *reader) {
+	m.PacketID = r.uint64()
+	m.SegSize = r.uint16()
+	m.Window = r.uint16()
+	m.SegCount = r.uint32()
+	m.ResumeFrom = r.uint32()
+}
+
+// kRespSendFileFailed PACKET_ID
+type SendFileFailed struct {
+	response
+	PacketID uint64
+}
+
+func (*SendFileFailed) ID() uint8          { return uint8(RespSendFileFailed) }
+func (m *SendFileFailed) Transfer() uint64 { return m.PacketID }
+func (m *SendFileFailed) encode(w *writer) { w.uint64(m.PacketID) }
+func (m *SendFileFailed) decode(r *reader) { m.PacketID = r.uint64() }
+
+// kRespRecvSegAck SegAck
+type RecvSegAck struct {
+	response
+	SegAck
+}
+
+func (*RecvSegAck) ID() uint8 { return uint8(RespRecvSegAck) }
+
+// kRespSendFileFinAck PACKET_ID STATUS
+type SendFileFinAck struct {
+	response
+	PacketID uint64
+	Status   uint8
+}
+
+func (*SendFileFinAck) ID() uint8          { return uint8(RespSendFileFinAck) }
+func (m *SendFileFinAck) Transfer() uint64 { return m.PacketID }
+
+func (m *SendFileFinAck) encode(w *writer) {
+	w.uint64(m.PacketID)
+	w.uint8(m.Status)
+}
+
+func (m *SendFileFinAck) decode(r *reader) {
+	m.PacketID = r.uint64()
+	m.Status = r.uint8()
+}
+
+// kRespGetFileOK FileSyn, TOTAL_SIZE being the size of the file.
+type GetFileOK struct {
+	response
+	FileSyn
+}
+
+func (*GetFileOK) ID() uint8 { return uint8(RespGetFileOK) }
+
+// kRespGetFileFailed PACKET_ID
+type GetFileFailed struct {
+	response
+	PacketID uint64
+}
+
+func (*GetFileFailed) ID() uint8          { return uint8(RespGetFileFailed) }
+func (m *GetFileFailed) Transfer() uint64 { return m.PacketID }
+func (m *GetFileFailed) encode(w *writer) { w.uint64(m.PacketID) }
+func (m *GetFileFailed) decode(r *reader) { m.PacketID = r.uint64() }
+
+// kRespFileSeg Segment
+type FileSeg struct {
+	response
+	Segment
+}
+
+func (*FileSeg) ID() uint8 { return uint8(RespFileSeg) }
+
+// kRespFileFin PACKET_ID SHA256
+type FileFin struct {
+	response
+	PacketID uint64
+	Digest   [DigestSize]byte
+}
+
+func (*FileFin) ID() uint8          { return uint8(RespFileFin) }
+func (m *FileFin) Transfer() uint64 { return m.PacketID }
+
+func (m *FileFin) encode(w *writer) {
+	w.uint64(m.PacketID)
+	w.bytes(m.Digest[:])
+}
+
+func (m *FileFin) decode(r *reader) {
+	m.PacketID = r.uint64()
+	r.fixed(m.Digest[:])
+}
+
+// kRespFileList COUNT [LEN <FILENAME (SIZE bytes)>]... [NEXT]
+type FileList struct {
+	response
+	Files []string
+	Next  uint32
+}
+
+func (*FileList) ID() uint8          { return uint8(RespFileList) }
+func (m *FileList) encode(w *writer) { encodeList(w, m.Files, m.Next) }
+func (m *FileList) decode(r *reader) { m.Files, m.Next = decodeList(r) }
+
+// kRespJoinOK
+type JoinOK struct {
+	response
+	empty
+}
+
+func (*JoinOK) ID() uint8 { return uint8(RespJoinOK) }
+
+// kRespChatMsg TEXT, a record of the history as shown to the user.
+type ChatMsg struct {
+	response
+	Text string
+}
+
+func (*ChatMsg) ID() uint8          { return uint8(RespChatMsg) }
+func (m *ChatMsg) encode(w *writer) { w.bytes([]byte(m.Text)) }
+func (m *ChatMsg) decode(r *reader) { m.Text = r.restString() }
+
+// kRespChannelList COUNT [LEN <CHANNEL_ID/NAME>]... [NEXT]
+type ChannelList struct {
+	response
+	Channels []string
+	Next     uint32
+}
+
+func (*ChannelList) ID() uint8          { return uint8(RespChannelList) }
+func (m *ChannelList) encode(w *writer) { encodeList(w, m.Channels, m.Next) }
+func (m *ChannelList) decode(r *reader) { m.Channels, m.Next = decodeList(r) }
+
+// kRespChannelOK CHANNEL_ID NAME
+type ChannelOK struct {
+	response
+	Channel uint32
+	Name    string
+}
+
+func (*ChannelOK) ID() uint8 { return uint8(RespChannelOK) }
+
+func (m *ChannelOK) encode(w *writer) {
+	w.uint32(m.Channel)
+	w.bytes([]byte(m.Name))
+}
+
+func (m *ChannelOK) decode(r *reader) {
+	m.Channel = r.uint32()
+	m.Name = r.restString()
+}
+
+// kRespChannelFailed REASON
+type ChannelFailed struct {
+	response
+	Reason string
+}
+
+func (*ChannelFailed) ID() uint8          { return uint8(RespChannelFailed) }
+func (m *ChannelFailed) encode(w *writer) { w.bytes([]byte(m.Reason)) }
+func (m *ChannelFailed) decode(r *reader) { m.Reason = r.restString() }
+
+// kRespHistory QUERY_ID PART PARTS MORE [RECORD]...
+//
+// The records are framed as in the history log of the hub.
+type History struct {
+	response
+	QueryID uint32
+	Part    uint16
+	Parts   uint16
+	More    bool
+	Records []byte
+}
+
+// Size of the fields before the records.
+const HistoryHeaderSize = 9
+
+func (*History) ID() uint8 { return uint8(RespHistory) }
+
+func (m *History) encode(w *writer) {
+	w.uint32(m.QueryID)
+	w.uint16(m.Part)
+	w.uint16(m.Parts)
+	w.bool(m.More)
+	w.bytes(m.Records)
+}
+
+func (m *History) decode(r *reader) {
+	m.QueryID = r.uint32()
+	m.Part = r.uint16()
+	m.Parts = r.uint16()
+	m.More = r.bool()
+	m.Records = r.rest()
+}
+
+// kRespLoginOK TOKEN
+type LoginOK struct {
+	response
+	Token [TokenSize]byte
+}
+
+func (*LoginOK) ID() uint8          { return uint8(RespLoginOK) }
+func (m *LoginOK) encode(w *writer) { w.bytes(m.Token[:]) }
+func (m *LoginOK) decode(r *reader) { r.fixed(m.Token[:]) }
+
+// kRespLoginFailed REASON
+type LoginFailed struct {
+	response
+	Reason string
+}
+
+func (*LoginFailed) ID() uint8          { return uint8(RespLoginFailed) }
+func (m *LoginFailed) encode(w *writer) { w.bytes([]byte(m.Reason)) }
+func (m *LoginFailed) decode(r *reader) { m.Reason = r.restString() }
+
+// kRespUnauthenticated REASON
+type Unauthenticated struct {
+	response
+	Reason string
+}
+
+func (*Unauthenticated) ID() uint8          { return uint8(RespUnauthenticated) }
+func (m *Unauthenticated) encode(w *writer) { w.bytes([]byte(m.Reason)) }
+func (m *Unauthenticated) decode(r *reader) { m.Reason = r.restString() }
+
+// kRespKeyPublished KEY
+type KeyPublished struct {
+	response
+	Key [KeySize]byte
+}
+
+func (*KeyPublished) ID() uint8          { return uint8(RespKeyPublished) }
+func (m *KeyPublished) encode(w *writer) { w.bytes(m.Key[:]) }
+func (m *KeyPublished) decode(r *reader) { r.fixed(m.Key[:]) }
+
+// kRespUserKey USER_LEN USERNAME [KEY]
+type UserKey struct {
+	response
+	Username string
+	Key      []byte // empty if the user has never published one
+}
+
+func (*UserKey) ID() uint8 { return uint8(RespUserKey) }
+
+func (m *UserKey) encode(w *writer) {
+	w.string8(m.Username)
+	w.bytes(m.Key)
+}
+
+func (m *UserKey) decode(r *reader) {
+	m.Username = r.string8()
+	if !r.empty() {
+		m.Key = make([]byte, KeySize)
+		r.fixed(m.Key)
+	}
+}
+
+// kRespDMSent DM_ID
+type DMSent struct {
+	response
+	DMID uint64
+}
+
+func (*DMSent) ID() uint8          { return uint8(RespDMSent) }
+func (m *DMSent) encode(w *writer) { w.uint64(m.DMID) }
+func (m *DMSent) decode(r *reader) { m.DMID = r.uint64() }
+
+// kRespDMFailed DM_ID REASON
+type DMFailed struct {
+	response
+	DMID   uint64
+	Reason string
+}
+
+func (*DMFailed) ID() uint8 { return uint8(RespDMFailed) }
+
+func (m *DMFailed) encode(w *writer) {
+	w.uint64(m.DMID)
+	w.bytes([]byte(m.Reason))
+}
+
+func (m *DMFailed) decode(r *reader) {
+	m.DMID = r.uint64()
+	m.Reason = r.restString()
+}
+
+// kRespDMCount COUNT
+type DMCount struct {
+	response
+	Count uint32
+}
+
+func (*DMCount) ID() uint8          { return uint8(RespDMCount) }
+func (m *DMCount) encode(w *writer) { w.uint32(m.Count) }
+func (m *DMCount) decode(r *reader) { m.Count = r.uint32() }
+
+// kRespDM MSG_ID TIME FROM_LEN FROM DM_ID KEY NONCE BOX
+type DM struct {
+	response
+	MsgID uint64
+	Time  uint64 // nanoseconds since the epoch
+	From  string
+	DMID  uint64
+	Key   [KeySize]byte
+	Nonce [NonceSize]byte
+	Box   []byte
+}
+
+func (*DM) ID() uint8 { return uint8(RespDM) }
+
+func (m *DM) encode(w *writer) {
+	w.uint64(m.MsgID)
+	w.uint64(m.Time)
+	w.string8(m.From)
+	w.uint64(m.DMID)
+	w.bytes(m.Key[:])
+	w.bytes(m.Nonce[:])
+	w.bytes(m.Box)
+}
+
+func (m *DM) decode(r *reader) {
+	m.MsgID = r.uint64()
+	m.Time = r.uint64()
+	m.From = r.string8()
+	m.DMID = r.uint64()
+	r.fixed(m.Key[:])
+	r.fixed(m.Nonce[:])
+	m.Box = r.rest()
+}
+
+// kRespPong
+type Pong struct {
+	response
+	empty
+}
+
+func (*Pong) ID() uint8 { return uint8(RespPong) }
+
+// kRespWho COUNT [LEN USERNAME]... [NEXT]
+type WhoList struct {
+	response
+	Users []string
+	Next  uint32
+}
+
+func (*WhoList) ID() uint8          { return uint8(RespWho) }
+func (m *WhoList) encode(w *writer) { encodeList(w, m.Users, m.Next) }
+func (m *WhoList) decode(r *reader) { m.Users, m.Next = decodeList(r) }
+
+// A page of a list is followed by NEXT, the index of the first entry of the
+// next page, unless it's the last page.
+func encodeList(w *writer, list []string, next uint32) {
+	w.strings16(list)
+	if next != 0 {
+		w.uint32(next)
+	}
+}
+
+func decodeList(r *reader) (list []string, next uint32) {
+	list = r.strings16()
+	if !r.empty() {
+		next = r.uint32()
+	}
+	return list, next
+}
+
+// The reasons of kRespRequestFailed.
+type ErrorCode uint8
+
+const (
+	CodeMalformed   ErrorCode = 1 // the request can't be decoded
+	CodeUnknownType ErrorCode = 2
+	CodeUnexpected  ErrorCode = 3 // in the state of the session, like a segment of an unknown transfer
+	CodeInvalid     ErrorCode = 4 // the request is decoded, but its fields are refused
+)
+
+// The ErrorCode of a decoding error.
+func CodeOf(err error) ErrorCode {
+	if err == ErrUnknownType {
+		return CodeUnknownType
+	}
+	return CodeMalformed
+}
+
+// kRespRequestFailed REQ_TYPE CODE REASON, answering a request the hub
+// couldn't handle.
+type RequestFailed struct {
+	response
+	Request uint8 // the RequestType of the request
+	Code    ErrorCode
+	Reason  string
+}
+
+func (*RequestFailed) ID() uint8 { return uint8(RespRequestFailed) }
+
+func (m *RequestFailed) encode(w *writer) {
+	w.uint8(m.Request)
+	w.uint8(uint8(m.Code))
+	w.bytes([]byte(m.Reason))
+}
+
+func (m *RequestFailed) decode(r *reader) {
+	m.Request = r.uint8()
+	m.Code = ErrorCode(r.uint8())
+	m.Reason = r.restString()
+}
@@ -0,0 +1,126 @@
+package udpchat
+
+import (
+	"time"
+)
+
+const (
+	// Lower bound of the retransmission timeout computed from RTT samples.
+	kMinRTO = 100 * time.Millisecond
+
+	// Congestion window at the start of a transfer, in segments.
+	kInitialCwnd = 4
+)
+
+// AIMD congestion control for file transfers, along the lines of TCP Reno
+// (RFC 5681), with the retransmission timeout estimated as in RFC 6298.
+//
+// The congestion window grows by one segment per ack during slow start, and by
+// one segment per round trip afterwards. It's halved when a gap is detected,
+// at most once per window of data, and falls back to a single segment on
+// timeout. Sends are paced evenly over the smoothed RTT, so that a transfer
+// does not flood the socket shared with chat messages.
+type congestionControl struct {
+	cwnd     float64
+	ssthresh float64
+
+	srtt   time.Duration
+	rttvar time.Duration
+	rto    time.Duration
+
+	// Losses of segments below recover belong to the window that has
+	// already been reduced.
+	recover uint32
+}
+
+func newCongestionControl() *congestionControl {
+	cc := new(congestionControl)
+	cc.cwnd = kInitialCwnd
+	cc.ssthresh = float64(kDefaultSendWindow)
+	cc.rto = kInitialRTO
+	return cc
+}
+
+// Number of segments allowed in flight, which is never larger than limit.
+func (cc *congestionControl) window(limit int) int {
+	w := int(cc.cwnd)
+	if w > limit {
+		w = limit
+	}
+	if w < 1 {
+		w = 1
+	}
+	return w
+}
+
+// Minimum interval between two segments sent.
+func (cc *congestionControl) pacingInterval() time.Duration {
+	if cc.srtt == 0 {
+		return 0
+	}
+	return time.Duration(float64(cc.srtt) / cc.cwnd)
+}
+
+// Called with the number of segments newly accepted by an ack.
+func (cc *congestionControl) onAck(acked int) {
+	for i := 0; i < acked; i++ {
+		if cc.cwnd < cc.ssthresh {
+			cc.cwnd += 1
+		} else {
+			cc.cwnd += 1 / cc.cwnd
+		}
+	}
+}
+
+// Called with the round trip time of a segment that was sent only once
+// (Karn's algorithm).
+func (cc *congestionControl) onRTTSample(rtt time.Duration) {
+	if cc.srtt == 0 {
+		cc.srtt = rtt
+		cc.rttvar = rtt / 2
+	} else {
+		delta := cc.srtt - rtt
+		if delta < 0 {
+			delta = -delta
+		}
+		cc.rttvar = (3*cc.rttvar + delta) / 4
+		cc.srtt = (7*cc.srtt + rtt) / 8
+	}
+
+	cc.rto = cc.srtt + 4*cc.rttvar
+	if cc.rto < kMinRTO {
+		cc.rto = kMinRTO
+	}
+	if cc.rto > kMaxRTO {
+		cc.rto = kMaxRTO
+	}
+}
+
+// Called when seg_id is detected as lost while next_sid is the next SEG_ID
+// to be sent.
+func (cc *congestionControl) onLoss(seg_id uint32, next_sid uint32) {
+	if seg_id < cc.recover {
+		return
+	}
+	cc.recover = next_sid
+	cc.ssthresh = cc.cwnd / 2
+	if cc.ssthresh < 2 {
+		cc.ssthresh = 2
+	}
+	cc.cwnd = cc.ssthresh
+}
+
+// Called when no ack has arrived within the retransmission timeout.
+func (cc *congestionControl) onTimeout(next_sid uint32) {
+	cc.recover = next_sid
+	cc.ssthresh = cc.cwnd / 2
+	if cc.ssthresh < 2 {
+		cc.ssthresh = 2
+	}
+	cc.cwnd = 1
+
+	cc.rto *= 2
+	if cc.rto > kMaxRTO {
+		cc.rto = kMaxRTO
+	}
+}
@@ -0,0 +1,58 @@
+package udpchat
+
+import (
+	"testing"
+	"time"
+)
+
+func TestCongestionControlAIMD(t *testing.T) {
+	cc := newCongestionControl()
+
+	// slow start doubles the window every round trip.
+	cc.onAck(kInitialCwnd)
+	if cc.window(1000) != 2*kInitialCwnd {
+		t.Fatalf("window after slow start = %d", cc.window(1000))
+	}
+	if cc.window(3) != 3 {
+		t.Fatalf("window is not bounded by the send window")
+	}
+
+	// only the first loss within a window halves it.
+	cc.onLoss(5, 20)
+	if cc.window(1000) != kInitialCwnd {
+		t.Fatalf("window after loss = %d", cc.window(1000))
+	}
+	cc.onLoss(10, 20)
+	if cc.window(1000) != kInitialCwnd {
+		t.Fatalf("window halved twice within a round trip: %d", cc.window(1000))
+	}
+
+	// congestion avoidance grows about one segment per window of acks.
+	cc.onAck(kInitialCwnd + 1)
+	if cc.window(1000) != kInitialCwnd+1 {
+		t.Fatalf("window after congestion avoidance = %d", cc.window(1000))
+	}
+
+	rto := cc.rto
+	cc.onTimeout(30)
+	if cc.window(1000) != 1 || cc.rto != 2*rto {
+		t.Fatalf("window %d and rto %v after timeout", cc.window(1000), cc.rto)
+	}
+}
+
+func TestCongestionControlRTO(t *testing.T) {
+	cc := newCongestionControl()
+	cc.onRTTSample(40 * time.Millisecond)
+	if cc.srtt != 40*time.Millisecond || cc.rto != 120*time.Millisecond {
+		t.Fatalf("srtt %v, rto %v", cc.srtt, cc.rto)
+	}
+	for i := 0; i < 50; i++ {
+		cc.onRTTSample(time.Millisecond)
+	}
+	if cc.rto != kMinRTO {
+		t.Fatalf("rto %v is below kMinRTO", cc.rto)
+	}
+	if cc.pacingInterval() >= cc.srtt {
+		t.Fatalf("pacing interval %v is not spread over the window", cc.pacingInterval())
+	}
+}
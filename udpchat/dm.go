@@ -0,0 +1,442 @@
+package udpchat
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"log"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/neverchanje/unplayground/udpchat/codec"
+	"golang.org/x/crypto/nacl/box"
+)
+
+// Direct messages are encrypted by the sender to the identity key of the
+// recipient (see keys.go) with NaCl box, which also authenticates the sender,
+// so that the hub only ever stores and relays ciphertext:
+//
+//	kReqSendDM DM_ID TO_LEN TO KEY NONCE BOX  ---->
+//		<----  kRespDMSent DM_ID
+//		<----  kRespDMFailed DM_ID REASON
+//
+// KEY is the identity key of the sender, which the hub checks is the one it
+// published, and DM_ID is chosen by the sender so that a retransmitted message
+// is kept once. The hub keeps the message in the mailbox of the recipient
+// until the recipient acks it, and pushes it to the clients the recipient
+// joined from, if any. The client fetches its mailbox when it starts, which
+// pushes the messages received while the user was away:
+//
+//	kReqGetDMs  ---->
+//		<----  kRespDMCount COUNT
+//		<----  kRespDM MSG_ID TIME FROM_LEN FROM DM_ID KEY NONCE BOX
+//	kReqDMAck MSG_ID  ---->
+//
+// MSG_ID is assigned by the hub. The client acks a message once it's shown,
+// so that a lost push is pushed again on the next fetch, but not the messages
+// whose KEY isn't the pinned key of the sender, which are kept until the user
+// verifies the new key. The hub stores the mailboxes as a file for each
+// message, <dm dir>/mailbox/<recipient>/<MSG_ID>, holding its kRespDM packet.
+const (
+	kNonceSize = codec.NonceSize
+
+	// Messages kept for a user until they are acked.
+	kMaxPendingDMs = 1000
+)
+
+type directMessage struct {
+	id    uint64 // MSG_ID
+	time  time.Time
+	from  string
+	dm_id uint64
+	key   []byte
+	nonce []byte
+	box   []byte
+}
+
+// Encodes the message as a kRespDM packet.
+func (m *directMessage) encode() []byte {
+	resp := &codec.DM{
+		MsgID: m.id,
+		Time:  uint64(m.time.UnixNano()),
+		From:  m.from,
+		DMID:  m.dm_id,
+		Box:   m.box,
+	}
+	copy(resp.Key[:], m.key)
+	copy(resp.Nonce[:], m.nonce)
+	return codec.Marshal(resp)
+}
+
+func decodeDirectMessage(packet []byte) (*directMessage, error) {
+	var resp codec.DM
+	if codec.Unmarshal(packet, &resp) != nil || len(resp.Box) < box.Overhead {
+		return nil, errors.New("Malformed direct message")
+	}
+	return &directMessage{
+		id:    resp.MsgID,
+		time:  time.Unix(0, int64(resp.Time)),
+		from:  resp.From,
+		dm_id: resp.DMID,
+		key:   resp.Key[:],
+		nonce: resp.Nonce[:],
+		box:   resp.Box,
+	}, nil
+}
+
+func encodeSendDM(dm_id uint64, to string, key []byte, nonce []byte, sealed []byte) []byte {
+	req := &codec.SendDM{DMID: dm_id, To: to, Box: sealed}
+	copy(req.Key[:], key)
+	copy(req.Nonce[:], nonce)
+	return codec.Marshal(req)
+}
+
+// Decodes a kReqSendDM into the message and its recipient.
+func decodeSendDM(recv []byte) (*directMessage, string, error) {
+	var req codec.SendDM
+	if codec.Unmarshal(recv, &req) != nil || len(req.Box) < box.Overhead {
+		return nil, "", errors.New("Malformed direct message")
+	}
+	m := &directMessage{
+		dm_id: req.DMID,
+		key:   req.Key[:],
+		nonce: req.Nonce[:],
+		box:   req.Box,
+	}
+	return m, req.To, nil
+}
+
+// The messages not acked yet, by recipient.
+type mailbox struct {
+	mu      sync.Mutex
+	dir     string // empty if the messages are only kept in memory
+	lastID  uint64
+	pending map[string][]*directMessage // in the order of MSG_ID
+}
+
+// Opens the mailboxes stored in dir, which is created on demand.
+func openMailbox(dir string) (*mailbox, error) {
+	mb := &mailbox{dir: dir, pending: make(map[string][]*directMessage)}
+	if len(dir) == 0 {
+		return mb, nil
+	}
+	users, err := os.ReadDir(dir)
+	if os.IsNotExist(err) {
+		return mb, nil
+	} else if err != nil {
+		return nil, err
+	}
+	for _, user := range users {
+		if !user.IsDir() {
+			continue
+		}
+		// ReadDir sorts the names, which are MSG_IDs of the same length.
+		files, err := os.ReadDir(filepath.Join(dir, user.Name()))
+		if err != nil {
+			return nil, err
+		}
+		for _, file := range files {
+			path := filepath.Join(dir, user.Name(), file.Name())
+			if strings.HasSuffix(path, ".tmp") {
+				os.Remove(path)
+				continue
+			}
+			content, err := os.ReadFile(path)
+			if err != nil {
+				return nil, err
+			}
+			m, err := decodeDirectMessage(content)
+			if err != nil {
+				log.Println("[Error] Malformed direct message in " + path)
+				continue
+			}
+			mb.pending[user.Name()] = append(mb.pending[user.Name()], m)
+			if m.id > mb.lastID {
+				mb.lastID = m.id
+			}
+		}
+	}
+	return mb, nil
+}
+
+// The names are padded so that they are sorted by id.
+func (mb *mailbox) path(to string, id uint64) string {
+	name := strconv.FormatUint(id, 16)
+	return filepath.Join(mb.dir, to, strings.Repeat("0", 16-len(name))+name)
+}
+
+// Keeps the message for the recipient, assigning its MSG_ID, unless it's
+// kept already. Returns the message kept.
+func (mb *mailbox) put(to string, m *directMessage) (*directMessage, error) {
+	mb.mu.Lock()
+	defer mb.mu.Unlock()
+
+	for _, prev := range mb.pending[to] {
+		if prev.from == m.from && prev.dm_id == m.dm_id {
+			return prev, nil
+		}
+	}
+	if len(mb.pending[to]) >= kMaxPendingDMs {
+		return nil, errors.New("The mailbox of " + to + " is full")
+	}
+	// the ids grow with the time, so that the ids of the messages acked
+	// before a restart are not reused.
+	m.id = mb.lastID + 1
+	if now := uint64(time.Now().UnixNano()); now > m.id {
+		m.id = now
+	}
+	if len(mb.dir) != 0 {
+		if err := os.MkdirAll(filepath.Join(mb.dir, to), 0700); err != nil {
+			return nil, err
+		}
+		tmp := mb.path(to, m.id) + ".tmp"
+		if err := os.WriteFile(tmp, m.encode(), 0600); err != nil {
+			return nil, err
+		}
+		if err := os.Rename(tmp, mb.path(to, m.id)); err != nil {
+			return nil, err
+		}
+	}
+	mb.lastID = m.id
+	mb.pending[to] = append(mb.pending[to], m)
+	return m, nil
+}
+
+// The messages of the recipient not acked yet.
+func (mb *mailbox) list(to string) []*directMessage {
+	mb.mu.Lock()
+	defer mb.mu.Unlock()
+	return append([]*directMessage(nil), mb.pending[to]...)
+}
+
+// Drops the message the recipient acked.
+func (mb *mailbox) remove(to string, id uint64) error {
+	mb.mu.Lock()
+	defer mb.mu.Unlock()
+
+	pending := mb.pending[to]
+	for i, m := range pending {
+		if m.id != id {
+			continue
+		}
+		mb.pending[to] = append(pending[:i:i], pending[i+1:]...)
+		if len(mb.pending[to]) == 0 {
+			delete(mb.pending, to)
+		}
+		if len(mb.dir) != 0 {
+			return os.Remove(mb.path(to, id))
+		}
+		return nil
+	}
+	return nil
+}
+
+// Sets the directory the published keys and the mailboxes are stored in,
+// which is created on demand.
+func (h *Hub) SetDMDir(dir string) error {
+	if len(dir) == 0 {
+		return errors.New("DM directory should not be empty")
+	}
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return err
+	}
+	keys, err := openKeyDirectory(filepath.Join(dir, kUserKeysFile))
+	if err != nil {
+		return err
+	}
+	mailbox, err := openMailbox(filepath.Join(dir, "mailbox"))
+	if err != nil {
+		return err
+	}
+	h.userKeys = keys
+	h.mailbox = mailbox
+	return nil
+}
+
+// The addresses of the clients the user joined from.
+func (h *Hub) joinedFrom(name string) []net.Addr {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	var clients []net.Addr
+	for _, s := range h.sessions {
+		if s.username == name && s.joined {
+			clients = append(clients, s.ra)
+		}
+	}
+	return clients
+}
+
+func (h *RequestHandler) handleSendDM(recv []byte) error {
+	m, to, err := decodeSendDM(recv)
+	if err != nil {
+		return errors.New(err.Error() + " from " + h.ra.String())
+	}
+	m.from = h.username()
+	m.time = time.Now()
+	switch {
+	case len(m.box) > kMaxChatMsgLen+box.Overhead:
+		return h.rejectDM(m.dm_id, "Message is too long")
+	case h.hub.userKeys.lookup(to) == nil:
+		return h.rejectDM(m.dm_id, to+" has not published a key yet")
+	case !bytes.Equal(h.hub.userKeys.lookup(m.from), m.key):
+		return h.rejectDM(m.dm_id, "Your key is not the published one")
+	}
+
+	kept, err := h.hub.mailbox.put(to, m)
+	if err != nil {
+		return h.rejectDM(m.dm_id, err.Error())
+	}
+	m = kept
+	if _, err = h.hub.writeTo(codec.Marshal(&codec.DMSent{DMID: m.dm_id}), h.ra); err != nil {
+		return err
+	}
+
+	packet := m.encode()
+	for _, ra := range h.hub.joinedFrom(to) {
+		if _, err := h.hub.writeTo(packet, ra); err != nil {
+			log.Println("Server " + err.Error())
+		}
+	}
+	return nil
+}
+
+// Replies the reason of the failure, which is also returned.
+func (h *RequestHandler) rejectDM(dm_id uint64, reason string) error {
+	resp := codec.Marshal(&codec.DMFailed{DMID: dm_id, Reason: reason})
+	if _, err := h.hub.writeTo(resp, h.ra); err != nil {
+		return err
+	}
+	return errors.New(reason + " from " + h.ra.String())
+}
+
+// Replies the number of messages in the mailbox of the user, and pushes
+// them.
+func (h *RequestHandler) handleGetDMs() error {
+	pending := h.hub.mailbox.list(h.username())
+	resp := codec.Marshal(&codec.DMCount{Count: uint32(len(pending))})
+	if _, err := h.hub.writeTo(resp, h.ra); err != nil {
+		return err
+	}
+	for _, m := range pending {
+		if _, err := h.hub.writeTo(m.encode(), h.ra); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (h *RequestHandler) handleDMAck(recv []byte) error {
+	var req codec.DMAck
+	if codec.Unmarshal(recv, &req) != nil {
+		return errors.New("Malformed direct message ack from " + h.ra.String())
+	}
+	return h.hub.mailbox.remove(h.username(), req.MsgID)
+}
+
+// Sends a direct message given as "<user> <message>".
+func (c *Client) SendDM(args string) {
+	if c.identity == nil {
+		println("Direct messages are disabled, as the identity key isn't opened.")
+		return
+	}
+	fields := strings.SplitN(strings.TrimSpace(args), " ", 2)
+	if len(fields) != 2 || len(strings.TrimSpace(fields[1])) == 0 {
+		println("Usage: dm: <user> <message>")
+		return
+	}
+	to, msg := fields[0], strings.TrimSpace(fields[1])
+	if len(msg) > kMaxChatMsgLen {
+		println("Message should be at most " + strconv.Itoa(kMaxChatMsgLen) + " bytes.")
+		return
+	}
+
+	key, err := c.userKey(to)
+	if err == nil {
+		err = c.trustKey(c.identity, to, key)
+	}
+	if err != nil {
+		log.Println("[Error] " + err.Error())
+		return
+	}
+	var peer [kKeySize]byte
+	copy(peer[:], key)
+	var nonce [kNonceSize]byte
+	var dm_id [8]byte
+	if _, err = rand.Read(nonce[:]); err == nil {
+		_, err = rand.Read(dm_id[:])
+	}
+	if err != nil {
+		log.Println("[Error] " + err.Error())
+		return
+	}
+	sealed := box.Seal(nil, []byte(msg), &nonce, &peer, c.identity.private)
+
+	id := binary.LittleEndian.Uint64(dm_id[:])
+	packet := encodeSendDM(id, to, c.identity.public[:], nonce[:], sealed)
+	var sent codec.DMSent
+	var failed codec.DMFailed
+	resp, err := exchange(c, packet, func(resp []byte) bool {
+		return (codec.Unmarshal(resp, &sent) == nil && sent.DMID == id) ||
+			(codec.Unmarshal(resp, &failed) == nil && failed.DMID == id)
+	})
+	if err != nil {
+		log.Println("[Error] Sending direct message: " + err.Error())
+	} else if ResponseType(resp[0]) == kRespDMFailed {
+		log.Println("[Error] " + failed.Reason)
+	}
+}
+
+// Asks the hub for the messages in the mailbox, which are pushed.
+func (c *Client) fetchDMs() error {
+	_, err := c.request(nil, kReqGetDMs, func(packet []byte) bool {
+		return codec.Unmarshal(packet, new(codec.DMCount)) == nil
+	})
+	if err != nil {
+		return errors.New("Fetching direct messages: " + err.Error())
+	}
+	return nil
+}
+
+// Shows a direct message pushed by the hub, and acks it.
+func (c *Client) receiveDM(packet []byte) {
+	c.mu.Lock()
+	id := c.identity
+	c.mu.Unlock()
+	if id == nil {
+		return
+	}
+	m, err := decodeDirectMessage(packet)
+	if err != nil {
+		return
+	}
+	if err = c.trustKey(id, m.from, m.key); err != nil {
+		c.printAsync("[Error] Direct message from " + m.from + " not shown: " + err.Error())
+		return
+	}
+
+	var peer [kKeySize]byte
+	copy(peer[:], m.key)
+	var nonce [kNonceSize]byte
+	copy(nonce[:], m.nonce)
+	msg, ok := box.Open(nil, m.box, &nonce, &peer, id.private)
+
+	// a message pushed again after its ack got lost is shown once.
+	seen := m.from + "/" + strconv.FormatUint(m.dm_id, 16)
+	c.mu.Lock()
+	shown := c.shownDMs[seen]
+	c.shownDMs[seen] = true
+	c.mu.Unlock()
+	switch {
+	case !ok:
+		c.printAsync("[Error] Dropped a direct message from " + m.from + " that can't be decrypted.")
+	case !shown:
+		c.printAsync(m.time.Format(time.UnixDate) + ": [dm] " + string(msg) + " from " + m.from)
+	}
+	c.write(codec.Marshal(&codec.DMAck{MsgID: m.id}))
+}
@@ -0,0 +1,103 @@
+package udpchat
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/nacl/box"
+)
+
+func TestMailbox(t *testing.T) {
+	dir := t.TempDir()
+	mb, err := openMailbox(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	newMessage := func(dm_id uint64) *directMessage {
+		return &directMessage{time: time.Now(), from: "alice", dm_id: dm_id,
+			key: make([]byte, kKeySize), nonce: make([]byte, kNonceSize), box: make([]byte, box.Overhead+2)}
+	}
+	first, _ := mb.put("bob", newMessage(1))
+	// a retransmitted message is kept once.
+	if again, _ := mb.put("bob", newMessage(1)); again.id != first.id {
+		t.Fatalf("retransmission kept as %d", again.id)
+	}
+	second, _ := mb.put("bob", newMessage(2))
+
+	if mb, err = openMailbox(dir); err != nil {
+		t.Fatal(err)
+	}
+	pending := mb.list("bob")
+	if len(pending) != 2 || pending[0].id != first.id || pending[1].dm_id != 2 || pending[0].from != "alice" {
+		t.Fatalf("reopened mailbox %v", pending)
+	}
+	if err = mb.remove("bob", first.id); err != nil {
+		t.Fatal(err)
+	}
+	if mb, err = openMailbox(dir); err != nil {
+		t.Fatal(err)
+	}
+	if pending = mb.list("bob"); len(pending) != 1 || pending[0].id != second.id {
+		t.Fatalf("mailbox after the ack %v", pending)
+	}
+}
+
+func TestDirectMessageRelay(t *testing.T) {
+	hub := newTestHub(t)
+	alice, bob := dialTestHub(t, hub), dialTestHub(t, hub)
+	loginTestHub(t, alice, "alice")
+	loginTestHub(t, bob, "bob")
+
+	publish := func(conn *testConn) (*[kKeySize]byte, *[kKeySize]byte) {
+		public, private, err := box.GenerateKey(rand.Reader)
+		if err != nil {
+			t.Fatal(err)
+		}
+		conn.Write(append([]byte{byte(kReqPublishKey)}, public[:]...))
+		if resp := readTestPacket(t, conn); ResponseType(resp[0]) != kRespKeyPublished {
+			t.Fatalf("published with response %q", resp)
+		}
+		return public, private
+	}
+	alicePublic, alicePrivate := publish(alice)
+	bobPublic, bobPrivate := publish(bob)
+
+	bob.Write(append([]byte{byte(kReqGetKey)}, "alice"...))
+	if resp := readTestPacket(t, bob); string(resp[2+len("alice"):]) != string(alicePublic[:]) {
+		t.Fatalf("key of alice %q", resp)
+	}
+
+	// bob hasn't joined, the message waits in his mailbox.
+	var nonce [kNonceSize]byte
+	sealed := box.Seal(nil, []byte("psst"), &nonce, bobPublic, alicePrivate)
+	alice.Write(encodeSendDM(7, "bob", alicePublic[:], nonce[:], sealed))
+	if resp := readTestPacket(t, alice); ResponseType(resp[0]) != kRespDMSent {
+		t.Fatalf("sent with response %q", resp)
+	}
+	alice.Write(encodeSendDM(8, "bob", bobPublic[:], nonce[:], sealed))
+	if resp := readTestPacket(t, alice); ResponseType(resp[0]) != kRespDMFailed {
+		t.Fatalf("sent with the key of bob, response %q", resp)
+	}
+
+	bob.Write([]byte{byte(kReqGetDMs)})
+	if resp := readTestPacket(t, bob); ResponseType(resp[0]) != kRespDMCount || binary.LittleEndian.Uint32(resp[1:]) != 1 {
+		t.Fatalf("fetched with response %q", resp)
+	}
+	m, err := decodeDirectMessage(readTestPacket(t, bob))
+	if err != nil || m.from != "alice" || m.dm_id != 7 {
+		t.Fatalf("pushed %+v, %v", m, err)
+	}
+	var peer [kKeySize]byte
+	copy(peer[:], m.key)
+	if msg, ok := box.Open(nil, m.box, &nonce, &peer, bobPrivate); !ok || string(msg) != "psst" {
+		t.Fatalf("opened %q, %v", msg, ok)
+	}
+
+	bob.Write(binary.LittleEndian.AppendUint64([]byte{byte(kReqDMAck)}, m.id))
+	time.Sleep(100 * time.Millisecond)
+	if pending := hub.mailbox.list("bob"); len(pending) != 0 {
+		t.Fatalf("%d messages left after the ack", len(pending))
+	}
+}
@@ -1,29 +1,117 @@
 package udpchat
 
 // We've designed a simple file transfer protocol based on UDP. This protocol
-// is far from efficiency and correctness, but it's available when client and
-// server are always connected, and packets between them never lost.
+// is far from efficiency and correctness, but it copes with packets lost,
+// duplicated or reordered between client and server, as the tests under the
+// bad networks of impair.go check. Chat messages are the exception: they are
+// sent once, and stored in the order they arrive.
 //
-//  Client					  			   |		Server
-//  kReqSendFile <packet_id> <filename>  ---->
-//				  		     			 <----  kRespSendFileOK
-//				  		     			 <----  kRespSendFileFailed
+//  Client										   |	Server
+//  kReqSendFile PACKET_ID SEG_SIZE WINDOW TOTAL_SIZE USER_LEN USERNAME FILENAME  ---->
+//				<----  kRespSendFileOK PACKET_ID SEG_SIZE WINDOW SEG_COUNT RESUME_FROM
+//								<----  kRespSendFileFailed PACKET_ID
+//  kReqSendFileAck PACKET_ID					  ---->
 //
-// At this stage, client requests for permission to send file, and the
-// server responses with either kRespSendFileOK that permits the request
-// or kRespSendFileFailed that doesn't. We can set up an unreliable connection
-// between client and server through this operation(only two-way handshake),
-// TODO Three-way handshake
+// At this stage, client requests for permission to send file, proposing the
+// segment size and the window, and the server responses with either
+// kRespSendFileOK that permits the request with the negotiated parameters
+// (never larger than the proposed ones), or kRespSendFileFailed that doesn't.
+// SEG_COUNT is the number of segments TOTAL_SIZE bytes are split into with the
+// negotiated SEG_SIZE, every segment carries SEG_SIZE bytes but the last one.
+// The client then acks the negotiated parameters, which completes the three-way
+// handshake. The request is retransmitted until answered, and the server
+// answers a retransmitted request with the parameters it negotiated the first
+// time. If the final ack is lost, the first segment establishes the transfer
+// implicitly.
 //
-//  kReqSendSeg PACKET_ID SEG_ID SEG_CONTENT  ---->
-//				  							  <----  kRespRecvSegAck PACKET_ID SEG_ID
+// The server stores the file as <upload dir>/<user>/FILENAME, <user> being the
+// user that logged in rather than USERNAME, where FILENAME is reduced to its
+// last path element, and rejects names that can't be made safe (see
+// storage.go). A file whose name is taken is stored as "name-1.ext",
+// "name-2.ext" and so on, existing files are never overwritten.
+//
+//  kReqSendSeg PACKET_ID SEG_ID CRC32C SEG_CONTENT  ---->
+//				  <----  kRespRecvSegAck PACKET_ID CUM_ACK N_RANGES [START END]...
 //
 // The file may firstly be segmented and each segment is identified by a unique
-// PACKET_ID along with a SEG_ID that's unique within the packet, followed by the
-// content of the segment. The server sends back an ack packet indicating that it has
-// accepted the packet.
-// When all segments are accepted, the file transfer finishes.
+// PACKET_ID along with a SEG_ID that's unique within the packet, followed by
+// the CRC32C (Castagnoli) checksum and the content of the segment. Segments
+// whose checksum mismatches are dropped by the server. It sends back a
+// selective ack for every segment it receives: all segments below CUM_ACK are
+// accepted, as well as those within the N_RANGES half-open ranges [START, END)
+// (at most kMaxSackRanges). When all segments are accepted, the client
+// terminates the transfer (see FIN below).
+//
+// The server reassembles the file in the order of SEG_ID: the contiguous prefix
+// of accepted segments is written to a temporary file as soon as it grows, and
+// only segments received out of order are buffered in memory, which is bounded
+// by the window. The temporary file is renamed to the file name on commit.
+//
+// Every kCheckpointSegments segments, the written prefix is flushed and its
+// length persisted beside the temporary file, both named after PACKET_ID.
+// PACKET_ID is derived from the user, the host, the path, the size and the
+// modification time of the file, so it stays the same when a client restarts
+// and sends the file again. The server then reopens the temporary file (even
+// after a restart of its own, or when the handshake comes from a new address
+// while the old transfer is still registered), and answers the handshake with
+// RESUME_FROM, the first segment missing. The client only reads the segments
+// below RESUME_FROM for the SHA-256 and sends the others.
+//
+// A client runs any number of transfers at the same time in background, each of
+// them under its own PACKET_ID: a single goroutine reads the socket and
+// dispatches the packets of the server to their transfer by PACKET_ID, and
+// hands the others to the command waiting for a reply. The "transfers" command
+// lists the progress and the throughput of each transfer.
+//
+// The client keeps at most a window of unacknowledged segments in flight
+// (Client.SetSendWindow), and only reads further segments from the file as acks
+// open the window. A segment that is not acked within the retransmission
+// timeout is sent again and the timeout is doubled (up to kMaxRTO). A gap,
+// that's a segment missing below the highest acked one, is retransmitted right
+// away once kFastRetransmitAcks acks have reported it. The transfer is
+// abandoned after kMaxRetries consecutive timeouts. The server acks duplicated
+// segments as well, since the previous ack may have been lost.
+//
+// The number of segments in flight is further limited by a congestion window
+// (see congestionControl): it grows as segments are acked, is halved when a
+// gap is detected and collapses to one segment on timeout. The retransmission
+// timeout is derived from the measured RTT, and segments are paced over the RTT
+// rather than sent in bursts, so that chat messages going through the same
+// server are not starved by a transfer.
+//
+//  kReqSendFileFin PACKET_ID FLAG [SHA256]  ---->
+//					    <----  kRespSendFileFinAck PACKET_ID STATUS
+//
+// Once all segments are acked, the client commits the file with a FIN (FLAG
+// kFinCommit) carrying the SHA-256 of the whole file. The server compares it
+// with the digest of what it has written, and answers kFinStatusOK if they
+// match, kFinStatusCorrupt if they don't (the file is then discarded), or
+// kFinStatusFailed if the file could not be written. A client that fails in the
+// middle of the transfer cancels it instead (FLAG kFinCancel), and the server
+// discards the received segments. The FIN is retransmitted until answered, so
+// the server keeps a closed transfer for kTimeWait in order to answer the
+// retransmissions with the same STATUS.
+//
+//  kReqListFiles [FROM]  ---->
+//		   <----  kRespFileList COUNT [LEN <FILENAME (SIZE bytes)>]... [NEXT]
 //
-// TODO four-way handshake to terminate connection
+// The list is sent a page at a time, see lists.go. Files uploaded to the server
+// can be listed and downloaded by any client, and are referred to as
+// "USERNAME/FILENAME". A download runs the same protocol with the roles
+// reversed, under types of its own so that the packets are not taken for an
+// upload:
 //
+//  kReqGetFile PACKET_ID SEG_SIZE WINDOW 0 USER_LEN USERNAME FILENAME  ---->
+//				<----  kRespGetFileOK PACKET_ID SEG_SIZE WINDOW TOTAL_SIZE USER_LEN USERNAME FILENAME
+//								<----  kRespGetFileFailed PACKET_ID
+//  kReqGetFileAck PACKET_ID RESUME_FROM			  ---->
+//				<----  kRespFileSeg PACKET_ID SEG_ID CRC32C SEG_CONTENT
+//  kReqFileSegAck PACKET_ID CUM_ACK N_RANGES [START END]...  ---->
+//						    <----  kRespFileFin PACKET_ID SHA256
+//  kReqFileFinAck PACKET_ID STATUS			  ---->
 //
+// PACKET_ID is chosen at random by the client. The server retransmits its offer
+// until the client acks it, and its FIN until the client tells whether the file
+// passed the SHA-256 check. Only files in the upload directory are served, and
+// the client writes the file to the working directory under the last element of
+// FILENAME, as another version if a local file has the same name.
@@ -0,0 +1,336 @@
+package udpchat
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"log"
+	"os"
+	"time"
+
+	"github.com/neverchanje/unplayground/udpchat/codec"
+)
+
+// A client that hears nothing from the server for this long gives up the
+// download.
+const kDownloadIdleTimeout = kMaxRetries * kMaxRTO
+
+// Only files uploaded to this server can be downloaded, FILENAME being
+// "<user>/<name>" as listed by kReqListFiles. The request has the same format
+// as kReqSendFile, PACKET_ID being chosen by the client and TOTAL_SIZE ignored.
+func (h *RequestHandler) handleGetFile(recv []byte) error {
+	var req codec.GetFile
+	if err := codec.Unmarshal(recv, &req); err != nil {
+		return errors.New("Malformed file transfer request from " + h.ra.String())
+	}
+	session, err := newFileSession(&req.FileSyn)
+	if err != nil {
+		return err
+	}
+
+	fname, err := h.hub.storedPath(session.fname)
+	if err != nil {
+		h.rejectDownload(session.packet_id)
+		return errors.New("No such file: " + session.fname)
+	}
+
+	h.hub.mu.Lock()
+	if prev, has := h.hub.fileHandlers[session.packet_id]; has {
+		h.hub.mu.Unlock()
+		if prev.ra.String() == h.ra.String() {
+			// serveDownload is retransmitting the offer.
+			return nil
+		}
+		h.rejectDownload(session.packet_id)
+		return errors.New("Duplicated download id from " + h.ra.String())
+	}
+
+	info, err := os.Stat(fname)
+	if err == nil && !info.Mode().IsRegular() {
+		err = errors.New("No such file: " + session.fname)
+	}
+	if err == nil {
+		session.total_size = uint64(info.Size())
+		err = session.negotiate()
+	}
+	if err != nil {
+		h.hub.mu.Unlock()
+		h.rejectDownload(session.packet_id)
+		return err
+	}
+	h.download = newQueuedLink(func(packet []byte) error {
+		_, err := h.hub.writeTo(packet, h.ra)
+		return err
+	}, kMaxRecvWindow)
+	h.hub.fileHandlers[session.packet_id] = h
+	h.hub.mu.Unlock()
+
+	go h.serveDownload(session, fname)
+	return nil
+}
+
+func (h *RequestHandler) rejectDownload(packet_id uint64) {
+	resp := codec.Marshal(&codec.GetFileFailed{PacketID: packet_id})
+	if _, err := h.hub.writeTo(resp, h.ra); err != nil {
+		log.Println("Server " + err.Error())
+	}
+}
+
+// Passes a packet of the client to serveDownload, dropping it if the
+// sender falls behind like the network would.
+func (h *RequestHandler) handleDownloadPacket(recv []byte) error {
+	if h.download == nil {
+		return errors.New("Unexpected download packet from " + h.ra.String())
+	}
+	h.download.deliver(recv)
+	return nil
+}
+
+// Runs the download with the roles of the upload reversed:
+//
+//	kRespGetFileOK PACKET_ID SEG_SIZE WINDOW TOTAL_SIZE USER_LEN USERNAME FILENAME  ---->
+//							 <----  kReqGetFileAck PACKET_ID RESUME_FROM
+//	kRespFileSeg PACKET_ID SEG_ID CRC32C SEG_CONTENT		  ---->
+//				   <----  kReqFileSegAck PACKET_ID CUM_ACK N_RANGES [START END]...
+//	kRespFileFin PACKET_ID SHA256				  ---->
+//							 <----  kReqFileFinAck PACKET_ID STATUS
+func (h *RequestHandler) serveDownload(session *fileSession, fname string) {
+	defer h.hub.unregisterLater(session.packet_id, h)
+
+	log.Println("File downloading " + session.fname + " to remote: " + h.ra.String())
+
+	var resume_from uint32
+	offer := codec.Marshal(&codec.GetFileOK{FileSyn: session.syn()})
+	_, err := exchange(h.download, offer, func(packet []byte) bool {
+		var ack codec.GetFileAck
+		if !decodeTransfer(packet, &ack, session.packet_id) {
+			return false
+		}
+		resume_from = ack.ResumeFrom
+		return resume_from <= session.seg_count
+	})
+	if err != nil {
+		log.Println("Failed to start download: " + session.fname + " " + err.Error())
+		return
+	}
+
+	fs := newFileSender(h.download, session.packet_id, int(session.window))
+	fs.seg_type = byte(kRespFileSeg)
+	fs.ack_type = byte(kReqFileSegAck)
+	fs.seg_size = int(session.seg_size)
+	fs.seg_count = session.seg_count
+	fs.next_sid = resume_from
+	if err = fs.sendFileImpl(fname); err != nil {
+		log.Println("Failed to send file: " + session.fname + " " + err.Error())
+		return
+	}
+
+	fin := &codec.FileFin{PacketID: session.packet_id}
+	copy(fin.Digest[:], fs.digest.Sum(nil))
+	var status byte
+	_, err = exchange(h.download, codec.Marshal(fin), func(packet []byte) bool {
+		var ack codec.FileFinAck
+		if !decodeTransfer(packet, &ack, session.packet_id) {
+			return false
+		}
+		status = ack.Status
+		return true
+	})
+	if err != nil || status != kFinStatusOK {
+		log.Println("File downloading failed: " + session.fname)
+		return
+	}
+	log.Println("File downloading finished: " + session.fname)
+}
+
+// Answers a page of the stored files, see lists.go.
+func (h *RequestHandler) handleListFiles(recv []byte) error {
+	var req codec.ListFiles
+	if err := codec.Unmarshal(recv, &req); err != nil {
+		return err
+	}
+	page, next := pageList(h.hub.listStored(), req.From)
+	resp := codec.Marshal(&codec.FileList{Files: page, Next: next})
+	_, err := h.hub.writeTo(resp, h.ra)
+	return err
+}
+
+func (c *Client) listFiles() ([]string, error) {
+	return fetchList(c, func(from uint32) codec.Message {
+		req := new(codec.ListFiles)
+		req.From = from
+		return req
+	}, func(packet []byte) ([]string, uint32, bool) {
+		var list codec.FileList
+		err := codec.Unmarshal(packet, &list)
+		return list.Files, list.Next, err == nil
+	})
+}
+
+func (c *Client) ListFiles() {
+	files, err := c.listFiles()
+	if err != nil {
+		log.Println("[Error] Listing files: " + err.Error())
+		return
+	}
+	if len(files) == 0 {
+		println("No files now.")
+	}
+	for _, file := range files {
+		println(file)
+	}
+}
+
+// Starts downloading a file uploaded to the server in background, into the
+// working directory under the last element of its name. A local file of the
+// same name is kept, the downloaded one is then stored as another version.
+func (c *Client) GetFile(name string) {
+	if len(name) == 0 {
+		println("Input file name should not be empty.")
+		return
+	}
+	local, err := sanitizeName(name)
+	if err != nil {
+		log.Println("[Error] Getting file: Invalid file name " + name)
+		return
+	}
+
+	id := make([]byte, 8)
+	if _, err = rand.Read(id); err != nil {
+		log.Println("[Error] Getting file: " + err.Error())
+		return
+	}
+	t, err := c.startTransfer(binary.LittleEndian.Uint64(id), false, name)
+	if err != nil {
+		log.Println("[Error] Getting file: " + err.Error())
+		return
+	}
+	go func() {
+		c.finishTransfer(t, c.getFile(t, local))
+	}()
+}
+
+func (c *Client) getFile(t *transfer, local string) error {
+	packet_id := t.packet_id
+	name := t.fname
+
+	req := &fileSession{
+		packet_id: packet_id,
+		seg_size:  kSegmentSize,
+		window:    uint16(c.sendWindow),
+		user:      c.username,
+		fname:     name,
+	}
+	var session *fileSession
+	syn := codec.Marshal(&codec.GetFile{FileSyn: req.syn()})
+	resp, err := exchange(t.link, syn, func(packet []byte) bool {
+		if decodeTransfer(packet, new(codec.GetFileFailed), packet_id) {
+			return true
+		}
+		var ok codec.GetFileOK
+		if codec.Unmarshal(packet, &ok) != nil {
+			return false
+		}
+		offer, err := newFileSession(&ok.FileSyn)
+		if err != nil || offer.packet_id != packet_id ||
+			offer.seg_size > req.seg_size || offer.window > req.window ||
+			offer.segCount() > uint64(^uint32(0)) {
+			return false
+		}
+		session = offer
+		return true
+	})
+	if err != nil {
+		return err
+	}
+	if ResponseType(resp[0]) == kRespGetFileFailed {
+		return errors.New("No such file on the server")
+	}
+	session.seg_count = uint32(session.segCount())
+
+	fr := newFileReceiver(session, local)
+	if err := fr.open(); err != nil {
+		return err
+	}
+	abort := func() {
+		fr.mu.Lock()
+		fr.close(kFinStatusFailed)
+		fr.mu.Unlock()
+	}
+
+	ack := codec.Marshal(&codec.GetFileAck{PacketID: packet_id, ResumeFrom: session.resume_from})
+	if err = t.link.write(ack); err != nil {
+		abort()
+		return err
+	}
+	t.establish(session.total_size, func() uint64 {
+		fr.mu.Lock()
+		defer fr.mu.Unlock()
+		return fr.written
+	})
+	println("Start file downloading " + name)
+
+	for {
+		packet, err := t.link.read(time.Now().Add(kDownloadIdleTimeout))
+		if err == errTimeout {
+			abort()
+			return errors.New("Server stopped responding")
+		} else if err != nil {
+			abort()
+			return err
+		}
+
+		switch ResponseType(packet[0]) {
+		case kRespGetFileOK:
+			// the ack got lost
+			err = t.link.write(ack)
+		case kRespFileSeg:
+			var seg codec.FileSeg
+			if codec.Unmarshal(packet, &seg) != nil {
+				continue
+			}
+			seg_ack := fr.handleSendSegment(newFileSegment(&seg.Segment))
+			err = t.link.write(seg_ack.encode(byte(kReqFileSegAck)))
+		case kRespFileFin:
+			var fin codec.FileFin
+			if codec.Unmarshal(packet, &fin) != nil {
+				continue
+			}
+			return finishDownload(t.link, fr, fin.Digest[:])
+		}
+		if err != nil {
+			log.Println("[Error] " + err.Error())
+		}
+	}
+}
+
+// Verifies the downloaded file against digest and reports the result to
+// the server. A FIN-ACK lost on the way is not retransmitted, the server
+// gives up after its own retransmissions.
+func finishDownload(link packetLink, fr *fileReceiver, digest []byte) error {
+	fr.mu.Lock()
+	complete := fr.isComplete()
+	if !complete {
+		fr.close(kFinStatusFailed)
+	}
+	fr.expected = append([]byte(nil), digest...)
+	fr.mu.Unlock()
+
+	status := kFinStatusFailed
+	var err error
+	if !complete {
+		err = errors.New("Incomplete file")
+	} else if err = fr.commit(); err == errDigestMismatch {
+		status = kFinStatusCorrupt
+	} else if err == nil {
+		status = kFinStatusOK
+	}
+
+	if werr := link.write(codec.Marshal(&codec.FileFinAck{PacketID: fr.packet_id, Status: status})); err == nil {
+		err = werr
+	}
+	if err == nil {
+		println("File downloading finished: " + fr.fname)
+	}
+	return err
+}
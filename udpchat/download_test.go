@@ -0,0 +1,73 @@
+package udpchat
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/neverchanje/unplayground/udpchat/codec"
+)
+
+func storeTestFile(t *testing.T, hub *Hub, user string, name string, content []byte) {
+	dir := filepath.Join(hub.uploadDir, user)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, name), content, 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestGetFile(t *testing.T) {
+	hub := newTestHub(t)
+	content := bytes.Repeat([]byte("fedcba9876543210"), 5000)
+	storeTestFile(t, hub, "alice", "notes.txt", content)
+	bob := newTestClient(t, hub, "bob")
+	t.Chdir(t.TempDir())
+
+	bob.GetFile("alice/notes.txt")
+	if err := waitTransfer(t, bob, 10*time.Second); err != nil {
+		t.Fatal(err)
+	}
+	if got, err := os.ReadFile("notes.txt"); err != nil || !bytes.Equal(got, content) {
+		t.Fatalf("downloaded %d bytes, %v", len(got), err)
+	}
+
+	bob.GetFile("alice/missing.txt")
+	if err := waitTransfer(t, bob, 10*time.Second); err == nil {
+		t.Fatal("downloaded a missing file")
+	}
+}
+
+// An upload reusing the PACKET_ID of a download is refused.
+func TestUploadOverDownload(t *testing.T) {
+	hub := newTestHub(t)
+	storeTestFile(t, hub, "alice", "notes.txt", bytes.Repeat([]byte("x"), 100000))
+	alice := dialTestHub(t, hub)
+	joinTestHub(t, alice, "alice")
+
+	syn := codec.FileSyn{PacketID: 7, SegSize: kSegmentSize, Window: 8, User: "alice", Filename: "alice/notes.txt"}
+	alice.Write(codec.Marshal(&codec.GetFile{FileSyn: syn}))
+	if err := codec.Unmarshal(readTestPacket(t, alice), new(codec.GetFileOK)); err != nil {
+		t.Fatal(err)
+	}
+
+	syn.Filename, syn.TotalSize = "notes.txt", 100
+	alice.Write(codec.Marshal(&codec.SendFile{FileSyn: syn}))
+	for {
+		resp := readTestPacket(t, alice)
+		if ResponseType(resp[0]) == kRespGetFileOK {
+			// the offer of the download being retransmitted
+			continue
+		}
+		if !decodeTransfer(resp, new(codec.SendFileFailed), 7) {
+			t.Fatalf("uploaded over a download with response %q", resp)
+		}
+		break
+	}
+	if faults := hub.faultsOf(alice.LocalAddr()); faults[kFaultPanic] != 0 {
+		t.Fatalf("counted faults %v", faults)
+	}
+}
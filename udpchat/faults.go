@@ -0,0 +1,175 @@
+package udpchat
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"runtime/debug"
+	"time"
+
+	"github.com/neverchanje/unplayground/udpchat/codec"
+)
+
+// Every request is decoded before it's handled, and the ones the hub can't
+// handle are answered with the reason:
+//
+//  Client								|	Server
+//  REQ_TYPE ...  ---->
+//		<----  kRespRequestFailed REQ_TYPE CODE REASON
+//
+// CODE tells whether the request is malformed, of an unknown type, unexpected
+// in the state of the session (like a segment of an unknown transfer), or
+// refused for its fields (like an empty message). The hub counts the bad
+// datagrams of every source, including the ones it can't answer, and stops
+// answering a source that sends too many of them in a short time, so that a
+// flood of garbage isn't reflected back. A panic in handling a datagram is
+// counted the same way rather than taking the hub down.
+
+type faultKind int
+
+const (
+	kFaultUnsealed        faultKind = iota // not sealed, forged, replayed, or a bad hello
+	kFaultUnauthenticated                  // without a valid session token
+	kFaultMalformed
+	kFaultUnknownType
+	kFaultUnexpected
+	kFaultInvalid
+	kFaultPanic
+	kNumFaults
+)
+
+const (
+	kFaultWindow     = 10 * time.Second
+	kMaxFaultReplies = 20 // to a source within kFaultWindow
+
+	// The counters of a source are forgotten once it has been quiet for
+	// kFaultExpiry, and at most kMaxFaultSources sources are tracked.
+	kFaultExpiry     = 10 * time.Minute
+	kMaxFaultSources = 4096
+)
+
+// The bad datagrams of a source, by kind.
+type sourceFaults struct {
+	counts [kNumFaults]uint64
+	last   time.Time
+
+	window  time.Time // start of the current kFaultWindow
+	replies int       // answered in the current window
+}
+
+func faultOf(code codec.ErrorCode) faultKind {
+	switch code {
+	case codec.CodeMalformed:
+		return kFaultMalformed
+	case codec.CodeUnknownType:
+		return kFaultUnknownType
+	case codec.CodeUnexpected:
+		return kFaultUnexpected
+	}
+	return kFaultInvalid
+}
+
+// The IP address of ra over UDP, so that a source is counted across ports.
+func sourceOf(ra net.Addr) string {
+	if udp, ok := ra.(*net.UDPAddr); ok {
+		return udp.IP.String()
+	}
+	return ra.String()
+}
+
+// Counts a bad datagram from ra, returns whether it may be answered.
+func (h *Hub) fault(ra net.Addr, kind faultKind) bool {
+	source := sourceOf(ra)
+	now := time.Now()
+
+	h.faultsMu.Lock()
+	defer h.faultsMu.Unlock()
+	f, has := h.faults[source]
+	if !has {
+		if len(h.faults) >= kMaxFaultSources {
+			return false
+		}
+		f = new(sourceFaults)
+		h.faults[source] = f
+	}
+	f.counts[kind]++
+	f.last = now
+
+	if now.Sub(f.window) >= kFaultWindow {
+		f.window = now
+		f.replies = 0
+	}
+	f.replies++
+	if f.replies == kMaxFaultReplies+1 {
+		log.Println("Server Too many bad datagrams from " + source + ", not answering them for a while")
+	}
+	return f.replies <= kMaxFaultReplies
+}
+
+// The bad datagrams counted of the source of ra, by kind.
+func (h *Hub) faultsOf(ra net.Addr) [kNumFaults]uint64 {
+	h.faultsMu.Lock()
+	defer h.faultsMu.Unlock()
+	if f, has := h.faults[sourceOf(ra)]; has {
+		return f.counts
+	}
+	return [kNumFaults]uint64{}
+}
+
+// Forgets the sources quiet since kFaultExpiry.
+func (h *Hub) reapFaults(now time.Time) {
+	h.faultsMu.Lock()
+	defer h.faultsMu.Unlock()
+	for source, f := range h.faults {
+		if now.Sub(f.last) >= kFaultExpiry {
+			delete(h.faults, source)
+		}
+	}
+}
+
+// Answers the request of type t from ra with kRespRequestFailed, unless ra
+// has sent too many bad datagrams lately.
+func (h *Hub) rejectRequest(ra net.Addr, t RequestType, code codec.ErrorCode, reason string) {
+	log.Println("Server " + reason + " from " + ra.String())
+	if !h.fault(ra, faultOf(code)) {
+		return
+	}
+	resp := codec.Marshal(&codec.RequestFailed{Request: uint8(t), Code: code, Reason: reason})
+	if _, err := h.writeTo(resp, ra); err != nil {
+		log.Println("Server " + err.Error())
+	}
+}
+
+// Recovers from a panic in handling a datagram of ra, to be deferred. It
+// doesn't take h.mu, which the handler may have held when it panicked.
+func (h *Hub) recoverPanic(ra net.Addr) {
+	if r := recover(); r != nil {
+		h.fault(ra, kFaultPanic)
+		log.Println("Server Panic handling a datagram from " + ra.String() + ": " +
+			fmt.Sprint(r) + "\n" + string(debug.Stack()))
+	}
+}
+
+// An error of a request that is answered with kRespRequestFailed.
+type requestError struct {
+	code   codec.ErrorCode
+	reason string
+}
+
+func (e *requestError) Error() string {
+	return e.reason
+}
+
+func invalidRequest(reason string) error {
+	return &requestError{codec.CodeInvalid, reason}
+}
+
+// The error of resp if it tells that the hub refused packet, nil otherwise.
+func requestFailure(packet []byte, resp []byte) error {
+	var failed codec.RequestFailed
+	if len(packet) == 0 || codec.Unmarshal(resp, &failed) != nil || failed.Request != packet[0] {
+		return nil
+	}
+	return errors.New("The hub refused the request: " + failed.Reason)
+}
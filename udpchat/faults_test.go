@@ -0,0 +1,136 @@
+package udpchat
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/neverchanje/unplayground/udpchat/codec"
+)
+
+func expectRequestFailed(t *testing.T, conn *testConn, req RequestType, code codec.ErrorCode) {
+	t.Helper()
+	var failed codec.RequestFailed
+	if err := codec.Unmarshal(readTestPacket(t, conn), &failed); err != nil ||
+		RequestType(failed.Request) != req || failed.Code != code {
+		t.Fatalf("request %d failed with %+v, %v", req, failed, err)
+	}
+}
+
+func TestRejectedRequests(t *testing.T) {
+	hub := newTestHub(t)
+	alice := dialTestHub(t, hub)
+	joinTestHub(t, alice, "alice")
+
+	alice.Write([]byte{99})
+	expectRequestFailed(t, alice, 99, codec.CodeUnknownType)
+	alice.Write([]byte{byte(kReqSubscribe), 1})
+	expectRequestFailed(t, alice, kReqSubscribe, codec.CodeMalformed)
+	alice.Write(append(codec.Marshal(new(codec.Ping)), 0))
+	expectRequestFailed(t, alice, kReqPing, codec.CodeMalformed)
+	// a segment before kReqSendFile
+	alice.Write(codec.Marshal(&codec.SendSeg{Segment: codec.Segment{PacketID: 42}}))
+	expectRequestFailed(t, alice, kReqSendSeg, codec.CodeUnexpected)
+	alice.Write(codec.Marshal(&codec.SendChatMsg{Channel: kDefaultChannel}))
+	expectRequestFailed(t, alice, kReqSendChatMsg, codec.CodeInvalid)
+	alice.Write(codec.Marshal(&codec.SendChatMsg{Channel: 42, Message: "hello"}))
+	expectRequestFailed(t, alice, kReqSendChatMsg, codec.CodeInvalid)
+
+	// Datagrams that can't be opened aren't answered.
+	alice.Conn.Write(nil)
+	alice.Conn.Write([]byte{kSecureHello})
+	alice.Conn.Write([]byte{kSecureData, 1, 2, 3})
+
+	// and the hub keeps serving.
+	alice.Write([]byte{byte(kReqPing)})
+	if resp := readTestPacket(t, alice); ResponseType(resp[0]) != kRespPong {
+		t.Fatalf("pinged with response %q", resp)
+	}
+
+	faults := hub.faultsOf(alice.LocalAddr())
+	want := [kNumFaults]uint64{
+		kFaultUnsealed:    3,
+		kFaultMalformed:   2,
+		kFaultUnknownType: 1,
+		kFaultUnexpected:  1,
+		kFaultInvalid:     2,
+	}
+	if faults != want {
+		t.Fatalf("counted faults %v, want %v", faults, want)
+	}
+}
+
+func TestFaultReplyLimit(t *testing.T) {
+	hub := newTestHub(t)
+	alice := dialTestHub(t, hub)
+	joinTestHub(t, alice, "alice")
+
+	for i := 0; i < kMaxFaultReplies+5; i++ {
+		alice.Write([]byte{99})
+	}
+	replies := 0
+	for {
+		alice.SetReadDeadline(time.Now().Add(200 * time.Millisecond))
+		if _, err := alice.Read(make([]byte, kMaxPacketSize)); err != nil {
+			break
+		}
+		replies++
+	}
+	if replies != kMaxFaultReplies {
+		t.Fatalf("answered %d bad requests", replies)
+	}
+	ra := alice.LocalAddr()
+	if faults := hub.faultsOf(ra); faults[kFaultUnknownType] != kMaxFaultReplies+5 {
+		t.Fatalf("counted faults %v", faults)
+	}
+
+	// Good requests are still answered, and bad ones once the window passes.
+	alice.Write([]byte{byte(kReqPing)})
+	if resp := readTestPacket(t, alice); ResponseType(resp[0]) != kRespPong {
+		t.Fatalf("pinged with response %q", resp)
+	}
+	hub.faultsMu.Lock()
+	hub.faults[sourceOf(ra)].window = time.Now().Add(-kFaultWindow)
+	hub.faultsMu.Unlock()
+	alice.Write([]byte{99})
+	expectRequestFailed(t, alice, 99, codec.CodeUnknownType)
+
+	hub.reapFaults(time.Now().Add(kFaultExpiry))
+	if faults := hub.faultsOf(ra); faults != ([kNumFaults]uint64{}) {
+		t.Fatalf("quiet source still counted %v", faults)
+	}
+}
+
+func TestRecoverPanic(t *testing.T) {
+	hub := newHub()
+	ra := &net.UDPAddr{IP: net.ParseIP("127.0.0.1"), Port: 1234}
+	func() {
+		defer hub.recoverPanic(ra)
+		var handler *RequestHandler
+		handler.handleSendFileAck()
+	}()
+	if faults := hub.faultsOf(ra); faults[kFaultPanic] != 1 {
+		t.Fatalf("counted faults %v", faults)
+	}
+}
+
+func TestRecoverPanicHoldingLock(t *testing.T) {
+	hub := newHub()
+	ra := &net.UDPAddr{IP: net.ParseIP("127.0.0.1"), Port: 1234}
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		defer hub.recoverPanic(ra)
+		hub.mu.Lock()
+		var handler *RequestHandler
+		handler.handleSendFileAck()
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("recovering from a panic holding hub.mu deadlocked")
+	}
+	if faults := hub.faultsOf(ra); faults[kFaultPanic] != 1 {
+		t.Fatalf("counted faults %v", faults)
+	}
+}
@@ -0,0 +1,167 @@
+package udpchat
+
+import (
+	"bytes"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/neverchanje/unplayground/udpchat/codec"
+	"golang.org/x/crypto/nacl/box"
+)
+
+// Fuzz targets of the decoders of the packets and files received, none of
+// which may panic whatever the input. The seeds run with the other tests,
+// run "go test -fuzz <target>" to fuzz one of them.
+
+func FuzzHubDatagram(f *testing.F) {
+	f.Add([]byte{})
+	f.Add([]byte{kSecureHello})
+	f.Add(append([]byte{kSecureHello}, make([]byte, 8+48)...))
+	f.Add(append([]byte{kSecureData}, make([]byte, kSecureHeaderSize+kSecureTagSize)...))
+	f.Add([]byte{byte(kReqJoin)})
+
+	hub := newHub()
+	if err := hub.startServer(NewMemoryTransport(), "hub"); err != nil {
+		f.Fatal(err)
+	}
+	f.Cleanup(func() { hub.conn.Close() })
+	ra := &net.UDPAddr{IP: net.ParseIP("127.0.0.1"), Port: 1234}
+	f.Fuzz(func(t *testing.T, datagram []byte) {
+		panics := hub.faultsOf(ra)[kFaultPanic]
+		hub.handleDatagram(datagram, ra)
+		if hub.faultsOf(ra)[kFaultPanic] != panics {
+			t.Fatalf("panicked on %v", datagram)
+		}
+	})
+}
+
+func FuzzDecodeChatRecord(f *testing.F) {
+	r := &chatRecord{id: 1, time: time.Unix(0, 2), channel: 3, name: "general", sender: "alice", msg: "hello"}
+	f.Add(r.encode()[8:])
+	f.Add([]byte{})
+	f.Add(make([]byte, 22))
+
+	f.Fuzz(func(t *testing.T, payload []byte) {
+		r, err := decodeChatRecord(payload)
+		if err != nil {
+			return
+		}
+		if again, err := decodeChatRecord(r.encode()[8:]); err != nil || *again != *r {
+			t.Fatalf("record %+v decoded again as %+v, %v", *r, again, err)
+		}
+	})
+}
+
+func FuzzDecodeHistoryPart(f *testing.F) {
+	r := &chatRecord{id: 1, time: time.Unix(0, 2), channel: 3, name: "general", sender: "alice", msg: "hello"}
+	f.Add(codec.Marshal(&codec.History{Parts: 1, Records: append(r.encode(), r.encode()...)}))
+	f.Add(codec.Marshal(&codec.History{Parts: 1, Records: r.encode()[:12]}))
+	f.Add([]byte{byte(kRespHistory)})
+
+	f.Fuzz(func(t *testing.T, packet []byte) {
+		decodeHistoryPart(packet)
+	})
+}
+
+func FuzzDecodeHistoryQuery(f *testing.F) {
+	f.Add((&historyQuery{query_id: 1, limit: 20, channel: 1, sender: "alice"}).encode())
+	f.Add([]byte{byte(kReqGetHistory)})
+
+	f.Fuzz(func(t *testing.T, recv []byte) {
+		q, err := decodeHistoryQuery(recv)
+		if err == nil && (q.limit == 0 || q.limit > kMaxHistoryLimit) {
+			t.Fatalf("query of limit %d", q.limit)
+		}
+	})
+}
+
+func FuzzDecodeSearchQuery(f *testing.F) {
+	f.Add((&searchQuery{query_id: 1, limit: 20, terms: "msg 7"}).encode())
+	f.Add([]byte{byte(kReqSearch)})
+
+	f.Fuzz(func(t *testing.T, recv []byte) {
+		q, err := decodeSearchQuery(recv)
+		if err == nil && (q.limit == 0 || q.limit > kMaxHistoryLimit) {
+			t.Fatalf("query of limit %d", q.limit)
+		}
+	})
+}
+
+func FuzzDecodeDirectMessage(f *testing.F) {
+	sealed := make([]byte, box.Overhead+5)
+	f.Add(encodeSendDM(1, "bob", make([]byte, kKeySize), make([]byte, kNonceSize), sealed))
+	f.Add((&directMessage{id: 1, from: "alice", key: make([]byte, kKeySize),
+		nonce: make([]byte, kNonceSize), box: sealed}).encode())
+	f.Add([]byte{byte(kReqSendDM)})
+
+	f.Fuzz(func(t *testing.T, packet []byte) {
+		if m, _, err := decodeSendDM(packet); err == nil && len(m.box) < box.Overhead {
+			t.Fatalf("sent box of %d bytes", len(m.box))
+		}
+		if m, err := decodeDirectMessage(packet); err == nil && len(m.box) < box.Overhead {
+			t.Fatalf("received box of %d bytes", len(m.box))
+		}
+	})
+}
+
+func FuzzDecodeSegAck(f *testing.F) {
+	ack := &segAck{packet_id: 7, cum_ack: 3, ranges: []segRange{{5, 6}, {8, 10}}}
+	f.Add(ack.encode(byte(kRespRecvSegAck)))
+	f.Add(ack.encode(byte(kReqFileSegAck)))
+	f.Add([]byte{byte(kRespRecvSegAck), 255})
+
+	f.Fuzz(func(t *testing.T, packet []byte) {
+		decodeSegAck(packet, byte(kRespRecvSegAck))
+		decodeSegAck(packet, byte(kReqFileSegAck))
+	})
+}
+
+func FuzzNewFileSession(f *testing.F) {
+	s := &fileSession{packet_id: 7, seg_size: 4096, window: 1000, total_size: 123456, user: "alice", fname: "a.txt"}
+	f.Add(codec.Marshal(&codec.SendFile{FileSyn: s.syn()}))
+	f.Add(codec.Marshal(&codec.GetFileOK{FileSyn: s.syn()}))
+	f.Add(s.encodeSynAck())
+	f.Add([]byte{byte(kReqSendFile)})
+
+	f.Fuzz(func(t *testing.T, packet []byte) {
+		var req codec.SendFile
+		if codec.Unmarshal(packet, &req) == nil {
+			if s, err := newFileSession(&req.FileSyn); err == nil && s.negotiate() == nil {
+				s.segLen(s.seg_count - 1)
+			}
+		}
+		client := *s
+		if client.decodeSynAck(packet) {
+			client.segLen(client.seg_count - 1)
+		}
+	})
+}
+
+func FuzzNewFileSegment(f *testing.F) {
+	f.Add(encodeSegment(byte(kReqSendSeg), 7, 3, []byte("content")))
+	f.Add(encodeSegment(byte(kRespFileSeg), 7, 3, nil))
+	f.Add([]byte{byte(kReqSendSeg)})
+
+	f.Fuzz(func(t *testing.T, packet []byte) {
+		var seg codec.SendSeg
+		if codec.Unmarshal(packet, &seg) != nil {
+			return
+		}
+		s := newFileSegment(&seg.Segment)
+		if s.verify() && !bytes.Equal(encodeSegment(byte(kReqSendSeg), s.packet_id, s.seg_id, s.content), packet) {
+			t.Fatalf("segment %s encoded otherwise", s.toString())
+		}
+	})
+}
+
+func FuzzDecodePartState(f *testing.F) {
+	f.Add((&partState{packet_id: 7, seg_size: 4096, total_size: 123456, next: 3}).encode())
+	f.Add([]byte{})
+
+	f.Fuzz(func(t *testing.T, buf []byte) {
+		if ps, err := decodePartState(buf); err == nil && !bytes.Equal(ps.encode(), buf) {
+			t.Fatalf("state %+v encoded otherwise", *ps)
+		}
+	})
+}
@@ -0,0 +1,147 @@
+package udpchat
+
+import (
+	"errors"
+	"math"
+
+	"github.com/neverchanje/unplayground/udpchat/codec"
+)
+
+const (
+	// Upper bounds the server accepts during the handshake.
+	kMaxSegmentSize = kMaxPacketSize - kSegHeaderSize
+	kMaxRecvWindow  = 256
+
+	// How long a closed transfer stays registered in the server, so that a
+	// retransmitted FIN whose FIN-ACK got lost can still be answered.
+	kTimeWait = 2 * kMaxRTO
+)
+
+// Flags of kReqSendFileFin.
+const (
+	kFinCommit byte = 0
+	kFinCancel byte = 1
+)
+
+// Status of kRespSendFileFinAck.
+const (
+	kFinStatusOK      byte = 0
+	kFinStatusFailed  byte = 1
+	kFinStatusCorrupt byte = 2 // SHA-256 of the file mismatches
+)
+
+// Parameters of a file transfer, proposed by the client in kReqSendFile and
+// negotiated by the server in kRespSendFileOK. The server also tells the
+// number of segments the file is split into with the negotiated SEG_SIZE,
+// all of which carry SEG_SIZE bytes but the last one, and the first segment
+// missing when an interrupted transfer is resumed. USERNAME is preceded by its
+// length in a single byte, see codec.FileSyn.
+//
+//	kReqSendFile PACKET_ID SEG_SIZE WINDOW TOTAL_SIZE USER_LEN USERNAME FILENAME
+//	kRespSendFileOK PACKET_ID SEG_SIZE WINDOW SEG_COUNT RESUME_FROM
+type fileSession struct {
+	packet_id   uint64
+	seg_size    uint16
+	window      uint16
+	total_size  uint64
+	seg_count   uint32
+	resume_from uint32
+	user        string
+	fname       string
+}
+
+// Number of segments of total_size bytes split by seg_size.
+func (s *fileSession) segCount() uint64 {
+	return (s.total_size + uint64(s.seg_size) - 1) / uint64(s.seg_size)
+}
+
+// Length of the content of segment seg_id.
+func (s *fileSession) segLen(seg_id uint32) int {
+	if seg_id+1 < s.seg_count {
+		return int(s.seg_size)
+	}
+	return int(s.total_size - uint64(s.seg_count-1)*uint64(s.seg_size))
+}
+
+// The FileSyn proposing the parameters of s, or offering the file of a
+// download. user is truncated to 255 bytes.
+func (s *fileSession) syn() codec.FileSyn {
+	return codec.FileSyn{
+		PacketID:  s.packet_id,
+		SegSize:   s.seg_size,
+		Window:    s.window,
+		TotalSize: s.total_size,
+		User:      s.user,
+		Filename:  s.fname,
+	}
+}
+
+// Checks the parameters proposed by a kReqSendFile or a kReqGetFile.
+func newFileSession(syn *codec.FileSyn) (*fileSession, error) {
+	if len(syn.Filename) == 0 {
+		return nil, errors.New("Malformed file transfer request")
+	}
+	if syn.SegSize == 0 || syn.Window == 0 {
+		return nil, errors.New("Invalid segment size or window")
+	}
+	return &fileSession{
+		packet_id:  syn.PacketID,
+		seg_size:   syn.SegSize,
+		window:     syn.Window,
+		total_size: syn.TotalSize,
+		user:       syn.User,
+		fname:      syn.Filename,
+	}, nil
+}
+
+// Lowers the proposed parameters to what the server supports.
+func (s *fileSession) negotiate() error {
+	if s.seg_size > kMaxSegmentSize {
+		s.seg_size = kMaxSegmentSize
+	}
+	if s.window > kMaxRecvWindow {
+		s.window = kMaxRecvWindow
+	}
+	if s.segCount() > math.MaxUint32 {
+		return errors.New("File too large")
+	}
+	s.seg_count = uint32(s.segCount())
+	return nil
+}
+
+func (s *fileSession) encodeSynAck() []byte {
+	return codec.Marshal(&codec.SendFileOK{
+		PacketID:   s.packet_id,
+		SegSize:    s.seg_size,
+		Window:     s.window,
+		SegCount:   s.seg_count,
+		ResumeFrom: s.resume_from,
+	})
+}
+
+// Applies the parameters negotiated in a kRespSendFileOK packet.
+func (s *fileSession) decodeSynAck(packet []byte) bool {
+	var ok codec.SendFileOK
+	if !decodeTransfer(packet, &ok, s.packet_id) {
+		return false
+	}
+	negotiated := *s
+	negotiated.seg_size = ok.SegSize
+	negotiated.window = ok.Window
+	negotiated.seg_count = ok.SegCount
+	negotiated.resume_from = ok.ResumeFrom
+	if negotiated.seg_size == 0 || negotiated.window == 0 ||
+		negotiated.seg_size > s.seg_size || negotiated.window > s.window ||
+		uint64(negotiated.seg_count) != negotiated.segCount() ||
+		negotiated.resume_from > negotiated.seg_count {
+		return false
+	}
+	*s = negotiated
+	return true
+}
+
+// Decodes packet into m, provided that it's a packet of the type of m for
+// the transfer packet_id.
+func decodeTransfer(packet []byte, m codec.TransferMessage, packet_id uint64) bool {
+	return codec.Unmarshal(packet, m) == nil && m.Transfer() == packet_id
+}
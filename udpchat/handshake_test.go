@@ -0,0 +1,73 @@
+package udpchat
+
+import (
+	"testing"
+
+	"github.com/neverchanje/unplayground/udpchat/codec"
+)
+
+func TestFileSessionNegotiation(t *testing.T) {
+	client := &fileSession{
+		packet_id:  7,
+		seg_size:   4096,
+		window:     1000,
+		total_size: 123456,
+		user:       "alice",
+		fname:      "a.txt",
+	}
+
+	var req codec.SendFile
+	if err := codec.Unmarshal(codec.Marshal(&codec.SendFile{FileSyn: client.syn()}), &req); err != nil {
+		t.Fatal(err)
+	}
+	server, err := newFileSession(&req.FileSyn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if *server != *client {
+		t.Fatalf("decoded %+v, want %+v", *server, *client)
+	}
+
+	if err = server.negotiate(); err != nil {
+		t.Fatal(err)
+	}
+	if server.seg_size != kMaxSegmentSize || server.window != kMaxRecvWindow {
+		t.Fatalf("negotiated %+v", *server)
+	}
+	if server.seg_count != 61 || server.segLen(59) != kMaxSegmentSize ||
+		server.segLen(60) != 123456-60*kMaxSegmentSize {
+		t.Fatalf("file is split into %d segments", server.seg_count)
+	}
+
+	if !client.decodeSynAck(server.encodeSynAck()) {
+		t.Fatal("failed to decode SYN-ACK")
+	}
+	if *client != *server {
+		t.Fatalf("client %+v disagrees with server %+v", *client, *server)
+	}
+
+	// the server may never raise the proposed parameters.
+	server.window = client.window + 1
+	if client.decodeSynAck(server.encodeSynAck()) {
+		t.Fatal("accepted a window larger than proposed")
+	}
+
+	req.Filename = ""
+	if _, err = newFileSession(&req.FileSyn); err == nil {
+		t.Fatal("accepted a request without file name")
+	}
+}
+
+func TestControlPacket(t *testing.T) {
+	packet := codec.Marshal(&codec.SendFileFinAck{PacketID: 42, Status: kFinStatusFailed})
+	var ack codec.SendFileFinAck
+	if !decodeTransfer(packet, &ack, 42) || ack.Status != kFinStatusFailed {
+		t.Fatalf("decoded status %d", ack.Status)
+	}
+	if decodeTransfer(packet, &ack, 43) {
+		t.Fatal("accepted a packet of another transfer")
+	}
+	if decodeTransfer(packet, new(codec.SendFileFailed), 42) {
+		t.Fatal("accepted a packet of another type")
+	}
+}
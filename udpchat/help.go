@@ -7,9 +7,26 @@ import (
 func PrintHelpInfo() {
 	fmt.Println(
 		"Usage:\n" +
-			"		>>> help ------------------ get help information\n" +
-			"		>>> history --------------- get chat history\n" +
-			"		>>> send: <msg> ----------- send message to the server\n" +
-			"		>>> sendfile: <filename> -- request for file transfer\n" +
-			"		>>> quit ------------------ exit from udpchat")
+			"		>>> help ---------------------------- get help information\n" +
+			"		>>> history ------------------------- get latest chat history of subscribed channels\n" +
+			"		>>> history: [<option>=<value>]... -- get a page of chat history, with options\n" +
+			"		      limit=<n> before=<msg-id> after=<msg-id> channel=<channel-id> from=<sender>\n" +
+			"		>>> search: [<option>=<value>]... <terms> -- find messages with all the words and \"phrases\"\n" +
+			"		      since=<time> until=<time> channel=<channel-id> limit=<n>, time as 2h or 2006-01-02[T15:04]\n" +
+			"		>>> send: <msg> --------------------- send message to the default channel\n" +
+			"		>>> sendto: <channel-id> <msg> ------ send message to a channel\n" +
+			"		>>> dm: <user> <msg> ---------------- send an end-to-end encrypted message to a user\n" +
+			"		>>> fingerprint[: <user>] ----------- show the fingerprint of your key, or of the key of a user\n" +
+			"		>>> verify: <user> <fingerprint> ---- trust the key of a user after comparing its fingerprint\n" +
+			"		>>> who ----------------------------- list users online\n" +
+			"		>>> channels ------------------------ list channels\n" +
+			"		>>> subscribe: <channel-id> --------- receive messages of a channel\n" +
+			"		>>> unsubscribe: <channel-id> ------- stop receiving messages of a channel\n" +
+			"		>>> mkchannel: <name> --------------- create a channel\n" +
+			"		>>> rmchannel: <channel-id> --------- remove a channel you created\n" +
+			"		>>> sendfile: <filename> ------------ request for file transfer\n" +
+			"		>>> transfers ----------------------- list file transfers and their progress\n" +
+			"		>>> files --------------------------- list files on the server\n" +
+			"		>>> getfile: <filename> ------------- download file from the server\n" +
+			"		>>> quit ---------------------------- exit from udpchat")
 }
@@ -0,0 +1,278 @@
+package udpchat
+
+import (
+	"bufio"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// The client keeps the history it receives in a cache on disk, one for each
+// hub and user:
+//
+//	<cache-dir>/<host>-<port>/<user>/history.log
+//	<cache-dir>/<host>-<port>/<user>/synced
+//
+// history.log holds the records framed as in the history log of the hub (see
+// histlog.go), and synced has a "<channel-id> <id>" line for each channel,
+// telling that the cache holds all the messages of the channel up to that id.
+// "history" prints the cached messages of the channels synced before right
+// away, and then asks the hub for the messages of the subscribed channels
+// after the synced id of each only, so that it also works while the hub is
+// unreachable.
+const (
+	kHistoryCacheFile = "history.log"
+	kSyncedFile       = "synced"
+)
+
+type historyCache struct {
+	mu      sync.Mutex
+	dir     string
+	file    *os.File
+	records map[uint64]*chatRecord
+	synced  map[uint32]uint64
+}
+
+// Default directory of the caches, under the user's config directory.
+func DefaultCacheDir() (string, error) {
+	dir, err := os.UserConfigDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(dir, "udpchat"), nil
+}
+
+// Opens the cache in dir, dropping a torn record at its end.
+func openHistoryCache(dir string) (*historyCache, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+	hc := &historyCache{dir: dir}
+	hc.records = make(map[uint64]*chatRecord)
+	hc.synced = make(map[uint32]uint64)
+
+	var err error
+	hc.file, err = os.OpenFile(filepath.Join(dir, kHistoryCacheFile), os.O_RDWR|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, err
+	}
+	valid, err := readRecords(bufio.NewReader(hc.file), func(r *chatRecord) bool {
+		hc.records[r.id] = r
+		return true
+	})
+	if err != nil {
+		log.Println("[Error] Dropping torn record of the history cache: " + err.Error())
+		if err = hc.file.Truncate(valid); err != nil {
+			hc.file.Close()
+			return nil, err
+		}
+	}
+	if _, err = hc.file.Seek(valid, io.SeekStart); err != nil {
+		hc.file.Close()
+		return nil, err
+	}
+
+	// a missing or corrupted synced file only makes the cache sync again.
+	content, _ := os.ReadFile(filepath.Join(dir, kSyncedFile))
+	for _, line := range strings.Split(string(content), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) != 2 {
+			continue
+		}
+		channel, err1 := strconv.ParseUint(fields[0], 10, 32)
+		id, err2 := strconv.ParseUint(fields[1], 10, 64)
+		if err1 == nil && err2 == nil {
+			hc.synced[uint32(channel)] = id
+		}
+	}
+	return hc, nil
+}
+
+// Caches the records not cached yet, which are returned.
+func (hc *historyCache) add(records []*chatRecord) ([]*chatRecord, error) {
+	hc.mu.Lock()
+	defer hc.mu.Unlock()
+
+	var added []*chatRecord
+	var buf []byte
+	for _, r := range records {
+		if _, has := hc.records[r.id]; !has {
+			hc.records[r.id] = r
+			added = append(added, r)
+			buf = append(buf, r.encode()...)
+		}
+	}
+	if len(buf) == 0 {
+		return nil, nil
+	}
+	_, err := hc.file.Write(buf)
+	return added, err
+}
+
+// The id up to which all the messages of the channel are cached.
+func (hc *historyCache) syncedTo(channel uint32) uint64 {
+	hc.mu.Lock()
+	defer hc.mu.Unlock()
+	return hc.synced[channel]
+}
+
+// The channels synced so far, or kDefaultChannel if none.
+func (hc *historyCache) syncedChannels() map[uint32]bool {
+	hc.mu.Lock()
+	defer hc.mu.Unlock()
+
+	channels := make(map[uint32]bool)
+	for channel := range hc.synced {
+		channels[channel] = true
+	}
+	if len(channels) == 0 {
+		channels[kDefaultChannel] = true
+	}
+	return channels
+}
+
+// Records that all the messages of the channel up to id are cached. The
+// synced file is replaced as a whole so that it's never half written.
+func (hc *historyCache) markSynced(channel uint32, id uint64) error {
+	hc.mu.Lock()
+	defer hc.mu.Unlock()
+
+	if hc.synced[channel] >= id {
+		return nil
+	}
+	hc.synced[channel] = id
+
+	var lines []string
+	for channel, id := range hc.synced {
+		lines = append(lines, strconv.FormatUint(uint64(channel), 10)+" "+strconv.FormatUint(id, 10)+"\n")
+	}
+	sort.Strings(lines)
+	tmp := filepath.Join(hc.dir, kSyncedFile+".tmp")
+	if err := os.WriteFile(tmp, []byte(strings.Join(lines, "")), 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, filepath.Join(hc.dir, kSyncedFile))
+}
+
+// The latest cached records of the channels, at most limit, in the order of
+// their ids.
+func (hc *historyCache) latest(channels map[uint32]bool, limit int) []*chatRecord {
+	hc.mu.Lock()
+	defer hc.mu.Unlock()
+
+	var page []*chatRecord
+	for _, r := range hc.records {
+		if channels[r.channel] {
+			page = append(page, r)
+		}
+	}
+	sort.Slice(page, func(i, j int) bool { return page[i].id < page[j].id })
+	if len(page) > limit {
+		page = page[len(page)-limit:]
+	}
+	return page
+}
+
+func (hc *historyCache) close() error {
+	hc.mu.Lock()
+	defer hc.mu.Unlock()
+	return hc.file.Close()
+}
+
+// Opens the cache of the history received from the hub, under dir. The
+// history is not cached until it's opened.
+func (c *Client) OpenHistoryCache(dir string) error {
+	dir, err := c.userDir(dir)
+	if err != nil {
+		return err
+	}
+	hc, err := openHistoryCache(dir)
+	if err != nil {
+		return err
+	}
+	c.history = hc
+	return nil
+}
+
+// The directory of the files kept for the hub and the user under dir.
+func (c *Client) userDir(dir string) (string, error) {
+	user, err := sanitizeUser(c.username)
+	if err != nil {
+		return "", err
+	}
+	hub := strings.NewReplacer(":", "-", "[", "", "]", "").Replace(c.remote.String())
+	return filepath.Join(dir, hub, user), nil
+}
+
+// Caches the records received from the hub, if the history is cached.
+func (c *Client) cacheRecords(records []*chatRecord) {
+	if c.history == nil {
+		return
+	}
+	if _, err := c.history.add(records); err != nil {
+		log.Println("[Error] Caching history: " + err.Error())
+	}
+}
+
+// Asks the hub for the messages of the channels newer than the cache, a page
+// at a time. Returns the messages that were not cached, in the order of their
+// ids.
+func (c *Client) syncHistory(channels map[uint32]bool) ([]*chatRecord, error) {
+	var fresh []*chatRecord
+	for channel := range channels {
+		after := c.history.syncedTo(channel)
+		for {
+			q := &historyQuery{query_id: c.nextQueryID(), limit: kMaxHistoryLimit, after: after, channel: channel}
+			page, more, err := queryHistory(c, q)
+			if err != nil {
+				return fresh, err
+			}
+			if len(page) == 0 {
+				break
+			}
+			added, err := c.history.add(page)
+			fresh = append(fresh, added...)
+			if err != nil {
+				return fresh, err
+			}
+			after = page[len(page)-1].id
+			if err = c.history.markSynced(channel, after); err != nil {
+				return fresh, err
+			}
+			if !more {
+				break
+			}
+		}
+	}
+	sort.Slice(fresh, func(i, j int) bool { return fresh[i].id < fresh[j].id })
+	return fresh, nil
+}
+
+// Shows the latest cached messages of the channels synced so far right away,
+// then syncs the channels subscribed and shows the messages the cache hadn't.
+// While the hub is unreachable, only the cached messages are shown.
+func (c *Client) showCachedHistory(show func([]*chatRecord)) {
+	cached := c.history.latest(c.history.syncedChannels(), kDefaultHistoryLimit)
+	show(cached)
+
+	channels, err := c.subscribedChannels()
+	if err != nil {
+		log.Println("[Error] Listing subscribed channels: " + err.Error())
+		return
+	}
+	fresh, err := c.syncHistory(channels)
+	if len(fresh) > kDefaultHistoryLimit {
+		fresh = fresh[len(fresh)-kDefaultHistoryLimit:]
+	}
+	show(fresh)
+	if err != nil {
+		log.Println("[Error] Syncing history: " + err.Error())
+	} else if len(cached) == 0 && len(fresh) == 0 {
+		println("No history now.")
+	}
+}
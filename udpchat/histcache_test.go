@@ -0,0 +1,133 @@
+package udpchat
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/neverchanje/unplayground/udpchat/codec"
+)
+
+func TestHistoryCache(t *testing.T) {
+	dir := t.TempDir()
+	hc, err := openHistoryCache(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var records []*chatRecord
+	for i := 1; i <= 5; i++ {
+		records = append(records, &chatRecord{id: uint64(i), time: time.Now(), channel: uint32(1 + i%2), msg: "m"})
+	}
+	if added, err := hc.add(records[:3]); err != nil || len(added) != 3 {
+		t.Fatalf("added %d records, %v", len(added), err)
+	}
+	if added, _ := hc.add(records); len(added) != 2 || added[0].id != 4 {
+		t.Fatalf("added %d records again", len(added))
+	}
+	hc.markSynced(1, 4)
+	hc.close()
+
+	// a crash in the middle of caching the next record.
+	torn := (&chatRecord{id: 6, msg: "torn"}).encode()
+	f, _ := os.OpenFile(filepath.Join(dir, kHistoryCacheFile), os.O_WRONLY|os.O_APPEND, 0600)
+	f.Write(torn[:len(torn)-1])
+	f.Close()
+
+	if hc, err = openHistoryCache(dir); err != nil {
+		t.Fatal(err)
+	}
+	defer hc.close()
+	if hc.syncedTo(1) != 4 || hc.syncedTo(2) != 0 {
+		t.Fatalf("synced to %d and %d", hc.syncedTo(1), hc.syncedTo(2))
+	}
+	page := hc.latest(map[uint32]bool{1: true}, 1)
+	if len(page) != 1 || page[0].id != 4 {
+		t.Fatalf("latest %v", testPageIDs(page))
+	}
+	if page = hc.latest(map[uint32]bool{1: true, 2: true}, 10); len(page) != 5 {
+		t.Fatalf("latest %v", testPageIDs(page))
+	}
+	if added, _ := hc.add([]*chatRecord{{id: 6, time: time.Now(), msg: "m"}}); len(added) != 1 {
+		t.Fatal("torn record cached")
+	}
+}
+
+func TestSyncHistory(t *testing.T) {
+	hub := newTestHub(t)
+	alice := dialTestHub(t, hub)
+	joinTestHub(t, alice, "alice")
+	for _, msg := range []string{"one", "two", "three"} {
+		alice.Write(codec.Marshal(&codec.SendChatMsg{Channel: kDefaultChannel, Message: msg}))
+	}
+	time.Sleep(100 * time.Millisecond)
+
+	c, err := NewClientOn(hub.transport, hub.conn.LocalAddr().String(), "bob")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = c.Register(kTestPassword); err != nil {
+		t.Fatal(err)
+	}
+	if err = c.OpenHistoryCache(t.TempDir()); err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	channels, err := c.subscribedChannels()
+	if err != nil || len(channels) != 1 || !channels[kDefaultChannel] {
+		t.Fatalf("subscribed to %v, %v", channels, err)
+	}
+	fresh, err := c.syncHistory(channels)
+	// the notice of the join of alice comes first.
+	if err != nil || len(fresh) != 4 || c.history.syncedTo(kDefaultChannel) != 4 {
+		t.Fatalf("synced %v, %v", testPageIDs(fresh), err)
+	}
+	alice.Write(codec.Marshal(&codec.SendChatMsg{Channel: kDefaultChannel, Message: "four"}))
+	time.Sleep(100 * time.Millisecond)
+	if fresh, err = c.syncHistory(channels); err != nil || len(fresh) != 1 || fresh[0].msg != "four" {
+		t.Fatalf("synced %v again, %v", testPageIDs(fresh), err)
+	}
+}
+
+// The cached messages are shown before the hub is asked for anything, so that
+// they don't wait on the retransmissions to a hub that's down.
+func TestCachedHistoryOffline(t *testing.T) {
+	hub := newTestHub(t)
+	alice := dialTestHub(t, hub)
+	joinTestHub(t, alice, "alice")
+	alice.Write(codec.Marshal(&codec.SendChatMsg{Channel: kDefaultChannel, Message: "one"}))
+	time.Sleep(100 * time.Millisecond)
+
+	c := newTestClient(t, hub, "bob")
+	if err := c.OpenHistoryCache(t.TempDir()); err != nil {
+		t.Fatal(err)
+	}
+	var shown [][]*chatRecord
+	c.showCachedHistory(func(page []*chatRecord) { shown = append(shown, page) })
+	// the message between the notices of the joins.
+	if len(shown) != 2 || len(shown[0]) != 0 || len(shown[1]) != 3 || shown[1][1].msg != "one" {
+		t.Fatalf("shown %v while the hub is up", shown)
+	}
+
+	hub.conn.Close()
+	pages := make(chan []*chatRecord, 2)
+	done := make(chan struct{})
+	go func() {
+		c.showCachedHistory(func(page []*chatRecord) { pages <- page })
+		close(done)
+	}()
+	select {
+	case page := <-pages:
+		if len(page) != 3 || page[1].msg != "one" {
+			t.Fatalf("shown %v while the hub is down", testPageIDs(page))
+		}
+	case <-time.After(kInitialRTO / 2):
+		t.Fatal("cached history not shown right away")
+	}
+	c.conn.Close()
+	<-done
+	if len(pages) != 0 {
+		t.Fatalf("shown %v after the cache", testPageIDs(<-pages))
+	}
+}
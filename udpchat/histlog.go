@@ -0,0 +1,492 @@
+package udpchat
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// The chat history is persisted in an append-only log, split into segment
+// files named after the id of their first record:
+//
+//	<dir>/00000000000000000001.log
+//	<dir>/00000000000000004242.log
+//
+// Each record is framed as:
+//
+//	LENGTH CRC32C ID TIME CHANNEL NAME_LEN NAME SENDER_LEN SENDER MESSAGE
+//
+// where LENGTH and CRC32C cover the rest of the record. A torn record at the
+// end of the log, left by a crash in the middle of a write, is truncated on
+// recovery. Only the latest kHistoryCacheSize records are kept in memory,
+// older ones are read from the segments.
+const (
+	kLogSegmentSize   = 4 << 20
+	kHistoryCacheSize = 1024
+	kMaxRecordSize    = 64 << 10
+
+	// how often the log is synced with SyncInterval
+	kSyncInterval = time.Second
+)
+
+// When the appended records are flushed to stable storage.
+type SyncPolicy int
+
+const (
+	SyncAlways   SyncPolicy = iota // before the append returns
+	SyncInterval                   // every kSyncInterval
+	SyncNever                      // whenever the OS does
+)
+
+func ParseSyncPolicy(s string) (SyncPolicy, error) {
+	switch s {
+	case "always":
+		return SyncAlways, nil
+	case "interval":
+		return SyncInterval, nil
+	case "never":
+		return SyncNever, nil
+	}
+	return 0, errors.New("Sync policy should be one of always, interval and never")
+}
+
+type historyLog struct {
+	mu     sync.Mutex
+	dir    string // empty if the history is only kept in memory
+	policy SyncPolicy
+
+	segments []uint64 // first id of each segment, in order
+	active   *os.File
+	size     int64 // of the active segment
+	dirty    bool  // records appended since the last sync
+
+	nextID uint64
+	cache  []*chatRecord // the latest records
+
+	closed    chan struct{}
+	closeOnce sync.Once
+
+	// the largest channel id found on recovery, so that the ids of removed
+	// channels are not reused after a restart.
+	maxChannel uint32
+}
+
+// Opens the log in dir, recovering the records written before. The log is
+// only kept in memory, and never evicted, if dir is empty.
+func openHistoryLog(dir string, policy SyncPolicy) (*historyLog, error) {
+	l := &historyLog{dir: dir, policy: policy, nextID: 1}
+	l.closed = make(chan struct{})
+	if len(dir) == 0 {
+		return l, nil
+	}
+
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	if err := l.recover(); err != nil {
+		return nil, err
+	}
+	if policy == SyncInterval {
+		go l.syncLoop()
+	}
+	return l, nil
+}
+
+func segmentName(dir string, first uint64) string {
+	return filepath.Join(dir, fmt.Sprintf("%020d.log", first))
+}
+
+// Reads all segments to find the next id and fill the cache, and truncates
+// the last segment after its last valid record.
+func (l *historyLog) recover() error {
+	names, err := filepath.Glob(filepath.Join(l.dir, "*.log"))
+	if err != nil {
+		return err
+	}
+	for _, name := range names {
+		first, err := strconv.ParseUint(strings.TrimSuffix(filepath.Base(name), ".log"), 10, 64)
+		if err == nil {
+			l.segments = append(l.segments, first)
+		}
+	}
+	sort.Slice(l.segments, func(i, j int) bool { return l.segments[i] < l.segments[j] })
+
+	for i, first := range l.segments {
+		valid, err := l.readSegment(first, func(r *chatRecord) bool {
+			l.nextID = r.id + 1
+			if r.channel > l.maxChannel {
+				l.maxChannel = r.channel
+			}
+			l.cacheRecord(r)
+			return true
+		})
+		if err == nil {
+			continue
+		}
+		if i != len(l.segments)-1 {
+			log.Println("[Error] History segment " + segmentName(l.dir, first) + " is corrupted: " + err.Error())
+			continue
+		}
+		log.Println("Truncating torn history record in " + segmentName(l.dir, first))
+		if err = os.Truncate(segmentName(l.dir, first), valid); err != nil {
+			return err
+		}
+	}
+
+	if len(l.segments) == 0 {
+		return l.roll()
+	}
+	last := segmentName(l.dir, l.segments[len(l.segments)-1])
+	l.active, err = os.OpenFile(last, os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	info, err := l.active.Stat()
+	if err != nil {
+		return err
+	}
+	l.size = info.Size()
+	log.Println("Recovered " + strconv.FormatUint(l.nextID-1, 10) + " history records")
+	return nil
+}
+
+// Calls fn with the records of the segment in order until it returns false.
+// Returns the length of the valid prefix of the segment, and the error that
+// stopped reading it if any.
+func (l *historyLog) readSegment(first uint64, fn func(*chatRecord) bool) (int64, error) {
+	file, err := os.Open(segmentName(l.dir, first))
+	if err != nil {
+		return 0, err
+	}
+	defer file.Close()
+	return readRecords(bufio.NewReader(file), fn)
+}
+
+// Calls fn with the framed records read from reader until it returns false,
+// see readSegment.
+func readRecords(reader io.Reader, fn func(*chatRecord) bool) (int64, error) {
+	var valid int64
+	header := make([]byte, 8)
+	for {
+		if _, err := io.ReadFull(reader, header); err == io.EOF {
+			return valid, nil
+		} else if err != nil {
+			return valid, err
+		}
+		length := binary.LittleEndian.Uint32(header[0:4])
+		if length > kMaxRecordSize {
+			return valid, errors.New("Record too large")
+		}
+		payload := make([]byte, length)
+		if _, err := io.ReadFull(reader, payload); err != nil {
+			return valid, err
+		}
+		if crc32.Checksum(payload, crc32c) != binary.LittleEndian.Uint32(header[4:8]) {
+			return valid, errors.New("Checksum mismatch")
+		}
+		r, err := decodeChatRecord(payload)
+		if err != nil {
+			return valid, err
+		}
+		valid += int64(8 + length)
+		if !fn(r) {
+			return valid, nil
+		}
+	}
+}
+
+func (r *chatRecord) encode() []byte {
+	name, sender := r.name, r.sender
+	if len(name) > 255 {
+		name = name[:255]
+	}
+	if len(sender) > 255 {
+		sender = sender[:255]
+	}
+
+	buf := make([]byte, 29, 31+len(name)+len(sender)+len(r.msg))
+	binary.LittleEndian.PutUint64(buf[8:16], r.id)
+	binary.LittleEndian.PutUint64(buf[16:24], uint64(r.time.UnixNano()))
+	binary.LittleEndian.PutUint32(buf[24:28], r.channel)
+	buf[28] = byte(len(name))
+	buf = append(buf, name...)
+	buf = append(buf, byte(len(sender)))
+	buf = append(buf, sender...)
+	buf = append(buf, r.msg...)
+
+	payload := buf[8:]
+	binary.LittleEndian.PutUint32(buf[0:4], uint32(len(payload)))
+	binary.LittleEndian.PutUint32(buf[4:8], crc32.Checksum(payload, crc32c))
+	return buf
+}
+
+// Decodes a record without its LENGTH and CRC32C.
+func decodeChatRecord(payload []byte) (*chatRecord, error) {
+	malformed := errors.New("Malformed history record")
+	if len(payload) < 22 {
+		return nil, malformed
+	}
+	r := new(chatRecord)
+	r.id = binary.LittleEndian.Uint64(payload[0:8])
+	r.time = time.Unix(0, int64(binary.LittleEndian.Uint64(payload[8:16])))
+	r.channel = binary.LittleEndian.Uint32(payload[16:20])
+
+	rest := payload[20:]
+	name_len := int(rest[0])
+	if len(rest) < 2+name_len {
+		return nil, malformed
+	}
+	r.name = string(rest[1 : 1+name_len])
+	rest = rest[1+name_len:]
+	sender_len := int(rest[0])
+	if len(rest) < 1+sender_len {
+		return nil, malformed
+	}
+	r.sender = string(rest[1 : 1+sender_len])
+	r.msg = string(rest[1+sender_len:])
+	return r, nil
+}
+
+// REQUIRE: mutex lock held
+func (l *historyLog) cacheRecord(r *chatRecord) {
+	l.cache = append(l.cache, r)
+	if len(l.dir) != 0 && len(l.cache) > 2*kHistoryCacheSize {
+		l.cache = append([]*chatRecord(nil), l.cache[len(l.cache)-kHistoryCacheSize:]...)
+	}
+}
+
+// Starts a new segment with the next record.
+// REQUIRE: mutex lock held
+func (l *historyLog) roll() error {
+	if l.active != nil {
+		if err := l.active.Sync(); err != nil {
+			return err
+		}
+		l.active.Close()
+	}
+
+	var err error
+	l.active, err = os.OpenFile(segmentName(l.dir, l.nextID), os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	l.segments = append(l.segments, l.nextID)
+	l.size = 0
+	return nil
+}
+
+// Assigns the next id to the record and appends it.
+func (l *historyLog) append(r *chatRecord) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	r.id = l.nextID
+	if len(l.dir) == 0 {
+		l.nextID++
+		l.cacheRecord(r)
+		return nil
+	}
+
+	if l.size >= kLogSegmentSize {
+		if err := l.roll(); err != nil {
+			return err
+		}
+	}
+	buf := r.encode()
+	if _, err := l.active.Write(buf); err != nil {
+		return err
+	}
+	l.size += int64(len(buf))
+	l.nextID++
+	l.cacheRecord(r)
+
+	if l.policy == SyncAlways {
+		return l.active.Sync()
+	}
+	l.dirty = true
+	return nil
+}
+
+// Calls fn with the records whose id is larger than after, in order, until
+// it returns false. The records are read from the segments unless they are
+// all cached.
+func (l *historyLog) scan(after uint64, fn func(*chatRecord) bool) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if len(l.cache) == 0 || l.cache[0].id <= after+1 || len(l.dir) == 0 {
+		for _, r := range l.cache {
+			if r.id > after && !fn(r) {
+				return nil
+			}
+		}
+		return nil
+	}
+
+	// the first segment that may hold after+1
+	i := sort.Search(len(l.segments), func(i int) bool { return l.segments[i] > after+1 })
+	if i > 0 {
+		i--
+	}
+	more := true
+	for ; i < len(l.segments) && more; i++ {
+		_, err := l.readSegment(l.segments[i], func(r *chatRecord) bool {
+			if r.id > after {
+				more = fn(r)
+			}
+			return more
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Calls fn with the records whose id is smaller than before, 0 for no bound,
+// from the latest to the oldest until it returns false. Records older than
+// the cache are read from the segments, a segment at a time.
+func (l *historyLog) scanBackward(before uint64, fn func(*chatRecord) bool) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if before == 0 || before > l.nextID {
+		before = l.nextID
+	}
+	for i := len(l.cache) - 1; i >= 0; i-- {
+		if r := l.cache[i]; r.id < before && !fn(r) {
+			return nil
+		}
+	}
+	if len(l.dir) == 0 {
+		return nil
+	}
+	if len(l.cache) != 0 && l.cache[0].id < before {
+		before = l.cache[0].id
+	}
+
+	for i := len(l.segments) - 1; i >= 0; i-- {
+		if l.segments[i] >= before {
+			continue
+		}
+		var records []*chatRecord
+		_, err := l.readSegment(l.segments[i], func(r *chatRecord) bool {
+			if r.id >= before {
+				return false
+			}
+			records = append(records, r)
+			return true
+		})
+		if err != nil {
+			return err
+		}
+		for j := len(records) - 1; j >= 0; j-- {
+			if !fn(records[j]) {
+				return nil
+			}
+		}
+	}
+	return nil
+}
+
+// Returns the records of the ids, which are in increasing order. Each
+// segment holding some of them is read once.
+func (l *historyLog) lookup(ids []uint64) ([]*chatRecord, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	var records []*chatRecord
+	for len(ids) != 0 {
+		if len(l.cache) != 0 && ids[0] >= l.cache[0].id || len(l.dir) == 0 {
+			for _, id := range ids {
+				i := sort.Search(len(l.cache), func(i int) bool { return l.cache[i].id >= id })
+				if i < len(l.cache) && l.cache[i].id == id {
+					records = append(records, l.cache[i])
+				}
+			}
+			return records, nil
+		}
+
+		i := sort.Search(len(l.segments), func(i int) bool { return l.segments[i] > ids[0] })
+		if i == 0 {
+			ids = ids[1:]
+			continue
+		}
+		_, err := l.readSegment(l.segments[i-1], func(r *chatRecord) bool {
+			for len(ids) != 0 && ids[0] < r.id {
+				ids = ids[1:]
+			}
+			if len(ids) != 0 && ids[0] == r.id {
+				records = append(records, r)
+				ids = ids[1:]
+			}
+			return len(ids) != 0 && (i == len(l.segments) || ids[0] < l.segments[i])
+		})
+		if err != nil {
+			return nil, err
+		}
+		// ids missing at the end of the segment
+		for len(ids) != 0 && (i == len(l.segments) || ids[0] < l.segments[i]) &&
+			(len(l.cache) == 0 || ids[0] < l.cache[0].id) {
+			ids = ids[1:]
+		}
+	}
+	return records, nil
+}
+
+// The id of the latest record, 0 if none.
+func (l *historyLog) lastID() uint64 {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.nextID - 1
+}
+
+func (l *historyLog) syncLoop() {
+	ticker := time.NewTicker(kSyncInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			l.mu.Lock()
+			if l.dirty {
+				if err := l.active.Sync(); err != nil {
+					log.Println("[Error] Syncing history: " + err.Error())
+				}
+				l.dirty = false
+			}
+			l.mu.Unlock()
+		case <-l.closed:
+			return
+		}
+	}
+}
+
+func (l *historyLog) close() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.closeOnce.Do(func() {
+		close(l.closed)
+	})
+	if l.active == nil {
+		return nil
+	}
+	err := l.active.Sync()
+	if cerr := l.active.Close(); err == nil {
+		err = cerr
+	}
+	l.active = nil
+	return err
+}
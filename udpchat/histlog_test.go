@@ -0,0 +1,101 @@
+package udpchat
+
+import (
+	"os"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func appendTestRecords(t *testing.T, l *historyLog, n int) {
+	for i := 0; i < n; i++ {
+		r := &chatRecord{time: time.Now(), channel: kDefaultChannel, name: "general", sender: "alice", msg: "msg " + strconv.Itoa(i)}
+		if err := l.append(r); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func countTestRecords(t *testing.T, l *historyLog, after uint64) (n int, last uint64) {
+	err := l.scan(after, func(r *chatRecord) bool {
+		if r.id != last+1 && last != 0 {
+			t.Fatalf("record %d follows %d", r.id, last)
+		}
+		n, last = n+1, r.id
+		return true
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return n, last
+}
+
+func TestHistoryLogRecovery(t *testing.T) {
+	dir := t.TempDir()
+	l, err := openHistoryLog(dir, SyncAlways)
+	if err != nil {
+		t.Fatal(err)
+	}
+	appendTestRecords(t, l, 3)
+	l.close()
+
+	// a crash in the middle of the next write.
+	torn := (&chatRecord{id: 4, msg: "torn"}).encode()
+	f, _ := os.OpenFile(segmentName(dir, 1), os.O_WRONLY|os.O_APPEND, 0644)
+	f.Write(torn[:len(torn)-2])
+	f.Close()
+
+	if l, err = openHistoryLog(dir, SyncAlways); err != nil {
+		t.Fatal(err)
+	}
+	defer l.close()
+	if l.lastID() != 3 {
+		t.Fatalf("recovered %d records", l.lastID())
+	}
+	appendTestRecords(t, l, 1)
+	if n, last := countTestRecords(t, l, 1); n != 3 || last != 4 {
+		t.Fatalf("scanned %d records up to %d", n, last)
+	}
+}
+
+func TestHistoryLogEviction(t *testing.T) {
+	dir := t.TempDir()
+	l, err := openHistoryLog(dir, SyncNever)
+	if err != nil {
+		t.Fatal(err)
+	}
+	total := 2*kHistoryCacheSize + 10
+	appendTestRecords(t, l, total)
+	if len(l.cache) > 2*kHistoryCacheSize {
+		t.Fatalf("%d records are cached", len(l.cache))
+	}
+
+	// the records that are not cached any more are read from disk.
+	if n, last := countTestRecords(t, l, 0); n != total || last != uint64(total) {
+		t.Fatalf("scanned %d records up to %d", n, last)
+	}
+	l.close()
+
+	if l, err = openHistoryLog(dir, SyncNever); err != nil {
+		t.Fatal(err)
+	}
+	defer l.close()
+	if n, _ := countTestRecords(t, l, uint64(total-5)); n != 5 {
+		t.Fatalf("scanned %d records", n)
+	}
+}
+
+// Closing the log again is harmless.
+func TestHistoryLogCloseTwice(t *testing.T) {
+	l, err := openHistoryLog(t.TempDir(), SyncInterval)
+	if err != nil {
+		t.Fatal(err)
+	}
+	appendTestRecords(t, l, 1)
+	if err = l.close(); err != nil {
+		t.Fatal(err)
+	}
+	if err = l.close(); err != nil {
+		t.Fatal(err)
+	}
+}
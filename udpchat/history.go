@@ -0,0 +1,349 @@
+package udpchat
+
+import (
+	"encoding/binary"
+	"errors"
+	"hash/crc32"
+	"log"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/neverchanje/unplayground/udpchat/codec"
+)
+
+// History is queried a page at a time:
+//
+//	kReqGetHistory QUERY_ID LIMIT BEFORE AFTER CHANNEL SENDER_LEN SENDER  ---->
+//			<----  kRespHistory QUERY_ID PART PARTS MORE [RECORD]...
+//
+// The page holds at most LIMIT records whose id is below BEFORE and above
+// AFTER (either being 0 for no bound), published to CHANNEL (0 for the
+// channels the client subscribed to) by SENDER (empty for anyone). When only
+// BEFORE is given, the page holds the latest matching records, otherwise the
+// oldest ones after AFTER. The records of the page are in the order of their
+// id, framed as in the history log (see histlog.go), and split into PARTS
+// datagrams. MORE tells whether more records match beyond the page.
+//
+// A bare kReqGetHistory asks for the latest kDefaultHistoryLimit records. A
+// client retransmits the query with the same QUERY_ID until it has received
+// all the parts, discarding the parts of the previous attempts as the page may
+// have changed in the meantime.
+const (
+	kDefaultHistoryLimit = 50
+	kMaxHistoryLimit     = 500
+
+	// so that a record always fits in a kRespHistory datagram.
+	kMaxChatMsgLen = 250
+
+	kHistoryHeaderSize = 1 + codec.HistoryHeaderSize
+)
+
+type historyQuery struct {
+	query_id uint32
+	limit    uint16
+	before   uint64
+	after    uint64
+	channel  uint32
+	sender   string
+}
+
+func (q *historyQuery) encode() []byte {
+	return codec.Marshal(&codec.GetHistory{
+		QueryID: q.query_id,
+		Limit:   q.limit,
+		Before:  q.before,
+		After:   q.after,
+		Channel: q.channel,
+		Sender:  q.sender,
+	})
+}
+
+// The limit is brought within [1, kMaxHistoryLimit].
+func decodeHistoryQuery(recv []byte) (*historyQuery, error) {
+	var req codec.GetHistory
+	if err := codec.Unmarshal(recv, &req); err != nil {
+		return nil, errors.New("Malformed history query")
+	}
+	q := &historyQuery{
+		query_id: req.QueryID,
+		limit:    req.Limit,
+		before:   req.Before,
+		after:    req.After,
+		channel:  req.Channel,
+		sender:   req.Sender,
+	}
+
+	if q.limit == 0 {
+		q.limit = kDefaultHistoryLimit
+	}
+	if q.limit > kMaxHistoryLimit {
+		q.limit = kMaxHistoryLimit
+	}
+	return q, nil
+}
+
+// Parses the options of "history: [limit=N] [before=ID] [after=ID]
+// [channel=ID] [from=SENDER]".
+func parseHistoryQuery(options string) (*historyQuery, error) {
+	q := &historyQuery{limit: kDefaultHistoryLimit}
+	for _, option := range strings.Fields(options) {
+		kv := strings.SplitN(option, "=", 2)
+		if len(kv) != 2 {
+			return nil, errors.New("Invalid history option " + option)
+		}
+
+		var err error
+		var n uint64
+		switch kv[0] {
+		case "limit":
+			n, err = strconv.ParseUint(kv[1], 10, 16)
+			q.limit = uint16(n)
+		case "before":
+			q.before, err = strconv.ParseUint(kv[1], 10, 64)
+		case "after":
+			q.after, err = strconv.ParseUint(kv[1], 10, 64)
+		case "channel":
+			if id, ok := parseChannelRef(kv[1]); ok {
+				q.channel = id
+			} else {
+				err = errors.New("Invalid channel id")
+			}
+		case "from":
+			q.sender = kv[1]
+		default:
+			err = errors.New("Unknown history option")
+		}
+		if err != nil {
+			return nil, errors.New("Invalid history option " + option)
+		}
+	}
+	return q, nil
+}
+
+// Collects the page of records answering q among those accepted by match,
+// and tells whether more records match beyond the page.
+func (l *historyLog) query(q *historyQuery, match func(*chatRecord) bool) ([]*chatRecord, bool, error) {
+	var page []*chatRecord
+	more := false
+	collect := func(r *chatRecord) bool {
+		if !match(r) {
+			return true
+		}
+		if len(page) == int(q.limit) {
+			more = true
+			return false
+		}
+		page = append(page, r)
+		return true
+	}
+
+	if q.after != 0 {
+		err := l.scan(q.after, func(r *chatRecord) bool {
+			return (q.before == 0 || r.id < q.before) && collect(r)
+		})
+		return page, more, err
+	}
+
+	err := l.scanBackward(q.before, collect)
+	for i, j := 0, len(page)-1; i < j; i, j = i+1, j-1 {
+		page[i], page[j] = page[j], page[i]
+	}
+	return page, more, err
+}
+
+// Splits the page into kRespHistory datagrams.
+func encodeHistoryPage(query_id uint32, page []*chatRecord, more bool) [][]byte {
+	parts := []*codec.History{{QueryID: query_id, More: more}}
+	for _, r := range page {
+		buf := r.encode()
+		last := parts[len(parts)-1]
+		if kHistoryHeaderSize+len(last.Records)+len(buf) > kMaxPacketSize && len(last.Records) != 0 {
+			last = &codec.History{QueryID: query_id, More: more}
+			parts = append(parts, last)
+		}
+		last.Records = append(last.Records, buf...)
+	}
+
+	packets := make([][]byte, len(parts))
+	for i, part := range parts {
+		part.Part = uint16(i)
+		part.Parts = uint16(len(parts))
+		packets[i] = codec.Marshal(part)
+	}
+	return packets
+}
+
+// Decodes the records of a kRespHistory datagram.
+func decodeHistoryPart(packet []byte) ([]*chatRecord, error) {
+	var part codec.History
+	if err := codec.Unmarshal(packet, &part); err != nil {
+		return nil, errors.New("Malformed history response")
+	}
+	return decodeHistoryRecords(part.Records)
+}
+
+// Decodes the records framed as in the history log.
+func decodeHistoryRecords(rest []byte) ([]*chatRecord, error) {
+	var records []*chatRecord
+	for len(rest) != 0 {
+		if len(rest) < 8 {
+			return nil, errors.New("Malformed history response")
+		}
+		length := int(binary.LittleEndian.Uint32(rest[0:4]))
+		if len(rest) < 8+length {
+			return nil, errors.New("Malformed history response")
+		}
+		if crc32.Checksum(rest[8:8+length], crc32c) != binary.LittleEndian.Uint32(rest[4:8]) {
+			return nil, errors.New("Checksum mismatch in history response")
+		}
+		r, err := decodeChatRecord(rest[8 : 8+length])
+		if err != nil {
+			return nil, err
+		}
+		records = append(records, r)
+		rest = rest[8+length:]
+	}
+	return records, nil
+}
+
+func (h *RequestHandler) handleHisReq(recv []byte) error {
+	q, err := decodeHistoryQuery(recv)
+	if err != nil {
+		return err
+	}
+
+	h.hub.mu.Lock()
+	subscribed := h.subscribedChannels()
+	h.hub.mu.Unlock()
+	if q.channel != 0 {
+		subscribed = map[uint32]bool{q.channel: true}
+	}
+
+	page, more, err := h.hub.history.query(q, func(r *chatRecord) bool {
+		return subscribed[r.channel] && (len(q.sender) == 0 || r.sender == q.sender)
+	})
+	if err != nil {
+		return err
+	}
+
+	packets := encodeHistoryPage(q.query_id, page, more)
+	log.Println("Sending " + strconv.Itoa(len(page)) + " history records in " +
+		strconv.Itoa(len(packets)) + " parts to " + h.ra.String())
+	for _, packet := range packets {
+		if _, err = h.hub.writeTo(packet, h.ra); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Sends the query over link until all the parts of the page are received.
+func queryHistory(link packetLink, q *historyQuery) ([]*chatRecord, bool, error) {
+	return fetchPage(link, q.encode(), q.query_id)
+}
+
+// Sends a query answered with kRespHistory datagrams until all the parts of
+// the page are received.
+func fetchPage(link packetLink, packet []byte, query_id uint32) ([]*chatRecord, bool, error) {
+	rto := kInitialRTO
+	for retries := 0; retries <= kMaxRetries; retries++ {
+		if err := link.write(packet); err != nil {
+			return nil, false, err
+		}
+
+		parts := make(map[uint16][]*chatRecord)
+		deadline := time.Now().Add(rto)
+		for {
+			resp, err := link.read(deadline)
+			if err == errTimeout {
+				break
+			} else if err != nil {
+				return nil, false, err
+			}
+			var hist codec.History
+			if codec.Unmarshal(resp, &hist) != nil || hist.QueryID != query_id {
+				continue
+			}
+			part, count := hist.Part, hist.Parts
+			if part >= count {
+				continue
+			}
+			records, err := decodeHistoryRecords(hist.Records)
+			if err != nil {
+				log.Println("[Error] " + err.Error())
+				continue
+			}
+			parts[part] = records
+			if len(parts) < int(count) {
+				continue
+			}
+
+			var page []*chatRecord
+			for i := uint16(0); i < count; i++ {
+				page = append(page, parts[i]...)
+			}
+			return page, hist.More, nil
+		}
+
+		rto *= 2
+		if rto > kMaxRTO {
+			rto = kMaxRTO
+		}
+	}
+	return nil, false, errors.New("No response after " + strconv.Itoa(kMaxRetries) + " retransmissions")
+}
+
+// Prints a page of the history, each record after its id, and how to get the
+// next page if any.
+// Without options, the cached history is printed first if the history is
+// cached.
+func (c *Client) SendHisReq(options string) {
+	if c.history != nil && len(strings.TrimSpace(options)) == 0 {
+		c.showCachedHistory(printRecords)
+		return
+	}
+
+	q, err := parseHistoryQuery(options)
+	if err != nil {
+		println(err.Error())
+		return
+	}
+	q.query_id = c.nextQueryID()
+
+	page, more, err := queryHistory(c, q)
+	if err != nil {
+		log.Println("[Error] Sending history request: " + err.Error())
+		return
+	}
+	c.cacheRecords(page)
+	if len(page) == 0 {
+		println("No history now.")
+		return
+	}
+	printRecords(page)
+	if more {
+		next := "before=" + strconv.FormatUint(page[0].id, 10)
+		if q.after != 0 {
+			next = "after=" + strconv.FormatUint(page[len(page)-1].id, 10)
+		}
+		println("More records with \"history: " + strings.TrimSpace(strings.Join(nextOptions(options), " ")+" "+next) + "\"")
+	}
+}
+
+// The options of a query but the cursors, to ask for the next page.
+func nextOptions(options string) []string {
+	var kept []string
+	for _, option := range strings.Fields(options) {
+		if !strings.HasPrefix(option, "before=") && !strings.HasPrefix(option, "after=") {
+			kept = append(kept, option)
+		}
+	}
+	return kept
+}
+
+func printRecords(page []*chatRecord) {
+	for _, r := range page {
+		println("#" + strconv.FormatUint(r.id, 10) + " " + r.toString())
+	}
+}
@@ -0,0 +1,133 @@
+package udpchat
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/neverchanje/unplayground/udpchat/codec"
+)
+
+func testPageIDs(page []*chatRecord) []uint64 {
+	ids := make([]uint64, len(page))
+	for i, r := range page {
+		ids[i] = r.id
+	}
+	return ids
+}
+
+func TestHistoryQuery(t *testing.T) {
+	l, err := openHistoryLog(t.TempDir(), SyncNever)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.close()
+	// older records are only found in the segments.
+	n := 2*kHistoryCacheSize + 10
+	appendTestRecords(t, l, n)
+	l.append(&chatRecord{time: time.Now(), channel: kDefaultChannel, sender: "bob", msg: "hi"})
+	all := func(*chatRecord) bool { return true }
+
+	for _, c := range []struct {
+		q     historyQuery
+		first uint64
+		count int
+		more  bool
+	}{
+		{historyQuery{limit: 10}, uint64(n) - 8, 10, true},
+		{historyQuery{limit: 5, before: 50}, 45, 5, true},
+		{historyQuery{limit: 5, before: 3}, 1, 2, false},
+		{historyQuery{limit: 5, after: 40}, 41, 5, true},
+		{historyQuery{limit: 5, after: uint64(n) - 1}, uint64(n), 2, false},
+		{historyQuery{limit: 5, after: 40, before: 43}, 41, 2, false},
+	} {
+		page, more, err := l.query(&c.q, all)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ids := testPageIDs(page)
+		if len(ids) != c.count || ids[0] != c.first || more != c.more {
+			t.Fatalf("query %+v: %v, more %v", c.q, ids, more)
+		}
+		for i := 1; i < len(ids); i++ {
+			if ids[i] != ids[i-1]+1 {
+				t.Fatalf("query %+v: %v", c.q, ids)
+			}
+		}
+	}
+
+	page, more, _ := l.query(&historyQuery{limit: 5}, func(r *chatRecord) bool { return r.sender == "bob" })
+	if len(page) != 1 || page[0].msg != "hi" || more {
+		t.Fatalf("records of bob: %v", testPageIDs(page))
+	}
+}
+
+func TestHistoryPageParts(t *testing.T) {
+	var page []*chatRecord
+	for i := 0; i < 40; i++ {
+		page = append(page, &chatRecord{id: uint64(i + 1), time: time.Now(), msg: strings.Repeat("x", kMaxChatMsgLen)})
+	}
+	packets := encodeHistoryPage(7, page, true)
+	if len(packets) < 2 {
+		t.Fatalf("page sent in %d datagrams", len(packets))
+	}
+
+	var decoded []*chatRecord
+	for _, packet := range packets {
+		if len(packet) > kMaxPacketSize {
+			t.Fatalf("datagram of %d bytes", len(packet))
+		}
+		records, err := decodeHistoryPart(packet)
+		if err != nil {
+			t.Fatal(err)
+		}
+		decoded = append(decoded, records...)
+	}
+	if len(decoded) != len(page) || decoded[39].id != 40 || decoded[0].msg != page[0].msg {
+		t.Fatalf("decoded %v", testPageIDs(decoded))
+	}
+
+	packets[0][len(packets[0])-1] ^= 1
+	if _, err := decodeHistoryPart(packets[0]); err == nil {
+		t.Fatal("corrupted part decoded")
+	}
+}
+
+func TestQueryHistoryFromHub(t *testing.T) {
+	hub := newTestHub(t)
+	alice := dialTestHub(t, hub)
+	joinTestHub(t, alice, "alice")
+	for i := 0; i < 30; i++ {
+		alice.Write(codec.Marshal(&codec.SendChatMsg{Channel: kDefaultChannel, Message: strings.Repeat("y", kMaxChatMsgLen)}))
+	}
+	alice.Write(codec.Marshal(&codec.SendChatMsg{Channel: kDefaultChannel, Message: strings.Repeat("z", kMaxChatMsgLen+1)}))
+	time.Sleep(100 * time.Millisecond)
+
+	link := newQueuedLink(func(packet []byte) error {
+		_, err := alice.Write(packet)
+		return err
+	}, 16)
+	go func() {
+		for {
+			packet := make([]byte, kMaxPacketSize)
+			n, err := alice.Read(packet)
+			if err != nil {
+				return
+			}
+			link.deliver(packet[:n])
+		}
+	}()
+
+	page, more, err := queryHistory(link, &historyQuery{query_id: 1, limit: 20})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the notice of the join of alice is the first record.
+	if ids := testPageIDs(page); len(ids) != 20 || ids[0] != 12 || ids[19] != 31 || !more {
+		t.Fatalf("latest page %v, more %v", ids, more)
+	}
+	page, more, err = queryHistory(link, &historyQuery{query_id: 2, limit: 20, before: 12})
+	if err != nil || len(page) != 11 || more {
+		t.Fatalf("previous page %v, more %v, %v", testPageIDs(page), more, err)
+	}
+}
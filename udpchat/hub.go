@@ -3,119 +3,243 @@ package udpchat
 import (
 	"bufio"
 	"bytes"
-	"encoding/binary"
+	"crypto/rand"
+	"crypto/sha256"
 	"errors"
+	"hash"
 	"log"
 	"net"
 	"os"
+	"path/filepath"
 	"strconv"
-	"strings"
 	"sync"
 	"time"
+
+	"github.com/flynn/noise"
+	"github.com/neverchanje/unplayground/udpchat/codec"
 )
 
 // One goroutine for each connection.
 // For each message the server receives, logs it to history
-// that's maintained by the server. The clients will not obtain the realtime
-// chat history until it requests for it.
-// TODO use some persistent database to store chat history, the server
-// should only keep the latest logs in memory, and stores the older logs
-// into disks. But on the other hand it could also brings many problems like
-// indexing of logs.
-// TODO the client should keep a local cache of the chat history, so that it
-// do not have to make requests every time.
+// that's maintained by the server, and pushes it to the clients that joined
+// the chat (see push.go).
+// The history is stored on disk, and only the latest records are kept in
+// memory (see histlog.go).
+// Clients keep a local cache of the chat history, so that they only ask for
+// the messages they haven't seen (see histcache.go).
 // TODO connect in TCP but chat in UDP.
-// TODO (HARD) each client can subscribe and publish for multiple channels,
-// they can type "channels" for information of the current existing channels,
-// and type "subscribe: <channel>" for subscribing specific channels so that
-// server can reply with the histories in those channels when users request for.
-// To complete this requirement, messages to be sent must start with the
-// destination channel, like: "send: <channel-id>/<channel-name> <message>".
-// Furthermore, users can type "mkchannel: <channel-name>" to create a new channel,
-// server must return a global unique channel-id if created successfully.
-// Also, only users who created the channel has the authorization to delete it (
-// "rmchannel: <channel-id>")
+// Messages are published to channels, see channel.go.
+// Every datagram is encrypted with the keys of a handshake, see secure.go.
+// Direct messages are end-to-end encrypted, see dm.go.
+
+// A message of the chat history, which is shown as:
+// <Date>: [<Channel-ID>/<Channel-Name>] <Message> from <Sender>
+// or without the sender for the notices of the hub.
+type chatRecord struct {
+	id      uint64 // assigned in the order the messages are appended
+	time    time.Time
+	channel uint32
+	name    string // of the channel when the message was sent
+	sender  string // empty for the notices of the hub
+	msg     string
+}
+
+func (r *chatRecord) toString() string {
+	s := r.time.Format(time.UnixDate) + ": [" + strconv.FormatUint(uint64(r.channel), 10) +
+		"/" + r.name + "] " + r.msg
+	if len(r.sender) == 0 {
+		return s
+	}
+	return s + " from " + r.sender
+}
 
 type Hub struct {
-	// The records in history have arbitrary length, each of them
-	// has the format of:
-	// <Date> <Message>
-	history []string
+	// messages of all channels, in the order they are received
+	history *historyLog
+	index   *searchIndex // of the words of the history, see search.go
 	mu      sync.Mutex
-	conn    *net.UDPConn
+	conn    net.PacketConn // listening on transport, see transport.go
+
+	transport Transport
+
+	channels    map[uint32]*channel
+	lastChannel uint32 // the id of the latest channel created
+
+	// see channel.go, empty if the channels are only kept in memory.
+	channelsPath string
+	channelsMu   sync.Mutex // serializes the stores of the channels
+
+	// see secure.go
+	key      noise.DHKey
+	secure   map[uint64]*secureSession // by SESSION_ID
+	peers    map[string]*secureSession // by the latest address of the client
+	versions codec.Versions            // of the protocol spoken, see codec
+
+	// see users.go
+	accounts *accountStore
+	sessions map[[kTokenSize]byte]*session
+	logins   map[string]bool // being handled, by address and LOGIN_ID
+
+	// see keys.go and dm.go
+	userKeys *keyDirectory
+	mailbox  *mailbox
 
 	fileHandlers map[uint64]*RequestHandler
+
+	// of the requests handled in order, see handleDatagram.
+	queues *requestQueues
+
+	// bad datagrams by the IP address of their source, see faults.go.
+	// Guarded by faultsMu rather than mu, so that a panic of a handler
+	// holding mu can still be counted.
+	faultsMu sync.Mutex
+	faults   map[string]*sourceFaults
+
+	// root of the files uploaded by the clients, see storage.go
+	uploadDir string
 }
 
 type RequestHandler struct {
-	ra  *net.UDPAddr
-	hub *Hub
+	ra      net.Addr
+	hub     *Hub
+	session *session // nil for kReqRegister and kReqLogin
 
 	receiver *fileReceiver
+	download *queuedLink
 }
 
+// Segments are reassembled in the order of SEG_ID: the contiguous prefix
+// of accepted segments is streamed to a temporary file as soon as it grows,
+// so that only the segments received out of order (bounded by the window)
+// are kept in memory. The temporary file is renamed to fname on commit.
 type fileReceiver struct {
-	accepted     map[uint32](*fileSegment)
+	accepted     map[uint32](*fileSegment) // segments above next
 	mu           sync.Mutex
 	fname        string
-	fileListener chan bool // indicates iff file segments are completely received
+	fileListener chan bool // true iff the client commits the file, false if abandoned
 	packet_id    uint64
+	done         bool // set once fileListener has been notified
+
+	// The lowest SEG_ID that has not been accepted yet, all segments below
+	// it have been written.
+	next    uint32
+	file    *os.File
+	writer  *bufio.Writer
+	written uint64
+	err     error // the first error writing the file
+
+	// SHA-256 of the written prefix, checked against the one sent in
+	// the FIN on commit.
+	digest   hash.Hash
+	expected []byte
+
+	// parameters negotiated in the handshake
+	session *fileSession
+
+	// set when the transfer has been committed or cancelled by a FIN,
+	// status is then sent back in response to retransmitted FINs.
+	closed bool
+	status byte
+
+	// when the client last sent a packet of the transfer, see presence.go.
+	active time.Time
 }
 
-// REQUIRE: mutex lock held
-func (fr *fileReceiver) isComplete() bool {
-
-	if len(fr.accepted) == 0 {
-		return false
-	}
+// Creates the receiver of the file negotiated in session, which is written
+// to fname.
+func newFileReceiver(session *fileSession, fname string) *fileReceiver {
+	fr := new(fileReceiver)
+	fr.session = session
+	fr.fname = fname
+	fr.accepted = make(map[uint32]*fileSegment)
+	fr.packet_id = session.packet_id
+	fr.fileListener = make(chan bool, 1)
+	fr.active = time.Now()
+	return fr
+}
 
-	max_id := uint32(0)
-	for id, _ := range fr.accepted {
-		if id > max_id {
-			max_id = id
+// Builds the selective ack describing all accepted segments.
+// REQUIRE: mutex lock held
+func (fr *fileReceiver) makeAck() *segAck {
+	ack := new(segAck)
+	ack.packet_id = fr.packet_id
+	ack.cum_ack = fr.next
+
+	var ids []uint32
+	for id := range fr.accepted {
+		if id > fr.next {
+			ids = append(ids, id)
 		}
 	}
+	ack.ranges = makeSegRanges(ids)
+	return ack
+}
 
-	l := uint32(len(fr.accepted))
-	if l != (max_id + 1) {
-		return false
-	}
-
-	return len(fr.accepted[l-1].content) == 0
+// REQUIRE: mutex lock held
+func (fr *fileReceiver) isComplete() bool {
+	return fr.err == nil && fr.next == fr.session.seg_count &&
+		fr.written == fr.session.total_size
 }
 
 // REQUIRE: mutex lock held
 func (fr *fileReceiver) insert(seg *fileSegment) {
 	fr.accepted[seg.seg_id] = seg
 	log.Println("Receiving segment " + seg.toString())
+
+	for next, has := fr.accepted[fr.next]; has; next, has = fr.accepted[fr.next] {
+		if fr.err == nil {
+			_, fr.err = fr.writer.Write(next.content)
+		}
+		fr.digest.Write(next.content)
+		fr.written += uint64(len(next.content))
+		delete(fr.accepted, fr.next)
+		fr.next++
+
+		if fr.next%kCheckpointSegments == 0 {
+			if err := fr.checkpoint(); err != nil {
+				log.Println("Failed to checkpoint file: " + fr.fname + " " + err.Error())
+			}
+		}
+	}
 }
 
-type fileSegment struct {
-	packet_id uint64
-	seg_id    uint32
-	content   []byte
-	seg_len   int
+// The temporary file is hidden, so that it never collides with a received
+// file, and named after the transfer, so that concurrent transfers of files
+// with the same name do not collide either.
+func (fr *fileReceiver) partName() string {
+	return filepath.Join(filepath.Dir(fr.fname),
+		"."+filepath.Base(fr.fname)+"."+strconv.FormatUint(fr.packet_id, 16)+".part")
 }
 
-func newFileSegment(seg []byte) *fileSegment {
-	fs := new(fileSegment)
-	fs.packet_id = binary.LittleEndian.Uint64(seg[1:9])
-	fs.seg_id = binary.LittleEndian.Uint32(seg[9:13])
-	fs.content = make([]byte, len(seg[13:]))
-	copy(fs.content, seg[13:])
-	fs.seg_len = len(seg)
-	return fs
+// Opens the temporary file the segments are written to, resuming an
+// interrupted transfer of the same file if any.
+func (fr *fileReceiver) open() error {
+	if fr.resume() {
+		return nil
+	}
+
+	var err error
+	os.Remove(fr.stateName())
+	fr.file, err = os.Create(fr.partName())
+	if err == nil {
+		fr.writer = bufio.NewWriter(fr.file)
+		fr.digest = sha256.New()
+	}
+	return err
 }
 
-func (fs *fileSegment) toString() string {
-	str := "<PACKET_ID: " + strconv.FormatUint(fs.packet_id, 10)
-	str += " , SEG_ID: " + strconv.FormatUint(uint64(fs.seg_id), 10)
-	str += " , SEG_LEN: " + strconv.FormatInt(int64(fs.seg_len), 10)
-	str += ">"
-	return str
+// Removes the temporary file of a cancelled transfer.
+// REQUIRE: mutex lock held
+func (fr *fileReceiver) discard() {
+	if fr.file != nil {
+		fr.file.Close()
+		os.Remove(fr.partName())
+		os.Remove(fr.stateName())
+		fr.file = nil
+	}
 }
 
-func NewRequestHandler(ra *net.UDPAddr, hub *Hub) *RequestHandler {
+func NewRequestHandler(ra net.Addr, hub *Hub) *RequestHandler {
 	handler := new(RequestHandler)
 	handler.ra = ra
 	handler.hub = hub
@@ -125,6 +249,7 @@ func NewRequestHandler(ra *net.UDPAddr, hub *Hub) *RequestHandler {
 // Serve for the requests from the client. There may have mutiple clients
 // concurrently handling the requests.
 func (h *RequestHandler) Handle(recv []byte) {
+	defer h.hub.recoverPanic(h.ra)
 	var err error
 
 	reqType := RequestType(recv[0])
@@ -133,172 +258,622 @@ func (h *RequestHandler) Handle(recv []byte) {
 	case kReqSendChatMsg:
 		err = h.handleSndMsg(recv)
 	case kReqGetHistory:
-		err = h.handleHisReq()
+		err = h.handleHisReq(recv)
 	case kReqSendFile:
 		err = h.handleSendFile(recv)
 	case kReqSendSeg:
-		err = h.receiver.handleSendSegment(recv)
+		err = h.handleSendSegment(recv)
+	case kReqSendFileAck:
+		err = h.handleSendFileAck()
+	case kReqSendFileFin:
+		err = h.handleSendFileFin(recv)
+	case kReqGetFile:
+		err = h.handleGetFile(recv)
+	case kReqGetFileAck, kReqFileSegAck, kReqFileFinAck:
+		err = h.handleDownloadPacket(recv)
+	case kReqListFiles:
+		err = h.handleListFiles(recv)
+	case kReqJoin:
+		err = h.handleJoin()
+	case kReqLeave:
+		err = h.handleLeave()
+		h.logout()
+	case kReqListChannels:
+		err = h.handleListChannels(recv)
+	case kReqListSubscribed:
+		err = h.handleListSubscribed(recv)
+	case kReqSubscribe:
+		err = h.handleSubscribe(recv)
+	case kReqUnsubscribe:
+		err = h.handleUnsubscribe(recv)
+	case kReqMakeChannel:
+		err = h.handleMakeChannel(recv)
+	case kReqRemoveChannel:
+		err = h.handleRemoveChannel(recv)
+	case kReqSearch:
+		err = h.handleSearch(recv)
+	case kReqRegister, kReqLogin:
+		err = h.handleLogin(recv)
+	case kReqPublishKey:
+		err = h.handlePublishKey(recv)
+	case kReqGetKey:
+		err = h.handleGetKey(recv)
+	case kReqSendDM:
+		err = h.handleSendDM(recv)
+	case kReqGetDMs:
+		err = h.handleGetDMs()
+	case kReqDMAck:
+		err = h.handleDMAck(recv)
+	case kReqPing:
+		err = h.handlePing()
+	case kReqWho:
+		err = h.handleWho(recv)
 	}
 
-	if err != nil {
+	var rerr *requestError
+	if errors.As(err, &rerr) {
+		h.hub.rejectRequest(h.ra, reqType, rerr.code, rerr.reason)
+	} else if err != nil {
 		log.Println("Server " + err.Error())
-		return
 	}
 }
 
+// Answers the first step of the three-way handshake. A retransmitted
+// request is answered with the parameters negotiated the first time.
 func (h *RequestHandler) handleSendFile(recv []byte) error {
-	buf := new(bytes.Buffer)
-	buf.WriteByte(byte(kRespSendFileOK))
-	_, err := h.hub.conn.WriteToUDP(buf.Bytes(), h.ra)
+	var req codec.SendFile
+	if err := codec.Unmarshal(recv, &req); err != nil {
+		return errors.New("Malformed file transfer request from " + h.ra.String())
+	}
+	session, err := newFileSession(&req.FileSyn)
+	if err != nil {
+		return err
+	}
+	// files are stored under the user that logged in.
+	session.user = h.username()
+	fname, err := h.hub.uploadPath(session.user, session.fname)
+	if err != nil {
+		h.rejectFile(session.packet_id)
+		return err
+	}
 
-	if err == nil {
-		go h.collectSegments()
+	// The requests of a PACKET_ID, downloads included, are handled one at a
+	// time (see handleDatagram), so that nobody else registers a handler
+	// for it while the file is opened without holding the hub lock.
+	h.hub.mu.Lock()
+	prev, has := h.hub.fileHandlers[session.packet_id]
+	h.hub.mu.Unlock()
+	if has && prev.receiver == nil {
+		// the PACKET_ID of a download
+		h.rejectFile(session.packet_id)
+		return errors.New("Duplicated upload id from " + h.ra.String())
+	}
+	if has && !prev.receiver.isClosed() {
+		if prev.ra.String() == h.ra.String() {
+			_, err = h.hub.writeTo(prev.receiver.session.encodeSynAck(), h.ra)
+			return err
+		}
 
-		log.Println("File transferring from remote: " + h.ra.String())
-		h.receiver = new(fileReceiver)
-		h.receiver.fname = string(recv[9:])
-		h.receiver.accepted = make(map[uint32]*fileSegment)
-		h.receiver.packet_id = binary.LittleEndian.Uint64(recv[1:9])
-		h.receiver.fileListener = make(chan bool)
-		h.hub.fileHandlers[h.receiver.packet_id] = h
+		// The client restarted in the middle of the transfer, and
+		// resumes it from another address. Nobody else may take it
+		// over.
+		if prev.username() != h.username() {
+			h.rejectFile(session.packet_id)
+			return errors.New("Transfer of another user taken over by remote: " + h.ra.String())
+		}
+		if !prev.receiver.takeOver() {
+			h.rejectFile(session.packet_id)
+			return nil
+		}
+		log.Println("File transferring taken over by remote: " + h.ra.String())
+	}
+
+	if err = session.negotiate(); err != nil {
+		h.rejectFile(session.packet_id)
+		return err
+	}
+	log.Println("File transferring from remote: " + h.ra.String())
+	h.receiver = newFileReceiver(session, fname)
+	if err = h.receiver.open(); err != nil {
+		h.rejectFile(session.packet_id)
+		return err
 	}
+
+	h.hub.mu.Lock()
+	h.hub.fileHandlers[h.receiver.packet_id] = h
+	h.hub.mu.Unlock()
+
+	go h.collectSegments()
+
+	_, err = h.hub.writeTo(session.encodeSynAck(), h.ra)
 	return err
 }
 
-func (h *RequestHandler) collectSegments() {
-loop:
-	for {
-		select {
-		case <-h.receiver.fileListener:
-			err := h.writeFile()
-			if err == nil {
-				delete(h.hub.fileHandlers, h.receiver.packet_id)
-				h.appendHistorys("Sending file " + h.receiver.fname)
-				//h.receiver = nil // do GC
-				break
-			}
-			log.Println("Failed to write file: " + h.receiver.fname + " " + err.Error())
-			break loop
-		}
+func (h *RequestHandler) rejectFile(packet_id uint64) {
+	resp := codec.Marshal(&codec.SendFileFailed{PacketID: packet_id})
+	if _, err := h.hub.writeTo(resp, h.ra); err != nil {
+		log.Println("Server " + err.Error())
 	}
 }
 
-func (fr *fileReceiver) handleSendSegment(recv []byte) error {
+// The ack completing the handshake only tells the transfer is active, as the
+// first segment establishes the transfer as well when the ack is lost.
+func (h *RequestHandler) handleSendFileAck() error {
+	h.receiver.mu.Lock()
+	defer h.receiver.mu.Unlock()
+
+	h.receiver.active = time.Now()
+	return nil
+}
+
+// Either commits the file once all segments are accepted, or cancels the
+// transfer. The FIN-ACK of a commit is sent after the file is written.
+func (h *RequestHandler) handleSendFileFin(recv []byte) error {
+	fr := h.receiver
+	var fin codec.SendFileFin
+	if !decodeTransfer(recv, &fin, fr.packet_id) {
+		return errors.New("Malformed FIN from " + h.ra.String())
+	}
+
 	fr.mu.Lock()
 	defer fr.mu.Unlock()
 
-	fr.insert(newFileSegment(recv))
-
-	if fr.isComplete() {
-		log.Println("All segments are received")
-		fr.fileListener <- true
+	fr.active = time.Now()
+	switch {
+	case fr.closed:
+		return h.sendFinAck(fr.status)
+	case fr.done:
+		// the file is being written
 		return nil
+	case fin.Flag == kFinCancel:
+		log.Println("File transferring cancelled: " + fr.fname)
+		fr.close(kFinStatusFailed)
+		h.hub.unregisterLater(h.receiver.packet_id, h)
+		return h.sendFinAck(fr.status)
+	case !fr.isComplete() || len(fin.Digest) == 0:
+		log.Println("Incomplete file committed: " + fr.fname)
+		fr.close(kFinStatusFailed)
+		h.hub.unregisterLater(h.receiver.packet_id, h)
+		return h.sendFinAck(fr.status)
 	}
+
+	fr.expected = fin.Digest
+	fr.done = true
+	fr.fileListener <- true
 	return nil
 }
 
-// TODO 当前版本为一次性写，应该每段写一个分文件，最终集合成大文件
-func (h *RequestHandler) writeFile() error {
-	file, err := os.Create(h.receiver.fname)
-	defer file.Close()
-	if err == nil {
-		log.Println("Writing file sended from client")
+func (h *RequestHandler) sendFinAck(status byte) error {
+	resp := codec.Marshal(&codec.SendFileFinAck{PacketID: h.receiver.packet_id, Status: status})
+	_, err := h.hub.writeTo(resp, h.ra)
+	return err
+}
 
-		writer := bufio.NewWriter(file)
-		for _, segment := range h.receiver.accepted {
-			_, err = writer.Write(segment.content)
+func (fr *fileReceiver) isClosed() bool {
+	fr.mu.Lock()
+	defer fr.mu.Unlock()
+	return fr.closed
+}
 
-			if err != nil {
-				break
-			}
+// REQUIRE: mutex lock held
+func (fr *fileReceiver) close(status byte) {
+	fr.closed = true
+	fr.status = status
+	fr.accepted = nil
+	if status != kFinStatusOK {
+		fr.discard()
+	}
+}
 
+// Keeps the closed transfer registered for kTimeWait, so that retransmitted
+// FINs are still answered. A new transfer reusing the PACKET_ID in the
+// meantime is left untouched.
+func (h *Hub) unregisterLater(packet_id uint64, handler *RequestHandler) {
+	time.AfterFunc(kTimeWait, func() {
+		h.mu.Lock()
+		defer h.mu.Unlock()
+		if h.fileHandlers[packet_id] == handler {
+			delete(h.fileHandlers, packet_id)
 		}
+	})
+}
+
+func (h *RequestHandler) collectSegments() {
+	if !<-h.receiver.fileListener {
+		return
+	}
+
+	log.Println("Writing file sended from client")
+	status := kFinStatusOK
+	err := h.receiver.commit()
+	if err == errDigestMismatch {
+		status = kFinStatusCorrupt
+	} else if err != nil {
+		status = kFinStatusFailed
+	}
+	if err != nil {
+		log.Println("Failed to write file: " + h.receiver.fname + " " + err.Error())
+	}
+
+	h.receiver.mu.Lock()
+	h.receiver.close(status)
+	h.receiver.mu.Unlock()
+	h.hub.unregisterLater(h.receiver.packet_id, h)
+
+	if err == nil {
+		h.appendHistorys(kDefaultChannel, "Sending file "+h.hub.storedRef(h.receiver.fname))
+	}
+	if err = h.sendFinAck(status); err != nil {
+		log.Println("Server " + err.Error())
+	}
+}
 
-		if err == nil {
-			err = writer.Flush()
+// Every segment is acknowledged, including duplicates whose previous ack
+// may have been lost, so that the client can stop retransmitting it.
+// The handler stays registered in hub.fileHandlers after the file is
+// complete for the same reason.
+// Corrupted segments are dropped, the ack then reports them as missing.
+func (h *RequestHandler) handleSendSegment(recv []byte) error {
+	var seg codec.SendSeg
+	if err := codec.Unmarshal(recv, &seg); err != nil {
+		return errors.New("Malformed segment from " + h.ra.String())
+	}
+	ack := h.receiver.handleSendSegment(newFileSegment(&seg.Segment))
+	_, err := h.hub.writeTo(ack.encode(byte(kRespRecvSegAck)), h.ra)
+	return err
+}
+
+// Segments beyond the negotiated window, and segments arriving after the
+// transfer is closed, are dropped.
+func (fr *fileReceiver) handleSendSegment(seg *fileSegment) *segAck {
+	fr.mu.Lock()
+	defer fr.mu.Unlock()
+
+	fr.active = time.Now()
+
+	if fr.closed || fr.done {
+		return fr.makeAck()
+	}
+	if !seg.verify() {
+		log.Println("Corrupted segment " + seg.toString())
+		return fr.makeAck()
+	}
+	if seg.seg_id >= fr.session.seg_count ||
+		seg.seg_id >= fr.next+uint32(fr.session.window) ||
+		len(seg.content) != fr.session.segLen(seg.seg_id) {
+		log.Println("Unexpected segment " + seg.toString())
+		return fr.makeAck()
+	}
+	if _, has := fr.accepted[seg.seg_id]; has || seg.seg_id < fr.next {
+		log.Println("Duplicate segment " + seg.toString())
+		return fr.makeAck()
+	}
+	fr.insert(seg)
+
+	if fr.isComplete() {
+		log.Println("All segments are received")
+	}
+	return fr.makeAck()
+}
+
+var errDigestMismatch = errors.New("SHA-256 mismatch")
+
+// Flushes the reassembled file and moves it to its final name, provided
+// that its digest matches the one sent by the client. fname is updated to the
+// version the file is stored as, if the name is taken.
+func (fr *fileReceiver) commit() error {
+	fr.mu.Lock()
+	defer fr.mu.Unlock()
+
+	err := fr.writer.Flush()
+	if cerr := fr.file.Close(); err == nil {
+		err = cerr
+	}
+	fr.file = nil
+	if err == nil && !bytes.Equal(fr.digest.Sum(nil), fr.expected) {
+		err = errDigestMismatch
+	}
+	part, state := fr.partName(), fr.stateName()
+	if err == nil {
+		var stored string
+		if stored, err = storeVersioned(part, fr.fname); err == nil {
+			fr.fname = stored
 		}
 	}
+	os.Remove(state)
+	if err != nil {
+		os.Remove(part)
+	}
 	return err
 }
 
 func (h *RequestHandler) handleSndMsg(recv []byte) error {
-	msg := recv[1:]
-	if len(recv)-1 == 0 {
-		return errors.New("Empty Message from " + h.ra.String())
+	var req codec.SendChatMsg
+	if err := codec.Unmarshal(recv, &req); err != nil {
+		return errors.New("Malformed Message from " + h.ra.String())
+	}
+	msg := req.Message
+	if len(msg) == 0 {
+		return invalidRequest("Empty message")
+	}
+	if len(msg) > kMaxChatMsgLen {
+		return invalidRequest("Too long message")
 	}
 
-	h.appendHistorys(string(msg))
+	record, err := h.appendHistorys(req.Channel, msg)
+	if err != nil {
+		return err
+	}
+	h.broadcast(record)
 	return nil
 }
 
-func (h *RequestHandler) appendHistorys(msg string) {
-	record := string(msg)
-	record = time.Now().Format(time.UnixDate) + ": " + record + " from " + h.ra.String()
-	h.hub.history = append(h.hub.history, record)
+// Returns the record appended to history, which fails if the channel does
+// not exist.
+func (h *RequestHandler) appendHistorys(channel uint32, msg string) (*chatRecord, error) {
+	h.hub.mu.Lock()
+	ch, has := h.hub.channels[channel]
+	h.hub.mu.Unlock()
+	if !has {
+		return nil, invalidRequest("Message to unknown channel")
+	}
+
+	record := &chatRecord{
+		time:    time.Now(),
+		channel: channel,
+		name:    ch.name,
+		sender:  h.username(),
+		msg:     msg,
+	}
+	if err := h.hub.appendRecord(record); err != nil {
+		return nil, err
+	}
+	return record, nil
 }
 
-func (h *RequestHandler) handleHisReq() error {
-	h.hub.mu.Lock()
-	defer h.hub.mu.Unlock()
+// Appends the record to the history, and indexes it.
+func (h *Hub) appendRecord(record *chatRecord) error {
+	if err := h.history.append(record); err != nil {
+		return err
+	}
+	h.index.add(record)
+	return nil
+}
 
-	logs := strings.Join(h.hub.history, "; ")
-	if len(logs) == 0 {
-		logs = "No history now."
+// Packets of an ongoing transfer, routed by PACKET_ID to its handler.
+func isFilePacket(t RequestType) bool {
+	switch t {
+	case kReqSendSeg, kReqSendFileAck, kReqSendFileFin,
+		kReqGetFileAck, kReqFileSegAck, kReqFileFinAck:
+		return true
 	}
+	return false
+}
 
-	log.Println("Sending: [" + logs + "] to " + h.ra.String())
-	_, err := h.hub.conn.WriteToUDP([]byte(logs), h.ra)
-	return err
+// Whether t belongs to the kind of transfer h is serving.
+func (h *RequestHandler) expects(t RequestType) bool {
+	switch t {
+	case kReqSendSeg, kReqSendFileAck, kReqSendFileFin:
+		return h.receiver != nil
+	case kReqGetFileAck, kReqFileSegAck, kReqFileFinAck:
+		return h.download != nil
+	}
+	return false
 }
 
 func (h *Hub) listen() {
+	done := make(chan struct{})
+	defer close(done)
+	go h.reapLoop(done)
+
 	for {
-		recv := make([]byte, 512)
+		recv := make([]byte, kMaxDatagramSize)
 
-		n, ra, err := h.conn.ReadFromUDP(recv)
-		if err != nil {
+		n, ra, err := h.conn.ReadFrom(recv)
+		if errors.Is(err, net.ErrClosed) {
+			return
+		} else if err != nil {
 			log.Println("Server " + err.Error())
 			continue
 		}
+		h.handleDatagram(recv[:n], ra)
+	}
+}
 
-		recv = recv[:n]
+// Handles a datagram of any content, the bad ones are counted against ra.
+func (h *Hub) handleDatagram(recv []byte, ra net.Addr) {
+	defer h.recoverPanic(ra)
 
-		var handler *RequestHandler
-		if RequestType(recv[0]) == kReqSendSeg {
-			var has bool
-			packet_id := binary.LittleEndian.Uint64(recv[1:9])
-			if handler, has = h.fileHandlers[packet_id]; !has {
-				log.Println("[Error] Unexpected segment from: " + ra.String())
-				continue
-			}
-		} else {
-			handler = NewRequestHandler(ra, h)
+	var err error
+	if len(recv) != 0 && recv[0] == kSecureHello {
+		if err = h.handleHello(recv, ra); err != nil {
+			h.fault(ra, kFaultUnsealed)
+			log.Println("Server " + err.Error())
+		}
+		return
+	}
+	if recv, err = h.unseal(recv, ra); err != nil {
+		h.fault(ra, kFaultUnsealed)
+		log.Println("Server " + err.Error())
+		return
+	}
+	session, recv, err := h.authenticate(recv, ra)
+	if err != nil {
+		if h.fault(ra, kFaultUnauthenticated) {
+			h.rejectUnauthenticated(ra, err)
+		}
+		return
+	}
+
+	t := RequestType(recv[0])
+	m, err := codec.DecodeRequest(recv)
+	if err != nil {
+		h.rejectRequest(ra, t, codec.CodeOf(err), "Malformed request: "+err.Error())
+		return
+	}
+
+	// Packets of a transfer are handled in the order they arrive, otherwise
+	// the reordering would be reported as gaps in the acks, and chat
+	// messages are stored in the order they arrive in their channel rather
+	// than in the order their handlers happen to run. Neither is handled
+	// here, as they write to disk.
+	if tm, ok := m.(codec.TransferMessage); ok {
+		packet_id := tm.Transfer()
+		h.queues.run("transfer/"+strconv.FormatUint(packet_id, 16), func() {
+			h.handleTransferPacket(recv, packet_id, session, ra)
+		})
+		return
+	}
+	handler := NewRequestHandler(ra, h)
+	handler.session = session
+	if msg, ok := m.(*codec.SendChatMsg); ok {
+		h.queues.run("channel/"+strconv.FormatUint(uint64(msg.Channel), 10), func() {
+			handler.Handle(recv)
+		})
+		return
+	}
+
+	// handle the request in background.
+	go handler.Handle(recv)
+}
+
+// Handles a request starting the transfer packet_id, or a packet of the
+// ongoing one.
+func (h *Hub) handleTransferPacket(recv []byte, packet_id uint64, session *session, ra net.Addr) {
+	defer h.recoverPanic(ra)
+
+	t := RequestType(recv[0])
+	if !isFilePacket(t) {
+		handler := NewRequestHandler(ra, h)
+		handler.session = session
+		handler.Handle(recv)
+		return
+	}
+	h.mu.Lock()
+	handler, has := h.fileHandlers[packet_id]
+	h.mu.Unlock()
+	if !has || !handler.expects(t) || handler.session != session {
+		h.rejectRequest(ra, t, codec.CodeUnexpected, "Packet of an unknown transfer")
+		return
+	}
+	handler.Handle(recv)
+}
+
+// Runs the functions queued under the same key one at a time, in the order
+// they are queued, and the ones of different keys concurrently. A worker
+// goroutine runs for each key while it has functions queued, up to
+// kMaxQueuedRequests of them, beyond which they are dropped like the
+// datagrams a full socket buffer drops.
+type requestQueues struct {
+	mu      sync.Mutex
+	pending map[string][]func() // by key, present while a worker runs
+}
+
+const kMaxQueuedRequests = 1024
+
+func newRequestQueues() *requestQueues {
+	return &requestQueues{pending: make(map[string][]func())}
+}
+
+func (q *requestQueues) run(key string, fn func()) {
+	q.mu.Lock()
+	queue, working := q.pending[key]
+	if len(queue) >= kMaxQueuedRequests {
+		q.mu.Unlock()
+		log.Println("Server dropping request, too many queued for " + key)
+		return
+	}
+	q.pending[key] = append(queue, fn)
+	q.mu.Unlock()
+	if !working {
+		go q.work(key)
+	}
+}
+
+func (q *requestQueues) work(key string) {
+	for {
+		q.mu.Lock()
+		queue := q.pending[key]
+		if len(queue) == 0 {
+			delete(q.pending, key)
+			q.mu.Unlock()
+			return
 		}
+		fn := queue[0]
+		q.pending[key] = queue[1:]
+		q.mu.Unlock()
+		fn()
+	}
+}
 
-		// handle the request in background.
-		go handler.Handle(recv)
+// Creates a hub that recovers the history stored in historyDir, listening
+// on the default address over UDP.
+func NewHub(historyDir string, policy SyncPolicy) (*Hub, error) {
+	return NewHubOn(UDP, ServiceAddress(), historyDir, policy)
+}
+
+// Creates a hub that recovers the history stored in historyDir, listening
+// on address over transport.
+func NewHubOn(transport Transport, address string, historyDir string, policy SyncPolicy) (*Hub, error) {
+	hub := newHub()
+	history, err := openHistoryLog(historyDir, policy)
+	if err != nil {
+		return hub, err
+	}
+	hub.history = history
+	if history.maxChannel > hub.lastChannel {
+		hub.lastChannel = history.maxChannel
 	}
+	if len(historyDir) != 0 {
+		if err = hub.openChannels(filepath.Join(historyDir, kChannelsFile)); err != nil {
+			return hub, err
+		}
+	}
+	if err = hub.index.fill(history); err != nil {
+		return hub, err
+	}
+
+	err = hub.startServer(transport, address)
+	return hub, err
 }
 
-func NewHub() (*Hub, error) {
+// Creates a hub whose history is only kept in memory.
+func newHub() *Hub {
 	hub := new(Hub)
+	hub.history, _ = openHistoryLog("", SyncNever)
+	hub.index = newSearchIndex()
 	hub.fileHandlers = make(map[uint64]*RequestHandler)
-	err := hub.startServer(ServiceHost, ServicePort)
-	return hub, err
+	hub.queues = newRequestQueues()
+	hub.faults = make(map[string]*sourceFaults)
+	hub.uploadDir = kDefaultUploadDir
+	hub.channels = make(map[uint32]*channel)
+	hub.lastChannel = kDefaultChannel
+	hub.accounts, _ = openAccountStore("")
+	hub.sessions = make(map[[kTokenSize]byte]*session)
+	hub.logins = make(map[string]bool)
+	hub.userKeys, _ = openKeyDirectory("")
+	hub.mailbox, _ = openMailbox("")
+	hub.key, _ = cipherSuite.GenerateKeypair(rand.Reader)
+	hub.secure = make(map[uint64]*secureSession)
+	hub.peers = make(map[string]*secureSession)
+	hub.versions = codec.Supported
+	hub.channels[kDefaultChannel] = newChannel(kDefaultChannel, kDefaultChannelName, "")
+	return hub
 }
 
-func (h *Hub) startServer(host string, port int) error {
+func (h *Hub) startServer(transport Transport, address string) error {
 	var err error
-	udpaddr := &net.UDPAddr{IP: net.ParseIP(host), Port: port}
-	h.conn, err = net.ListenUDP("udp", udpaddr)
+	h.conn, err = transport.Listen(address)
 	if err != nil {
 		return err
 	}
-	log.Println("Server starts.")
+	h.transport = transport
+	log.Println("Server starts on " + h.conn.LocalAddr().String() + ".")
 	return nil
 }
 
 func (h *Hub) RunLoop() {
 	h.listen()
 	defer h.conn.Close()
+	defer h.history.close()
 }
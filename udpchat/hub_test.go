@@ -2,8 +2,75 @@ package udpchat
 
 import (
 	"testing"
+	"time"
 )
 
-func TestFuck(t *testing.T) {
+// Polls the history of channel sent by sender, as c, until it holds n
+// records.
+func waitHistory(t *testing.T, c *Client, channel uint32, sender string, n int) []*chatRecord {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		q := &historyQuery{query_id: c.nextQueryID(), limit: kDefaultHistoryLimit, channel: channel, sender: sender}
+		page, _, err := queryHistory(c, q)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(page) >= n || time.Now().After(deadline) {
+			return page
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestChat(t *testing.T) {
+	hub := newTestHub(t)
+	alice := newTestClient(t, hub, "alice")
+	bob := newTestClient(t, hub, "bob")
+
+	alice.SendChatMsg("hello bob")
+	alice.SendChatMsg("how are you?")
+	page := waitHistory(t, bob, kDefaultChannel, "alice", 2)
+	if len(page) != 2 || page[0].msg+"|"+page[1].msg != "hello bob|how are you?" {
+		t.Fatalf("bob sees %v", page)
+	}
+
+	bob.SendChatMsg("fine")
+	page = waitHistory(t, alice, kDefaultChannel, "", 5)
+	// after the notices of the joins of alice and bob.
+	if len(page) != 5 || page[4].sender != "bob" || page[4].msg != "fine" || page[4].id <= page[3].id {
+		t.Fatalf("alice sees %v", page)
+	}
+}
+
+// The requests of a key run in order, while another key isn't held up.
+func TestRequestQueues(t *testing.T) {
+	q := newRequestQueues()
+	blocked := make(chan struct{})
+	q.run("slow", func() { <-blocked })
+
+	var order []int
+	done := make(chan struct{})
+	for i := 0; i < 3; i++ {
+		i := i
+		q.run("slow", func() {
+			order = append(order, i)
+			if i == 2 {
+				close(done)
+			}
+		})
+	}
+	ran := make(chan struct{})
+	q.run("fast", func() { close(ran) })
+	select {
+	case <-ran:
+	case <-time.After(time.Second):
+		t.Fatal("request held up by another key")
+	}
 
+	close(blocked)
+	<-done
+	if len(order) != 3 || order[0] != 0 || order[1] != 1 {
+		t.Fatalf("ran in order %v", order)
+	}
 }
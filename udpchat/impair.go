@@ -0,0 +1,370 @@
+package udpchat
+
+import (
+	"errors"
+	"math/rand"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// A Transport impairing the datagrams written to it on the way to another
+// Transport, as a bad network does, so that the protocol can be tested under
+// loss and reordering:
+//
+//	write ----> loss ----> duplication ----> bandwidth ----> delay, jitter, reordering ----> written
+//
+// A datagram is dropped with probability Loss, or else sent twice with
+// probability Duplicate. Then it waits for the datagrams written before it by
+// the same endpoint to go out at Bandwidth bytes per second, and is dropped if
+// more than kMaxImpairBacklog of them are waiting, like in the queue of a
+// router. Once out, it's delayed by Delay plus a uniform jitter below Jitter,
+// which reorders the datagrams closer than the jitter, and held back further
+// with probability Reorder, so that the next ones overtake it.
+//
+// The decisions are drawn from a random source per endpoint, seeded with Seed
+// and the rank of the endpoint, so that a run can be replayed as far as the
+// goroutines write in the same order. Reads aren't impaired: when both the
+// hub and the clients are on the same ImpairedTransport, both directions are.
+type Impairment struct {
+	Loss      float64
+	Duplicate float64
+	Reorder   float64
+	Delay     time.Duration
+	Jitter    time.Duration
+	Bandwidth int // bytes per second, unlimited if 0
+	Seed      int64
+}
+
+const (
+	kMaxImpairBacklog = 200 * time.Millisecond
+
+	// held back by Delay+Jitter more than that when reordered.
+	kReorderHold = 5 * time.Millisecond
+)
+
+// Impairments of some bad networks, by name.
+var ImpairProfiles = map[string]Impairment{
+	"lossy":       {Loss: 0.05},
+	"duplicating": {Duplicate: 0.1},
+	"reordering":  {Reorder: 0.1, Delay: time.Millisecond},
+	"jittery":     {Delay: 20 * time.Millisecond, Jitter: 20 * time.Millisecond},
+	"narrow":      {Bandwidth: 256 << 10},
+	"hostile": {Loss: 0.03, Duplicate: 0.03, Reorder: 0.05, Delay: 5 * time.Millisecond,
+		Jitter: 5 * time.Millisecond, Bandwidth: 1 << 20},
+}
+
+// Parses either the name of a profile of ImpairProfiles, or comma separated
+// "<field>=<value>" settings with the fields loss, dup, reorder (as
+// probabilities), delay, jitter (as durations), bandwidth (in bytes per
+// second) and seed. A profile may be followed by settings overriding it, like
+// "lossy,loss=0.2".
+func ParseImpairment(s string) (Impairment, error) {
+	var imp Impairment
+	for i, setting := range strings.Split(s, ",") {
+		field, value, isSetting := strings.Cut(strings.TrimSpace(setting), "=")
+		if !isSetting {
+			profile, has := ImpairProfiles[field]
+			if i != 0 || !has {
+				return imp, errors.New("Unknown impairment profile " + field + ", should be one of " +
+					strings.Join(impairProfileNames(), ", "))
+			}
+			imp = profile
+			continue
+		}
+
+		var err error
+		switch field {
+		case "loss":
+			imp.Loss, err = parseProbability(value)
+		case "dup":
+			imp.Duplicate, err = parseProbability(value)
+		case "reorder":
+			imp.Reorder, err = parseProbability(value)
+		case "delay":
+			imp.Delay, err = time.ParseDuration(value)
+		case "jitter":
+			imp.Jitter, err = time.ParseDuration(value)
+		case "bandwidth":
+			imp.Bandwidth, err = strconv.Atoi(value)
+		case "seed":
+			imp.Seed, err = strconv.ParseInt(value, 10, 64)
+		default:
+			err = errors.New("unknown setting")
+		}
+		if err == nil && (imp.Delay < 0 || imp.Jitter < 0 || imp.Bandwidth < 0) {
+			err = errors.New("negative value")
+		}
+		if err != nil {
+			return imp, errors.New("Invalid impairment " + setting + ": " + err.Error())
+		}
+	}
+	return imp, nil
+}
+
+func parseProbability(s string) (float64, error) {
+	p, err := strconv.ParseFloat(s, 64)
+	if err == nil && !(p >= 0 && p <= 1) {
+		err = errors.New("not a probability")
+	}
+	return p, err
+}
+
+func impairProfileNames() []string {
+	var names []string
+	for name := range ImpairProfiles {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// What an ImpairedTransport did to the datagrams written so far.
+type ImpairStats struct {
+	Written    uint64
+	Dropped    uint64 // lost or over the backlog
+	Duplicated uint64
+	Reordered  uint64 // held back by Reorder
+}
+
+type ImpairedTransport struct {
+	transport Transport
+	impair    Impairment
+
+	mu        sync.Mutex
+	endpoints int64
+	stats     ImpairStats
+	links     map[string]*impairedLink // by the local address of the endpoint
+}
+
+func NewImpairedTransport(transport Transport, impair Impairment) *ImpairedTransport {
+	t := &ImpairedTransport{transport: transport, impair: impair}
+	t.links = make(map[string]*impairedLink)
+	return t
+}
+
+// Of the datagrams written by all the endpoints.
+func (t *ImpairedTransport) Stats() ImpairStats {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.stats
+}
+
+// Of the datagrams written by the endpoint listening on or dialed from addr,
+// the latest one if the address was reused.
+func (t *ImpairedTransport) StatsOf(addr net.Addr) ImpairStats {
+	t.mu.Lock()
+	l, has := t.links[addr.String()]
+	t.mu.Unlock()
+	if !has {
+		return ImpairStats{}
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.stats
+}
+
+func (t *ImpairedTransport) Listen(address string) (net.PacketConn, error) {
+	conn, err := t.transport.Listen(address)
+	if err != nil {
+		return nil, err
+	}
+	return &impairedPacketConn{conn, t.newLink(conn.LocalAddr(), conn.WriteTo)}, nil
+}
+
+func (t *ImpairedTransport) Dial(address string) (net.Conn, error) {
+	conn, err := t.transport.Dial(address)
+	if err != nil {
+		return nil, err
+	}
+	link := t.newLink(conn.LocalAddr(), func(p []byte, _ net.Addr) (int, error) {
+		return conn.Write(p)
+	})
+	return &impairedConn{conn, link}, nil
+}
+
+func (t *ImpairedTransport) newLink(local net.Addr, send func([]byte, net.Addr) (int, error)) *impairedLink {
+	l := &impairedLink{
+		transport: t,
+		send:      send,
+		wake:      make(chan struct{}, 1),
+		closed:    make(chan struct{}),
+	}
+	t.mu.Lock()
+	l.rng = rand.New(rand.NewSource(t.impair.Seed + t.endpoints))
+	t.endpoints++
+	t.links[local.String()] = l
+	t.mu.Unlock()
+	go l.run()
+	return l
+}
+
+type impairedDatagram struct {
+	payload []byte
+	addr    net.Addr
+	due     time.Time
+}
+
+// The datagrams written by an endpoint, sent by run once due.
+type impairedLink struct {
+	transport *ImpairedTransport
+	send      func([]byte, net.Addr) (int, error)
+
+	mu      sync.Mutex
+	rng     *rand.Rand
+	pending []impairedDatagram // by due, in the order written if equal
+	busy    time.Time          // until the datagrams written go out
+	stats   ImpairStats        // of the datagrams written by this endpoint
+
+	wake      chan struct{}
+	closed    chan struct{}
+	closeOnce sync.Once
+}
+
+func (l *impairedLink) write(p []byte, addr net.Addr) (int, error) {
+	select {
+	case <-l.closed:
+		// fails as the endpoint is closed.
+		return l.send(p, addr)
+	default:
+	}
+	imp := &l.transport.impair
+	var stats ImpairStats
+	stats.Written++
+
+	l.mu.Lock()
+	copies := 1
+	if l.rng.Float64() < imp.Loss {
+		copies = 0
+		stats.Dropped++
+	} else if l.rng.Float64() < imp.Duplicate {
+		copies = 2
+		stats.Duplicated++
+	}
+	for i := 0; i < copies; i++ {
+		now := time.Now()
+		out := now
+		if imp.Bandwidth != 0 {
+			if l.busy.After(now) {
+				out = l.busy
+			}
+			if out.Sub(now) > kMaxImpairBacklog {
+				stats.Dropped++
+				continue
+			}
+			out = out.Add(time.Duration(len(p)) * time.Second / time.Duration(imp.Bandwidth))
+			l.busy = out
+		}
+
+		due := out.Add(imp.Delay)
+		if imp.Jitter != 0 {
+			due = due.Add(time.Duration(l.rng.Int63n(int64(imp.Jitter))))
+		}
+		if l.rng.Float64() < imp.Reorder {
+			due = due.Add(imp.Delay + imp.Jitter + kReorderHold)
+			stats.Reordered++
+		}
+		at := sort.Search(len(l.pending), func(i int) bool {
+			return l.pending[i].due.After(due)
+		})
+		d := impairedDatagram{append([]byte(nil), p...), addr, due}
+		l.pending = append(l.pending, impairedDatagram{})
+		copy(l.pending[at+1:], l.pending[at:])
+		l.pending[at] = d
+	}
+	l.stats.Written += stats.Written
+	l.stats.Dropped += stats.Dropped
+	l.stats.Duplicated += stats.Duplicated
+	l.stats.Reordered += stats.Reordered
+	l.mu.Unlock()
+
+	select {
+	case l.wake <- struct{}{}:
+	default:
+	}
+
+	t := l.transport
+	t.mu.Lock()
+	t.stats.Written += stats.Written
+	t.stats.Dropped += stats.Dropped
+	t.stats.Duplicated += stats.Duplicated
+	t.stats.Reordered += stats.Reordered
+	t.mu.Unlock()
+	return len(p), nil
+}
+
+// Sends the pending datagrams once due, until the link is closed. The ones
+// still pending then are lost.
+func (l *impairedLink) run() {
+	for {
+		now := time.Now()
+		l.mu.Lock()
+		var due []impairedDatagram
+		for len(l.pending) != 0 && !l.pending[0].due.After(now) {
+			due = append(due, l.pending[0])
+			l.pending = l.pending[1:]
+		}
+		wait := time.Hour
+		if len(l.pending) != 0 {
+			wait = l.pending[0].due.Sub(now)
+		}
+		l.mu.Unlock()
+
+		for _, d := range due {
+			l.send(d.payload, d.addr)
+		}
+		if len(due) != 0 {
+			continue
+		}
+
+		timer := time.NewTimer(wait)
+		select {
+		case <-timer.C:
+		case <-l.wake:
+		case <-l.closed:
+		}
+		timer.Stop()
+		select {
+		case <-l.closed:
+			return
+		default:
+		}
+	}
+}
+
+func (l *impairedLink) close() {
+	l.closeOnce.Do(func() {
+		close(l.closed)
+	})
+}
+
+type impairedPacketConn struct {
+	net.PacketConn
+	link *impairedLink
+}
+
+func (c *impairedPacketConn) WriteTo(p []byte, addr net.Addr) (int, error) {
+	return c.link.write(p, addr)
+}
+
+func (c *impairedPacketConn) Close() error {
+	c.link.close()
+	return c.PacketConn.Close()
+}
+
+type impairedConn struct {
+	net.Conn
+	link *impairedLink
+}
+
+func (c *impairedConn) Write(p []byte) (int, error) {
+	return c.link.write(p, c.RemoteAddr())
+}
+
+func (c *impairedConn) Close() error {
+	c.link.close()
+	return c.Conn.Close()
+}
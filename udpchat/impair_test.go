@@ -0,0 +1,142 @@
+package udpchat
+
+import (
+	"flag"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+var impairSeed = flag.Int64("impair-seed", 1, "seed of the impairments of the tests under bad networks")
+
+// Runs test with a hub on a MemoryTransport impaired by each of the profiles.
+// Run with -v to see what was done to the datagrams, and -impair-seed to
+// replay another run.
+func forEachImpairment(t *testing.T, test func(t *testing.T, hub *Hub, imp Impairment)) {
+	for _, name := range impairProfileNames() {
+		imp := ImpairProfiles[name]
+		imp.Seed = *impairSeed
+		t.Run(name, func(t *testing.T) {
+			transport := NewImpairedTransport(NewMemoryTransport(), imp)
+			test(t, newTestHubOn(t, transport), imp)
+			t.Logf("%+v with seed %d", transport.Stats(), imp.Seed)
+		})
+	}
+}
+
+func TestImpairedChat(t *testing.T) {
+	forEachImpairment(t, func(t *testing.T, hub *Hub, imp Impairment) {
+		alice := newTestClient(t, hub, "alice")
+		bob := newTestClient(t, hub, "bob")
+
+		// the messages lost on the way from alice to the hub.
+		transport := hub.transport.(*ImpairedTransport)
+		dropped := func() int {
+			return int(transport.StatsOf(alice.conn.LocalAddr()).Dropped)
+		}
+
+		const count = 20
+		before := dropped()
+		for i := 0; i < count; i++ {
+			alice.SendChatMsg("msg " + strconv.Itoa(i))
+		}
+		lost := dropped() - before
+		page := waitHistory(t, bob, kDefaultChannel, "alice", count-lost)
+
+		// Chat messages aren't retransmitted, so all but the lost ones are
+		// stored, and never twice.
+		if len(page) < count-lost || len(page) > count {
+			t.Fatalf("stored %d of %d messages, %d lost", len(page), count, lost)
+		}
+		seen := make(map[string]bool)
+		var msgs []string
+		for _, r := range page {
+			if seen[r.msg] || !strings.HasPrefix(r.msg, "msg ") {
+				t.Fatalf("stored %q", r.msg)
+			}
+			seen[r.msg] = true
+			msgs = append(msgs, r.msg)
+		}
+		if imp.Reorder == 0 && imp.Jitter == 0 {
+			for i := 1; i < len(msgs); i++ {
+				if n, m := msgIndex(msgs[i-1]), msgIndex(msgs[i]); n >= m {
+					t.Fatalf("stored out of order: %v", msgs)
+				}
+			}
+		}
+	})
+}
+
+func msgIndex(msg string) int {
+	i, _ := strconv.Atoi(strings.TrimPrefix(msg, "msg "))
+	return i
+}
+
+func TestImpairedFileTransfer(t *testing.T) {
+	forEachImpairment(t, func(t *testing.T, hub *Hub, imp Impairment) {
+		testFileTransfer(t, hub)
+	})
+}
+
+func TestImpairment(t *testing.T) {
+	imp := Impairment{Loss: 0.2, Duplicate: 0.2, Reorder: 0.2, Seed: 7}
+	received := func() []string {
+		transport := NewImpairedTransport(NewMemoryTransport(), imp)
+		hub, _ := transport.Listen("hub")
+		defer hub.Close()
+		alice, _ := transport.Dial("hub")
+		defer alice.Close()
+		for i := 0; i < 100; i++ {
+			alice.Write([]byte(strconv.Itoa(i)))
+		}
+
+		var got []string
+		buf := make([]byte, 16)
+		for {
+			hub.SetReadDeadline(time.Now().Add(50 * time.Millisecond))
+			n, _, err := hub.ReadFrom(buf)
+			if err != nil {
+				break
+			}
+			got = append(got, string(buf[:n]))
+		}
+		stats := transport.Stats()
+		if stats.Written != 100 || uint64(len(got)) != 100-stats.Dropped+stats.Duplicated {
+			t.Fatalf("received %d datagrams, %+v", len(got), stats)
+		}
+		// alice wrote them all, and the hub nothing.
+		if transport.StatsOf(alice.LocalAddr()) != stats || transport.StatsOf(hub.LocalAddr()).Written != 0 {
+			t.Fatalf("stats of alice %+v", transport.StatsOf(alice.LocalAddr()))
+		}
+		return got
+	}
+
+	// the same seed does the same.
+	got := received()
+	if again := received(); strings.Join(got, " ") != strings.Join(again, " ") {
+		t.Fatalf("received %v, then %v", got, again)
+	}
+	reordered := false
+	for i := 1; i < len(got); i++ {
+		n, _ := strconv.Atoi(got[i-1])
+		m, _ := strconv.Atoi(got[i])
+		reordered = reordered || n > m
+	}
+	if !reordered {
+		t.Fatalf("received in order %v", got)
+	}
+}
+
+func TestParseImpairment(t *testing.T) {
+	imp, err := ParseImpairment("lossy,dup=0.1,delay=20ms,bandwidth=1000,seed=3")
+	want := Impairment{Loss: 0.05, Duplicate: 0.1, Delay: 20 * time.Millisecond, Bandwidth: 1000, Seed: 3}
+	if err != nil || imp != want {
+		t.Fatalf("parsed %+v, %v", imp, err)
+	}
+	for _, s := range []string{"", "nowhere", "loss=2", "delay=-1s", "loss=0.1,lossy", "speed=3"} {
+		if _, err := ParseImpairment(s); err == nil {
+			t.Fatalf("parsed %q", s)
+		}
+	}
+}
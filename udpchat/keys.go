@@ -0,0 +1,357 @@
+package udpchat
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/neverchanje/unplayground/udpchat/codec"
+	"golang.org/x/crypto/nacl/box"
+)
+
+// Every user has an identity key, a X25519 key pair generated by the client
+// the first time the user logs in from it, which direct messages are
+// encrypted to (see dm.go). The client publishes its public key once joined,
+// and asks the hub for the keys of the other users:
+//
+//	kReqPublishKey KEY  ---->
+//		<----  kRespKeyPublished KEY
+//	kReqGetKey USERNAME  ---->
+//		<----  kRespUserKey USER_LEN USERNAME [KEY]
+//
+// KEY is missing if the user has never published one. As the hub could hand
+// out keys of its own, the client pins the key of each user the first time it
+// sees it, and refuses the keys that differ from the pinned ones. Users tell
+// each other the fingerprints of their keys out of band ("fingerprint"), and
+// mark the keys whose fingerprints they compared as verified ("verify"),
+// which also pins the new key of a user who changed it.
+//
+// The client stores its identity with the history cache (see histcache.go):
+//
+//	<dir>/<host>-<port>/<user>/identity
+//	<dir>/<host>-<port>/<user>/contacts
+//
+// identity holds the private key in hex, and contacts has a
+// "<username> <key> <verified>" line for each pinned key. The hub stores the
+// published keys in a file of "<username> <key>" lines.
+const (
+	kIdentityFile = "identity"
+	kContactsFile = "contacts"
+	kUserKeysFile = "keys"
+
+	kKeySize = codec.KeySize
+)
+
+// The published keys of the users, by username.
+type keyDirectory struct {
+	mu   sync.Mutex
+	path string // empty if the keys are only kept in memory
+	keys map[string][]byte
+}
+
+func openKeyDirectory(path string) (*keyDirectory, error) {
+	d := &keyDirectory{path: path, keys: make(map[string][]byte)}
+	if len(path) == 0 {
+		return d, nil
+	}
+	content, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return d, nil
+	} else if err != nil {
+		return nil, err
+	}
+	for _, line := range strings.Split(string(content), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) == 0 {
+			continue
+		}
+		key, err := hex.DecodeString(fields[len(fields)-1])
+		if len(fields) != 2 || err != nil || len(key) != kKeySize {
+			log.Println("[Error] Malformed user key in " + path)
+			continue
+		}
+		d.keys[fields[0]] = key
+	}
+	return d, nil
+}
+
+// Replaces the key of the user. The file is replaced as a whole so that it's
+// never half written.
+func (d *keyDirectory) publish(name string, key []byte) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if bytes.Equal(d.keys[name], key) {
+		return nil
+	}
+	d.keys[name] = key
+	if len(d.path) == 0 {
+		return nil
+	}
+	var lines []string
+	for name, key := range d.keys {
+		lines = append(lines, name+" "+hex.EncodeToString(key)+"\n")
+	}
+	sort.Strings(lines)
+	tmp := d.path + ".tmp"
+	if err := os.WriteFile(tmp, []byte(strings.Join(lines, "")), 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, d.path)
+}
+
+// The published key of the user, nil if none.
+func (d *keyDirectory) lookup(name string) []byte {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.keys[name]
+}
+
+func (h *RequestHandler) handlePublishKey(recv []byte) error {
+	var req codec.PublishKey
+	if codec.Unmarshal(recv, &req) != nil {
+		return errors.New("Malformed key from " + h.ra.String())
+	}
+	key := req.Key[:]
+	if prev := h.hub.userKeys.lookup(h.username()); prev != nil && !bytes.Equal(prev, key) {
+		log.Println("Key of " + h.username() + " changed to " + fingerprint(key))
+	}
+	if err := h.hub.userKeys.publish(h.username(), key); err != nil {
+		return err
+	}
+	_, err := h.hub.writeTo(codec.Marshal(&codec.KeyPublished{Key: req.Key}), h.ra)
+	return err
+}
+
+func (h *RequestHandler) handleGetKey(recv []byte) error {
+	var req codec.GetKey
+	if codec.Unmarshal(recv, &req) != nil || !validUsername(req.Username) {
+		return errors.New("Invalid username from " + h.ra.String())
+	}
+	resp := &codec.UserKey{Username: req.Username, Key: h.hub.userKeys.lookup(req.Username)}
+	_, err := h.hub.writeTo(codec.Marshal(resp), h.ra)
+	return err
+}
+
+// A key of another user, pinned by the client.
+type contact struct {
+	key      []byte
+	verified bool // whether the user compared its fingerprint
+}
+
+// The identity key of the user, and the keys of the other users.
+type identity struct {
+	dir     string
+	public  *[kKeySize]byte
+	private *[kKeySize]byte
+
+	mu       sync.Mutex
+	contacts map[string]*contact
+}
+
+// Opens the identity in dir, generating the key pair if there's none.
+func openIdentity(dir string) (*identity, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+	id := &identity{dir: dir, contacts: make(map[string]*contact)}
+
+	path := filepath.Join(dir, kIdentityFile)
+	content, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		if id.public, id.private, err = box.GenerateKey(rand.Reader); err != nil {
+			return nil, err
+		}
+		err = os.WriteFile(path, []byte(hex.EncodeToString(id.private[:])+"\n"), 0600)
+		if err != nil {
+			return nil, err
+		}
+	} else if err != nil {
+		return nil, err
+	} else {
+		private, err := hex.DecodeString(strings.TrimSpace(string(content)))
+		if err != nil || len(private) != kKeySize {
+			return nil, errors.New("Malformed identity key in " + path)
+		}
+		id.private = new([kKeySize]byte)
+		copy(id.private[:], private)
+		id.public = new([kKeySize]byte)
+		public, err := publicKey(private)
+		if err != nil {
+			return nil, err
+		}
+		copy(id.public[:], public)
+	}
+
+	content, err = os.ReadFile(filepath.Join(dir, kContactsFile))
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	for _, line := range strings.Split(string(content), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) != 3 {
+			continue
+		}
+		key, err := hex.DecodeString(fields[1])
+		if err == nil && len(key) == kKeySize {
+			id.contacts[fields[0]] = &contact{key: key, verified: fields[2] == "verified"}
+		}
+	}
+	return id, nil
+}
+
+// The contact of the user, nil if its key isn't pinned.
+func (id *identity) contact(name string) *contact {
+	id.mu.Lock()
+	defer id.mu.Unlock()
+	return id.contacts[name]
+}
+
+// Pins the key of the user. The contacts file is replaced as a whole so
+// that it's never half written.
+func (id *identity) pin(name string, key []byte, verified bool) error {
+	id.mu.Lock()
+	defer id.mu.Unlock()
+
+	id.contacts[name] = &contact{key: key, verified: verified}
+	var lines []string
+	for name, c := range id.contacts {
+		status := "unverified"
+		if c.verified {
+			status = "verified"
+		}
+		lines = append(lines, name+" "+hex.EncodeToString(c.key)+" "+status+"\n")
+	}
+	sort.Strings(lines)
+	tmp := filepath.Join(id.dir, kContactsFile+".tmp")
+	if err := os.WriteFile(tmp, []byte(strings.Join(lines, "")), 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, filepath.Join(id.dir, kContactsFile))
+}
+
+// Opens the identity of the user under dir, publishes its key, and fetches
+// the direct messages received while the user was away. Direct messages
+// can't be sent or read until it's opened.
+func (c *Client) OpenIdentity(dir string) error {
+	dir, err := c.userDir(dir)
+	if err != nil {
+		return err
+	}
+	id, err := openIdentity(dir)
+	if err != nil {
+		return err
+	}
+	_, err = exchange(c, codec.Marshal(&codec.PublishKey{Key: *id.public}), func(packet []byte) bool {
+		var resp codec.KeyPublished
+		return codec.Unmarshal(packet, &resp) == nil && resp.Key == *id.public
+	})
+	if err != nil {
+		return errors.New("Publishing the identity key: " + err.Error())
+	}
+
+	c.mu.Lock()
+	c.identity = id
+	c.mu.Unlock()
+	return c.fetchDMs()
+}
+
+// The key the user published, or an error if none.
+func (c *Client) userKey(name string) ([]byte, error) {
+	var key []byte
+	_, err := exchange(c, codec.Marshal(&codec.GetKey{Username: name}), func(packet []byte) bool {
+		var resp codec.UserKey
+		if codec.Unmarshal(packet, &resp) != nil || resp.Username != name {
+			return false
+		}
+		key = resp.Key
+		return true
+	})
+	if err != nil {
+		return nil, err
+	}
+	if len(key) != kKeySize {
+		return nil, errors.New(name + " has not published a key yet")
+	}
+	return key, nil
+}
+
+// Pins the key of the user on first use, or returns an error if it isn't
+// the pinned one.
+func (c *Client) trustKey(id *identity, name string, key []byte) error {
+	pinned := id.contact(name)
+	if pinned == nil {
+		c.printAsync("Trusting the key of " + name + " on first use, fingerprint " + fingerprint(key) +
+			". Compare it with " + name + " and run \"verify: " + name + " <fingerprint>\".")
+		return id.pin(name, key, false)
+	}
+	if !bytes.Equal(pinned.key, key) {
+		return errors.New("The key of " + name + " changed to fingerprint " + fingerprint(key) +
+			", someone may be impersonating them. Compare it with " + name +
+			" and run \"verify: " + name + " <fingerprint>\" if the change is expected.")
+	}
+	return nil
+}
+
+// Prints the fingerprint of the key of the user, or of the own key if name
+// is empty.
+func (c *Client) Fingerprint(name string) {
+	if c.identity == nil {
+		println("Direct messages are disabled, as the identity key isn't opened.")
+		return
+	}
+	if len(name) == 0 {
+		println("Your key fingerprint: " + fingerprint(c.identity.public[:]))
+		return
+	}
+	key, err := c.userKey(name)
+	if err == nil {
+		err = c.trustKey(c.identity, name, key)
+	}
+	if err != nil {
+		log.Println("[Error] " + err.Error())
+		return
+	}
+	status := "not verified"
+	if c.identity.contact(name).verified {
+		status = "verified"
+	}
+	println("Key fingerprint of " + name + ": " + fingerprint(key) + " (" + status + ")")
+}
+
+// Marks the key of the user as verified if its fingerprint is the one the
+// user told, given as "<user> <fingerprint>".
+func (c *Client) Verify(args string) {
+	if c.identity == nil {
+		println("Direct messages are disabled, as the identity key isn't opened.")
+		return
+	}
+	fields := strings.Fields(args)
+	if len(fields) != 2 {
+		println("Usage: verify: <user> <fingerprint>")
+		return
+	}
+	name := fields[0]
+	key, err := c.userKey(name)
+	if err != nil {
+		log.Println("[Error] " + err.Error())
+		return
+	}
+	normalize := strings.NewReplacer(":", "", " ", "")
+	if normalize.Replace(strings.ToLower(fields[1])) != normalize.Replace(fingerprint(key)) {
+		log.Println("[Error] The key of " + name + " has fingerprint " + fingerprint(key) + ", not " + fields[1])
+		return
+	}
+	if err = c.identity.pin(name, key, true); err != nil {
+		log.Println("[Error] " + err.Error())
+		return
+	}
+	println("Verified the key of " + name + ".")
+}
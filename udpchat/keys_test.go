@@ -0,0 +1,38 @@
+package udpchat
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestIdentity(t *testing.T) {
+	dir := t.TempDir()
+	id, err := openIdentity(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	bobKey := bytes.Repeat([]byte{1}, kKeySize)
+	if err = id.pin("bob", bobKey, false); err != nil {
+		t.Fatal(err)
+	}
+
+	reopened, err := openIdentity(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if *reopened.public != *id.public || *reopened.private != *id.private {
+		t.Fatal("identity key not kept")
+	}
+	if bob := reopened.contact("bob"); bob == nil || !bytes.Equal(bob.key, bobKey) || bob.verified {
+		t.Fatalf("contact of bob %+v", bob)
+	}
+
+	// a changed key is refused until verified.
+	c := &Client{}
+	if err = c.trustKey(reopened, "bob", bytes.Repeat([]byte{2}, kKeySize)); err == nil {
+		t.Fatal("changed key trusted")
+	}
+	if err = c.trustKey(reopened, "carol", bytes.Repeat([]byte{3}, kKeySize)); err != nil || reopened.contact("carol") == nil {
+		t.Fatalf("key of carol not pinned on first use, %v", err)
+	}
+}
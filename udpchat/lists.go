@@ -0,0 +1,68 @@
+package udpchat
+
+import (
+	"github.com/neverchanje/unplayground/udpchat/codec"
+)
+
+// The lists kept by the hub are sent a page at a time, so that a reply always
+// fits in a datagram however long the list grows:
+//
+//	kReqListFiles [FROM]  ---->
+//		<----  kRespFileList COUNT [LEN <FILENAME (SIZE bytes)>]... [NEXT]
+//
+// FROM is the index of the first entry of the page, 0 if absent, and NEXT the
+// index of the first entry of the next page, absent on the last page. A client
+// asks for the pages in turn until NEXT is absent, each request being
+// retransmitted until answered. The list may change between two pages, an
+// entry may then be missed or listed twice.
+
+// Size of the fields of a page but its entries.
+const kListHeaderSize = 1 + 2 + 4
+
+// The entries of list from index from that fit in a datagram, and the index
+// of the next page, 0 if it's the last one. A page holds at least one entry.
+func pageList(list []string, from uint32) ([]string, uint32) {
+	if int64(from) >= int64(len(list)) {
+		return nil, 0
+	}
+	size := kListHeaderSize
+	end := int(from)
+	for end < len(list) {
+		size += 2 + len(list[end])
+		if size > kMaxPacketSize && end > int(from) {
+			break
+		}
+		end++
+	}
+	if end == len(list) {
+		return list[from:], 0
+	}
+	return list[from:end], uint32(end)
+}
+
+// Fetches every page of a list over link. request makes the request of the
+// page from an index, and decode returns the entries of a page and the index
+// of the next one, ok being false if the packet isn't a page.
+func fetchList(link packetLink, request func(from uint32) codec.Message,
+	decode func(packet []byte) (page []string, next uint32, ok bool)) ([]string, error) {
+	var list []string
+	var from uint32
+	for {
+		var page []string
+		var next uint32
+		_, err := exchange(link, codec.Marshal(request(from)), func(packet []byte) bool {
+			var ok bool
+			page, next, ok = decode(packet)
+			return ok
+		})
+		if err != nil {
+			return nil, err
+		}
+		list = append(list, page...)
+		// a shrinking list may point back.
+		if next <= from {
+			return list, nil
+		}
+		from = next
+	}
+}
@@ -0,0 +1,77 @@
+package udpchat
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+)
+
+func TestPageList(t *testing.T) {
+	var list []string
+	for i := 0; i < 100; i++ {
+		list = append(list, strings.Repeat("x", 100))
+	}
+	var got []string
+	pages := 0
+	for from := uint32(0); ; {
+		page, next := pageList(list, from)
+		size := kListHeaderSize
+		for _, entry := range page {
+			size += 2 + len(entry)
+		}
+		if len(page) == 0 || size > kMaxPacketSize {
+			t.Fatalf("page of %d entries, %d bytes", len(page), size)
+		}
+		got = append(got, page...)
+		pages++
+		if next == 0 {
+			break
+		}
+		from = next
+	}
+	if len(got) != len(list) || pages < 5 {
+		t.Fatalf("paged %d entries in %d pages", len(got), pages)
+	}
+
+	// an entry too long for a page is still listed.
+	if page, next := pageList([]string{strings.Repeat("x", kMaxPacketSize), "y"}, 0); len(page) != 1 || next != 1 {
+		t.Fatalf("paged %d entries, next %d", len(page), next)
+	}
+	if page, next := pageList(list, 1000); len(page) != 0 || next != 0 {
+		t.Fatalf("paged %d entries past the end, next %d", len(page), next)
+	}
+}
+
+func TestListFiles(t *testing.T) {
+	hub := newTestHub(t)
+	var want []string
+	for i := 0; i < 200; i++ {
+		name := fmt.Sprintf("file-with-a-rather-long-name-%03d.txt", i)
+		storeTestFile(t, hub, "alice", name, []byte("abc"))
+		want = append(want, "alice/"+name+" (3 bytes)")
+	}
+	bob := newTestClient(t, hub, "bob")
+
+	files, err := bob.listFiles()
+	if err != nil || strings.Join(files, "\n") != strings.Join(want, "\n") {
+		t.Fatalf("listed %d files, %v", len(files), err)
+	}
+}
+
+func TestListChannels(t *testing.T) {
+	hub := newTestHub(t)
+	want := []string{"1/general"}
+	hub.mu.Lock()
+	for id := uint32(2); id <= 200; id++ {
+		ch := newChannel(id, fmt.Sprintf("channel-with-a-rather-long-name-%03d", id), "alice")
+		hub.channels[id] = ch
+		want = append(want, ch.toString())
+	}
+	hub.mu.Unlock()
+	bob := newTestClient(t, hub, "bob")
+
+	channels, err := bob.listChannels()
+	if err != nil || strings.Join(channels, "\n") != strings.Join(want, "\n") {
+		t.Fatalf("listed %d channels, %v", len(channels), err)
+	}
+}
@@ -0,0 +1,229 @@
+package udpchat
+
+import (
+	"log"
+	"sort"
+	"time"
+
+	"github.com/neverchanje/unplayground/udpchat/codec"
+)
+
+// The hub knows who is online from the sessions that joined the chat (see
+// users.go and push.go). A joined client pings the hub when it sent nothing
+// else for kPingInterval, and asks who is online with "who":
+//
+//	kReqPing  ---->
+//		<----  kRespPong
+//	kReqWho [FROM]  ---->
+//		<----  kRespWho COUNT [LEN <Username>]... [NEXT]
+//
+// Users joining and leaving are recorded in the history of kDefaultChannel as
+// notices of the hub, which have no sender:
+//
+//	<Date>: [1/<Channel-Name>] alice joined
+//	<Date>: [1/<Channel-Name>] alice left (timed out)
+//
+// Every kReapInterval, the hub expires the sessions that sent no request for
+// kSessionTimeout, as clients that crashed or lost their network never leave,
+// the keys of the handshakes unused for kSecureSessionTimeout, and the uploads
+// that received no packet for kTransferTimeout, whose state is checkpointed so
+// that the client can still resume them (see resume.go).
+const (
+	kPingInterval         = 15 * time.Second
+	kSessionTimeout       = 4 * kPingInterval
+	kSecureSessionTimeout = 2 * kSessionTimeout
+	kTransferTimeout      = 2 * kMaxRetries * kMaxRTO
+	kReapInterval         = 5 * time.Second
+)
+
+func (h *RequestHandler) handlePing() error {
+	_, err := h.hub.writeTo(codec.Marshal(new(codec.Pong)), h.ra)
+	return err
+}
+
+// Answers a page of the users online, see lists.go.
+func (h *RequestHandler) handleWho(recv []byte) error {
+	var req codec.Who
+	if err := codec.Unmarshal(recv, &req); err != nil {
+		return err
+	}
+	page, next := pageList(h.hub.online(), req.From)
+	resp := codec.Marshal(&codec.WhoList{Users: page, Next: next})
+	_, err := h.hub.writeTo(resp, h.ra)
+	return err
+}
+
+// The users that joined the chat, sorted.
+func (h *Hub) online() []string {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	joined := make(map[string]bool)
+	for _, s := range h.sessions {
+		if s.joined {
+			joined[s.username] = true
+		}
+	}
+	users := make([]string, 0, len(joined))
+	for name := range joined {
+		users = append(users, name)
+	}
+	sort.Strings(users)
+	return users
+}
+
+// Records a notice of the hub in kDefaultChannel, and pushes it to the
+// subscribers but the client of the session except, if any.
+func (h *Hub) notice(msg string, except *session) {
+	h.mu.Lock()
+	name := h.channels[kDefaultChannel].name
+	h.mu.Unlock()
+
+	record := &chatRecord{
+		time:    time.Now(),
+		channel: kDefaultChannel,
+		name:    name,
+		msg:     msg,
+	}
+	if err := h.appendRecord(record); err != nil {
+		log.Println("Server " + err.Error())
+		return
+	}
+	h.broadcast(record, except)
+}
+
+// Abandons the transfer if the client sent nothing since kTransferTimeout
+// before now. Returns whether it's abandoned.
+func (fr *fileReceiver) abandonIfIdle(now time.Time) bool {
+	fr.mu.Lock()
+	defer fr.mu.Unlock()
+
+	if fr.closed || fr.done || now.Sub(fr.active) < kTransferTimeout {
+		return false
+	}
+	log.Println("Abandoning idle transfer of file " + fr.fname)
+	fr.abandonLocked()
+	return true
+}
+
+// Expires what has been idle for too long as of now. The idle transfers are
+// abandoned out of the hub mutex, as they are checkpointed to disk, and
+// "left" is noticed only for the users not joined from another session.
+func (h *Hub) reap(now time.Time) {
+	left := make(map[string]bool)
+
+	h.mu.Lock()
+	for token, s := range h.sessions {
+		if now.Sub(s.lastSeen) < kSessionTimeout {
+			continue
+		}
+		delete(h.sessions, token)
+		for _, ch := range h.channels {
+			delete(ch.subscribers, token)
+		}
+		if s.joined {
+			left[s.username] = true
+		}
+		log.Println("Session " + s.toString() + " expired")
+	}
+	for _, s := range h.sessions {
+		if s.joined {
+			delete(left, s.username)
+		}
+	}
+	for session_id, s := range h.secure {
+		if now.Sub(s.lastSeen) < kSecureSessionTimeout {
+			continue
+		}
+		delete(h.secure, session_id)
+		if h.peers[s.ra.String()] == s {
+			delete(h.peers, s.ra.String())
+		}
+	}
+	uploads := make(map[uint64]*RequestHandler)
+	for packet_id, handler := range h.fileHandlers {
+		if handler.receiver != nil {
+			uploads[packet_id] = handler
+		}
+	}
+	h.mu.Unlock()
+	h.reapFaults(now)
+
+	for packet_id, handler := range uploads {
+		if !handler.receiver.abandonIfIdle(now) {
+			continue
+		}
+		h.mu.Lock()
+		if h.fileHandlers[packet_id] == handler {
+			delete(h.fileHandlers, packet_id)
+		}
+		h.mu.Unlock()
+	}
+	for name := range left {
+		h.notice(name+" left (timed out)", nil)
+	}
+}
+
+// Reaps every kReapInterval until done is closed.
+func (h *Hub) reapLoop(done chan struct{}) {
+	ticker := time.NewTicker(kReapInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-done:
+			return
+		case now := <-ticker.C:
+			h.reap(now)
+		}
+	}
+}
+
+// Pings the hub until the client is closed, so that its session doesn't
+// expire while the user is idle. A ping is skipped when another request was
+// sent within kPingInterval, so that the hub hears from the client at least
+// every 2*kPingInterval, well within kSessionTimeout.
+func (c *Client) keepAlive() {
+	ticker := time.NewTicker(kPingInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-c.closed:
+			return
+		case <-ticker.C:
+			c.mu.Lock()
+			idle := time.Since(c.lastSent) >= kPingInterval
+			c.mu.Unlock()
+			if !idle {
+				continue
+			}
+			if err := c.Send(nil, kReqPing); err != nil {
+				log.Println("[Error] Pinging the hub: " + err.Error())
+			}
+		}
+	}
+}
+
+// Fetches the names of the users online, a page at a time.
+func (c *Client) who() ([]string, error) {
+	return fetchList(c, func(from uint32) codec.Message {
+		req := new(codec.Who)
+		req.From = from
+		return req
+	}, func(packet []byte) ([]string, uint32, bool) {
+		var list codec.WhoList
+		err := codec.Unmarshal(packet, &list)
+		return list.Users, list.Next, err == nil
+	})
+}
+
+// Prints the users online.
+func (c *Client) Who() {
+	users, err := c.who()
+	if err != nil {
+		log.Println("[Error] Listing users online: " + err.Error())
+		return
+	}
+	for _, name := range users {
+		println(name)
+	}
+}
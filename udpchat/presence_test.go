@@ -0,0 +1,144 @@
+package udpchat
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/neverchanje/unplayground/udpchat/codec"
+)
+
+func TestWho(t *testing.T) {
+	hub := newTestHub(t)
+	alice, bob, carol := dialTestHub(t, hub), dialTestHub(t, hub), dialTestHub(t, hub)
+	joinTestHub(t, alice, "alice")
+	joinTestHub(t, bob, "bob")
+	// logged in, but not joined.
+	loginTestHub(t, carol, "carol")
+
+	carol.Write([]byte{byte(kReqPing)})
+	if resp := readTestPacket(t, carol); ResponseType(resp[0]) != kRespPong {
+		t.Fatalf("pinged with response %q", resp)
+	}
+	carol.Write([]byte{byte(kReqWho)})
+	var who codec.WhoList
+	if err := codec.Unmarshal(readTestPacket(t, carol), &who); err != nil ||
+		strings.Join(who.Users, " ") != "alice bob" {
+		t.Fatalf("who: %q, %v", who.Users, err)
+	}
+
+	dave := newTestClient(t, hub, "dave")
+	if users, err := dave.who(); err != nil || strings.Join(users, " ") != "alice bob dave" {
+		t.Fatalf("who: %q, %v", users, err)
+	}
+}
+
+func TestReapSessions(t *testing.T) {
+	hub := newTestHub(t)
+	alice, bob := dialTestHub(t, hub), dialTestHub(t, hub)
+	joinTestHub(t, alice, "alice")
+	joinTestHub(t, bob, "bob")
+	readTestPacket(t, alice) // bob joined
+
+	hub.mu.Lock()
+	for _, s := range hub.sessions {
+		if s.username == "alice" {
+			s.lastSeen = time.Now().Add(-kSessionTimeout)
+		}
+	}
+	hub.mu.Unlock()
+	hub.reap(time.Now())
+
+	if push := readTestPacket(t, bob); !strings.HasSuffix(string(push[1:]), ": [1/general] alice left (timed out)") {
+		t.Fatalf("pushed %q", push)
+	}
+	alice.Write([]byte{byte(kReqJoin)})
+	if resp := readTestPacket(t, alice); ResponseType(resp[0]) != kRespUnauthenticated {
+		t.Fatalf("join after expiry answered with %q", resp)
+	}
+
+	// the keys of the handshakes expire later than the sessions.
+	hub.reap(time.Now().Add(kSecureSessionTimeout))
+	hub.mu.Lock()
+	sessions, secure, peers := len(hub.sessions), len(hub.secure), len(hub.peers)
+	hub.mu.Unlock()
+	if sessions != 0 || secure != 0 || peers != 0 {
+		t.Fatalf("%d sessions, %d secure sessions and %d peers left", sessions, secure, peers)
+	}
+	bob.Write([]byte{byte(kReqPing)})
+	bob.SetReadDeadline(time.Now().Add(200 * time.Millisecond))
+	if n, err := bob.Read(make([]byte, kMaxPacketSize)); err == nil {
+		t.Fatalf("answered %d bytes with expired keys", n)
+	}
+}
+
+// A user still joined from another client isn't noticed to have left when
+// the session of one of its clients expires.
+func TestReapSessionOfUserStillJoined(t *testing.T) {
+	hub := newTestHub(t)
+	laptop, phone, bob := dialTestHub(t, hub), dialTestHub(t, hub), dialTestHub(t, hub)
+	joinTestHub(t, laptop, "alice")
+	joinTestHub(t, bob, "bob")
+	phone.Write(encodeLogin(kReqLogin, 2, "alice", kTestPassword))
+	resp := readTestPacket(t, phone)
+	if ResponseType(resp[0]) != kRespLoginOK {
+		t.Fatalf("logged in with response %q", resp)
+	}
+	phone.token = resp[1:]
+	phone.Write([]byte{byte(kReqJoin)})
+	if resp = readTestPacket(t, phone); ResponseType(resp[0]) != kRespJoinOK {
+		t.Fatalf("joined with response %q", resp)
+	}
+	if push := readTestPacket(t, bob); !strings.HasSuffix(string(push[1:]), "alice joined") {
+		t.Fatalf("pushed %q", push)
+	}
+
+	hub.mu.Lock()
+	for _, s := range hub.sessions {
+		if s.username == "alice" && s.login_id == 1 {
+			s.lastSeen = time.Now().Add(-kSessionTimeout)
+		}
+	}
+	hub.mu.Unlock()
+	hub.reap(time.Now())
+
+	hub.mu.Lock()
+	sessions := len(hub.sessions)
+	hub.mu.Unlock()
+	if sessions != 2 {
+		t.Fatalf("%d sessions left", sessions)
+	}
+	bob.SetReadDeadline(time.Now().Add(200 * time.Millisecond))
+	if n, err := bob.Read(make([]byte, kMaxPacketSize)); err == nil {
+		t.Fatalf("unexpected push of %d bytes", n)
+	}
+}
+
+func TestReapIdleUpload(t *testing.T) {
+	hub := newHub()
+	fr := newFileReceiver(&fileSession{packet_id: 5, seg_size: 16, total_size: 64}, filepath.Join(t.TempDir(), "a.txt"))
+	if err := fr.open(); err != nil {
+		t.Fatal(err)
+	}
+	handler := NewRequestHandler(nil, hub)
+	handler.receiver = fr
+	hub.fileHandlers[fr.packet_id] = handler
+
+	hub.reap(time.Now())
+	if _, has := hub.fileHandlers[fr.packet_id]; !has {
+		t.Fatal("active upload reaped")
+	}
+	hub.reap(time.Now().Add(kTransferTimeout))
+	if _, has := hub.fileHandlers[fr.packet_id]; has {
+		t.Fatal("idle upload not reaped")
+	}
+	if committed := <-fr.fileListener; committed || !fr.isClosed() {
+		t.Fatal("idle upload not abandoned")
+	}
+	// checkpointed to be resumed.
+	if _, err := os.Stat(fr.stateName()); err != nil {
+		t.Fatal(err)
+	}
+}
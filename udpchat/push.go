@@ -0,0 +1,108 @@
+package udpchat
+
+import (
+	"fmt"
+	"log"
+	"net"
+
+	"github.com/neverchanje/unplayground/udpchat/codec"
+)
+
+// Clients join the chat when they start, once logged in (see users.go), which
+// subscribes them to kDefaultChannel, and leave when they quit, which
+// unsubscribes them from all channels and ends their session:
+//
+//	kReqJoin   ---->
+//	      <----  kRespJoinOK
+//	kReqLeave  ---->
+//
+// Every chat message received by the hub is pushed right away to the
+// subscribers of its channel, as a record of the history:
+//
+//	<----  kRespChatMsg <Date>: [<Channel-ID>/<Channel-Name>] <Message> from <Username>
+//
+// Pushes are not acknowledged, a client that misses one still finds it with
+// "history". Joining and leaving are recorded as notices of the hub, see
+// presence.go.
+
+// A retransmitted join is answered again, but noticed once.
+func (h *RequestHandler) handleJoin() error {
+	h.hub.mu.Lock()
+	h.hub.channels[kDefaultChannel].subscribers[h.session.token] = h.session
+	joined := !h.session.joined
+	h.session.joined = true
+	h.hub.mu.Unlock()
+
+	_, err := h.hub.writeTo(codec.Marshal(new(codec.JoinOK)), h.ra)
+	if joined {
+		h.hub.notice(h.username()+" joined", h.session)
+	}
+	return err
+}
+
+func (h *RequestHandler) handleLeave() error {
+	h.hub.mu.Lock()
+	for _, ch := range h.hub.channels {
+		delete(ch.subscribers, h.session.token)
+	}
+	joined := h.session.joined
+	h.session.joined = false
+	h.hub.mu.Unlock()
+
+	if joined {
+		h.hub.notice(h.username()+" left", h.session)
+	}
+	return nil
+}
+
+// Pushes a record to the subscribers of its channel, but the sender.
+func (h *RequestHandler) broadcast(record *chatRecord) {
+	h.hub.broadcast(record, h.session)
+}
+
+// Pushes a record to the subscribers of its channel, but the client of the
+// session except, if any. Each subscriber is pushed to at the address it
+// last sent a request from.
+func (h *Hub) broadcast(record *chatRecord, except *session) {
+	h.mu.Lock()
+	var clients []net.Addr
+	if ch, has := h.channels[record.channel]; has {
+		for _, s := range ch.subscribers {
+			if s != except {
+				clients = append(clients, s.ra)
+			}
+		}
+	}
+	h.mu.Unlock()
+
+	packet := codec.Marshal(&codec.ChatMsg{Text: record.toString()})
+	for _, ra := range clients {
+		if _, err := h.writeTo(packet, ra); err != nil {
+			log.Println("Server " + err.Error())
+		}
+	}
+}
+
+// Prints a message received while the user may be typing a command. The
+// prompt is cleared first, and printed again after the message.
+func (c *Client) printAsync(msg string) {
+	c.out.Lock()
+	defer c.out.Unlock()
+
+	if c.prompting {
+		fmt.Print("\r\033[K" + msg + "\n>>> ")
+	} else {
+		fmt.Println(msg)
+	}
+}
+
+// Prints the prompt of the next command.
+func (c *Client) prompt(prompting bool) {
+	c.out.Lock()
+	defer c.out.Unlock()
+
+	if prompting && !c.prompting {
+		fmt.Print(">>> ")
+	}
+	c.prompting = prompting
+}
@@ -0,0 +1,135 @@
+package udpchat
+
+import (
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/neverchanje/unplayground/udpchat/codec"
+	"golang.org/x/crypto/bcrypt"
+)
+
+func newTestHub(t *testing.T) *Hub {
+	return newTestHubOn(t, NewMemoryTransport())
+}
+
+func newTestHubOn(t *testing.T, transport Transport) *Hub {
+	passwordCost = bcrypt.MinCost
+	hub := newHub()
+	hub.uploadDir = t.TempDir()
+	if err := hub.startServer(transport, "hub"); err != nil {
+		t.Fatal(err)
+	}
+	go hub.listen()
+	t.Cleanup(func() { hub.conn.Close() })
+	return hub
+}
+
+// A secure connection to the test hub, whose requests carry the token of
+// the session once logged in.
+type testConn struct {
+	net.Conn
+	secure *secureChannel
+	token  []byte
+}
+
+func (conn *testConn) Write(packet []byte) (int, error) {
+	if len(conn.token) != 0 && !isLoginRequest(RequestType(packet[0])) {
+		packet = append(append([]byte{packet[0]}, conn.token...), packet[1:]...)
+	}
+	datagram, err := conn.secure.seal(packet)
+	if err != nil {
+		return 0, err
+	}
+	return conn.Conn.Write(datagram)
+}
+
+// Reads the next packet opened with the keys of the connection.
+func (conn *testConn) Read(buf []byte) (int, error) {
+	for {
+		datagram := make([]byte, kMaxDatagramSize)
+		n, err := conn.Conn.Read(datagram)
+		if err != nil {
+			return 0, err
+		}
+		if packet, err := conn.secure.open(datagram[:n]); err == nil {
+			return copy(buf, packet), nil
+		}
+	}
+}
+
+func dialTestHub(t *testing.T, hub *Hub) *testConn {
+	conn, err := hub.transport.Dial(hub.conn.LocalAddr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	secure, _, err := dialSecure(conn, codec.Supported)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &testConn{Conn: conn, secure: secure}
+}
+
+func readTestPacket(t *testing.T, conn *testConn) []byte {
+	buf := make([]byte, kMaxPacketSize)
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	n, err := conn.Read(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return buf[:n]
+}
+
+const kTestPassword = "password"
+
+// Logs in, registering the account first if it doesn't exist.
+func loginTestHub(t *testing.T, conn *testConn, name string) {
+	conn.Write(encodeLogin(kReqRegister, 1, name, kTestPassword))
+	resp := readTestPacket(t, conn)
+	if ResponseType(resp[0]) != kRespLoginOK || len(resp) != 1+kTokenSize {
+		t.Fatalf("logged in with response %q", resp)
+	}
+	conn.token = resp[1:]
+}
+
+func joinTestHub(t *testing.T, conn *testConn, name string) {
+	loginTestHub(t, conn, name)
+	conn.Write([]byte{byte(kReqJoin)})
+	if resp := readTestPacket(t, conn); ResponseType(resp[0]) != kRespJoinOK {
+		t.Fatalf("joined with response %q", resp)
+	}
+}
+
+func TestPushChatMsg(t *testing.T) {
+	hub := newTestHub(t)
+	alice, bob := dialTestHub(t, hub), dialTestHub(t, hub)
+
+	joinTestHub(t, alice, "alice")
+	joinTestHub(t, bob, "bob")
+	push := readTestPacket(t, alice)
+	if ResponseType(push[0]) != kRespChatMsg || !strings.HasSuffix(string(push[1:]), ": [1/general] bob joined") {
+		t.Fatalf("pushed %q", push)
+	}
+
+	bob.Write(codec.Marshal(&codec.SendChatMsg{Channel: kDefaultChannel, Message: "hello"}))
+	push = readTestPacket(t, alice)
+	if ResponseType(push[0]) != kRespChatMsg || !strings.Contains(string(push[1:]), ": [1/general] hello from bob") {
+		t.Fatalf("pushed %q", push)
+	}
+
+	// the sender is not pushed its own message, and a client that left is
+	// not pushed any more.
+	alice.Write([]byte{byte(kReqLeave)})
+	if push = readTestPacket(t, bob); !strings.HasSuffix(string(push[1:]), ": [1/general] alice left") {
+		t.Fatalf("pushed %q", push)
+	}
+	bob.Write(codec.Marshal(&codec.SendChatMsg{Channel: kDefaultChannel, Message: "bye"}))
+	for _, conn := range []*testConn{alice, bob} {
+		conn.SetReadDeadline(time.Now().Add(200 * time.Millisecond))
+		if n, err := conn.Read(make([]byte, kMaxPacketSize)); err == nil {
+			t.Fatalf("unexpected push of %d bytes", n)
+		}
+	}
+}
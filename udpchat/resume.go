@@ -0,0 +1,159 @@
+package udpchat
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"io"
+	"log"
+	"os"
+)
+
+// The contiguous prefix written to the temporary file is checkpointed every
+// kCheckpointSegments segments, so that a transfer interrupted by a restart
+// of either side can be resumed from there.
+const kCheckpointSegments = 64
+
+// Partial receive state persisted beside the temporary file:
+//
+//	PACKET_ID SEG_SIZE TOTAL_SIZE NEXT
+//
+// All segments below NEXT have been flushed to the temporary file.
+type partState struct {
+	packet_id  uint64
+	seg_size   uint16
+	total_size uint64
+	next       uint32
+}
+
+func (ps *partState) encode() []byte {
+	buf := make([]byte, 22)
+	binary.LittleEndian.PutUint64(buf[0:8], ps.packet_id)
+	binary.LittleEndian.PutUint16(buf[8:10], ps.seg_size)
+	binary.LittleEndian.PutUint64(buf[10:18], ps.total_size)
+	binary.LittleEndian.PutUint32(buf[18:22], ps.next)
+	return buf
+}
+
+func decodePartState(buf []byte) (*partState, error) {
+	if len(buf) != 22 {
+		return nil, errors.New("Malformed partial state")
+	}
+	ps := new(partState)
+	ps.packet_id = binary.LittleEndian.Uint64(buf[0:8])
+	ps.seg_size = binary.LittleEndian.Uint16(buf[8:10])
+	ps.total_size = binary.LittleEndian.Uint64(buf[10:18])
+	ps.next = binary.LittleEndian.Uint32(buf[18:22])
+	return ps, nil
+}
+
+func (fr *fileReceiver) stateName() string {
+	return fr.partName() + ".state"
+}
+
+// Flushes the written prefix and persists the receive state.
+// REQUIRE: mutex lock held
+func (fr *fileReceiver) checkpoint() error {
+	if fr.err != nil {
+		return fr.err
+	}
+	if fr.err = fr.writer.Flush(); fr.err != nil {
+		return fr.err
+	}
+
+	ps := &partState{
+		packet_id:  fr.packet_id,
+		seg_size:   fr.session.seg_size,
+		total_size: fr.session.total_size,
+		next:       fr.next,
+	}
+	tmp := fr.stateName() + ".tmp"
+	if err := os.WriteFile(tmp, ps.encode(), 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, fr.stateName())
+}
+
+// Reopens the temporary file of an interrupted transfer of the same file,
+// and sets session.resume_from to the first segment that's missing.
+// Returns false if there is nothing to resume, in which case the transfer
+// starts over.
+func (fr *fileReceiver) resume() bool {
+	buf, err := os.ReadFile(fr.stateName())
+	if err != nil {
+		return false
+	}
+	ps, err := decodePartState(buf)
+	if err != nil || ps.packet_id != fr.packet_id ||
+		ps.total_size != fr.session.total_size || ps.seg_size > fr.session.seg_size {
+		return false
+	}
+
+	file, err := os.OpenFile(fr.partName(), os.O_RDWR, 0644)
+	if err != nil {
+		return false
+	}
+
+	session := *fr.session
+	session.seg_size = ps.seg_size
+	session.seg_count = uint32(session.segCount())
+	prefix := uint64(ps.next) * uint64(ps.seg_size)
+	if prefix > session.total_size {
+		prefix = session.total_size
+	}
+
+	// The file may contain segments written after the checkpoint, which
+	// are truncated.
+	info, err := file.Stat()
+	if err != nil || ps.next > session.seg_count || uint64(info.Size()) < prefix {
+		file.Close()
+		return false
+	}
+	digest := sha256.New()
+	if err = file.Truncate(int64(prefix)); err == nil {
+		_, err = io.Copy(digest, bufio.NewReader(file))
+	}
+	if err != nil {
+		file.Close()
+		return false
+	}
+
+	session.resume_from = ps.next
+	*fr.session = session
+	fr.file = file
+	fr.writer = bufio.NewWriter(file)
+	fr.digest = digest
+	fr.next = ps.next
+	fr.written = prefix
+	log.Println("Resuming file "+fr.fname+" from segment", ps.next)
+	return true
+}
+
+// Detaches the receiver from an interrupted transfer whose client came back
+// with another handshake. The receive state is checkpointed so that the new
+// receiver resumes from it. Returns false if the transfer is being committed
+// and can't be taken over anymore.
+func (fr *fileReceiver) takeOver() bool {
+	fr.mu.Lock()
+	defer fr.mu.Unlock()
+	if fr.done {
+		return false
+	}
+	if !fr.closed {
+		fr.abandonLocked()
+	}
+	return true
+}
+
+// REQUIRE: mutex lock held
+func (fr *fileReceiver) abandonLocked() {
+	if err := fr.checkpoint(); err != nil {
+		log.Println("Failed to checkpoint file: " + fr.fname + " " + err.Error())
+	}
+	fr.file.Close()
+	fr.file = nil
+	fr.closed = true
+	fr.status = kFinStatusFailed
+	fr.fileListener <- false
+}
@@ -0,0 +1,87 @@
+package udpchat
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/neverchanje/unplayground/udpchat/codec"
+)
+
+func TestFileReceiverResume(t *testing.T) {
+	content := bytes.Repeat([]byte("0123456789"), 40)
+	fname := filepath.Join(t.TempDir(), "a.txt")
+
+	fr := newTestReceiver(fname, content)
+	if err := fr.open(); err != nil {
+		t.Fatal(err)
+	}
+	for id := uint32(0); id < kCheckpointSegments+3; id++ {
+		fr.insert(&fileSegment{seg_id: id, content: content[id*4 : id*4+4]})
+	}
+	// the server crashes, the segments after the checkpoint are lost.
+	fr.file.Close()
+
+	fr = newTestReceiver(fname, content)
+	if err := fr.open(); err != nil {
+		t.Fatal(err)
+	}
+	if fr.session.resume_from != kCheckpointSegments {
+		t.Fatalf("resumed from %d, want %d", fr.session.resume_from, kCheckpointSegments)
+	}
+	for id := fr.session.resume_from; id < fr.session.seg_count; id++ {
+		fr.insert(&fileSegment{seg_id: id, content: content[id*4 : id*4+4]})
+	}
+	if !fr.isComplete() {
+		t.Fatal("resumed transfer is not complete")
+	}
+
+	sum := sha256.Sum256(content)
+	fr.expected = sum[:]
+	if err := fr.commit(); err != nil {
+		t.Fatal(err)
+	}
+	if got, _ := os.ReadFile(fname); !bytes.Equal(got, content) {
+		t.Fatal("resumed file differs from the original")
+	}
+	if _, err := os.Stat(fr.stateName()); !os.IsNotExist(err) {
+		t.Fatal("partial state is left behind")
+	}
+}
+
+// Only the user of an upload may take it over from another address.
+func TestTakeOverUpload(t *testing.T) {
+	hub := newTestHub(t)
+	alice, mallory, again := dialTestHub(t, hub), dialTestHub(t, hub), dialTestHub(t, hub)
+	loginTestHub(t, alice, "alice")
+	loginTestHub(t, mallory, "mallory")
+	loginTestHub(t, again, "alice")
+
+	syn := codec.Marshal(&codec.SendFile{FileSyn: codec.FileSyn{PacketID: 9, SegSize: 16, Window: 8,
+		TotalSize: 1000, User: "alice", Filename: "a.txt"}})
+	alice.Write(syn)
+	if resp := readTestPacket(t, alice); ResponseType(resp[0]) != kRespSendFileOK {
+		t.Fatalf("started upload with response %q", resp)
+	}
+	hub.mu.Lock()
+	handler := hub.fileHandlers[9]
+	hub.mu.Unlock()
+
+	mallory.Write(syn)
+	if resp := readTestPacket(t, mallory); !decodeTransfer(resp, new(codec.SendFileFailed), 9) {
+		t.Fatalf("took over the upload of alice with response %q", resp)
+	}
+	if handler.receiver.isClosed() {
+		t.Fatal("upload of alice abandoned")
+	}
+
+	again.Write(syn)
+	if resp := readTestPacket(t, again); ResponseType(resp[0]) != kRespSendFileOK {
+		t.Fatalf("resumed upload with response %q", resp)
+	}
+	if !handler.receiver.isClosed() {
+		t.Fatal("upload taken over not abandoned")
+	}
+}
@@ -0,0 +1,474 @@
+package udpchat
+
+import (
+	"errors"
+	"log"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"unicode"
+
+	"github.com/neverchanje/unplayground/udpchat/codec"
+)
+
+// The hub indexes every message it appends to the history, so that clients
+// can search the history for words and phrases:
+//
+//	kReqSearch QUERY_ID LIMIT SINCE UNTIL CHANNEL TERMS  ---->
+//			<----  kRespHistory QUERY_ID PART PARTS MORE [RECORD]...
+//
+// TERMS is the text of the search, words and "quoted phrases" that all have
+// to be found in a message, regardless of case. SINCE and UNTIL bound the
+// time of the messages, in nanoseconds since the epoch, 0 for no bound, and
+// CHANNEL is 0 for the channels the client subscribed to. The latest LIMIT
+// matching messages are replied like a page of history (see history.go).
+//
+// Only the latest kSearchIndexSize messages are indexed in memory, which the
+// hub indexes again from the end of the history log when it restarts. When
+// they hold fewer matches than LIMIT, the older messages are searched in the
+// segments of the log.
+const (
+	kDefaultSearchLimit = 20
+	kSearchIndexSize    = 64 * kHistoryCacheSize
+)
+
+type posting struct {
+	id        uint64
+	positions []uint32 // of the word in the message
+}
+
+type searchDoc struct {
+	time    int64
+	channel uint32
+	words   []string // distinct, to evict the doc
+}
+
+// An inverted index of the words of the messages.
+type searchIndex struct {
+	mu       sync.RWMutex
+	postings map[string][]posting // in the order of the ids
+	docs     map[uint64]searchDoc
+	ids      []uint64 // of the docs, in order
+
+	size int    // of the docs, beyond which the oldest is evicted
+	from uint64 // the messages from which on are all indexed
+}
+
+func newSearchIndex() *searchIndex {
+	index := &searchIndex{size: kSearchIndexSize, from: 1}
+	index.postings = make(map[string][]posting)
+	index.docs = make(map[uint64]searchDoc)
+	return index
+}
+
+// Splits text into lower-case words of letters and digits.
+func tokenize(text string) []string {
+	return strings.FieldsFunc(strings.ToLower(text), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+	})
+}
+
+// Records are added concurrently, and may be added out of the order of
+// their ids.
+func (index *searchIndex) add(r *chatRecord) {
+	positions := make(map[string][]uint32)
+	for i, word := range tokenize(r.msg) {
+		positions[word] = append(positions[word], uint32(i))
+	}
+
+	index.mu.Lock()
+	defer index.mu.Unlock()
+
+	doc := searchDoc{time: r.time.UnixNano(), channel: r.channel}
+	for word, pos := range positions {
+		doc.words = append(doc.words, word)
+		index.postings[word] = insertPosting(index.postings[word], posting{id: r.id, positions: pos})
+	}
+	index.docs[r.id] = doc
+	i := len(index.ids)
+	if i != 0 && index.ids[i-1] > r.id {
+		i = sort.Search(len(index.ids), func(i int) bool { return index.ids[i] > r.id })
+	}
+	index.ids = append(index.ids, 0)
+	copy(index.ids[i+1:], index.ids[i:])
+	index.ids[i] = r.id
+
+	for len(index.ids) > index.size {
+		index.evictOldest()
+	}
+}
+
+func insertPosting(list []posting, p posting) []posting {
+	i := len(list)
+	if i != 0 && list[i-1].id > p.id {
+		i = sort.Search(len(list), func(i int) bool { return list[i].id > p.id })
+	}
+	list = append(list, posting{})
+	copy(list[i+1:], list[i:])
+	list[i] = p
+	return list
+}
+
+// The oldest doc comes first in the postings of its words.
+// REQUIRE: write lock held
+func (index *searchIndex) evictOldest() {
+	id := index.ids[0]
+	for _, word := range index.docs[id].words {
+		if list := index.postings[word][1:]; len(list) != 0 {
+			index.postings[word] = list
+		} else {
+			delete(index.postings, word)
+		}
+	}
+	delete(index.docs, id)
+	index.ids = index.ids[1:]
+	index.from = id + 1
+}
+
+// Indexes the latest records of the history, as many as the index holds.
+func (index *searchIndex) fill(history *historyLog) error {
+	var oldest uint64
+	n := 0
+	err := history.scanBackward(0, func(r *chatRecord) bool {
+		index.add(r)
+		oldest = r.id
+		n++
+		return n < index.size
+	})
+	if n == index.size {
+		index.mu.Lock()
+		index.from = oldest
+		index.mu.Unlock()
+	}
+	return err
+}
+
+// Parses the words and the "quoted phrases" of a search, each returned as
+// the list of its words.
+func parseSearchTerms(text string) [][]string {
+	var terms [][]string
+	for i, part := range strings.Split(text, "\"") {
+		if i%2 == 1 {
+			if words := tokenize(part); len(words) != 0 {
+				terms = append(terms, words)
+			}
+			continue
+		}
+		for _, word := range tokenize(part) {
+			terms = append(terms, []string{word})
+		}
+	}
+	return terms
+}
+
+// Positions at which the phrase starts in the message id.
+// REQUIRE: read lock held
+func (index *searchIndex) phraseAt(phrase []string, id uint64) []uint32 {
+	var starts []uint32
+	for k, word := range phrase {
+		list := index.postings[word]
+		i := sort.Search(len(list), func(i int) bool { return list[i].id >= id })
+		if i == len(list) || list[i].id != id {
+			return nil
+		}
+		if k == 0 {
+			starts = list[i].positions
+			continue
+		}
+		var next []uint32
+		for _, start := range starts {
+			j := sort.Search(len(list[i].positions), func(j int) bool { return list[i].positions[j] >= start+uint32(k) })
+			if j < len(list[i].positions) && list[i].positions[j] == start+uint32(k) {
+				next = append(next, start)
+			}
+		}
+		if starts = next; len(starts) == 0 {
+			return nil
+		}
+	}
+	return starts
+}
+
+// Returns the ids of the latest messages indexed, at most limit, that contain
+// all the terms and are accepted by match, in increasing order. Tells whether
+// more messages match, and the id from which on the messages are indexed.
+func (index *searchIndex) search(terms [][]string, limit int, match func(searchDoc) bool) ([]uint64, bool, uint64) {
+	index.mu.RLock()
+	defer index.mu.RUnlock()
+
+	ids, more := index.searchIndexed(terms, limit, match)
+	return ids, more, index.from
+}
+
+// REQUIRE: read lock held
+func (index *searchIndex) searchIndexed(terms [][]string, limit int, match func(searchDoc) bool) ([]uint64, bool) {
+	if len(terms) == 0 {
+		return nil, false
+	}
+
+	// candidates are the messages with the rarest word.
+	rarest := index.postings[terms[0][0]]
+	for _, term := range terms {
+		for _, word := range term {
+			if list := index.postings[word]; len(list) < len(rarest) {
+				rarest = list
+			}
+		}
+	}
+
+	var ids []uint64
+	for i := len(rarest) - 1; i >= 0; i-- {
+		id := rarest[i].id
+		if !match(index.docs[id]) {
+			continue
+		}
+		found := true
+		for _, term := range terms {
+			if found = len(index.phraseAt(term, id)) != 0; !found {
+				break
+			}
+		}
+		if !found {
+			continue
+		}
+		if len(ids) == limit {
+			return reverseIDs(ids), true
+		}
+		ids = append(ids, id)
+	}
+	return reverseIDs(ids), false
+}
+
+// Whether the words of a message contain all the terms, each phrase as
+// consecutive words.
+func containsTerms(words []string, terms [][]string) bool {
+	for _, term := range terms {
+		found := false
+		for i := 0; i+len(term) <= len(words) && !found; i++ {
+			found = true
+			for k, word := range term {
+				if words[i+k] != word {
+					found = false
+					break
+				}
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	return true
+}
+
+// Searches the index, and the messages older than the index in the history
+// log if the index has fewer than limit matches.
+func (h *Hub) search(terms [][]string, limit int, match func(searchDoc) bool) ([]uint64, bool, error) {
+	ids, more, from := h.index.search(terms, limit, match)
+	if more || from <= 1 || len(terms) == 0 {
+		return ids, more, nil
+	}
+	var older []uint64
+	err := h.history.scanBackward(from, func(r *chatRecord) bool {
+		doc := searchDoc{time: r.time.UnixNano(), channel: r.channel}
+		if !match(doc) || !containsTerms(tokenize(r.msg), terms) {
+			return true
+		}
+		if len(ids)+len(older) == limit {
+			more = true
+			return false
+		}
+		older = append(older, r.id)
+		return true
+	})
+	return append(reverseIDs(older), ids...), more, err
+}
+
+func reverseIDs(ids []uint64) []uint64 {
+	for i, j := 0, len(ids)-1; i < j; i, j = i+1, j-1 {
+		ids[i], ids[j] = ids[j], ids[i]
+	}
+	return ids
+}
+
+type searchQuery struct {
+	query_id uint32
+	limit    uint16
+	since    time.Time
+	until    time.Time
+	channel  uint32
+	terms    string
+}
+
+func unixNano(t time.Time) uint64 {
+	if t.IsZero() {
+		return 0
+	}
+	return uint64(t.UnixNano())
+}
+
+func fromUnixNano(ns uint64) time.Time {
+	if ns == 0 {
+		return time.Time{}
+	}
+	return time.Unix(0, int64(ns))
+}
+
+func (q *searchQuery) encode() []byte {
+	return codec.Marshal(&codec.Search{
+		QueryID: q.query_id,
+		Limit:   q.limit,
+		Since:   unixNano(q.since),
+		Until:   unixNano(q.until),
+		Channel: q.channel,
+		Terms:   q.terms,
+	})
+}
+
+// The limit is brought within [1, kMaxHistoryLimit].
+func decodeSearchQuery(recv []byte) (*searchQuery, error) {
+	var req codec.Search
+	if err := codec.Unmarshal(recv, &req); err != nil {
+		return nil, errors.New("Malformed search query")
+	}
+	q := &searchQuery{
+		query_id: req.QueryID,
+		limit:    req.Limit,
+		since:    fromUnixNano(req.Since),
+		until:    fromUnixNano(req.Until),
+		channel:  req.Channel,
+		terms:    req.Terms,
+	}
+
+	if q.limit == 0 {
+		q.limit = kDefaultSearchLimit
+	}
+	if q.limit > kMaxHistoryLimit {
+		q.limit = kMaxHistoryLimit
+	}
+	return q, nil
+}
+
+// Parses a time bound of a search, either a date like "2006-01-02" or
+// "2006-01-02T15:04" in local time, a RFC 3339 time, or a duration like "2h"
+// meaning that long ago.
+func parseSearchTime(s string) (time.Time, error) {
+	if d, err := time.ParseDuration(s); err == nil {
+		return time.Now().Add(-d), nil
+	}
+	for _, layout := range []string{"2006-01-02", "2006-01-02T15:04", time.RFC3339} {
+		if t, err := time.ParseInLocation(layout, s, time.Local); err == nil {
+			return t, nil
+		}
+	}
+	return time.Time{}, errors.New("Invalid time " + s)
+}
+
+// Parses "search: [since=TIME] [until=TIME] [channel=ID] [limit=N] <terms>",
+// the options being the words with '=' outside of the quoted phrases.
+func parseSearchQuery(text string) (*searchQuery, error) {
+	q := &searchQuery{limit: kDefaultSearchLimit}
+	var terms []string
+	for i, part := range strings.Split(text, "\"") {
+		if i%2 == 1 {
+			terms = append(terms, "\""+part+"\"")
+			continue
+		}
+		for _, field := range strings.Fields(part) {
+			kv := strings.SplitN(field, "=", 2)
+			if len(kv) != 2 {
+				terms = append(terms, field)
+				continue
+			}
+
+			var err error
+			var n uint64
+			switch kv[0] {
+			case "since":
+				q.since, err = parseSearchTime(kv[1])
+			case "until":
+				q.until, err = parseSearchTime(kv[1])
+			case "limit":
+				n, err = strconv.ParseUint(kv[1], 10, 16)
+				q.limit = uint16(n)
+			case "channel":
+				if id, ok := parseChannelRef(kv[1]); ok {
+					q.channel = id
+				} else {
+					err = errors.New("Invalid channel id")
+				}
+			default:
+				err = errors.New("Unknown search option")
+			}
+			if err != nil {
+				return nil, errors.New("Invalid search option " + field)
+			}
+		}
+	}
+
+	q.terms = strings.Join(terms, " ")
+	if len(parseSearchTerms(q.terms)) == 0 {
+		return nil, errors.New("Search should have some words to find")
+	}
+	return q, nil
+}
+
+func (h *RequestHandler) handleSearch(recv []byte) error {
+	q, err := decodeSearchQuery(recv)
+	if err != nil {
+		return err
+	}
+
+	h.hub.mu.Lock()
+	subscribed := h.subscribedChannels()
+	h.hub.mu.Unlock()
+	if q.channel != 0 {
+		subscribed = map[uint32]bool{q.channel: true}
+	}
+	since, until := unixNano(q.since), unixNano(q.until)
+
+	ids, more, err := h.hub.search(parseSearchTerms(q.terms), int(q.limit), func(doc searchDoc) bool {
+		return subscribed[doc.channel] && uint64(doc.time) >= since && (until == 0 || uint64(doc.time) <= until)
+	})
+	if err != nil {
+		return err
+	}
+	page, err := h.hub.history.lookup(ids)
+	if err != nil {
+		return err
+	}
+
+	log.Println("Found " + strconv.Itoa(len(page)) + " messages for search [" + q.terms + "] from " + h.ra.String())
+	for _, packet := range encodeHistoryPage(q.query_id, page, more) {
+		if _, err = h.hub.writeTo(packet, h.ra); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Prints the latest messages matching the search.
+func (c *Client) Search(text string) {
+	q, err := parseSearchQuery(text)
+	if err != nil {
+		println(err.Error())
+		return
+	}
+	q.query_id = c.nextQueryID()
+
+	page, more, err := fetchPage(c, q.encode(), q.query_id)
+	if err != nil {
+		log.Println("[Error] Searching history: " + err.Error())
+		return
+	}
+	c.cacheRecords(page)
+	if len(page) == 0 {
+		println("No messages found.")
+		return
+	}
+	printRecords(page)
+	if more {
+		println("More messages found, the older ones are not shown.")
+	}
+}
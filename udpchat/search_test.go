@@ -0,0 +1,123 @@
+package udpchat
+
+import (
+	"testing"
+	"time"
+)
+
+func TestSearchIndex(t *testing.T) {
+	index := newSearchIndex()
+	start := time.Now()
+	msgs := []string{
+		"Deploying the new release",
+		"the release is out, deploying tomorrow",
+		"New release notes",
+		"lunch?",
+	}
+	// added out of order, as concurrent appends may be.
+	for _, i := range []int{1, 0, 3, 2} {
+		index.add(&chatRecord{id: uint64(i + 1), time: start.Add(time.Duration(i) * time.Hour), channel: kDefaultChannel, msg: msgs[i]})
+	}
+	all := func(searchDoc) bool { return true }
+
+	for _, c := range []struct {
+		terms string
+		ids   []uint64
+	}{
+		{"release", []uint64{1, 2, 3}},
+		{"RELEASE deploying", []uint64{1, 2}},
+		{"\"new release\"", []uint64{1, 3}},
+		{"\"release new\"", nil},
+		{"\"the release\" tomorrow", []uint64{2}},
+		{"dinner", nil},
+	} {
+		ids, more, _ := index.search(parseSearchTerms(c.terms), 10, all)
+		if len(ids) != len(c.ids) || more {
+			t.Fatalf("search %q: %v", c.terms, ids)
+		}
+		for i := range ids {
+			if ids[i] != c.ids[i] {
+				t.Fatalf("search %q: %v", c.terms, ids)
+			}
+		}
+	}
+
+	ids, more, _ := index.search(parseSearchTerms("release"), 1, all)
+	if len(ids) != 1 || ids[0] != 3 || !more {
+		t.Fatalf("latest match %v, more %v", ids, more)
+	}
+	until := start.Add(90 * time.Minute).UnixNano()
+	ids, _, _ = index.search(parseSearchTerms("release"), 10, func(doc searchDoc) bool { return doc.time <= until })
+	if len(ids) != 2 || ids[1] != 2 {
+		t.Fatalf("matches until %v: %v", until, ids)
+	}
+
+	// the oldest messages are evicted beyond the size of the index.
+	index.size = 2
+	index.add(&chatRecord{id: 5, time: start, channel: kDefaultChannel, msg: "release"})
+	ids, _, from := index.search(parseSearchTerms("release"), 10, all)
+	if len(ids) != 1 || ids[0] != 5 || from != 4 || len(index.docs) != 2 {
+		t.Fatalf("matches %v from %d after eviction", ids, from)
+	}
+	if _, has := index.postings["deploying"]; has {
+		t.Fatal("postings of the evicted messages kept")
+	}
+}
+
+func TestParseSearchQuery(t *testing.T) {
+	q, err := parseSearchQuery(` since=2h "a = b" channel=2 release  until=2024-01-02`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if q.terms != `"a = b" release` || q.channel != 2 || q.until.Day() != 2 ||
+		time.Since(q.since) < 2*time.Hour || time.Since(q.since) > 3*time.Hour {
+		t.Fatalf("parsed %+v", q)
+	}
+	if _, err = parseSearchQuery("since=2h"); err == nil {
+		t.Fatal("search without terms")
+	}
+	if _, err = parseSearchQuery("release since=yesterday"); err == nil {
+		t.Fatal("invalid time accepted")
+	}
+}
+
+func TestSearchFromHub(t *testing.T) {
+	dir := t.TempDir()
+	l, err := openHistoryLog(dir, SyncNever)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the matches older than the cache are read from the segments.
+	appendTestRecords(t, l, 2*kHistoryCacheSize+10)
+	l.close()
+
+	hub := newTestHub(t)
+	if hub.history, err = openHistoryLog(dir, SyncNever); err != nil {
+		t.Fatal(err)
+	}
+	// and the matches older than the index too.
+	hub.index.size = kHistoryCacheSize
+	if err = hub.index.fill(hub.history); err != nil {
+		t.Fatal(err)
+	}
+	if len(hub.index.docs) != kHistoryCacheSize {
+		t.Fatalf("indexed %d records", len(hub.index.docs))
+	}
+	alice := dialTestHub(t, hub)
+	loginTestHub(t, alice, "alice")
+
+	q := &searchQuery{query_id: 3, limit: 3, terms: "\"msg 7\""}
+	alice.Write(q.encode())
+	page, err := decodeHistoryPart(readTestPacket(t, alice))
+	if err != nil || len(page) != 1 || page[0].id != 8 || page[0].msg != "msg 7" {
+		t.Fatalf("found %v, %v", page, err)
+	}
+
+	// the latest matches are found in the index alone.
+	q = &searchQuery{query_id: 4, limit: 3, terms: "msg"}
+	alice.Write(q.encode())
+	page, err = decodeHistoryPart(readTestPacket(t, alice))
+	if err != nil || len(page) != 3 || page[2].id != 2*kHistoryCacheSize+10 {
+		t.Fatalf("found %v, %v", testPageIDs(page), err)
+	}
+}
@@ -0,0 +1,476 @@
+package udpchat
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"log"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/flynn/noise"
+	"github.com/neverchanje/unplayground/udpchat/codec"
+	"golang.org/x/crypto/curve25519"
+)
+
+// Every datagram between a client and the hub is encrypted. The client
+// starts with a Noise_NX_25519_ChaChaPoly_BLAKE2s handshake, which
+// authenticates the static key of the hub and derives a key for each
+// direction:
+//
+//	kSecureHello SESSION_ID NOISE_MSG1  ---->
+//		<----  kSecureWelcome SESSION_ID NOISE_MSG2
+//
+// SESSION_ID is chosen by the client, and a retransmitted hello gets the same
+// welcome. The client pins the key of the hub the first time it connects to
+// it, and refuses to go on if the hub presents another one later (see
+// Client.CheckHubKey).
+//
+// The payload of NOISE_MSG1 is the range of versions of the protocol the
+// client speaks, and the one of NOISE_MSG2 the version the hub chose (see
+// codec.Negotiate). A hub without a version in common answers with its own
+// range instead, and forgets the client. Clients and hubs of the releases
+// before the versions leave the payloads empty, and speak codec.Version1.
+//
+// Then every request and response is framed by the codec of the negotiated
+// version, and sealed with ChaCha20-Poly1305, the header being authenticated
+// as well:
+//
+//	kSecureData SESSION_ID NONCE CIPHERTEXT  <--->
+//
+// NONCE counts the datagrams sent in each direction. A datagram whose NONCE
+// was received already, or is older than the last kReplayWindow ones, is
+// dropped, as is any datagram that isn't sealed. The hub finds the keys of a
+// client by SESSION_ID, so that a client whose address changes keeps them.
+// The keys are lost when the hub restarts, the client has to connect again.
+const (
+	kSecureHello   byte = 1
+	kSecureWelcome byte = 2
+	kSecureData    byte = 3
+
+	kSecureHeaderSize = 17
+	kSecureTagSize    = 16
+
+	// Size of the buffer for receiving a single datagram.
+	kMaxDatagramSize = kMaxPacketSize + kTokenSize + codec.HeaderSize + kSecureHeaderSize + kSecureTagSize
+
+	// Number of the latest nonces remembered, a multiple of 64.
+	kReplayWindow = 1024
+)
+
+var (
+	cipherSuite = noise.NewCipherSuite(noise.DH25519, noise.CipherChaChaPoly, noise.HashBLAKE2s)
+	prologue    = []byte("udpchat")
+)
+
+// Nonces received recently, to detect replayed datagrams.
+type replayWindow struct {
+	top  uint64 // the highest nonce received, plus one
+	bits [kReplayWindow / 64]uint64
+}
+
+func (w *replayWindow) bit(n uint64) (int, uint64) {
+	return int(n / 64 % uint64(len(w.bits))), 1 << (n % 64)
+}
+
+func (w *replayWindow) accepts(n uint64) bool {
+	if n >= w.top {
+		return true
+	}
+	if w.top-n > kReplayWindow {
+		return false
+	}
+	i, mask := w.bit(n)
+	return w.bits[i]&mask == 0
+}
+
+func (w *replayWindow) mark(n uint64) {
+	// the nonces skipped enter the window, in place of the oldest ones.
+	for next := w.top; next <= n && next-w.top < kReplayWindow; next++ {
+		i, mask := w.bit(next)
+		w.bits[i] &^= mask
+	}
+	if n >= w.top {
+		w.top = n + 1
+	}
+	i, mask := w.bit(n)
+	w.bits[i] |= mask
+}
+
+// The keys derived by a handshake, and the codec of the version it
+// negotiated.
+type secureChannel struct {
+	session_id uint64
+	send       noise.Cipher
+	recv       noise.Cipher
+	framer     codec.Framer
+
+	nonce uint64 // of the next datagram sent, updated atomically
+
+	mu     sync.Mutex
+	replay replayWindow
+}
+
+func (sc *secureChannel) seal(packet []byte) ([]byte, error) {
+	frame, err := sc.framer.Encode(packet)
+	if err != nil {
+		return nil, err
+	}
+	nonce := atomic.AddUint64(&sc.nonce, 1) - 1
+	header := make([]byte, kSecureHeaderSize, kSecureHeaderSize+len(frame)+kSecureTagSize)
+	header[0] = kSecureData
+	binary.LittleEndian.PutUint64(header[1:9], sc.session_id)
+	binary.LittleEndian.PutUint64(header[9:17], nonce)
+	return sc.send.Encrypt(header, nonce, header, frame), nil
+}
+
+// Returns the packet sealed in datagram, unless it's forged or replayed.
+func (sc *secureChannel) open(datagram []byte) ([]byte, error) {
+	if len(datagram) < kSecureHeaderSize+kSecureTagSize || datagram[0] != kSecureData ||
+		binary.LittleEndian.Uint64(datagram[1:9]) != sc.session_id {
+		return nil, errors.New("Datagram not sealed")
+	}
+	nonce := binary.LittleEndian.Uint64(datagram[9:17])
+	sc.mu.Lock()
+	fresh := sc.replay.accepts(nonce)
+	sc.mu.Unlock()
+	if !fresh {
+		return nil, errors.New("Datagram replayed")
+	}
+
+	header := datagram[:kSecureHeaderSize]
+	frame, err := sc.recv.Decrypt(nil, nonce, header, datagram[kSecureHeaderSize:])
+	if err != nil {
+		return nil, errors.New("Datagram forged")
+	}
+
+	sc.mu.Lock()
+	if !sc.replay.accepts(nonce) {
+		sc.mu.Unlock()
+		return nil, errors.New("Datagram replayed")
+	}
+	sc.replay.mark(nonce)
+	sc.mu.Unlock()
+
+	packet, err := sc.framer.Decode(frame)
+	if err != nil {
+		return nil, errors.New("Malformed frame: " + err.Error())
+	}
+	return packet, nil
+}
+
+// The first bytes of the SHA-256 of a static key, for users to compare.
+func fingerprint(key []byte) string {
+	sum := sha256.Sum256(key)
+	digits := hex.EncodeToString(sum[:16])
+	groups := make([]string, 0, len(digits)/4)
+	for i := 0; i < len(digits); i += 4 {
+		groups = append(groups, digits[i:i+4])
+	}
+	return strings.Join(groups, ":")
+}
+
+// A packetLink reading from conn directly, before the client receives in
+// background.
+type connLink struct {
+	conn net.Conn
+}
+
+func (l connLink) write(packet []byte) error {
+	_, err := l.conn.Write(packet)
+	return err
+}
+
+func (l connLink) read(deadline time.Time) ([]byte, error) {
+	l.conn.SetReadDeadline(deadline)
+	defer l.conn.SetReadDeadline(time.Time{})
+	packet := make([]byte, kMaxDatagramSize)
+	n, err := l.conn.Read(packet)
+	if errors.Is(err, os.ErrDeadlineExceeded) {
+		return nil, errTimeout
+	}
+	return packet[:n], err
+}
+
+// Runs the handshake with the hub conn is connected to, and returns the
+// keys along with the static key of the hub. versions are the ones the
+// client speaks, codec.Supported but in tests.
+func dialSecure(conn net.Conn, versions codec.Versions) (*secureChannel, []byte, error) {
+	hs, err := noise.NewHandshakeState(noise.Config{
+		CipherSuite: cipherSuite,
+		Random:      rand.Reader,
+		Pattern:     noise.HandshakeNX,
+		Initiator:   true,
+		Prologue:    prologue,
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+	var id [8]byte
+	if _, err = rand.Read(id[:]); err != nil {
+		return nil, nil, err
+	}
+	hello := append([]byte{kSecureHello}, id[:]...)
+	if hello, _, _, err = hs.WriteMessage(hello, versions.Encode()); err != nil {
+		return nil, nil, err
+	}
+
+	// a welcome that doesn't complete the handshake is ignored.
+	var send, recv *noise.CipherState
+	var choice []byte
+	_, err = exchange(connLink{conn}, hello, func(resp []byte) bool {
+		if len(resp) < 9 || resp[0] != kSecureWelcome || !bytes.Equal(resp[1:9], id[:]) {
+			return false
+		}
+		var herr error
+		choice, send, recv, herr = hs.ReadMessage(nil, resp[9:])
+		return herr == nil && send != nil
+	})
+	if err != nil {
+		return nil, nil, errors.New("Connecting to the hub: " + err.Error())
+	}
+	version, err := codec.DecodeChoice(choice, versions)
+	if err != nil {
+		return nil, nil, err
+	}
+	sc := &secureChannel{
+		session_id: binary.LittleEndian.Uint64(id[:]),
+		send:       send.Cipher(),
+		recv:       recv.Cipher(),
+		framer:     codec.Framer{Version: version},
+	}
+	return sc, hs.PeerStatic(), nil
+}
+
+// Keys of a client, and the handshake that derived them.
+type secureSession struct {
+	*secureChannel
+	ra       net.Addr // the latest address of the client
+	hello    []byte
+	welcome  []byte
+	lastSeen time.Time // when the client last sent a datagram, see presence.go
+}
+
+// Answers a hello, or retransmits the welcome of a retransmitted hello.
+func (h *Hub) handleHello(recv []byte, ra net.Addr) error {
+	if len(recv) < 9 {
+		return errors.New("Malformed hello from " + ra.String())
+	}
+	session_id := binary.LittleEndian.Uint64(recv[1:9])
+	h.mu.Lock()
+	s, has := h.secure[session_id]
+	versions := h.versions
+	h.mu.Unlock()
+	if has {
+		if !bytes.Equal(s.hello, recv) {
+			return errors.New("Hello of a taken session from " + ra.String())
+		}
+		_, err := h.conn.WriteTo(s.welcome, ra)
+		return err
+	}
+
+	hs, err := noise.NewHandshakeState(noise.Config{
+		CipherSuite:   cipherSuite,
+		Random:        rand.Reader,
+		Pattern:       noise.HandshakeNX,
+		Prologue:      prologue,
+		StaticKeypair: h.key,
+	})
+	if err != nil {
+		return err
+	}
+	payload, _, _, err := hs.ReadMessage(nil, recv[9:])
+	if err != nil {
+		return errors.New("Malformed hello from " + ra.String() + ": " + err.Error())
+	}
+	remote, err := codec.DecodeVersions(payload)
+	if err != nil {
+		return errors.New("Malformed hello from " + ra.String() + ": " + err.Error())
+	}
+	// the client is told the versions of the hub, and isn't answered any
+	// further.
+	version, verr := codec.Negotiate(versions, remote)
+	welcome := append([]byte{kSecureWelcome}, recv[1:9]...)
+	welcome, recvCipher, sendCipher, err := hs.WriteMessage(welcome, choice(version, versions))
+	if err != nil {
+		return err
+	}
+	if verr != nil {
+		h.conn.WriteTo(welcome, ra)
+		return errors.New("Refused client " + ra.String() + ": " + verr.Error())
+	}
+	s = &secureSession{
+		secureChannel: &secureChannel{
+			session_id: session_id,
+			send:       sendCipher.Cipher(),
+			recv:       recvCipher.Cipher(),
+			framer:     codec.Framer{Version: version, Response: true},
+		},
+		ra:       ra,
+		hello:    recv,
+		welcome:  welcome,
+		lastSeen: time.Now(),
+	}
+
+	h.mu.Lock()
+	if prev, has := h.secure[session_id]; has {
+		s = prev
+	} else {
+		h.secure[session_id] = s
+		h.peers[ra.String()] = s
+	}
+	h.mu.Unlock()
+	_, err = h.conn.WriteTo(s.welcome, ra)
+	return err
+}
+
+// Returns the request sealed in recv, which is then sent from ra.
+func (h *Hub) unseal(recv []byte, ra net.Addr) ([]byte, error) {
+	if len(recv) < 9 || recv[0] != kSecureData {
+		return nil, errors.New("Datagram not sealed from " + ra.String())
+	}
+	h.mu.Lock()
+	s, has := h.secure[binary.LittleEndian.Uint64(recv[1:9])]
+	h.mu.Unlock()
+	if !has {
+		return nil, errors.New("Unknown secure session from " + ra.String())
+	}
+	packet, err := s.open(recv)
+	if err != nil {
+		return nil, errors.New(err.Error() + " from " + ra.String())
+	}
+
+	h.mu.Lock()
+	s.lastSeen = time.Now()
+	if s.ra.String() != ra.String() {
+		delete(h.peers, s.ra.String())
+		s.ra = ra
+	}
+	h.peers[ra.String()] = s
+	h.mu.Unlock()
+	return packet, nil
+}
+
+// Sends a response sealed with the keys of the client at ra.
+func (h *Hub) writeTo(packet []byte, ra net.Addr) (int, error) {
+	h.mu.Lock()
+	s, has := h.peers[ra.String()]
+	h.mu.Unlock()
+	if !has {
+		return 0, errors.New("No secure session with " + ra.String())
+	}
+	datagram, err := s.seal(packet)
+	if err != nil {
+		return 0, err
+	}
+	return h.conn.WriteTo(datagram, ra)
+}
+
+// The payload of the welcome for version, which is empty for the clients of
+// codec.Version1 as they expect nothing.
+func choice(version uint8, versions codec.Versions) []byte {
+	if version == codec.Version1 {
+		return nil
+	}
+	return codec.EncodeChoice(version, versions)
+}
+
+func loadHubKey(path string) (noise.DHKey, error) {
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		key, err := cipherSuite.GenerateKeypair(rand.Reader)
+		if err != nil {
+			return key, err
+		}
+		return key, os.WriteFile(path, []byte(hex.EncodeToString(key.Private)+"\n"), 0600)
+	} else if err != nil {
+		return noise.DHKey{}, err
+	}
+
+	private, err := hex.DecodeString(strings.TrimSpace(string(data)))
+	if err != nil || len(private) != curve25519.ScalarSize {
+		return noise.DHKey{}, errors.New("Malformed hub key in " + path)
+	}
+	public, err := publicKey(private)
+	return noise.DHKey{Private: private, Public: public}, err
+}
+
+// The X25519 public key of the private key.
+func publicKey(private []byte) ([]byte, error) {
+	return curve25519.X25519(private, curve25519.Basepoint)
+}
+
+// Sets the file the static key of the hub is stored in, which is generated
+// if it doesn't exist. The key is only kept in memory otherwise.
+func (h *Hub) SetKeyFile(path string) error {
+	if len(path) == 0 {
+		return errors.New("Key file should not be empty")
+	}
+	key, err := loadHubKey(path)
+	if err != nil {
+		return err
+	}
+	h.key = key
+	log.Println("Hub key fingerprint " + fingerprint(key.Public))
+	return nil
+}
+
+// The fingerprint of the key the hub authenticated with.
+func (c *Client) HubFingerprint() string {
+	return fingerprint(c.hubKey)
+}
+
+// Pins the key of the hub in file, which holds "<host>:<port> <key>" lines.
+// Returns true if the hub wasn't known, and its key got trusted on first
+// use, or an error if the hub presents another key than the pinned one.
+func (c *Client) CheckHubKey(path string) (bool, error) {
+	addr := c.remote.String()
+	key := hex.EncodeToString(c.hubKey)
+
+	file, err := os.Open(path)
+	if err != nil && !os.IsNotExist(err) {
+		return false, err
+	}
+	if err == nil {
+		scanner := bufio.NewScanner(file)
+		for scanner.Scan() {
+			fields := strings.Fields(scanner.Text())
+			if len(fields) != 2 || fields[0] != addr {
+				continue
+			}
+			file.Close()
+			if fields[1] != key {
+				return false, errors.New("The key of hub " + addr + " changed to " + c.HubFingerprint() +
+					", someone may be impersonating it. Remove the line of the hub from " + path +
+					" if the change is expected.")
+			}
+			return false, nil
+		}
+		file.Close()
+		if err = scanner.Err(); err != nil {
+			return false, err
+		}
+	}
+
+	if err = os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return false, err
+	}
+	file, err = os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600)
+	if err != nil {
+		return false, err
+	}
+	_, err = file.WriteString(addr + " " + key + "\n")
+	if cerr := file.Close(); err == nil {
+		err = cerr
+	}
+	return err == nil, err
+}
@@ -0,0 +1,111 @@
+package udpchat
+
+import (
+	"errors"
+	"net"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/neverchanje/unplayground/udpchat/codec"
+)
+
+func TestReplayWindow(t *testing.T) {
+	var w replayWindow
+	for _, n := range []uint64{0, 1, 5, 3, kReplayWindow + 2} {
+		if !w.accepts(n) {
+			t.Fatalf("nonce %d rejected", n)
+		}
+		w.mark(n)
+	}
+	// 4 arrived late but is still in the window, 1 is too old.
+	for n, accepted := range map[uint64]bool{3: false, 4: true, 5: false, 1: false, kReplayWindow + 2: false, kReplayWindow + 1: true} {
+		if w.accepts(n) != accepted {
+			t.Fatalf("nonce %d accepted: %v", n, !accepted)
+		}
+	}
+}
+
+func TestSecureChannel(t *testing.T) {
+	hub := newTestHub(t)
+	alice := dialTestHub(t, hub)
+	loginTestHub(t, alice, "alice")
+
+	expectNothing := func(what string) {
+		alice.SetReadDeadline(time.Now().Add(200 * time.Millisecond))
+		if n, err := alice.Read(make([]byte, kMaxPacketSize)); err == nil {
+			t.Fatalf("%s answered with %d bytes", what, n)
+		}
+	}
+
+	join, _ := alice.secure.seal(append([]byte{byte(kReqJoin)}, alice.token...))
+	alice.Conn.Write(join)
+	if resp := readTestPacket(t, alice); ResponseType(resp[0]) != kRespJoinOK {
+		t.Fatalf("joined with response %q", resp)
+	}
+	alice.Conn.Write(join)
+	expectNothing("replayed join")
+
+	tampered, _ := alice.secure.seal(append([]byte{byte(kReqJoin)}, alice.token...))
+	tampered[len(tampered)-1] ^= 1
+	alice.Conn.Write(tampered)
+	expectNothing("tampered join")
+
+	alice.Conn.Write(append([]byte{byte(kReqJoin)}, alice.token...))
+	expectNothing("plaintext join")
+}
+
+// Clients of Version1 still talk to the hub, and clients without a version
+// in common with the hub are refused.
+func TestVersionNegotiation(t *testing.T) {
+	hub := newTestHub(t)
+	alice := dialTestHub(t, hub)
+	if alice.secure.framer.Version != codec.Version2 {
+		t.Fatalf("negotiated version %d", alice.secure.framer.Version)
+	}
+	joinTestHub(t, alice, "alice")
+
+	dial := func(versions codec.Versions) (*testConn, error) {
+		conn, err := hub.transport.Dial(hub.conn.LocalAddr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { conn.Close() })
+		secure, _, err := dialSecure(conn, versions)
+		return &testConn{Conn: conn, secure: secure}, err
+	}
+	legacy, err := dial(codec.Versions{Min: codec.Version1, Max: codec.Version1})
+	if err != nil || legacy.secure.framer.Version != codec.Version1 {
+		t.Fatalf("legacy client negotiated %v", err)
+	}
+	joinTestHub(t, legacy, "bob")
+	readTestPacket(t, alice) // bob joined
+	legacy.Write([]byte{byte(kReqWho)})
+	var who codec.WhoList
+	if err := codec.Unmarshal(readTestPacket(t, legacy), &who); err != nil || strings.Join(who.Users, " ") != "alice bob" {
+		t.Fatalf("who of a legacy client: %v, %v", who.Users, err)
+	}
+
+	hub.mu.Lock()
+	hub.versions = codec.Versions{Min: codec.Version2, Max: codec.Version2}
+	hub.mu.Unlock()
+	if _, err = dial(codec.Versions{Min: codec.Version1, Max: codec.Version1}); !errors.Is(err, codec.ErrVersion) {
+		t.Fatalf("refused client connected with %v", err)
+	}
+}
+
+func TestCheckHubKey(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "udpchat", "known_hubs")
+	c := &Client{remote: &net.UDPAddr{IP: net.ParseIP(ServiceHost), Port: ServicePort}, hubKey: []byte("key of the hub")}
+	if trusted, err := c.CheckHubKey(path); !trusted || err != nil {
+		t.Fatalf("first use trusted %v, %v", trusted, err)
+	}
+	if trusted, err := c.CheckHubKey(path); trusted || err != nil {
+		t.Fatalf("pinned key trusted %v, %v", trusted, err)
+	}
+	c.hubKey = []byte("key of an impostor")
+	if _, err := c.CheckHubKey(path); err == nil {
+		t.Fatal("changed key accepted")
+	}
+}
@@ -0,0 +1,61 @@
+package udpchat
+
+import (
+	"hash/crc32"
+	"strconv"
+
+	"github.com/neverchanje/unplayground/udpchat/codec"
+)
+
+// Size of the fixed-length header of kReqSendSeg and kRespFileSeg:
+//
+//	kReqSendSeg PACKET_ID SEG_ID CRC32C SEG_CONTENT
+const kSegHeaderSize = 1 + codec.SegmentHeaderSize
+
+var crc32c = crc32.MakeTable(crc32.Castagnoli)
+
+type fileSegment struct {
+	packet_id uint64
+	seg_id    uint32
+	checksum  uint32 // CRC32C of content
+	content   []byte
+	seg_len   int
+}
+
+// Encodes a segment as a packet of type t, that's kReqSendSeg for uploads
+// and kRespFileSeg for downloads.
+func encodeSegment(t byte, packet_id uint64, seg_id uint32, content []byte) []byte {
+	seg := codec.Segment{
+		PacketID: packet_id,
+		SegID:    seg_id,
+		Checksum: crc32.Checksum(content, crc32c),
+		Content:  content,
+	}
+	if t == byte(kRespFileSeg) {
+		return codec.Marshal(&codec.FileSeg{Segment: seg})
+	}
+	return codec.Marshal(&codec.SendSeg{Segment: seg})
+}
+
+func newFileSegment(seg *codec.Segment) *fileSegment {
+	fs := new(fileSegment)
+	fs.packet_id = seg.PacketID
+	fs.seg_id = seg.SegID
+	fs.checksum = seg.Checksum
+	fs.content = seg.Content
+	fs.seg_len = kSegHeaderSize + len(seg.Content)
+	return fs
+}
+
+// Returns false if the content is corrupted.
+func (fs *fileSegment) verify() bool {
+	return crc32.Checksum(fs.content, crc32c) == fs.checksum
+}
+
+func (fs *fileSegment) toString() string {
+	str := "<PACKET_ID: " + strconv.FormatUint(fs.packet_id, 10)
+	str += " , SEG_ID: " + strconv.FormatUint(uint64(fs.seg_id), 10)
+	str += " , SEG_LEN: " + strconv.FormatInt(int64(fs.seg_len), 10)
+	str += ">"
+	return str
+}
@@ -0,0 +1,373 @@
+package udpchat
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"hash"
+	"io"
+	"log"
+	"os"
+	"strconv"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// Size of the content carried by each segment, as proposed in the
+	// handshake.
+	kSegmentSize = 512
+
+	// Maximum number of unacknowledged segments in flight, unless
+	// changed with Client.SetSendWindow.
+	kDefaultSendWindow = 32
+
+	// Retransmission timeout before any RTT has been measured. It's doubled
+	// on every timeout without progress up to kMaxRTO.
+	kInitialRTO = 200 * time.Millisecond
+	kMaxRTO     = 3 * time.Second
+
+	// Number of consecutive timeouts without any ack before the transfer
+	// is abandoned.
+	kMaxRetries = 8
+
+	// A gap is retransmitted without waiting for the timeout once this many
+	// acks have reported segments above it.
+	kFastRetransmitAcks = 3
+)
+
+// A segment that has been sent but not acknowledged yet.
+type outSegment struct {
+	content []byte
+	sent_at time.Time
+
+	// set once the segment has been sent more than once, its ack is then
+	// ambiguous for RTT measurement.
+	retransmitted bool
+
+	// number of acks that accepted a later segment but not this one.
+	skipped int
+
+	// set when the segment has been retransmitted as a gap, so that it's
+	// only retransmitted again on timeout.
+	fast_retransmitted bool
+}
+
+// The way a fileSender exchanges packets with the receiver.
+type packetLink interface {
+	// Sends a packet as is.
+	write(packet []byte) error
+
+	// Returns the next packet received before deadline, or errTimeout.
+	read(deadline time.Time) ([]byte, error)
+}
+
+var errTimeout = errors.New("i/o timeout")
+
+// A packetLink whose packets are read by another goroutine, which dispatches
+// them to the link of their transfer. Packets are dropped when the queue is
+// full, as the network would do.
+type queuedLink struct {
+	send    func(packet []byte) error
+	packets chan []byte
+}
+
+func newQueuedLink(send func(packet []byte) error, capacity int) *queuedLink {
+	return &queuedLink{send, make(chan []byte, capacity)}
+}
+
+func (l *queuedLink) write(packet []byte) error {
+	return l.send(packet)
+}
+
+func (l *queuedLink) read(deadline time.Time) ([]byte, error) {
+	timer := time.NewTimer(time.Until(deadline))
+	defer timer.Stop()
+
+	select {
+	case packet := <-l.packets:
+		return packet, nil
+	case <-timer.C:
+		return nil, errTimeout
+	}
+}
+
+// Queues a packet for read, the packet must not be reused by the caller.
+func (l *queuedLink) deliver(packet []byte) {
+	select {
+	case l.packets <- packet:
+	default:
+	}
+}
+
+// Sends packet through link and waits for the response accepted by
+// isResponse. The packet is retransmitted with backoff when no such
+// response arrives in time.
+func exchange(link packetLink, packet []byte, isResponse func([]byte) bool) ([]byte, error) {
+	rto := kInitialRTO
+	for retries := 0; retries <= kMaxRetries; retries++ {
+		if err := link.write(packet); err != nil {
+			return nil, err
+		}
+
+		deadline := time.Now().Add(rto)
+		for {
+			resp, err := link.read(deadline)
+			if err == errTimeout {
+				break
+			} else if err != nil {
+				return nil, err
+			}
+			if isResponse(resp) {
+				return resp, nil
+			}
+			if err := requestFailure(packet, resp); err != nil {
+				return nil, err
+			}
+		}
+
+		rto *= 2
+		if rto > kMaxRTO {
+			rto = kMaxRTO
+		}
+	}
+	return nil, errors.New("No response after " + strconv.Itoa(kMaxRetries) + " retransmissions")
+}
+
+// Sends a file segment by segment, either from the client to the server
+// (kReqSendSeg acked by kRespRecvSegAck) or the other way around
+// (kRespFileSeg acked by kReqFileSegAck).
+type fileSender struct {
+	link     packetLink
+	seg_type byte
+	ack_type byte
+
+	// segments in flight, the size of which is bounded by both window
+	// and the congestion window.
+	unaccepted map[uint32]*outSegment
+	window     int
+	cc         *congestionControl
+
+	// negotiated in the handshake
+	seg_size  int
+	seg_count uint32
+
+	packet_id []byte
+
+	reader   *bufio.Reader
+	next_sid uint32
+	hitsEOF  bool
+	last_tx  time.Time
+
+	// SHA-256 of the segments read so far, sent in the FIN.
+	digest hash.Hash
+
+	// number of bytes accepted by the receiver, read concurrently by the
+	// "transfers" command.
+	acked uint64
+}
+
+func newFileSender(link packetLink, packet_id uint64, window int) *fileSender {
+	f := new(fileSender)
+	f.link = link
+	f.seg_type = byte(kReqSendSeg)
+	f.ack_type = byte(kRespRecvSegAck)
+	f.unaccepted = make(map[uint32]*outSegment)
+	f.window = window
+	f.seg_size = kSegmentSize
+	f.cc = newCongestionControl()
+	f.digest = sha256.New()
+	f.packet_id = make([]byte, 8)
+	binary.LittleEndian.PutUint64(f.packet_id, packet_id)
+	return f
+}
+
+// Reads the file segment by segment, keeping at most
+// fs.cc.window(fs.window) segments in flight, paced over the round trip
+// time. New segments are only read once acks have opened the window.
+func (fs *fileSender) sendFileImpl(fname string) error {
+	file, err := os.Open(fname)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	fs.reader = bufio.NewReader(file)
+	fs.hitsEOF = fs.next_sid == fs.seg_count
+	retries := 0
+
+	// The segments the server already has when resuming are only read for
+	// the digest.
+	if fs.next_sid != 0 {
+		skip := int64(fs.next_sid) * int64(fs.seg_size)
+		n, err := io.CopyN(fs.digest, fs.reader, skip)
+		if err != nil && err != io.EOF {
+			return errors.New("File reading " + err.Error())
+		}
+		atomic.StoreUint64(&fs.acked, uint64(n))
+	}
+
+	for !fs.hitsEOF || len(fs.unaccepted) != 0 {
+		if err := fs.sendNewSegments(); err != nil {
+			return err
+		}
+
+		packet, err := fs.link.read(fs.nextDeadline())
+
+		if err != nil {
+			if err != errTimeout {
+				return err
+			}
+			if len(fs.unaccepted) == 0 || time.Now().Before(fs.nextTimeout()) {
+				// woken up for pacing
+				continue
+			}
+
+			retries += 1
+			if retries > kMaxRetries {
+				return errors.New("Segments not acknowledged after " +
+					strconv.Itoa(kMaxRetries) + " retransmissions")
+			}
+			fs.retransmitExpired()
+			fs.cc.onTimeout(fs.next_sid)
+			continue
+		}
+
+		if fs.handleAck(packet) {
+			retries = 0
+		}
+	}
+	return nil
+}
+
+// Sends as many new segments as the windows and pacing allow.
+func (fs *fileSender) sendNewSegments() error {
+	for !fs.hitsEOF && len(fs.unaccepted) < fs.cc.window(fs.window) {
+		if time.Since(fs.last_tx) < fs.cc.pacingInterval() {
+			return nil
+		}
+
+		// Each segment owns its buffer since it is kept in
+		// fs.unaccepted until acknowledged. Only the last segment may
+		// be shorter than the segment size.
+		content := make([]byte, fs.seg_size)
+		n, err := io.ReadFull(fs.reader, content)
+		last := fs.next_sid+1 == fs.seg_count
+		if err == io.ErrUnexpectedEOF && last {
+			err = nil
+		}
+		if err != nil {
+			return errors.New("File reading " + err.Error())
+		}
+
+		fs.digest.Write(content[:n])
+		fs.sendSegmentLogged(content[:n], fs.next_sid)
+		fs.next_sid += 1
+		fs.hitsEOF = fs.next_sid == fs.seg_count
+	}
+	return nil
+}
+
+func (fs *fileSender) sendSegmentLogged(content []byte, seg_id uint32) {
+	err := fs.sendSegment(content, seg_id)
+	if err != nil {
+		log.Println("[Error] Segment sending " + err.Error())
+	}
+}
+
+// The moment at which the oldest segment in flight times out.
+func (fs *fileSender) nextTimeout() time.Time {
+	var oldest time.Time
+	for _, seg := range fs.unaccepted {
+		if oldest.IsZero() || seg.sent_at.Before(oldest) {
+			oldest = seg.sent_at
+		}
+	}
+	return oldest.Add(fs.cc.rto)
+}
+
+// The moment to stop waiting for acks, either to retransmit on timeout or
+// to send the next paced segment.
+func (fs *fileSender) nextDeadline() time.Time {
+	paced := fs.last_tx.Add(fs.cc.pacingInterval())
+	if len(fs.unaccepted) == 0 {
+		return paced
+	}
+
+	deadline := fs.nextTimeout()
+	if !fs.hitsEOF && len(fs.unaccepted) < fs.cc.window(fs.window) && paced.Before(deadline) {
+		deadline = paced
+	}
+	return deadline
+}
+
+// Retransmits the segments that have not been acknowledged within fs.cc.rto.
+func (fs *fileSender) retransmitExpired() {
+	now := time.Now()
+	for seg_id, seg := range fs.unaccepted {
+		if now.Sub(seg.sent_at) >= fs.cc.rto {
+			log.Println("Retransmitting segment " + strconv.FormatUint(uint64(seg_id), 10))
+			fs.sendSegmentLogged(seg.content, seg_id)
+		}
+	}
+}
+
+// Removes the acknowledged segments from flight and retransmits the gaps
+// reported by the ack. Returns true iff the ack made progress.
+func (fs *fileSender) handleAck(packet []byte) bool {
+	ack, ok := decodeSegAck(packet, fs.ack_type)
+	if !ok || ack.packet_id != binary.LittleEndian.Uint64(fs.packet_id) {
+		return false
+	}
+
+	now := time.Now()
+	acked := 0
+	for seg_id, seg := range fs.unaccepted {
+		if ack.acks(seg_id) {
+			if !seg.retransmitted {
+				fs.cc.onRTTSample(now.Sub(seg.sent_at))
+			}
+			delete(fs.unaccepted, seg_id)
+			atomic.AddUint64(&fs.acked, uint64(len(seg.content)))
+			acked++
+		}
+	}
+	fs.cc.onAck(acked)
+
+	highest, ok := ack.highest()
+	if !ok {
+		return acked != 0
+	}
+	for seg_id, seg := range fs.unaccepted {
+		if seg_id > highest {
+			continue
+		}
+		seg.skipped++
+		if seg.skipped >= kFastRetransmitAcks && !seg.fast_retransmitted {
+			log.Println("Retransmitting gap " + strconv.FormatUint(uint64(seg_id), 10))
+			fs.cc.onLoss(seg_id, fs.next_sid)
+			fs.sendSegmentLogged(seg.content, seg_id)
+			fs.unaccepted[seg_id].fast_retransmitted = true
+		}
+	}
+	return acked != 0
+}
+
+func (fs *fileSender) sendSegment(content []byte, seg_id uint32) error {
+	packet := encodeSegment(fs.seg_type, binary.LittleEndian.Uint64(fs.packet_id), seg_id, content)
+
+	fs.last_tx = time.Now()
+	if seg, has := fs.unaccepted[seg_id]; has {
+		seg.sent_at = fs.last_tx
+		seg.retransmitted = true
+		seg.skipped = 0
+	} else {
+		fs.unaccepted[seg_id] = &outSegment{content: content, sent_at: fs.last_tx}
+	}
+
+	err := fs.link.write(packet)
+
+	log.Println("Writing segment "+strconv.FormatUint(uint64(seg_id), 10)+" in length ", len(content))
+	return err
+}
@@ -1,19 +1,67 @@
 package main
 
 import (
+	"flag"
 	"fmt"
 	"os"
 
 	"github.com/neverchanje/unplayground/udpchat"
 )
 
+var (
+	uploadDir  = flag.String("upload-dir", "uploads", "directory the uploaded files are stored in")
+	historyDir = flag.String("history-dir", "history", "directory the chat history is stored in")
+	fsync      = flag.String("fsync", "interval", "when the history is synced to disk: always, interval or never")
+	accounts   = flag.String("accounts", "accounts", "file the accounts of the users are stored in")
+	keyFile    = flag.String("key", "hub.key", "file the static key of the hub is stored in, generated if missing")
+	dmDir      = flag.String("dm-dir", "dms", "directory the keys of the users and their direct messages are stored in")
+	impair     = flag.String("impair", "", "impair the datagrams sent as a bad network, e.g. lossy or loss=0.05,delay=20ms, for testing")
+)
+
 func main() {
+	flag.Parse()
 
-	hub, err := udpchat.NewHub()
+	policy, err := udpchat.ParseSyncPolicy(*fsync)
 	if err != nil {
 		fmt.Println(err)
 		os.Exit(1)
 	}
 
+	transport := udpchat.UDP
+	if len(*impair) != 0 {
+		imp, err := udpchat.ParseImpairment(*impair)
+		if err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+		transport = udpchat.NewImpairedTransport(transport, imp)
+	}
+
+	hub, err := udpchat.NewHubOn(transport, udpchat.ServiceAddress(), *historyDir, policy)
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+
+	if err = hub.SetUploadDir(*uploadDir); err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+
+	if err = hub.SetAccountsFile(*accounts); err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+
+	if err = hub.SetDMDir(*dmDir); err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+
+	if err = hub.SetKeyFile(*keyFile); err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+
 	hub.RunLoop()
 }
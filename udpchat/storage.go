@@ -0,0 +1,164 @@
+package udpchat
+
+import (
+	"errors"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// Files received by the hub are stored under the upload root, in a
+// subdirectory for each user:
+//
+//	<root>/<user>/<name>
+//
+// and are referred to as "<user>/<name>" by the clients. Both parts are
+// sanitized into a single path element, so that no request can reach a file
+// outside of the root. Names starting with a dot are reserved for the
+// temporary files of ongoing transfers.
+const (
+	kDefaultUploadDir = "uploads"
+	kAnonymousUser    = "anonymous"
+	kMaxNameLen       = 255
+
+	// A file received under a name that's taken is stored as "name-1.ext",
+	// "name-2.ext"... up to this many versions.
+	kMaxVersions = 1000
+)
+
+var errInvalidName = errors.New("Invalid file name")
+
+// Reduces a file name sent by the client to its last path element, in either
+// the slash or the backslash form.
+func sanitizeName(name string) (string, error) {
+	name = path.Base(strings.ReplaceAll(name, "\\", "/"))
+	if name == "." || name == "/" || strings.HasPrefix(name, ".") ||
+		len(name) > kMaxNameLen || !utf8.ValidString(name) {
+		return "", errInvalidName
+	}
+	for _, r := range name {
+		if unicode.IsControl(r) {
+			return "", errInvalidName
+		}
+	}
+	return name, nil
+}
+
+// Unlike file names, user names are never shortened, so that two users can
+// not share a directory.
+func sanitizeUser(user string) (string, error) {
+	if len(user) == 0 {
+		return kAnonymousUser, nil
+	}
+	if strings.ContainsAny(user, "/\\") {
+		return "", errors.New("Invalid user name")
+	}
+	if _, err := sanitizeName(user); err != nil {
+		return "", errors.New("Invalid user name")
+	}
+	return user, nil
+}
+
+// Sets the directory files are uploaded to, which is created on demand.
+func (h *Hub) SetUploadDir(dir string) error {
+	if len(dir) == 0 {
+		return errors.New("Upload directory should not be empty")
+	}
+	h.uploadDir = dir
+	return nil
+}
+
+// Path a file sent by user is received at, creating the directory of the user
+// if needed.
+func (h *Hub) uploadPath(user string, name string) (string, error) {
+	user, err := sanitizeUser(user)
+	if err != nil {
+		return "", err
+	}
+	if name, err = sanitizeName(name); err != nil {
+		return "", err
+	}
+	dir := filepath.Join(h.uploadDir, user)
+	if err = os.MkdirAll(dir, 0755); err != nil {
+		return "", err
+	}
+	return filepath.Join(dir, name), nil
+}
+
+// Path of a stored file referred to as "<user>/<name>".
+func (h *Hub) storedPath(ref string) (string, error) {
+	parts := strings.Split(ref, "/")
+	if len(parts) != 2 {
+		return "", errInvalidName
+	}
+	user, err := sanitizeUser(parts[0])
+	if err != nil || user != parts[0] {
+		return "", errInvalidName
+	}
+	if name, err := sanitizeName(parts[1]); err != nil || name != parts[1] {
+		return "", errInvalidName
+	}
+	return filepath.Join(h.uploadDir, user, parts[1]), nil
+}
+
+// Name a stored file is referred to by the clients.
+func (h *Hub) storedRef(fname string) string {
+	if rel, err := filepath.Rel(h.uploadDir, fname); err == nil {
+		return filepath.ToSlash(rel)
+	}
+	return fname
+}
+
+// Lists the stored files as "<user>/<name> (<size> bytes)".
+func (h *Hub) listStored() []string {
+	var files []string
+	users, _ := os.ReadDir(h.uploadDir)
+	for _, user := range users {
+		if !user.IsDir() || strings.HasPrefix(user.Name(), ".") {
+			continue
+		}
+		entries, _ := os.ReadDir(filepath.Join(h.uploadDir, user.Name()))
+		for _, entry := range entries {
+			if !entry.Type().IsRegular() || strings.HasPrefix(entry.Name(), ".") {
+				continue
+			}
+			if info, err := entry.Info(); err == nil {
+				files = append(files, user.Name()+"/"+entry.Name()+
+					" ("+strconv.FormatInt(info.Size(), 10)+" bytes)")
+			}
+		}
+	}
+	sort.Strings(files)
+	return files
+}
+
+// The i-th version of fname, which is fname itself for i == 0.
+func versionedName(fname string, i int) string {
+	if i == 0 {
+		return fname
+	}
+	ext := filepath.Ext(fname)
+	return strings.TrimSuffix(fname, ext) + "-" + strconv.Itoa(i) + ext
+}
+
+// Moves the temporary file part to the first version of fname that does not
+// exist, and returns that version. An existing file is never replaced, even
+// by a transfer committed concurrently.
+func storeVersioned(part string, fname string) (string, error) {
+	for i := 0; i < kMaxVersions; i++ {
+		target := versionedName(fname, i)
+		err := os.Link(part, target)
+		if err == nil {
+			return target, os.Remove(part)
+		}
+		if !os.IsExist(err) {
+			return "", err
+		}
+	}
+	return "", errors.New("Too many versions of " + fname)
+}
@@ -0,0 +1,84 @@
+package udpchat
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestSanitizeName(t *testing.T) {
+	valid := map[string]string{
+		"a.txt":                "a.txt",
+		"dir/a.txt":            "a.txt",
+		"../../etc/passwd":     "passwd",
+		"C:\\Users\\bob\\a.go": "a.go",
+		"/abs/path/report":     "report",
+	}
+	for name, want := range valid {
+		if got, err := sanitizeName(name); err != nil || got != want {
+			t.Errorf("sanitizeName(%q) = %q, %v, want %q", name, got, err, want)
+		}
+	}
+
+	for _, name := range []string{"", ".", "..", "/", "dir/..", ".hidden", "a\x00b", "a\nb"} {
+		if got, err := sanitizeName(name); err == nil {
+			t.Errorf("sanitizeName(%q) = %q, want error", name, got)
+		}
+	}
+
+	if _, err := sanitizeUser("../alice"); err == nil {
+		t.Error("accepted a user name with a separator")
+	}
+	if user, _ := sanitizeUser(""); user != kAnonymousUser {
+		t.Errorf("empty user name is stored as %q", user)
+	}
+}
+
+func TestStoredPath(t *testing.T) {
+	h := &Hub{uploadDir: t.TempDir()}
+
+	fname, err := h.uploadPath("alice", "../../a.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fname != filepath.Join(h.uploadDir, "alice", "a.txt") {
+		t.Fatalf("file is uploaded to %s", fname)
+	}
+	if ref := h.storedRef(fname); ref != "alice/a.txt" {
+		t.Fatalf("file is referred to as %s", ref)
+	}
+	if got, err := h.storedPath("alice/a.txt"); err != nil || got != fname {
+		t.Fatalf("alice/a.txt resolves to %s, %v", got, err)
+	}
+
+	for _, ref := range []string{"a.txt", "../alice/a.txt", "alice/../a.txt", "alice/.a.txt.part", "alice/b/a.txt"} {
+		if _, err := h.storedPath(ref); err == nil {
+			t.Errorf("resolved %q", ref)
+		}
+	}
+}
+
+func TestStoreVersioned(t *testing.T) {
+	dir := t.TempDir()
+	fname := filepath.Join(dir, "a.txt")
+
+	for i, want := range []string{"a.txt", "a-1.txt", "a-2.txt"} {
+		part := filepath.Join(dir, ".a.txt.part")
+		if err := os.WriteFile(part, []byte{byte(i)}, 0644); err != nil {
+			t.Fatal(err)
+		}
+		stored, err := storeVersioned(part, fname)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if stored != filepath.Join(dir, want) {
+			t.Fatalf("stored as %s, want %s", stored, want)
+		}
+		if got, _ := os.ReadFile(stored); len(got) != 1 || got[0] != byte(i) {
+			t.Fatalf("%s is overwritten", want)
+		}
+		if _, err = os.Stat(part); !os.IsNotExist(err) {
+			t.Fatal("temporary file is left behind")
+		}
+	}
+}
@@ -0,0 +1,207 @@
+package udpchat
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/neverchanje/unplayground/udpchat/codec"
+)
+
+const (
+	// Number of packets of a transfer queued before the transfer reads them.
+	kTransferQueueSize = 4 * kMaxRecvWindow
+
+	// Number of finished transfers kept for the "transfers" command, the
+	// older ones are forgotten.
+	kMaxFinishedTransfers = 64
+)
+
+// A file transfer of the client, running in background. The packets of the
+// server are dispatched to link by PACKET_ID.
+type transfer struct {
+	packet_id uint64
+	upload    bool
+	fname     string
+	link      *queuedLink
+
+	mu    sync.Mutex
+	total uint64
+
+	// bytes transferred so far, set once the handshake is done. base is
+	// what was already transferred before, when the transfer is resumed.
+	progress func() uint64
+	base     uint64
+	started  time.Time
+
+	finished time.Time
+	err      error
+}
+
+// Registers a transfer, which fails if another one with the same PACKET_ID
+// is running, e.g. the same file being sent twice.
+func (c *Client) startTransfer(packet_id uint64, upload bool, fname string) (*transfer, error) {
+	t := &transfer{packet_id: packet_id, upload: upload, fname: fname}
+	t.link = newQueuedLink(c.write, kTransferQueueSize)
+	t.started = time.Now()
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if _, has := c.transfers[packet_id]; has {
+		return nil, errors.New("Transfer of " + fname + " is in progress")
+	}
+	c.transfers[packet_id] = t
+	c.pruneTransfers()
+	c.allTransfers = append(c.allTransfers, t)
+	return t, nil
+}
+
+// Forgets the oldest finished transfers beyond kMaxFinishedTransfers.
+// REQUIRE: mutex lock held
+func (c *Client) pruneTransfers() {
+	finished := 0
+	for _, t := range c.allTransfers {
+		if t.isFinished() {
+			finished++
+		}
+	}
+	kept := c.allTransfers[:0]
+	for _, t := range c.allTransfers {
+		if finished > kMaxFinishedTransfers && t.isFinished() {
+			finished--
+			continue
+		}
+		kept = append(kept, t)
+	}
+	clear(c.allTransfers[len(kept):])
+	c.allTransfers = kept
+}
+
+// Unregisters the transfer, which is kept for the "transfers" command.
+func (c *Client) finishTransfer(t *transfer, err error) {
+	c.mu.Lock()
+	delete(c.transfers, t.packet_id)
+	c.mu.Unlock()
+
+	t.mu.Lock()
+	t.finished = time.Now()
+	t.err = err
+	t.mu.Unlock()
+
+	if err != nil {
+		if t.upload {
+			log.Println("[Error] Sending file " + t.fname + ": " + err.Error())
+		} else {
+			log.Println("[Error] Getting file " + t.fname + ": " + err.Error())
+		}
+	}
+}
+
+func (t *transfer) isFinished() bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return !t.finished.IsZero()
+}
+
+// Called once the handshake has told the size of the file and how much of
+// it is already transferred.
+func (t *transfer) establish(total uint64, progress func() uint64) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.total = total
+	t.progress = progress
+	t.base = progress()
+	t.started = time.Now()
+}
+
+// Dispatches a packet of the server to its transfer. Returns false if it's
+// not a packet of a file transfer, packets of finished transfers are dropped.
+func (c *Client) dispatch(packet []byte) bool {
+	if len(packet) == 0 || !isTransferResponse(ResponseType(packet[0])) {
+		return false
+	}
+	m, err := codec.DecodeResponse(packet)
+	if err != nil {
+		return true
+	}
+
+	c.mu.Lock()
+	t, has := c.transfers[m.(codec.TransferMessage).Transfer()]
+	c.mu.Unlock()
+	if has {
+		t.link.deliver(packet)
+	}
+	return true
+}
+
+// Responses carrying a PACKET_ID after the type.
+func isTransferResponse(t ResponseType) bool {
+	switch t {
+	case kRespSendFileOK, kRespSendFileFailed, kRespRecvSegAck, kRespSendFileFinAck,
+		kRespGetFileOK, kRespGetFileFailed, kRespFileSeg, kRespFileFin:
+		return true
+	}
+	return false
+}
+
+// One line for each transfer, in the order they were started:
+//
+//	upload   a.txt  42.0%  1.25 MB/s  active
+func (t *transfer) toString() string {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	direction := "download"
+	if t.upload {
+		direction = "upload"
+	}
+
+	var done uint64
+	if t.progress != nil {
+		done = t.progress()
+	}
+	percent := 100.0
+	if t.total != 0 {
+		percent = 100 * float64(done) / float64(t.total)
+	}
+
+	end := time.Now()
+	state := "active"
+	if !t.finished.IsZero() {
+		end = t.finished
+		state = "finished"
+		if t.err != nil {
+			state = "failed: " + t.err.Error()
+		}
+	}
+	rate := 0.0
+	if elapsed := end.Sub(t.started).Seconds(); elapsed > 0 && done > t.base {
+		rate = float64(done-t.base) / elapsed / 1e6
+	}
+
+	return fmt.Sprintf("%-8s %s  %.1f%%  %.2f MB/s  %s", direction, t.fname, percent, rate, state)
+}
+
+func (c *Client) listTransfers() []string {
+	c.mu.Lock()
+	transfers := append([]*transfer(nil), c.allTransfers...)
+	c.mu.Unlock()
+
+	lines := make([]string, len(transfers))
+	for i, t := range transfers {
+		lines[i] = t.toString()
+	}
+	return lines
+}
+
+func (c *Client) ListTransfers() {
+	lines := c.listTransfers()
+	if len(lines) == 0 {
+		println("No transfers now.")
+		return
+	}
+	println(strings.Join(lines, "\n"))
+}
@@ -0,0 +1,92 @@
+package udpchat
+
+import (
+	"bytes"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Two uploads of alice run at once, and "transfers" tells how each ended.
+func TestConcurrentUploads(t *testing.T) {
+	hub := newTestHub(t)
+	alice := newTestClient(t, hub, "alice")
+
+	dir := t.TempDir()
+	contents := map[string][]byte{
+		"a.txt": bytes.Repeat([]byte("a"), 300000),
+		"b.txt": bytes.Repeat([]byte("0123456789"), 20000),
+	}
+	for name, content := range contents {
+		file := filepath.Join(dir, name)
+		if err := os.WriteFile(file, content, 0644); err != nil {
+			t.Fatal(err)
+		}
+		alice.SendFile(file)
+	}
+	if lines := alice.listTransfers(); len(lines) != 2 {
+		t.Fatalf("transfers %q", lines)
+	}
+
+	deadline := time.Now().Add(20 * time.Second)
+	for {
+		lines := alice.listTransfers()
+		finished := 0
+		for _, line := range lines {
+			if !strings.HasSuffix(line, "active") {
+				finished++
+			}
+		}
+		if finished == len(contents) {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("transfers not finished: %q", lines)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	lines := alice.listTransfers()
+	for name, content := range contents {
+		var line string
+		for _, l := range lines {
+			if strings.Contains(l, name) {
+				line = l
+			}
+		}
+		if !strings.HasPrefix(line, "upload ") || !strings.Contains(line, " 100.0% ") ||
+			!strings.HasSuffix(line, " finished") {
+			t.Errorf("transfer of %s: %q", name, line)
+		}
+		if stored, err := os.ReadFile(filepath.Join(hub.uploadDir, "alice", name)); err != nil || !bytes.Equal(stored, content) {
+			t.Errorf("stored %d bytes of %s, %v", len(stored), name, err)
+		}
+	}
+}
+
+// Only the latest finished transfers are kept, and the active ones.
+func TestPruneTransfers(t *testing.T) {
+	c := &Client{transfers: make(map[uint64]*transfer)}
+	active, err := c.startTransfer(0, true, "active.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 1; i <= 2*kMaxFinishedTransfers; i++ {
+		tr, err := c.startTransfer(uint64(i), false, "a.txt")
+		if err != nil {
+			t.Fatal(err)
+		}
+		c.finishTransfer(tr, errors.New("failed"))
+	}
+
+	c.startTransfer(uint64(2*kMaxFinishedTransfers+1), false, "b.txt")
+	if len(c.allTransfers) != kMaxFinishedTransfers+2 || c.allTransfers[0] != active {
+		t.Fatalf("%d transfers kept", len(c.allTransfers))
+	}
+	if first := c.allTransfers[1].packet_id; first != kMaxFinishedTransfers+1 {
+		t.Fatalf("oldest finished transfer kept is %d", first)
+	}
+}
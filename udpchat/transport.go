@@ -0,0 +1,238 @@
+package udpchat
+
+import (
+	"errors"
+	"net"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// The clients and the hub exchange datagrams over a Transport. It's UDP but
+// in tests, which run the hub and its clients in a single process over a
+// MemoryTransport.
+type Transport interface {
+	// Listens for the datagrams sent to address, for the hub.
+	Listen(address string) (net.PacketConn, error)
+
+	// Connects to address, for the clients. Only the datagrams from
+	// address are read from the connection.
+	Dial(address string) (net.Conn, error)
+}
+
+// The Transport over UDP, whose addresses are "host:port".
+var UDP Transport = udpTransport{}
+
+type udpTransport struct{}
+
+func (udpTransport) Listen(address string) (net.PacketConn, error) {
+	return net.ListenPacket("udp", address)
+}
+
+func (udpTransport) Dial(address string) (net.Conn, error) {
+	return net.Dial("udp", address)
+}
+
+// The address of the hub by default.
+func ServiceAddress() string {
+	return net.JoinHostPort(ServiceHost, strconv.Itoa(ServicePort))
+}
+
+// Size of the queue of datagrams of an endpoint of a MemoryTransport.
+const kMemoryQueueSize = 4096
+
+// A Transport delivering the datagrams between the endpoints of a single
+// process through channels. As over UDP, datagrams are dropped if nobody
+// listens on their destination or its queue is full, and truncated to the
+// buffer they are read into. Otherwise they are delivered in order, exactly
+// once. Addresses are any string, the ones of the clients are picked by
+// Dial.
+type MemoryTransport struct {
+	mu        sync.Mutex
+	endpoints map[string]*memEndpoint // by address
+	lastPort  int
+}
+
+func NewMemoryTransport() *MemoryTransport {
+	return &MemoryTransport{endpoints: make(map[string]*memEndpoint)}
+}
+
+func (t *MemoryTransport) Listen(address string) (net.PacketConn, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if _, has := t.endpoints[address]; has {
+		return nil, errors.New("Address " + address + " is in use")
+	}
+	return t.open(memAddr(address), ""), nil
+}
+
+func (t *MemoryTransport) Dial(address string) (net.Conn, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.lastPort++
+	local := memAddr("client:" + strconv.Itoa(t.lastPort))
+	return t.open(local, memAddr(address)), nil
+}
+
+// REQUIRE: mutex lock held
+func (t *MemoryTransport) open(local memAddr, remote memAddr) *memEndpoint {
+	e := &memEndpoint{
+		transport:       t,
+		local:           local,
+		remote:          remote,
+		inbox:           make(chan memDatagram, kMemoryQueueSize),
+		closed:          make(chan struct{}),
+		deadlineChanged: make(chan struct{}),
+	}
+	t.endpoints[string(local)] = e
+	return e
+}
+
+// Queues a copy of payload for to, if it exists.
+func (t *MemoryTransport) deliver(payload []byte, from memAddr, to string) {
+	t.mu.Lock()
+	e, has := t.endpoints[to]
+	t.mu.Unlock()
+	if !has || (e.remote != "" && e.remote != from) {
+		return
+	}
+	select {
+	case e.inbox <- memDatagram{append([]byte(nil), payload...), from}:
+	default:
+	}
+}
+
+type memAddr string
+
+func (a memAddr) Network() string { return "memory" }
+func (a memAddr) String() string  { return string(a) }
+
+type memDatagram struct {
+	payload []byte
+	from    memAddr
+}
+
+// An endpoint of a MemoryTransport, either listening or connected to
+// remote. It's both a net.PacketConn and a net.Conn.
+type memEndpoint struct {
+	transport *MemoryTransport
+	local     memAddr
+	remote    memAddr // empty if listening
+	inbox     chan memDatagram
+
+	closed    chan struct{}
+	closeOnce sync.Once
+
+	mu           sync.Mutex
+	readDeadline time.Time
+	// closed and replaced when readDeadline changes, to wake up the
+	// readers.
+	deadlineChanged chan struct{}
+}
+
+func (e *memEndpoint) opError(op string, err error) error {
+	return &net.OpError{Op: op, Net: e.local.Network(), Addr: e.local, Err: err}
+}
+
+func (e *memEndpoint) ReadFrom(p []byte) (int, net.Addr, error) {
+	for {
+		e.mu.Lock()
+		deadline, changed := e.readDeadline, e.deadlineChanged
+		e.mu.Unlock()
+
+		if n, from, done, err := e.readBefore(deadline, changed, p); done {
+			return n, from, err
+		}
+	}
+}
+
+// Reads a datagram unless the deadline passes, done is false if the deadline
+// changed meanwhile.
+func (e *memEndpoint) readBefore(deadline time.Time, changed chan struct{}, p []byte) (int, net.Addr, bool, error) {
+	var timeout <-chan time.Time
+	if !deadline.IsZero() {
+		wait := time.Until(deadline)
+		if wait <= 0 {
+			return 0, nil, true, e.opError("read", os.ErrDeadlineExceeded)
+		}
+		timer := time.NewTimer(wait)
+		defer timer.Stop()
+		timeout = timer.C
+	}
+
+	select {
+	case d := <-e.inbox:
+		return copy(p, d.payload), d.from, true, nil
+	case <-e.closed:
+		return 0, nil, true, e.opError("read", net.ErrClosed)
+	case <-timeout:
+		return 0, nil, true, e.opError("read", os.ErrDeadlineExceeded)
+	case <-changed:
+		return 0, nil, false, nil
+	}
+}
+
+func (e *memEndpoint) WriteTo(p []byte, addr net.Addr) (int, error) {
+	select {
+	case <-e.closed:
+		return 0, e.opError("write", net.ErrClosed)
+	default:
+	}
+	e.transport.deliver(p, e.local, addr.String())
+	return len(p), nil
+}
+
+func (e *memEndpoint) Read(p []byte) (int, error) {
+	n, _, err := e.ReadFrom(p)
+	return n, err
+}
+
+func (e *memEndpoint) Write(p []byte) (int, error) {
+	if e.remote == "" {
+		return 0, e.opError("write", errors.New("Not connected"))
+	}
+	return e.WriteTo(p, e.remote)
+}
+
+func (e *memEndpoint) Close() error {
+	err := e.opError("close", net.ErrClosed)
+	e.closeOnce.Do(func() {
+		e.transport.mu.Lock()
+		delete(e.transport.endpoints, string(e.local))
+		e.transport.mu.Unlock()
+		close(e.closed)
+		err = nil
+	})
+	return err
+}
+
+func (e *memEndpoint) LocalAddr() net.Addr {
+	return e.local
+}
+
+// nil if listening.
+func (e *memEndpoint) RemoteAddr() net.Addr {
+	if e.remote == "" {
+		return nil
+	}
+	return e.remote
+}
+
+func (e *memEndpoint) SetDeadline(t time.Time) error {
+	return e.SetReadDeadline(t)
+}
+
+func (e *memEndpoint) SetReadDeadline(t time.Time) error {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.readDeadline = t
+	close(e.deadlineChanged)
+	e.deadlineChanged = make(chan struct{})
+	return nil
+}
+
+// Writes never block.
+func (e *memEndpoint) SetWriteDeadline(t time.Time) error {
+	return nil
+}
@@ -0,0 +1,63 @@
+package udpchat
+
+import (
+	"errors"
+	"net"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestMemoryTransport(t *testing.T) {
+	transport := NewMemoryTransport()
+	hub, err := transport.Listen("hub")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = transport.Listen("hub"); err == nil {
+		t.Fatal("listened twice on hub")
+	}
+	alice, _ := transport.Dial("hub")
+	bob, _ := transport.Dial("elsewhere")
+
+	alice.Write([]byte("hello"))
+	buf := make([]byte, 4)
+	n, from, err := hub.ReadFrom(buf)
+	if err != nil || string(buf[:n]) != "hell" || from.String() != alice.LocalAddr().String() {
+		t.Fatalf("read %q from %v, %v", buf[:n], from, err)
+	}
+
+	// alice only reads what the hub sends.
+	hub.WriteTo([]byte("hi alice"), alice.LocalAddr())
+	bob.(net.PacketConn).WriteTo([]byte("not from the hub"), alice.LocalAddr())
+	n, err = alice.Read(buf)
+	if err != nil || string(buf[:n]) != "hi a" {
+		t.Fatalf("read %q, %v", buf[:n], err)
+	}
+	alice.SetReadDeadline(time.Now().Add(10 * time.Millisecond))
+	if _, err = alice.Read(buf); !errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Fatalf("read after the deadline, %v", err)
+	}
+
+	// A reader blocked in Read is woken up by Close.
+	done := make(chan error)
+	go func() {
+		_, _, err := hub.ReadFrom(buf)
+		done <- err
+	}()
+	hub.Close()
+	if err = <-done; !errors.Is(err, net.ErrClosed) {
+		t.Fatalf("read after close, %v", err)
+	}
+	// and the address is free again.
+	if _, err = alice.Write([]byte("lost")); err != nil {
+		t.Fatal(err)
+	}
+	if hub, err = transport.Listen("hub"); err != nil {
+		t.Fatal(err)
+	}
+	hub.SetReadDeadline(time.Now().Add(10 * time.Millisecond))
+	if _, _, err = hub.ReadFrom(buf); !errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Fatalf("read %q, %v", buf, err)
+	}
+}
@@ -1,22 +1,84 @@
 package udpchat
 
+import (
+	"github.com/neverchanje/unplayground/udpchat/codec"
+)
+
 const (
 	ServicePort int    = 3000
 	ServiceHost string = "127.0.0.1"
+
+	// Maximum size of a request or a response, large enough for a
+	// kReqSendSeg packet carrying a full segment. Datagrams are larger, see
+	// kMaxDatagramSize.
+	kMaxPacketSize = 2048
 )
 
-type RequestType int
+// Requests and responses are encoded by the codec package, which documents
+// the format of each of them.
+type RequestType = codec.RequestType
 
 const (
-	kReqSendChatMsg RequestType = 1
-	kReqGetHistory  RequestType = 2
-	kReqSendFile    RequestType = 3
-	kReqSendSeg     RequestType = 4
+	kReqSendChatMsg = codec.ReqSendChatMsg
+	kReqGetHistory  = codec.ReqGetHistory
+	kReqSendFile    = codec.ReqSendFile
+	kReqSendSeg     = codec.ReqSendSeg
+	kReqSendFileAck = codec.ReqSendFileAck
+	kReqSendFileFin = codec.ReqSendFileFin
+	kReqGetFile     = codec.ReqGetFile
+	kReqGetFileAck  = codec.ReqGetFileAck
+	kReqFileSegAck  = codec.ReqFileSegAck
+	kReqFileFinAck  = codec.ReqFileFinAck
+	kReqListFiles   = codec.ReqListFiles
+	kReqJoin        = codec.ReqJoin
+	kReqLeave       = codec.ReqLeave
+
+	kReqListChannels   = codec.ReqListChannels
+	kReqSubscribe      = codec.ReqSubscribe
+	kReqUnsubscribe    = codec.ReqUnsubscribe
+	kReqMakeChannel    = codec.ReqMakeChannel
+	kReqRemoveChannel  = codec.ReqRemoveChannel
+	kReqSearch         = codec.ReqSearch
+	kReqRegister       = codec.ReqRegister
+	kReqLogin          = codec.ReqLogin
+	kReqPublishKey     = codec.ReqPublishKey
+	kReqGetKey         = codec.ReqGetKey
+	kReqSendDM         = codec.ReqSendDM
+	kReqGetDMs         = codec.ReqGetDMs
+	kReqDMAck          = codec.ReqDMAck
+	kReqPing           = codec.ReqPing
+	kReqWho            = codec.ReqWho
+	kReqListSubscribed = codec.ReqListSubscribed
 )
 
-type ResponseType int
+type ResponseType = codec.ResponseType
 
 const (
-	kRespSendFileOK     ResponseType = 3
-	kRespSendFileFailed ResponseType = 4
+	kRespSendFileOK      = codec.RespSendFileOK
+	kRespSendFileFailed  = codec.RespSendFileFailed
+	kRespRecvSegAck      = codec.RespRecvSegAck
+	kRespSendFileFinAck  = codec.RespSendFileFinAck
+	kRespGetFileOK       = codec.RespGetFileOK
+	kRespGetFileFailed   = codec.RespGetFileFailed
+	kRespFileSeg         = codec.RespFileSeg
+	kRespFileFin         = codec.RespFileFin
+	kRespFileList        = codec.RespFileList
+	kRespJoinOK          = codec.RespJoinOK
+	kRespChatMsg         = codec.RespChatMsg
+	kRespChannelList     = codec.RespChannelList
+	kRespChannelOK       = codec.RespChannelOK
+	kRespChannelFailed   = codec.RespChannelFailed
+	kRespHistory         = codec.RespHistory
+	kRespLoginOK         = codec.RespLoginOK
+	kRespLoginFailed     = codec.RespLoginFailed
+	kRespUnauthenticated = codec.RespUnauthenticated
+	kRespKeyPublished    = codec.RespKeyPublished
+	kRespUserKey         = codec.RespUserKey
+	kRespDMSent          = codec.RespDMSent
+	kRespDMFailed        = codec.RespDMFailed
+	kRespDMCount         = codec.RespDMCount
+	kRespDM              = codec.RespDM
+	kRespPong            = codec.RespPong
+	kRespWho             = codec.RespWho
+	kRespRequestFailed   = codec.RespRequestFailed
 )
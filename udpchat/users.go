@@ -0,0 +1,379 @@
+package udpchat
+
+import (
+	"bufio"
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"log"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"unicode"
+
+	"github.com/neverchanje/unplayground/udpchat/codec"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// Users register an account with a password, and log in to get a session
+// token, which follows the type of every other request:
+//
+//	kReqRegister LOGIN_ID USER_LEN USERNAME PASSWORD  ---->
+//	kReqLogin LOGIN_ID USER_LEN USERNAME PASSWORD     ---->
+//		<----  kRespLoginOK TOKEN
+//		<----  kRespLoginFailed REASON
+//
+//	<RequestType> TOKEN ...  ---->
+//		<----  kRespUnauthenticated REASON
+//
+// A request without the token of a session is rejected with
+// kRespUnauthenticated and not handled. LOGIN_ID is chosen by the client so
+// that a retransmitted login gets the same session. The session ends when the
+// client leaves, or when the hub restarts.
+//
+// The hub stores the accounts in a file of "<username> <bcrypt hash>" lines,
+// which is appended to as users register.
+const (
+	kMaxUsernameLen = 32
+	kMinPasswordLen = 8
+	kMaxPasswordLen = 72 // bcrypt ignores the rest
+
+	kTokenSize = codec.TokenSize
+)
+
+// bcrypt cost of the password hashes.
+var passwordCost = bcrypt.DefaultCost
+
+func validUsername(name string) bool {
+	if len(name) == 0 || len(name) > kMaxUsernameLen || name == kAnonymousUser {
+		return false
+	}
+	if _, err := sanitizeUser(name); err != nil {
+		return false
+	}
+	for _, r := range name {
+		if unicode.IsSpace(r) || !unicode.IsPrint(r) {
+			return false
+		}
+	}
+	return true
+}
+
+func validPassword(password string) bool {
+	return len(password) >= kMinPasswordLen && len(password) <= kMaxPasswordLen
+}
+
+// Accounts of the users, by username.
+type accountStore struct {
+	mu     sync.Mutex
+	path   string // empty if the accounts are only kept in memory
+	hashes map[string][]byte
+}
+
+func openAccountStore(path string) (*accountStore, error) {
+	s := &accountStore{path: path, hashes: make(map[string][]byte)}
+	if len(path) == 0 {
+		return s, nil
+	}
+
+	file, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return s, nil
+	} else if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) != 2 || !validUsername(fields[0]) {
+			log.Println("[Error] Malformed account in " + path)
+			continue
+		}
+		s.hashes[fields[0]] = []byte(fields[1])
+	}
+	return s, scanner.Err()
+}
+
+func (s *accountStore) register(name string, password string) error {
+	if !validUsername(name) {
+		return errors.New("Invalid username")
+	}
+	if !validPassword(password) {
+		return errors.New("Password should be " + strconv.Itoa(kMinPasswordLen) + " to " +
+			strconv.Itoa(kMaxPasswordLen) + " bytes")
+	}
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), passwordCost)
+	if err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, has := s.hashes[name]; has {
+		return errors.New("Username " + name + " is taken")
+	}
+	if len(s.path) != 0 {
+		file, err := os.OpenFile(s.path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600)
+		if err != nil {
+			return err
+		}
+		_, err = file.WriteString(name + " " + string(hash) + "\n")
+		if err == nil {
+			err = file.Sync()
+		}
+		if cerr := file.Close(); err == nil {
+			err = cerr
+		}
+		if err != nil {
+			return err
+		}
+	}
+	s.hashes[name] = hash
+	return nil
+}
+
+// Whether the password is the one of the account. Unknown users take as
+// long to check as known ones.
+func (s *accountStore) verify(name string, password string) bool {
+	s.mu.Lock()
+	hash, has := s.hashes[name]
+	s.mu.Unlock()
+	if !has {
+		unknownUserOnce.Do(func() {
+			unknownUserHash, _ = bcrypt.GenerateFromPassword([]byte("unknown user"), passwordCost)
+		})
+		hash = unknownUserHash
+	}
+	return bcrypt.CompareHashAndPassword(hash, []byte(password)) == nil && has
+}
+
+var (
+	unknownUserOnce sync.Once
+	unknownUserHash []byte
+)
+
+// Sets the file the accounts are stored in, which is created on demand.
+func (h *Hub) SetAccountsFile(path string) error {
+	if len(path) == 0 {
+		return errors.New("Accounts file should not be empty")
+	}
+	accounts, err := openAccountStore(path)
+	if err != nil {
+		return err
+	}
+	h.accounts = accounts
+	return nil
+}
+
+type session struct {
+	token    [kTokenSize]byte
+	username string
+	login_id uint64
+	ra       net.Addr  // the client last sent a request from
+	joined   bool      // see push.go
+	lastSeen time.Time // when the client last sent a request, see presence.go
+
+	// the REQ_ID of the latest channel made or removed, and the reply to it,
+	// see channel.go.
+	channel_req   uint64
+	channel_reply codec.ChannelOK
+}
+
+func (s *session) toString() string {
+	return s.username + "/" + hex.EncodeToString(s.token[:4])
+}
+
+// Requests handled without a session.
+func isLoginRequest(t RequestType) bool {
+	return t == kReqRegister || t == kReqLogin
+}
+
+// Finds the session of the token following the type of the request, which
+// is removed from recv. The session follows the client to ra, as a NAT may
+// have rebound its address.
+func (h *Hub) authenticate(recv []byte, ra net.Addr) (*session, []byte, error) {
+	if len(recv) == 0 {
+		return nil, nil, errors.New("Empty request")
+	}
+	if isLoginRequest(RequestType(recv[0])) {
+		return nil, recv, nil
+	}
+	if len(recv) < 1+kTokenSize {
+		return nil, nil, errors.New("Not logged in")
+	}
+	var token [kTokenSize]byte
+	copy(token[:], recv[1:1+kTokenSize])
+
+	h.mu.Lock()
+	s, has := h.sessions[token]
+	if has {
+		s.ra = ra
+		s.lastSeen = time.Now()
+	}
+	h.mu.Unlock()
+	if !has {
+		return nil, nil, errors.New("Not logged in, or the session has ended")
+	}
+	recv[kTokenSize] = recv[0]
+	return s, recv[kTokenSize:], nil
+}
+
+func (h *Hub) rejectUnauthenticated(ra net.Addr, reason error) {
+	resp := codec.Marshal(&codec.Unauthenticated{Reason: reason.Error()})
+	if _, err := h.writeTo(resp, ra); err != nil {
+		log.Println("Server " + err.Error())
+	}
+}
+
+func encodeLogin(t RequestType, login_id uint64, name string, password string) []byte {
+	return codec.Marshal(&codec.Login{
+		Register: t == kReqRegister,
+		LoginID:  login_id,
+		Username: name,
+		Password: password,
+	})
+}
+
+// Registers the account first for kReqRegister.
+func (h *RequestHandler) handleLogin(recv []byte) error {
+	req := codec.Login{Register: RequestType(recv[0]) == kReqRegister}
+	if err := codec.Unmarshal(recv, &req); err != nil {
+		return errors.New("Malformed login request from " + h.ra.String())
+	}
+	login_id, name, password := req.LoginID, req.Username, req.Password
+
+	// retransmissions are dropped while the password is being checked, which
+	// takes a while on purpose.
+	pending := h.ra.String() + "/" + strconv.FormatUint(login_id, 16)
+	h.hub.mu.Lock()
+	if h.hub.logins[pending] {
+		h.hub.mu.Unlock()
+		return nil
+	}
+	h.hub.logins[pending] = true
+	h.hub.mu.Unlock()
+	defer func() {
+		h.hub.mu.Lock()
+		delete(h.hub.logins, pending)
+		h.hub.mu.Unlock()
+	}()
+
+	// a retransmitted registration fails, but logs in.
+	var err error
+	if req.Register {
+		if err = h.hub.accounts.register(name, password); err == nil {
+			log.Println("Account " + name + " registered from " + h.ra.String())
+		}
+	}
+	if !h.hub.accounts.verify(name, password) {
+		if err != nil {
+			return h.rejectLogin(err.Error())
+		}
+		return h.rejectLogin("Wrong username or password")
+	}
+
+	h.hub.mu.Lock()
+	var s *session
+	for _, prev := range h.hub.sessions {
+		if prev.username == name && prev.login_id == login_id {
+			s = prev
+		}
+	}
+	if s == nil {
+		s = &session{username: name, login_id: login_id, ra: h.ra, lastSeen: time.Now()}
+		if _, err = rand.Read(s.token[:]); err != nil {
+			h.hub.mu.Unlock()
+			return err
+		}
+		h.hub.sessions[s.token] = s
+		log.Println("Session " + s.toString() + " started from " + h.ra.String())
+	}
+	h.hub.mu.Unlock()
+
+	_, err = h.hub.writeTo(codec.Marshal(&codec.LoginOK{Token: s.token}), h.ra)
+	return err
+}
+
+// Replies the reason of the failure, which is also returned.
+func (h *RequestHandler) rejectLogin(reason string) error {
+	resp := codec.Marshal(&codec.LoginFailed{Reason: reason})
+	if _, err := h.hub.writeTo(resp, h.ra); err != nil {
+		return err
+	}
+	return errors.New(reason + " from " + h.ra.String())
+}
+
+// Ends the session of the client.
+func (h *RequestHandler) logout() {
+	h.hub.mu.Lock()
+	defer h.hub.mu.Unlock()
+	delete(h.hub.sessions, h.session.token)
+	log.Println("Session " + h.session.toString() + " ended")
+}
+
+// The username the client logged in with.
+func (h *RequestHandler) username() string {
+	return h.session.username
+}
+
+// Sets the session of the client, which then follows every request.
+func (c *Client) login(t RequestType, password string) error {
+	if !validUsername(c.username) {
+		return errors.New("Username should be 1 to " + strconv.Itoa(kMaxUsernameLen) +
+			" characters, without spaces, '/' or '\\', and not " + kAnonymousUser + ".")
+	}
+	if !validPassword(password) {
+		return errors.New("Password should be " + strconv.Itoa(kMinPasswordLen) + " to " +
+			strconv.Itoa(kMaxPasswordLen) + " bytes.")
+	}
+
+	var id [8]byte
+	if _, err := rand.Read(id[:]); err != nil {
+		return err
+	}
+	packet := encodeLogin(t, binary.LittleEndian.Uint64(id[:]), c.username, password)
+	var ok codec.LoginOK
+	var failed codec.LoginFailed
+	resp, err := exchange(c.background, packet, func(resp []byte) bool {
+		return codec.Unmarshal(resp, &ok) == nil || codec.Unmarshal(resp, &failed) == nil
+	})
+	if err != nil {
+		return errors.New("Logging in: " + err.Error())
+	}
+	if ResponseType(resp[0]) == kRespLoginFailed {
+		return errors.New(failed.Reason)
+	}
+
+	c.mu.Lock()
+	c.token = ok.Token[:]
+	c.mu.Unlock()
+	return nil
+}
+
+func (c *Client) Login(password string) error {
+	return c.login(kReqLogin, password)
+}
+
+// Registers an account with the username of the client, and logs in.
+func (c *Client) Register(password string) error {
+	return c.login(kReqRegister, password)
+}
+
+// Joins the chat, which subscribes the client to kDefaultChannel. The
+// request is retransmitted until the hub answers.
+func (c *Client) Join() error {
+	_, err := exchange(c.background, codec.Marshal(new(codec.Join)), func(resp []byte) bool {
+		return codec.Unmarshal(resp, new(codec.JoinOK)) == nil
+	})
+	if err != nil {
+		return errors.New("Joining the chat: " + err.Error())
+	}
+	go c.keepAlive()
+	return nil
+}
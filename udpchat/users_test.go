@@ -0,0 +1,95 @@
+package udpchat
+
+import (
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/neverchanje/unplayground/udpchat/codec"
+	"golang.org/x/crypto/bcrypt"
+)
+
+func TestAccountStore(t *testing.T) {
+	passwordCost = bcrypt.MinCost
+	path := filepath.Join(t.TempDir(), "accounts")
+	s, err := openAccountStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"", "al ice", "a/b", kAnonymousUser, strings.Repeat("a", kMaxUsernameLen+1)} {
+		if s.register(name, kTestPassword) == nil {
+			t.Fatalf("registered %q", name)
+		}
+	}
+	if s.register("alice", "short") == nil {
+		t.Fatal("registered a short password")
+	}
+	if err = s.register("alice", kTestPassword); err != nil {
+		t.Fatal(err)
+	}
+	if s.register("alice", "another password") == nil {
+		t.Fatal("registered alice twice")
+	}
+
+	if s, err = openAccountStore(path); err != nil {
+		t.Fatal(err)
+	}
+	if !s.verify("alice", kTestPassword) || s.verify("alice", "another password") || s.verify("bob", kTestPassword) {
+		t.Fatal("passwords are not verified")
+	}
+}
+
+func TestLogin(t *testing.T) {
+	hub := newTestHub(t)
+	alice, mallory := dialTestHub(t, hub), dialTestHub(t, hub)
+
+	// requests without a session are not handled.
+	mallory.Write(codec.Marshal(&codec.SendChatMsg{Channel: kDefaultChannel, Message: "spoofed"}))
+	if resp := readTestPacket(t, mallory); ResponseType(resp[0]) != kRespUnauthenticated {
+		t.Fatalf("unauthenticated message answered with %q", resp)
+	}
+	mallory.token = make([]byte, kTokenSize)
+	mallory.Write([]byte{byte(kReqJoin)})
+	if resp := readTestPacket(t, mallory); ResponseType(resp[0]) != kRespUnauthenticated {
+		t.Fatalf("join with a forged token answered with %q", resp)
+	}
+
+	// a retransmitted login gets the same session.
+	loginTestHub(t, alice, "alice")
+	token := string(alice.token)
+	loginTestHub(t, alice, "alice")
+	hub.mu.Lock()
+	sessions := len(hub.sessions)
+	hub.mu.Unlock()
+	if string(alice.token) != token || sessions != 1 {
+		t.Fatalf("%d sessions", sessions)
+	}
+
+	mallory.Write(encodeLogin(kReqLogin, 2, "alice", "wrong password"))
+	if resp := readTestPacket(t, mallory); ResponseType(resp[0]) != kRespLoginFailed {
+		t.Fatalf("logged in with a wrong password, response %q", resp)
+	}
+	mallory.Write(encodeLogin(kReqRegister, 2, "alice", "another password"))
+	if resp := readTestPacket(t, mallory); ResponseType(resp[0]) != kRespLoginFailed || !strings.Contains(string(resp), "taken") {
+		t.Fatalf("registered a taken name, response %q", resp)
+	}
+
+	// messages are recorded with the username of the session, after the
+	// notice of the join.
+	joinTestHub(t, alice, "alice")
+	alice.Write(codec.Marshal(&codec.SendChatMsg{Channel: kDefaultChannel, Message: "hi"}))
+	time.Sleep(100 * time.Millisecond)
+	page, _, _ := hub.history.query(&historyQuery{limit: 10}, func(*chatRecord) bool { return true })
+	if len(page) != 2 || page[0].sender != "" || page[0].msg != "alice joined" || page[1].sender != "alice" {
+		t.Fatalf("history %v", page)
+	}
+
+	// leaving ends the session.
+	alice.Write([]byte{byte(kReqLeave)})
+	time.Sleep(100 * time.Millisecond)
+	alice.Write([]byte{byte(kReqJoin)})
+	if resp := readTestPacket(t, alice); ResponseType(resp[0]) != kRespUnauthenticated {
+		t.Fatalf("join after leaving answered with %q", resp)
+	}
+}